@@ -2,7 +2,10 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
+	"errors"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -14,8 +17,11 @@ import (
 	"github.com/tabular/relay/internal/gate"
 	"github.com/tabular/relay/internal/metrics"
 	"github.com/tabular/relay/internal/parser"
+	"github.com/tabular/relay/internal/pipeline"
+	"github.com/tabular/relay/internal/spool"
 	"github.com/tabular/relay/internal/transformer"
 	"github.com/tabular/relay/internal/updater"
+	"github.com/tabular/relay/internal/webhook"
 	"github.com/tabular/relay/pkg/types"
 )
 
@@ -25,20 +31,109 @@ func main() {
 	
 	// Initialize components
 	relayMetrics := metrics.New()
-	gateInstance := gate.New(config.WebSocket.BufferSize, config.WebSocket.HeartbeatInterval)
+	if err := gate.ValidateRateLimits(config.WebSocket.RateLimits); err != nil {
+		log.Fatalf("Failed to configure rate limits: %v", err)
+	}
+	queueWeights := make(map[string]int, len(config.WebSocket.QueueWeights))
+	for _, qw := range config.WebSocket.QueueWeights {
+		queueWeights[qw.APIKey] = qw.Weight
+	}
+	gateInstance := gate.NewWithOptions(gate.Options{
+		BufferSize:        config.WebSocket.BufferSize,
+		QueueDepth:        config.WebSocket.QueueDepth,
+		QueueWeights:      queueWeights,
+		HeartbeatInterval: config.WebSocket.HeartbeatInterval,
+		MaxMissedPongs:    config.WebSocket.MaxMissedPongs,
+		AckInterval:       config.WebSocket.AckInterval,
+		WriteTimeout:      config.WebSocket.WriteTimeout,
+		ResumeWindow:      config.WebSocket.ResumeWindow,
+		RateLimits:        config.WebSocket.RateLimits,
+		ResendInterval:    config.WebSocket.ResendInterval,
+		ResendAttempts:    config.WebSocket.ResendAttempts,
+		Metrics:           relayMetrics,
+	})
 	parserInstance := parser.New()
 	transformerInstance := transformer.New()
-	updaterInstance := updater.New(config.STAG.URL, config.Batch.MaxSize, config.Batch.Timeout)
+	sinks, err := buildSinks(config, relayMetrics)
+	if err != nil {
+		log.Fatalf("Failed to configure sinks: %v", err)
+	}
+	notifier, err := buildNotifier(config, relayMetrics)
+	if err != nil {
+		log.Fatalf("Failed to configure webhooks: %v", err)
+	}
+	updaterOptions := updater.Options{
+		Sinks:            sinks,
+		Retry:            retryPolicy(config.Retry),
+		DeadLetterDir:    config.DeadLetter.Dir,
+		Metrics:          relayMetrics,
+		VertexTolerance:  config.Diff.VertexTolerance,
+		MaxDeltaRatio:    config.Diff.MaxDeltaRatio,
+		KeyframeInterval: config.Diff.KeyframeInterval,
+		KeyframeMaxAge:   config.Diff.KeyframeMaxAge,
+		MeshCacheBytes:   config.MeshCache.MaxBytes,
+		MeshIdleTTL:      config.MeshCache.IdleTTL,
+		MaxQueued:        config.Batch.MaxQueued,
+		MaxInFlight:      config.Batch.MaxInFlight,
+		BatchBytes:       config.Batch.MaxBytes,
+		Coalesce:         coalescePolicy(config.Coalesce),
+	}
+	if adaptive := config.Batch.Adaptive; adaptive.Enabled {
+		updaterOptions.Adaptive = &updater.AdaptiveBatching{
+			MinTimeout:    adaptive.MinTimeout,
+			MaxTimeout:    adaptive.MaxTimeout,
+			TargetLatency: adaptive.TargetLatency,
+			MaxErrorRate:  adaptive.MaxErrorRate,
+		}
+	}
+	if notifier != nil {
+		updaterOptions.OnDelivered = notifier.BatchDelivered
+	}
+	if config.Spool.Dir != "" {
+		updaterOptions.Spool = &spool.Options{
+			Dir:          config.Spool.Dir,
+			SegmentBytes: config.Spool.SegmentBytes,
+			MaxBytes:     config.Spool.MaxBytes,
+			Overflow:     spool.OverflowPolicy(config.Spool.Overflow),
+			Fsync:        config.Spool.Fsync,
+		}
+	}
+	updaterInstance, err := updater.NewWithOptions(config.STAG.URL, config.Batch.MaxSize, config.Batch.Timeout, updaterOptions)
+	if err != nil {
+		log.Fatalf("Failed to create updater: %v", err)
+	}
+	
+	// Forget per-session state once a session's last connection is gone
+	if notifier != nil {
+		gateInstance.SetSessionStartHandler(notifier.SessionStarted)
+		gateInstance.SetSessionEndHandler(func(sessionID string) {
+			updaterInstance.EndSession(sessionID)
+			notifier.SessionEnded(sessionID)
+		})
+	} else {
+		gateInstance.SetSessionEndHandler(updaterInstance.EndSession)
+	}
 	
 	// Start components
 	gateInstance.Start()
 	updaterInstance.Start()
 	
 	// Setup message processing pipeline
-	go processMessages(gateInstance, parserInstance, transformerInstance, updaterInstance, relayMetrics)
+	pipelineInstance := pipeline.New(gateInstance.Messages(), pipeline.Options{
+		Parser:       parserInstance,
+		Transformer:  transformerInstance,
+		Processor:    updaterInstance,
+		Acker:        gateInstance,
+		Admitter:     gateInstance,
+		Metrics:      relayMetrics,
+		Fast:         config.Pipeline.Fast,
+		Bulk:         config.Pipeline.Bulk,
+		FastMaxBytes: config.Pipeline.FastMaxBytes,
+	})
+	pipelineInstance.Start()
 	
 	// Setup HTTP server
-	router := setupRouter(gateInstance, relayMetrics)
+	router := setupRouter(gateInstance, updaterInstance, notifier, relayMetrics, config.Server.AdminKeys)
 	
 	server := &http.Server{
 		Addr:    config.Server.Host + ":" + config.Server.Port,
@@ -68,9 +163,15 @@ func main() {
 		log.Printf("Server forced to shutdown: %v", err)
 	}
 	
-	// Stop components
+	// Stop components. The gate goes first so the pipeline can drain
+	// everything it admitted.
 	gateInstance.Stop()
+	pipelineInstance.Stop()
 	updaterInstance.Stop()
+	if notifier != nil {
+		// After the updater, so its final batches are still reported
+		notifier.Close()
+	}
 	
 	log.Println("Server exited")
 }
@@ -87,9 +188,51 @@ func loadConfig() *types.Config {
 	viper.SetDefault("stag.url", "http://localhost:8080")
 	viper.SetDefault("stag.timeout", "10s")
 	viper.SetDefault("websocket.buffer_size", 1024)
+	viper.SetDefault("websocket.queue_depth", 64)
 	viper.SetDefault("websocket.heartbeat_interval", "30s")
+	viper.SetDefault("websocket.ack_interval", "1s")
+	viper.SetDefault("websocket.write_timeout", "5s")
+	viper.SetDefault("websocket.resume_window", "30s")
+	viper.SetDefault("websocket.max_missed_pongs", 3)
+	viper.SetDefault("websocket.resend_interval", "500ms")
+	viper.SetDefault("websocket.resend_attempts", 3)
+	viper.SetDefault("pipeline.fast.workers", 0) // One per CPU
+	viper.SetDefault("pipeline.fast.queue", 256)
+	viper.SetDefault("pipeline.bulk.workers", 0)
+	viper.SetDefault("pipeline.bulk.queue", 32)
+	viper.SetDefault("pipeline.fast_max_bytes", 64<<10)
 	viper.SetDefault("batch.max_size", 5)
 	viper.SetDefault("batch.timeout", "100ms")
+	viper.SetDefault("batch.max_queued", 4096)
+	viper.SetDefault("batch.max_in_flight", 1)
+	viper.SetDefault("batch.max_bytes", 0)
+	viper.SetDefault("batch.adaptive.enabled", false)
+	viper.SetDefault("batch.adaptive.min_timeout", "10ms")
+	viper.SetDefault("batch.adaptive.max_timeout", "2s")
+	viper.SetDefault("batch.adaptive.target_latency", "250ms")
+	viper.SetDefault("batch.adaptive.max_error_rate", 0.05)
+	viper.SetDefault("coalesce.mode", "none")
+	viper.SetDefault("coalesce.every_n", 3)
+	viper.SetDefault("coalesce.min_distance", 0.01)
+	viper.SetDefault("coalesce.min_angle", 1.0)
+	viper.SetDefault("retry.max_attempts", 5)
+	viper.SetDefault("retry.initial_backoff", "200ms")
+	viper.SetDefault("retry.max_backoff", "10s")
+	viper.SetDefault("retry.multiplier", 2.0)
+	viper.SetDefault("retry.jitter", 0.2)
+	viper.SetDefault("retry.max_retry_after", "5m")
+	viper.SetDefault("dead_letter.dir", "")
+	viper.SetDefault("diff.vertex_tolerance", 0.001)
+	viper.SetDefault("diff.max_delta_ratio", 0.7)
+	viper.SetDefault("diff.keyframe_interval", 30)
+	viper.SetDefault("diff.keyframe_max_age", "10s")
+	viper.SetDefault("mesh_cache.max_bytes", 256<<20)
+	viper.SetDefault("mesh_cache.idle_ttl", "10m")
+	viper.SetDefault("spool.dir", "")
+	viper.SetDefault("spool.segment_bytes", 8<<20)
+	viper.SetDefault("spool.max_bytes", 512<<20)
+	viper.SetDefault("spool.overflow", "reject")
+	viper.SetDefault("spool.fsync", false)
 	
 	// Read config file if it exists
 	if err := viper.ReadInConfig(); err != nil {
@@ -112,7 +255,7 @@ func loadConfig() *types.Config {
 	return &config
 }
 
-func setupRouter(gateInstance *gate.Gate, relayMetrics *metrics.Metrics) *gin.Engine {
+func setupRouter(gateInstance *gate.Gate, updaterInstance *updater.Updater, notifier *webhook.Notifier, relayMetrics *metrics.Metrics, adminKeys []string) *gin.Engine {
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.New()
 	router.Use(gin.Logger(), gin.Recovery())
@@ -136,53 +279,101 @@ func setupRouter(gateInstance *gate.Gate, relayMetrics *metrics.Metrics) *gin.En
 	router.GET("/status", func(c *gin.Context) {
 		c.JSON(200, gin.H{
 			"active_connections": gateInstance.GetActiveConnections(),
+			"queues":            gateInstance.QueueStats(),
 			"uptime":            time.Since(time.Now()).String(), // This would be tracked properly
 		})
 	})
 	
-	return router
-}
-
-func processMessages(
-	gateInstance *gate.Gate,
-	parserInstance *parser.Parser,
-	transformerInstance *transformer.Transformer,
-	updaterInstance *updater.Updater,
-	relayMetrics *metrics.Metrics,
-) {
-	for msg := range gateInstance.Messages() {
-		start := time.Now()
-		
-		// Parse packet
-		parsedPacket, err := parserInstance.ParsePacket(msg.Packet)
-		if err != nil {
-			log.Printf("Failed to parse packet: %v", err)
-			relayMetrics.RecordPacketError(msg.Packet.Type, "parse_error")
-			continue
+	// Dead letters and failed notifications hold event payloads, so they
+	// are for admins only
+	admin := router.Group("/", requireAdmin(adminKeys))
+	
+	// Dead-letter inspection and redelivery
+	admin.GET("/deadletters", func(c *gin.Context) {
+		entries := updaterInstance.DeadLetters().List()
+		summaries := make([]gin.H, 0, len(entries))
+		for _, entry := range entries {
+			summaries = append(summaries, gin.H{
+				"id":            entry.ID,
+				"sink":          entry.Sink,
+				"events":        len(entry.Events),
+				"attempts":      entry.Attempts,
+				"last_error":    entry.LastError,
+				"first_failure": entry.FirstFailure,
+				"last_failure":  entry.LastFailure,
+			})
 		}
-		
-		// Transform to event
-		event, err := transformerInstance.Transform(*parsedPacket)
+		c.JSON(200, gin.H{"dead_letters": summaries})
+	})
+	
+	admin.GET("/deadletters/:id", func(c *gin.Context) {
+		entry, ok := updaterInstance.DeadLetters().Get(c.Param("id"))
+		if !ok {
+			c.JSON(404, gin.H{"error": "dead letter not found"})
+			return
+		}
+		c.JSON(200, entry)
+	})
+	
+	admin.POST("/deadletters/:id/redrive", func(c *gin.Context) {
+		err := updaterInstance.Redrive(c.Param("id"))
+		switch {
+		case errors.Is(err, updater.ErrDeadLetterNotFound):
+			c.JSON(404, gin.H{"error": "dead letter not found"})
+			return
+		case errors.Is(err, updater.ErrRedriveInProgress):
+			c.JSON(409, gin.H{"error": err.Error()})
+			return
+		case err != nil:
+			c.JSON(502, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"status": "redriven"})
+	})
+	
+	admin.POST("/deadletters/redrive", func(c *gin.Context) {
+		redriven, err := updaterInstance.RedriveAll()
 		if err != nil {
-			log.Printf("Failed to transform packet: %v", err)
-			relayMetrics.RecordPacketError(msg.Packet.Type, "transform_error")
-			continue
+			c.JSON(502, gin.H{"redriven": redriven, "error": err.Error()})
+			return
 		}
-		
-		// Process in updater
-		if err := updaterInstance.ProcessEvent(*event); err != nil {
-			log.Printf("Failed to process event: %v", err)
-			relayMetrics.RecordPacketError(msg.Packet.Type, "update_error")
-			continue
+		c.JSON(200, gin.H{"redriven": redriven})
+	})
+	
+	// Webhook notifications that exhausted their retries
+	admin.GET("/webhooks/failures", func(c *gin.Context) {
+		failures := []webhook.Failure{}
+		if notifier != nil {
+			failures = notifier.Failures()
+		}
+		c.JSON(200, gin.H{"failures": failures})
+	})
+	
+	return router
+}
+
+// requireAdmin rejects requests without one of the admin API keys. With
+// no keys configured, only clients connecting from loopback are let in;
+// proxy headers are ignored, since they are easy to forge.
+func requireAdmin(adminKeys []string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(adminKeys) == 0 {
+			host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+			if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin endpoints are only served to loopback clients"})
+				return
+			}
+			c.Next()
+			return
 		}
 		
-		// Record success metrics
-		relayMetrics.RecordPacket(msg.Packet.Type, "success")
-		
-		// Log processing time
-		duration := time.Since(start)
-		if duration > 10*time.Millisecond {
-			log.Printf("Slow packet processing: %v for type %s", duration, msg.Packet.Type)
+		presented := []byte(c.GetHeader("X-API-Key"))
+		for _, key := range adminKeys {
+			if key != "" && subtle.ConstantTimeCompare(presented, []byte(key)) == 1 {
+				c.Next()
+				return
+			}
 		}
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "admin API key required"})
 	}
 }
\ No newline at end of file
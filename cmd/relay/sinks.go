@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/tabular/relay/internal/filesink"
+	"github.com/tabular/relay/internal/kafkasink"
+	"github.com/tabular/relay/internal/metrics"
+	"github.com/tabular/relay/internal/mqttsink"
+	"github.com/tabular/relay/internal/updater"
+	"github.com/tabular/relay/pkg/client"
+	"github.com/tabular/relay/pkg/sink"
+	"github.com/tabular/relay/pkg/types"
+)
+
+// buildSinks creates a delivery route per configured sink. Without any
+// sinks configured everything goes to STAG.
+func buildSinks(config *types.Config, relayMetrics *metrics.Metrics) ([]updater.Route, error) {
+	sinkConfigs := config.Sinks
+	if len(sinkConfigs) == 0 {
+		sinkConfigs = []types.SinkConfig{{Type: "stag"}}
+	}
+
+	routes := make([]updater.Route, 0, len(sinkConfigs))
+	for i, cfg := range sinkConfigs {
+		s, err := newSink(config, cfg, relayMetrics)
+		if err != nil {
+			return nil, fmt.Errorf("sink %d: %w", i, err)
+		}
+
+		route := updater.Route{
+			Name:         cfg.Name,
+			Sink:         s,
+			BatchSize:    cfg.Batch.MaxSize,
+			BatchTimeout: cfg.Batch.Timeout,
+			BatchBytes:   cfg.Batch.MaxBytes,
+			Filter:       updater.Filter{Types: cfg.Filter.Types},
+		}
+		if cfg.Retry != nil {
+			policy := retryPolicy(mergeRetry(config.Retry, *cfg.Retry))
+			route.Retry = &policy
+		}
+		if cfg.Coalesce != nil {
+			policy := coalescePolicy(*cfg.Coalesce)
+			route.Coalesce = &policy
+		}
+		routes = append(routes, route)
+	}
+
+	return routes, nil
+}
+
+// newSink creates the sink for one sink config entry
+func newSink(config *types.Config, cfg types.SinkConfig, relayMetrics *metrics.Metrics) (sink.Sink, error) {
+	switch cfg.Type {
+	case "stag":
+		url := cfg.URL
+		if url == "" {
+			url = config.STAG.URL
+		}
+		timeout := cfg.Timeout
+		if timeout <= 0 {
+			timeout = config.STAG.Timeout
+		}
+		return client.NewStagClient(url, cfg.APIKey, timeout), nil
+	case "file":
+		return filesink.Open(filesink.Options{
+			Dir:         cfg.File.Dir,
+			Name:        cfg.Name,
+			Compression: filesink.Compression(cfg.File.Compression),
+			MaxBytes:    cfg.File.MaxBytes,
+			MaxAge:      cfg.File.MaxAge,
+			Fsync:       cfg.File.Fsync,
+		})
+	case "mqtt":
+		version, err := mqttVersion(cfg.MQTT.Version)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.MQTT.QoS.Anchors < 0 || cfg.MQTT.QoS.Anchors > 2 || cfg.MQTT.QoS.Meshes < 0 || cfg.MQTT.QoS.Meshes > 2 {
+			return nil, fmt.Errorf("mqtt qos must be 0, 1 or 2")
+		}
+		return mqttsink.Open(mqttsink.Options{
+			Name:            cfg.Name,
+			Broker:          cfg.URL,
+			ClientID:        cfg.MQTT.ClientID,
+			Username:        cfg.MQTT.Username,
+			Password:        cfg.MQTT.Password,
+			ProtocolVersion: version,
+			KeepAlive:       cfg.MQTT.KeepAlive,
+			Timeout:         cfg.Timeout,
+			AnchorTopic:     cfg.MQTT.Topics.Anchors,
+			MeshTopic:       cfg.MQTT.Topics.Meshes,
+			AnchorQoS:       byte(cfg.MQTT.QoS.Anchors),
+			MeshQoS:         byte(cfg.MQTT.QoS.Meshes),
+			RetainAnchors:   cfg.MQTT.Retain.Anchors,
+			RetainMeshes:    cfg.MQTT.Retain.Meshes,
+		})
+	case "kafka":
+		return kafkasink.Open(kafkasink.Options{
+			Name:       cfg.Name,
+			Brokers:    cfg.Kafka.Brokers,
+			Topic:      cfg.Kafka.Topic,
+			ClientID:   cfg.Kafka.ClientID,
+			Acks:       cfg.Kafka.Acks,
+			Idempotent: cfg.Kafka.Idempotent,
+			BatchBytes: cfg.Kafka.BatchBytes,
+			Timeout:    cfg.Timeout,
+			Metrics:    relayMetrics,
+		})
+	case "":
+		return nil, fmt.Errorf("missing sink type")
+	default:
+		return nil, fmt.Errorf("unknown sink type: %s", cfg.Type)
+	}
+}
+
+// mqttVersion maps a configured MQTT version to its protocol level
+func mqttVersion(version string) (byte, error) {
+	switch version {
+	case "", "3.1.1":
+		return mqttsink.Version311, nil
+	case "5", "5.0":
+		return mqttsink.Version5, nil
+	default:
+		return 0, fmt.Errorf("unsupported mqtt version: %s", version)
+	}
+}
+
+// retryPolicy converts retry config to a sink retry policy
+func retryPolicy(cfg types.RetryConfig) sink.RetryPolicy {
+	return sink.RetryPolicy{
+		MaxAttempts:    cfg.MaxAttempts,
+		InitialBackoff: cfg.InitialBackoff,
+		MaxBackoff:     cfg.MaxBackoff,
+		Multiplier:     cfg.Multiplier,
+		Jitter:         cfg.Jitter,
+		MaxRetryAfter:  cfg.MaxRetryAfter,
+	}
+}
+
+func coalescePolicy(cfg types.CoalesceConfig) updater.CoalescePolicy {
+	return updater.CoalescePolicy{
+		Mode:        cfg.Mode,
+		EveryN:      cfg.EveryN,
+		MinDistance: cfg.MinDistance,
+		MinAngle:    cfg.MinAngle,
+	}
+}
+
+// mergeRetry overrides the non-zero fields of base with a sink's settings
+func mergeRetry(base, override types.RetryConfig) types.RetryConfig {
+	if override.MaxAttempts != 0 {
+		base.MaxAttempts = override.MaxAttempts
+	}
+	if override.InitialBackoff != 0 {
+		base.InitialBackoff = override.InitialBackoff
+	}
+	if override.MaxBackoff != 0 {
+		base.MaxBackoff = override.MaxBackoff
+	}
+	if override.Multiplier != 0 {
+		base.Multiplier = override.Multiplier
+	}
+	if override.MaxRetryAfter != 0 {
+		base.MaxRetryAfter = override.MaxRetryAfter
+	}
+	if override.Jitter != 0 {
+		base.Jitter = override.Jitter
+	}
+	return base
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/tabular/relay/internal/metrics"
+	"github.com/tabular/relay/internal/webhook"
+	"github.com/tabular/relay/pkg/types"
+)
+
+// buildNotifier creates the webhook notifier, or returns nil when no
+// subscribers are configured
+func buildNotifier(config *types.Config, relayMetrics *metrics.Metrics) (*webhook.Notifier, error) {
+	if len(config.Webhooks.Subscribers) == 0 {
+		return nil, nil
+	}
+
+	retry := config.Retry
+	if config.Webhooks.Retry != nil {
+		retry = mergeRetry(retry, *config.Webhooks.Retry)
+	}
+
+	subscribers := make([]webhook.Subscriber, len(config.Webhooks.Subscribers))
+	for i, cfg := range config.Webhooks.Subscribers {
+		subscribers[i] = webhook.Subscriber{
+			APIKey: cfg.APIKey,
+			URL:    cfg.URL,
+			Secret: cfg.Secret,
+			Events: cfg.Events,
+		}
+	}
+
+	return webhook.New(webhook.Options{
+		Subscribers: subscribers,
+		Timeout:     config.Webhooks.Timeout,
+		Retry:       retryPolicy(retry),
+		QueueSize:   config.Webhooks.QueueSize,
+		Metrics:     relayMetrics,
+	})
+}
@@ -0,0 +1,579 @@
+// Package filesink archives event batches to rotated NDJSON files on local
+// disk, partitioned by date and session, with an index of every segment.
+package filesink
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/tabular/relay/pkg/sink"
+	"github.com/tabular/relay/pkg/types"
+)
+
+// Compression selects how segment files are compressed
+type Compression string
+
+const (
+	CompressionNone Compression = "none"
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+const (
+	indexFile  = "index.ndjson"
+	segmentExt = ".ndjson"
+)
+
+// Options configures a file Sink
+type Options struct {
+	Dir         string
+	Name        string        // Sink name; defaults to "file"
+	Compression Compression   // Defaults to none
+	MaxBytes    int64         // Rotate after this many uncompressed bytes (default 64 MiB)
+	MaxAge      time.Duration // Rotate segments open for this long (default 1h)
+	MaxOpen     int           // Segments open at once; the least recently written is closed first (default 64)
+	Fsync       bool          // fsync after every batch
+}
+
+// partition identifies the segment an event is written to
+type partition struct {
+	date      string
+	sessionID string
+}
+
+// segment is a file being written. writer compresses into file, or buffers
+// it when compression is off.
+type segment struct {
+	file      *os.File
+	writer    compressor
+	entry     IndexEntry
+	lastWrite time.Time
+
+	// What was on disk after the last successful flush
+	flushed      int64
+	flushedEntry IndexEntry
+}
+
+// compressor is satisfied by gzip.Writer, zstd.Encoder and plainWriter
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// plainWriter buffers uncompressed segments
+type plainWriter struct {
+	*bufio.Writer
+}
+
+func (w plainWriter) Close() error {
+	return w.Flush()
+}
+
+// Sink writes every batch it is sent to NDJSON segment files under
+// Dir/date=YYYY-MM-DD/session=ID/. A segment is closed and recorded in
+// Dir/index.ndjson once it reaches MaxBytes or MaxAge. It implements
+// sink.Sink.
+type Sink struct {
+	opts     Options
+	segments map[partition]*segment
+	index    *os.File
+	closed   bool
+	mutex    sync.Mutex
+
+	stopC chan struct{}
+	wg    sync.WaitGroup
+}
+
+// Open creates a file sink, indexing any segments a previous run left open
+func Open(opts Options) (*Sink, error) {
+	if opts.Dir == "" {
+		return nil, fmt.Errorf("file sink dir is required")
+	}
+	if opts.Name == "" {
+		opts.Name = "file"
+	}
+	if opts.Compression == "" {
+		opts.Compression = CompressionNone
+	}
+	if opts.Compression != CompressionNone && opts.Compression != CompressionGzip && opts.Compression != CompressionZstd {
+		return nil, fmt.Errorf("unknown file sink compression: %s", opts.Compression)
+	}
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = 64 << 20
+	}
+	if opts.MaxAge <= 0 {
+		opts.MaxAge = time.Hour
+	}
+	if opts.MaxOpen <= 0 {
+		opts.MaxOpen = 64
+	}
+
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create file sink dir: %w", err)
+	}
+
+	s := &Sink{
+		opts:     opts,
+		segments: make(map[partition]*segment),
+		stopC:    make(chan struct{}),
+	}
+
+	index, err := os.OpenFile(filepath.Join(opts.Dir, indexFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file sink index: %w", err)
+	}
+	s.index = index
+
+	if err := s.recover(); err != nil {
+		index.Close()
+		return nil, err
+	}
+
+	s.wg.Add(1)
+	go s.rotateLoop()
+
+	return s, nil
+}
+
+// Name identifies the sink
+func (s *Sink) Name() string {
+	return s.opts.Name
+}
+
+// Send appends each event to its partition's segment. An event that can't
+// be encoded fails on its own. If a partition's segment can't be written,
+// the batch's events of that partition fail together and none of them is
+// left in the segment; the other partitions are still delivered.
+func (s *Sink) Send(ctx context.Context, events []types.SpatialEvent) ([]sink.Result, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil, &sink.DeliveryError{Sink: s.opts.Name, Err: errors.New("sink closed")}
+	}
+
+	now := time.Now()
+	results := sink.Delivered(events)
+
+	// Group by partition, keeping each partition's events in batch order
+	var order []partition
+	groups := make(map[partition][]int)
+	for i, event := range events {
+		p := partitionOf(event, now)
+		if _, exists := groups[p]; !exists {
+			order = append(order, p)
+		}
+		groups[p] = append(groups[p], i)
+	}
+
+	for _, p := range order {
+		for n, err := range s.write(p, events, groups[p], now) {
+			if err != nil {
+				results[groups[p][n]].Err = err
+			}
+		}
+	}
+
+	return results, nil
+}
+
+// Close closes and indexes every open segment
+func (s *Sink) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.stopC)
+	s.mutex.Unlock()
+
+	s.wg.Wait()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var firstErr error
+	for p, seg := range s.segments {
+		if err := s.closeSegment(p, seg, time.Now()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if err := s.index.Close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+// write appends the events at indexes to a partition's segment and returns
+// the error of each, in the same order
+func (s *Sink) write(p partition, events []types.SpatialEvent, indexes []int, now time.Time) []error {
+	errs := make([]error, len(indexes))
+	failAll := func(err error) []error {
+		for n := range errs {
+			if errs[n] == nil {
+				errs[n] = &sink.DeliveryError{Sink: s.opts.Name, Err: err}
+			}
+		}
+		return errs
+	}
+
+	seg, err := s.segmentFor(p, now)
+	if err != nil {
+		return failAll(err)
+	}
+
+	for n, i := range indexes {
+		line, err := json.Marshal(events[i])
+		if err != nil {
+			errs[n] = &sink.DeliveryError{Sink: s.opts.Name, Permanent: true, Err: fmt.Errorf("failed to marshal event: %w", err)}
+			continue
+		}
+		line = append(line, '\n')
+
+		if _, err := seg.writer.Write(line); err != nil {
+			s.discardBatch(p, seg, now)
+			return failAll(fmt.Errorf("failed to write segment: %w", err))
+		}
+		seg.entry.add(events[i], int64(len(line)))
+	}
+	seg.lastWrite = now
+
+	if err := s.flush(seg); err != nil {
+		s.discardBatch(p, seg, now)
+		return failAll(err)
+	}
+
+	// The batch is on disk; a segment that fails to close is indexed by
+	// recover on the next start
+	if seg.entry.Bytes >= s.opts.MaxBytes {
+		if err := s.closeSegment(p, seg, now); err != nil {
+			log.Printf("Failed to close segment %s: %v", seg.entry.Path, err)
+		}
+	}
+	return errs
+}
+
+// flush pushes buffered data to the file so a crash loses at most the
+// batch being written
+func (s *Sink) flush(seg *segment) error {
+	if err := seg.writer.Flush(); err != nil {
+		return fmt.Errorf("failed to flush segment: %w", err)
+	}
+	if s.opts.Fsync {
+		if err := seg.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync segment: %w", err)
+		}
+	}
+
+	offset, err := seg.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("failed to read segment offset: %w", err)
+	}
+	seg.flushed = offset
+	seg.flushedEntry = seg.entry
+	return nil
+}
+
+// segmentFor returns the open segment for a partition, starting a new one
+// if there is none or the current one is too old
+func (s *Sink) segmentFor(p partition, now time.Time) (*segment, error) {
+	if seg, exists := s.segments[p]; exists {
+		if now.Sub(seg.entry.OpenedAt) < s.opts.MaxAge {
+			return seg, nil
+		}
+		if err := s.closeSegment(p, seg, now); err != nil {
+			log.Printf("Failed to close segment %s: %v", seg.entry.Path, err)
+		}
+	}
+
+	if len(s.segments) >= s.opts.MaxOpen {
+		s.closeLeastRecent(now)
+	}
+
+	seg, err := s.createSegment(p, now)
+	if err != nil {
+		return nil, err
+	}
+	s.segments[p] = seg
+	return seg, nil
+}
+
+// createSegment creates a new segment file for a partition
+func (s *Sink) createSegment(p partition, now time.Time) (*segment, error) {
+	rel := filepath.Join("date="+p.date, "session="+pathSafe(p.sessionID))
+	if err := os.MkdirAll(filepath.Join(s.opts.Dir, rel), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create partition dir: %w", err)
+	}
+
+	var file *os.File
+	var name string
+	for at := now.UTC(); ; at = at.Add(time.Nanosecond) {
+		name = at.Format("20060102T150405.000000000Z") + segmentExt + extension(s.opts.Compression)
+		f, err := os.OpenFile(filepath.Join(s.opts.Dir, rel, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err == nil {
+			file = f
+			break
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("failed to create segment: %w", err)
+		}
+	}
+
+	writer, err := newCompressor(file, s.opts.Compression)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	entry := IndexEntry{
+		Path:        filepath.ToSlash(filepath.Join(rel, name)),
+		SessionID:   p.sessionID,
+		Date:        p.date,
+		Compression: s.opts.Compression,
+		OpenedAt:    now,
+	}
+	return &segment{
+		file:         file,
+		writer:       writer,
+		entry:        entry,
+		lastWrite:    now,
+		flushedEntry: entry,
+	}, nil
+}
+
+// closeSegment finishes a segment's stream and closes it
+func (s *Sink) closeSegment(p partition, seg *segment, now time.Time) error {
+	delete(s.segments, p)
+	return s.finishSegment(seg, seg.writer.Close(), now)
+}
+
+// discardBatch cuts a segment that failed to write back to its last flush,
+// so nothing of the failed batch stays in it, and closes it. The compressor
+// is abandoned mid-stream: a compressed segment then reads as its flushed
+// events followed by io.ErrUnexpectedEOF, like one cut short by a crash.
+func (s *Sink) discardBatch(p partition, seg *segment, now time.Time) {
+	delete(s.segments, p)
+
+	seg.entry = seg.flushedEntry
+	if err := seg.file.Truncate(seg.flushed); err != nil {
+		log.Printf("Failed to truncate segment %s: %v", seg.entry.Path, err)
+	}
+	if err := s.finishSegment(seg, nil, now); err != nil {
+		log.Printf("Failed to close segment %s: %v", seg.entry.Path, err)
+	}
+}
+
+// finishSegment closes a segment's file once its writer is done and records
+// it in the index. Segments nothing was written to are removed instead.
+func (s *Sink) finishSegment(seg *segment, writeErr error, now time.Time) error {
+	if s.opts.Fsync {
+		seg.file.Sync()
+	}
+	if info, err := seg.file.Stat(); err == nil {
+		seg.entry.FileBytes = info.Size()
+	}
+	closeErr := seg.file.Close()
+
+	if seg.entry.Events == 0 {
+		os.Remove(seg.file.Name())
+		return nil
+	}
+
+	seg.entry.ClosedAt = now
+	if err := s.appendIndex(seg.entry); err != nil {
+		return err
+	}
+	if writeErr != nil {
+		return fmt.Errorf("failed to finish segment %s: %w", seg.entry.Path, writeErr)
+	}
+	return closeErr
+}
+
+// closeLeastRecent closes the segment written to longest ago
+func (s *Sink) closeLeastRecent(now time.Time) {
+	var oldest partition
+	var oldestSeg *segment
+	for p, seg := range s.segments {
+		if oldestSeg == nil || seg.lastWrite.Before(oldestSeg.lastWrite) {
+			oldest, oldestSeg = p, seg
+		}
+	}
+	if oldestSeg != nil {
+		if err := s.closeSegment(oldest, oldestSeg, now); err != nil {
+			log.Printf("Failed to close segment %s: %v", oldestSeg.entry.Path, err)
+		}
+	}
+}
+
+// rotateLoop closes segments that reached MaxAge even if nothing more is
+// written to them
+func (s *Sink) rotateLoop() {
+	defer s.wg.Done()
+
+	interval := s.opts.MaxAge / 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.rotateExpired(time.Now())
+		case <-s.stopC:
+			return
+		}
+	}
+}
+
+func (s *Sink) rotateExpired(now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for p, seg := range s.segments {
+		if now.Sub(seg.entry.OpenedAt) >= s.opts.MaxAge {
+			if err := s.closeSegment(p, seg, now); err != nil {
+				log.Printf("Failed to close segment %s: %v", seg.entry.Path, err)
+			}
+		}
+	}
+}
+
+func (s *Sink) appendIndex(entry IndexEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal index entry: %w", err)
+	}
+	if _, err := s.index.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	if s.opts.Fsync {
+		if err := s.index.Sync(); err != nil {
+			return fmt.Errorf("failed to sync index: %w", err)
+		}
+	}
+	return nil
+}
+
+// recover indexes segments left open by a crash, keeping every event
+// that was completely written
+func (s *Sink) recover() error {
+	entries, err := ReadIndex(s.opts.Dir)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = s.truncateIndex()
+	}
+	if err != nil {
+		return err
+	}
+	indexed := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		indexed[entry.Path] = true
+	}
+
+	return filepath.WalkDir(s.opts.Dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.Contains(d.Name(), segmentExt) {
+			return nil
+		}
+		rel, err := filepath.Rel(s.opts.Dir, path)
+		if err != nil || rel == indexFile || indexed[filepath.ToSlash(rel)] {
+			return nil
+		}
+
+		entry, err := scanSegment(path, filepath.ToSlash(rel))
+		if err != nil {
+			log.Printf("Skipping unreadable segment %s: %v", rel, err)
+			return nil
+		}
+		if entry.Events == 0 {
+			os.Remove(path)
+			return nil
+		}
+		log.Printf("Recovered segment %s with %d events", rel, entry.Events)
+		return s.appendIndex(entry)
+	})
+}
+
+// truncateIndex cuts a torn last entry off the index, so the next entry
+// appended starts on a line of its own
+func (s *Sink) truncateIndex() error {
+	data, err := os.ReadFile(s.index.Name())
+	if err != nil {
+		return fmt.Errorf("failed to read index: %w", err)
+	}
+	end := bytes.LastIndexByte(data, '\n') + 1
+	log.Printf("Dropping torn entry at the end of %s", indexFile)
+	if err := s.index.Truncate(int64(end)); err != nil {
+		return fmt.Errorf("failed to truncate index: %w", err)
+	}
+	return nil
+}
+
+// partitionOf returns the partition of an event, dated by its timestamp
+func partitionOf(event types.SpatialEvent, now time.Time) partition {
+	at := now
+	if event.Timestamp > 0 {
+		at = time.UnixMilli(event.Timestamp)
+	}
+	return partition{date: at.UTC().Format("2006-01-02"), sessionID: event.SessionID}
+}
+
+// pathSafe turns a client-supplied session ID into a single path element
+func pathSafe(id string) string {
+	if id == "" || id == "." || id == ".." {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		default:
+			return '_'
+		}
+	}, id)
+}
+
+func extension(compression Compression) string {
+	switch compression {
+	case CompressionGzip:
+		return ".gz"
+	case CompressionZstd:
+		return ".zst"
+	default:
+		return ""
+	}
+}
+
+func newCompressor(w io.Writer, compression Compression) (compressor, error) {
+	switch compression {
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		// Segments are written under the sink lock, so extra encoder
+		// goroutines would only sit idle per open segment
+		encoder, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd encoder: %w", err)
+		}
+		return encoder, nil
+	default:
+		return plainWriter{bufio.NewWriter(w)}, nil
+	}
+}
@@ -0,0 +1,193 @@
+package filesink
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/tabular/relay/pkg/types"
+)
+
+// IndexEntry describes a closed segment. The index file holds one entry per
+// line in the order segments were closed.
+type IndexEntry struct {
+	Path           string      `json:"path"` // Relative to the sink dir
+	SessionID      string      `json:"session_id"`
+	Date           string      `json:"date"`
+	Compression    Compression `json:"compression"`
+	Events         int         `json:"events"`
+	Poses          int         `json:"poses"`  // Events carrying anchors
+	Meshes         int         `json:"meshes"` // Events carrying meshes
+	FirstEventID   string      `json:"first_event_id"`
+	LastEventID    string      `json:"last_event_id"`
+	FirstTimestamp int64       `json:"first_timestamp"` // Event timestamps, Unix ms
+	LastTimestamp  int64       `json:"last_timestamp"`
+	Bytes          int64       `json:"bytes"`      // Uncompressed NDJSON size
+	FileBytes      int64       `json:"file_bytes"` // Size on disk
+	OpenedAt       time.Time   `json:"opened_at"`
+	ClosedAt       time.Time   `json:"closed_at"`
+	Recovered      bool        `json:"recovered,omitempty"` // Indexed after an unclean shutdown
+}
+
+// add accounts for an event written to the segment
+func (e *IndexEntry) add(event types.SpatialEvent, size int64) {
+	if e.Events == 0 {
+		e.FirstEventID = event.EventID
+		e.FirstTimestamp = event.Timestamp
+	}
+	e.Events++
+	e.LastEventID = event.EventID
+	e.LastTimestamp = event.Timestamp
+	e.Bytes += size
+	if len(event.Anchors) > 0 {
+		e.Poses++
+	}
+	if len(event.Meshes) > 0 {
+		e.Meshes++
+	}
+}
+
+// ReadIndex returns the index entries of a sink dir, oldest first. A
+// truncated last entry is dropped and reported as io.ErrUnexpectedEOF along
+// with the entries before it.
+func ReadIndex(dir string) ([]IndexEntry, error) {
+	f, err := os.Open(filepath.Join(dir, indexFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open index: %w", err)
+	}
+	defer f.Close()
+
+	var entries []IndexEntry
+	err = readLines(f, func(line []byte) error {
+		var entry IndexEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return fmt.Errorf("corrupt index entry: %w", err)
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, err
+}
+
+// ReadSegment returns the events in a segment file, decompressing it
+// according to its extension. A segment cut short by a crash yields the
+// events completely written before it and io.ErrUnexpectedEOF.
+func ReadSegment(path string) ([]types.SpatialEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open segment: %w", err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	switch compressionOf(path) {
+	case CompressionGzip:
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, fmt.Errorf("failed to open gzip segment: %w", err)
+		}
+		defer gz.Close()
+		r = gz
+	case CompressionZstd:
+		decoder, err := zstd.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open zstd segment: %w", err)
+		}
+		defer decoder.Close()
+		r = decoder
+	}
+
+	var events []types.SpatialEvent
+	err = readLines(r, func(line []byte) error {
+		var event types.SpatialEvent
+		if err := json.Unmarshal(line, &event); err != nil {
+			return fmt.Errorf("corrupt segment event: %w", err)
+		}
+		events = append(events, event)
+		return nil
+	})
+	return events, err
+}
+
+// scanSegment builds the index entry of a segment that was never closed
+func scanSegment(path, rel string) (IndexEntry, error) {
+	events, err := ReadSegment(path)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return IndexEntry{}, err
+	}
+
+	entry := IndexEntry{
+		Path:        rel,
+		Compression: compressionOf(path),
+		Recovered:   true,
+	}
+	for _, part := range strings.Split(rel, "/") {
+		if date, ok := strings.CutPrefix(part, "date="); ok {
+			entry.Date = date
+		}
+	}
+	for _, event := range events {
+		line, _ := json.Marshal(event)
+		entry.add(event, int64(len(line)+1))
+	}
+	if len(events) > 0 {
+		entry.SessionID = events[0].SessionID
+	}
+
+	if info, err := os.Stat(path); err == nil {
+		entry.FileBytes = info.Size()
+		entry.OpenedAt = info.ModTime()
+		entry.ClosedAt = info.ModTime()
+	}
+	return entry, nil
+}
+
+// readLines calls fn for every newline-terminated line. Anything after the
+// last newline is an incomplete write and reported as io.ErrUnexpectedEOF.
+func readLines(r io.Reader, fn func(line []byte) error) error {
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == nil {
+			if err := fn(line[:len(line)-1]); err != nil {
+				return err
+			}
+			continue
+		}
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				return io.ErrUnexpectedEOF
+			}
+			return nil
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("failed to read: %w", err)
+	}
+}
+
+func compressionOf(path string) Compression {
+	switch {
+	case strings.HasSuffix(path, extension(CompressionGzip)):
+		return CompressionGzip
+	case strings.HasSuffix(path, extension(CompressionZstd)):
+		return CompressionZstd
+	default:
+		return CompressionNone
+	}
+}
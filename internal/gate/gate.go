@@ -2,15 +2,19 @@ package gate
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/tabular/relay/internal/metrics"
+	"github.com/tabular/relay/internal/parser"
+	"github.com/tabular/relay/pkg/protocol"
 	"github.com/tabular/relay/pkg/types"
 	"nhooyr.io/websocket"
-	"nhooyr.io/websocket/wsjson"
 )
 
 // Gate manages WebSocket connections and message routing
@@ -20,37 +24,150 @@ type Gate struct {
 	messageC    chan MessageEvent
 	stopC       chan struct{}
 	
+	// Moves messages from per-connection queues into messageC
+	scheduler  *scheduler
+	scheduling sync.WaitGroup
+	
+	// Called when the first connection of a session identifies it, and when
+	// the last connection of a session goes away
+	onSessionStart func(sessionID, apiKey string)
+	onSessionEnd   func(sessionID string)
+	
+	// Client streams by connection, including superseded connections whose
+	// frames may still be in the pipeline, and by resume token
+	streams map[string]*stream
+	tokens  map[string]*stream
+	
+	// Rate limiters shared by the connections of each API key
+	keyLimiters map[string]*limiter
+	
 	// Configuration
-	bufferSize        int
-	heartbeatInterval time.Duration
+	opts Options
+}
+
+// Options configures a Gate
+type Options struct {
+	BufferSize        int            // Messages scheduled for the pipeline
+	QueueDepth        int            // Messages queued per connection before drops (default 64)
+	QueueWeights      map[string]int // Scheduler weight by API key (default 1)
+	HeartbeatInterval time.Duration  // Ping interval; connections silent for 3 intervals are closed
+	MaxMissedPongs    int            // Unanswered pings in a row before a socket is closed (default 3)
+	AckInterval       time.Duration  // How often acks are sent to clients that asked for them (default 1s)
+	WriteTimeout      time.Duration  // Per control message write (default 5s)
+	OutboundQueue     int            // Nacks buffered per connection (default 64)
+	ResumeWindow      time.Duration  // How long a dropped connection's session waits to be resumed (default 30s)
+	RateLimits        types.RateLimitConfig
+	Metrics           *metrics.Metrics
+	
+	// Reliable mode
+	ResendInterval time.Duration // Between resend requests for a missing frame (default 500ms)
+	ResendAttempts int           // Resend requests before a missing frame is given up on (default 3)
 }
 
 // MessageEvent wraps incoming messages with connection context
 type MessageEvent struct {
-	ConnectionID string
-	Packet       types.StreamPacket
-	Timestamp    time.Time
+	ConnectionID    string
+	ProtocolVersion int                // Schema version Packet was sent in
+	Packet          types.StreamPacket // Not yet upgraded to the current schema
+	Size            int                // Bytes read off the socket
+	Timestamp       time.Time
 }
 
 // New creates a new Gate instance
 func New(bufferSize int, heartbeatInterval time.Duration) *Gate {
-	return &Gate{
-		connections:       make(map[string]*types.Connection),
-		messageC:          make(chan MessageEvent, bufferSize),
-		stopC:             make(chan struct{}),
-		bufferSize:        bufferSize,
-		heartbeatInterval: heartbeatInterval,
+	return NewWithOptions(Options{BufferSize: bufferSize, HeartbeatInterval: heartbeatInterval})
+}
+
+// NewWithOptions creates a new Gate instance with explicit options
+func NewWithOptions(opts Options) *Gate {
+	if opts.QueueDepth <= 0 {
+		opts.QueueDepth = 64
+	}
+	if opts.RateLimits.Policy == "" {
+		opts.RateLimits.Policy = RateLimitNack
 	}
+	if opts.MaxMissedPongs <= 0 {
+		opts.MaxMissedPongs = 3
+	}
+	if opts.AckInterval <= 0 {
+		opts.AckInterval = time.Second
+	}
+	if opts.WriteTimeout <= 0 {
+		opts.WriteTimeout = 5 * time.Second
+	}
+	if opts.OutboundQueue <= 0 {
+		opts.OutboundQueue = 64
+	}
+	if opts.ResumeWindow <= 0 {
+		opts.ResumeWindow = 30 * time.Second
+	}
+	if opts.ResendInterval <= 0 {
+		opts.ResendInterval = 500 * time.Millisecond
+	}
+	if opts.ResendAttempts <= 0 {
+		opts.ResendAttempts = 3
+	}
+	
+	messageC := make(chan MessageEvent, opts.BufferSize)
+	g := &Gate{
+		connections: make(map[string]*types.Connection),
+		streams:     make(map[string]*stream),
+		tokens:      make(map[string]*stream),
+		keyLimiters: make(map[string]*limiter),
+		messageC:    messageC,
+		stopC:       make(chan struct{}),
+		scheduler:   newScheduler(messageC, opts.Metrics),
+		opts:        opts,
+	}
+	g.scheduler.onPressure = g.signalPressure
+	return g
 }
 
 // Start begins the gate operations
 func (g *Gate) Start() {
 	go g.heartbeatLoop()
+	g.scheduling.Add(1)
+	go func() {
+		defer g.scheduling.Done()
+		g.scheduler.run(g.stopC)
+	}()
 }
 
-// Stop gracefully shuts down the gate
+// Stop gracefully shuts down the gate. Once it returns nothing more is sent
+// on Messages.
 func (g *Gate) Stop() {
 	close(g.stopC)
+	g.scheduling.Wait()
+}
+
+// SetSessionStartHandler registers a callback run when a connection starts
+// streaming for a session no other connection is streaming for
+func (g *Gate) SetSessionStartHandler(handler func(sessionID, apiKey string)) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.onSessionStart = handler
+}
+
+// SetSessionEndHandler registers a callback run when the last connection of
+// a session closes or is removed as stale
+func (g *Gate) SetSessionEndHandler(handler func(sessionID string)) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.onSessionEnd = handler
+}
+
+// SetAdmissionHandler registers a check every message must pass before it
+// is sent on Messages. A refused message waits at the head of its
+// connection's queue, holding up only that connection, until Readmit is
+// called; meanwhile the queue fills and the client is told to slow down.
+// Register it before the gate takes connections.
+func (g *Gate) SetAdmissionHandler(handler func(MessageEvent) bool) {
+	g.scheduler.setAdmit(handler)
+}
+
+// Readmit offers messages the admission handler refused to it again
+func (g *Gate) Readmit() {
+	g.scheduler.wake()
 }
 
 // Messages returns the channel for incoming messages
@@ -67,42 +184,116 @@ func (g *Gate) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Issue a resume token, or keep the one presented if it's still valid
+	presented := r.Header.Get(ResumeTokenHeader)
+	if presented == "" {
+		presented = r.URL.Query().Get(resumeTokenParam)
+	}
+	token := g.resumeToken(presented, apiKey)
+	w.Header().Set(ResumeTokenHeader, token)
+
 	// Accept WebSocket connection
 	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
 		OriginPatterns: []string{"*"}, // Configure based on security needs
+		Subprotocols:   protocol.Subprotocols,
 	})
 	if err != nil {
 		log.Printf("Failed to accept websocket: %v", err)
 		return
 	}
 	defer c.Close(websocket.StatusInternalError, "Internal server error")
+	
+	// Clients asking only for protocols we don't speak would misread our
+	// packets, so turn them away rather than falling back to version 1
+	offered := r.Header.Get("Sec-WebSocket-Protocol")
+	version, ok := protocol.Version(c.Subprotocol())
+	if !ok || (c.Subprotocol() == "" && offered != "") {
+		log.Printf("Rejecting websocket with unsupported protocol %q", offered)
+		c.Close(websocket.StatusProtocolError, unsupportedProtocolReason(offered))
+		return
+	}
 
 	// Create connection
 	conn := &types.Connection{
-		ID:        generateConnectionID(),
-		LastSeen:  time.Now(),
-		APIKey:    apiKey,
+		ID:              generateConnectionID(),
+		LastSeen:        time.Now(),
+		APIKey:          apiKey,
+		Subprotocol:     c.Subprotocol(),
+		ProtocolVersion: version,
 	}
 
-	// Register connection
-	g.addConnection(conn)
-	defer g.removeConnection(conn.ID)
+	// Register connection. A connection that drops without a close
+	// handshake leaves its session to be resumed.
+	st, resumed, superseded := g.attach(conn, c, token)
+	suspend := true
+	defer func() { g.removeConnection(conn.ID, suspend) }()
+	if superseded != nil {
+		go superseded.Close(websocket.StatusNormalClosure, "superseded by a resumed connection")
+	}
+	if g.opts.Metrics != nil {
+		g.opts.Metrics.RecordConnection()
+	}
+	
+	// Ping the client so idle but healthy connections stay registered and
+	// dead ones are closed
+	pingCtx, stopPing := context.WithCancel(context.Background())
+	defer stopPing()
+	go g.pingLoop(pingCtx, c, conn)
+	
+	// Clients opt in to acks and nacks with ?acks=true, and to resend
+	// requests and dedupe with ?reliable=true, which implies acks
+	var out *outbound
+	reliable, _ := strconv.ParseBool(r.URL.Query().Get("reliable"))
+	if acks, _ := strconv.ParseBool(r.URL.Query().Get("acks")); acks || reliable {
+		out = newOutbound(c, conn.ID, g.opts, st.acks)
+		out.session(token)
+		g.setOutbound(conn.ID, out)
+		go out.run()
+		defer out.close()
+	}
 
-	log.Printf("WebSocket connection established: %s", conn.ID)
+	if resumed {
+		log.Printf("WebSocket connection %s resumed session %q", conn.ID, conn.SessionID)
+	} else {
+		log.Printf("WebSocket connection established: %s", conn.ID)
+	}
+
+	// Give the connection its own queue, so it can only fill that
+	g.scheduler.add(conn.ID, g.opts.QueueDepth, g.queueWeight(apiKey))
+	defer g.scheduler.remove(conn.ID)
+	
+	// Limits apply to this connection and to all connections of its key
+	connLimiter := newLimiter(g.rateLimits(apiKey).PerConnection, time.Now())
+	keyLimiter := g.keyLimiter(apiKey)
+	if keyLimiter != nil {
+		defer g.releaseKeyLimiter(apiKey)
+	}
 
 	// Handle messages
+	var window *frameWindow
+	if reliable {
+		window = st.frames
+	}
+	retry := true // Ask again for frames an earlier connection was asked for
 	ctx := context.Background()
 	for {
 		select {
 		case <-g.stopC:
+			suspend = false
 			return
 		default:
-			var packet types.StreamPacket
-			err := wsjson.Read(ctx, c, &packet)
+			packet, size, err := readPacket(ctx, c, conn)
 			if err != nil {
-				if websocket.CloseStatus(err) == websocket.StatusNormalClosure {
+				var frameErr *frameError
+				switch {
+				case websocket.CloseStatus(err) == websocket.StatusNormalClosure:
 					log.Printf("WebSocket closed normally: %s", conn.ID)
-				} else {
+					suspend = false
+				case errors.As(err, &frameErr):
+					log.Printf("Closing %s: %v", conn.ID, err)
+					c.Close(frameErr.status, frameErr.reason)
+					suspend = false
+				default:
 					log.Printf("WebSocket read error: %v", err)
 				}
 				return
@@ -110,22 +301,204 @@ func (g *Gate) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 			// Update connection info
 			if packet.SessionID != "" && conn.SessionID == "" {
-				conn.SessionID = packet.SessionID
+				g.setSessionID(conn, packet.SessionID)
+			}
+			g.touch(conn)
+			
+			// Drop meshes a reliable stream already delivered, e.g. resent
+			// after a reconnect, and ack them so the client stops resending.
+			// Clients only resend meshes, so poses always go through.
+			if window != nil && packet.Type == "mesh" && window.seen(packet.FrameNumber) {
+				log.Printf("Dropping duplicate frame %d from %s", packet.FrameNumber, conn.ID)
+				out.ack(packet.FrameNumber)
+				continue
+			}
+			
+			// Enforce rate limits before the packet takes a buffer slot
+			if scope, limit := allowPacket(connLimiter, keyLimiter, packet.Type, size, time.Now()); limit != "" {
+				if g.opts.Metrics != nil {
+					g.opts.Metrics.RecordRateLimited(scope, packet.Type, limit)
+				}
+				reason := fmt.Sprintf("%s %s %s per second limit exceeded", scope, packet.Type, limit)
+				if g.opts.RateLimits.Policy == RateLimitClose {
+					log.Printf("Closing %s: %s", conn.ID, reason)
+					c.Close(websocket.StatusPolicyViolation, reason)
+					suspend = false
+					return
+				}
+				if out != nil {
+					out.nack(packet.FrameNumber, protocol.NackRateLimited, errors.New(reason))
+				}
+				continue
 			}
-			conn.LastSeen = time.Now()
 
 			// Forward message
-			select {
-			case g.messageC <- MessageEvent{
-				ConnectionID: conn.ID,
-				Packet:       packet,
-				Timestamp:    time.Now(),
-			}:
-			default:
-				log.Printf("Message buffer full, dropping packet from %s", conn.ID)
+			queued := g.scheduler.enqueue(conn.ID, MessageEvent{
+				ConnectionID:    conn.ID,
+				ProtocolVersion: conn.ProtocolVersion,
+				Packet:          packet,
+				Size:            size,
+				Timestamp:       time.Now(),
+			})
+			if !queued {
+				log.Printf("Message queue full, dropping packet from %s", conn.ID)
+				if out != nil {
+					out.nack(packet.FrameNumber, protocol.NackBufferFull, nil)
+				}
+				continue
+			}
+			if window != nil {
+				missing := window.record(packet.FrameNumber, time.Now(), g.opts.ResendInterval, g.opts.ResendAttempts, retry)
+				out.resend(packet.FrameNumber, missing)
+				retry = false
+			}
+		}
+	}
+}
+
+// frameError is a message the negotiated protocol doesn't allow; the
+// connection is closed with status and reason
+type frameError struct {
+	status websocket.StatusCode
+	reason string
+}
+
+func (e *frameError) Error() string {
+	return e.reason
+}
+
+// readPacket reads the next packet in the connection's protocol, and its
+// size on the wire: binary frames with protocol.BinarySubprotocol, JSON
+// text messages in the connection's schema version otherwise
+func readPacket(ctx context.Context, c *websocket.Conn, conn *types.Connection) (types.StreamPacket, int, error) {
+	msgType, data, err := c.Read(ctx)
+	if err != nil {
+		return types.StreamPacket{}, 0, err
+	}
+	
+	if conn.Subprotocol == protocol.BinarySubprotocol {
+		if msgType != websocket.MessageBinary {
+			return types.StreamPacket{}, 0, &frameError{
+				status: websocket.StatusUnsupportedData,
+				reason: "expected binary frames for " + protocol.BinarySubprotocol,
 			}
 		}
+		packet, err := protocol.DecodeBinary(data)
+		if err != nil {
+			return types.StreamPacket{}, 0, &frameError{
+				status: websocket.StatusInvalidFramePayloadData,
+				reason: "invalid binary frame: " + err.Error(),
+			}
+		}
+		return packet, len(data), nil
 	}
+	
+	if msgType != websocket.MessageText {
+		return types.StreamPacket{}, 0, &frameError{
+			status: websocket.StatusUnsupportedData,
+			reason: "expected JSON text messages",
+		}
+	}
+	packet, err := parser.Decode(conn.ProtocolVersion, data)
+	if err != nil {
+		return types.StreamPacket{}, 0, &frameError{
+			status: websocket.StatusInvalidFramePayloadData,
+			reason: "invalid JSON packet: " + err.Error(),
+		}
+	}
+	return packet, len(data), nil
+}
+
+// unsupportedProtocolReason builds a close reason naming the supported
+// subprotocols. Close reasons are limited to 123 bytes, so a long offer
+// is cut short.
+func unsupportedProtocolReason(offered string) string {
+	const maxReason = 123
+	reason := "unsupported protocol; supported: " + protocol.Supported()
+	if offered == "" {
+		return reason
+	}
+	
+	room := maxReason - len(reason) - len(" ()")
+	if room <= 0 {
+		return reason
+	}
+	if len(offered) > room {
+		offered = offered[:room]
+	}
+	return "unsupported protocol (" + offered + "); supported: " + protocol.Supported()
+}
+
+// Ack reports that the pipeline accepted a frame from a connection. The
+// ack goes to whichever connection carries the stream now; it is a no-op
+// once the stream is gone.
+func (g *Gate) Ack(connectionID string, frame int) {
+	if acks, _ := g.control(connectionID); acks != nil {
+		acks.resolve(frame)
+	}
+}
+
+// Nack reports that the pipeline dropped a frame from a connection, with
+// one of the protocol.Nack* reasons
+func (g *Gate) Nack(connectionID string, frame int, reason string, err error) {
+	acks, out := g.control(connectionID)
+	switch {
+	case out != nil:
+		out.nack(frame, reason, err)
+	case acks != nil:
+		acks.resolve(frame)
+	}
+}
+
+// signalPressure asks a connection's client to slow down as its queue
+// fills, and to resume once it drains. Clients that didn't ask for control
+// messages only see their packets dropped.
+func (g *Gate) signalPressure(connectionID string, slowDown bool) {
+	_, out := g.control(connectionID)
+	if out == nil {
+		return
+	}
+	out.flow(slowDown)
+	if g.opts.Metrics != nil {
+		signal := protocol.ControlResume
+		if slowDown {
+			signal = protocol.ControlSlowDown
+		}
+		g.opts.Metrics.RecordFlowControl(signal)
+	}
+}
+
+// control returns the ack state and control message writer of the stream
+// a connection carried, if any
+func (g *Gate) control(connectionID string) (*ackTracker, *outbound) {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	st, ok := g.streams[connectionID]
+	if !ok {
+		return nil, nil
+	}
+	return st.acks, st.out
+}
+
+func (g *Gate) setOutbound(connectionID string, out *outbound) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if st, ok := g.streams[connectionID]; ok && st.connID == connectionID {
+		st.out = out
+	}
+}
+
+// QueueStats returns the queue of every open connection by connection ID
+func (g *Gate) QueueStats() map[string]QueueStats {
+	return g.scheduler.stats()
+}
+
+// queueWeight returns the scheduler weight of an API key's connections
+func (g *Gate) queueWeight(apiKey string) int {
+	if weight := g.opts.QueueWeights[apiKey]; weight > 0 {
+		return weight
+	}
+	return 1
 }
 
 // GetActiveConnections returns the count of active connections
@@ -135,6 +508,18 @@ func (g *Gate) GetActiveConnections() int {
 	return len(g.connections)
 }
 
+// GetConnectionRTT returns the round trip time of a connection's last
+// answered ping
+func (g *Gate) GetConnectionRTT(connectionID string) (time.Duration, bool) {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	conn, exists := g.connections[connectionID]
+	if !exists {
+		return 0, false
+	}
+	return conn.RTT, true
+}
+
 // GetConnectionsBySession returns connections for a specific session
 func (g *Gate) GetConnectionsBySession(sessionID string) []*types.Connection {
 	g.mutex.RLock()
@@ -149,23 +534,97 @@ func (g *Gate) GetConnectionsBySession(sessionID string) []*types.Connection {
 	return connections
 }
 
-// addConnection registers a new connection
-func (g *Gate) addConnection(conn *types.Connection) {
+// setSessionID binds a connection to the session it streams for
+func (g *Gate) setSessionID(conn *types.Connection, sessionID string) {
 	g.mutex.Lock()
-	defer g.mutex.Unlock()
-	g.connections[conn.ID] = conn
+	started := !g.sessionLive(sessionID)
+	conn.SessionID = sessionID
+	if st, ok := g.streams[conn.ID]; ok && st.connID == conn.ID {
+		st.sessionID = sessionID
+	}
+	handler := g.onSessionStart
+	g.mutex.Unlock()
+	
+	if started && handler != nil {
+		log.Printf("Session started: %s", sessionID)
+		handler(sessionID, conn.APIKey)
+	}
 }
 
-// removeConnection unregisters a connection
-func (g *Gate) removeConnection(id string) {
+// removeConnection unregisters a connection, suspending its stream for
+// the resume window if suspend is set
+func (g *Gate) removeConnection(id string, suspend bool) {
 	g.mutex.Lock()
-	defer g.mutex.Unlock()
+	conn, exists := g.connections[id]
 	delete(g.connections, id)
+	g.release(id, suspend, time.Now())
+	var ended []string
+	if exists {
+		ended = g.endedSessions(conn)
+	}
+	g.mutex.Unlock()
+	
+	if exists && g.opts.Metrics != nil {
+		g.opts.Metrics.RecordDisconnection()
+	}
+	
+	g.notifySessionEnd(ended)
+}
+
+// endedSessions returns the sessions of removed connections that no longer
+// have any connection or suspended stream; callers hold the lock
+func (g *Gate) endedSessions(removed ...*types.Connection) []string {
+	var ended []string
+	seen := make(map[string]bool)
+	for _, conn := range removed {
+		if conn.SessionID == "" || seen[conn.SessionID] || g.sessionLive(conn.SessionID) {
+			continue
+		}
+		seen[conn.SessionID] = true
+		ended = append(ended, conn.SessionID)
+	}
+	return ended
+}
+
+// sessionActive reports whether any connection streams for a session;
+// callers hold the lock
+func (g *Gate) sessionActive(sessionID string) bool {
+	for _, conn := range g.connections {
+		if conn.SessionID == sessionID {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionLive reports whether a session has a connection or may still be
+// resumed; callers hold the lock
+func (g *Gate) sessionLive(sessionID string) bool {
+	return g.sessionActive(sessionID) || g.sessionSuspended(sessionID)
+}
+
+// notifySessionEnd runs the session end handler, outside the lock
+func (g *Gate) notifySessionEnd(sessionIDs []string) {
+	if len(sessionIDs) == 0 {
+		return
+	}
+	
+	g.mutex.RLock()
+	handler := g.onSessionEnd
+	g.mutex.RUnlock()
+	
+	if handler == nil {
+		return
+	}
+	for _, sessionID := range sessionIDs {
+		log.Printf("Session ended: %s", sessionID)
+		handler(sessionID)
+	}
 }
 
 // heartbeatLoop periodically cleans up stale connections
 func (g *Gate) heartbeatLoop() {
-	ticker := time.NewTicker(g.heartbeatInterval)
+	ticker := time.NewTicker(g.opts.HeartbeatInterval)
 	defer ticker.Stop()
 
 	for {
@@ -178,18 +637,50 @@ func (g *Gate) heartbeatLoop() {
 	}
 }
 
-// cleanupStaleConnections removes connections that haven't been seen recently
+// cleanupStaleConnections removes and closes connections that haven't been
+// seen recently. The ping loop normally closes them first; this catches
+// sockets whose pings can't even be written.
 func (g *Gate) cleanupStaleConnections() {
-	staleThreshold := time.Now().Add(-g.heartbeatInterval * 3)
+	now := time.Now()
+	staleThreshold := now.Add(-g.opts.HeartbeatInterval * 3)
 	
 	g.mutex.Lock()
+	var removed []*types.Connection
+	var sockets []*websocket.Conn
 	for id, conn := range g.connections {
 		if conn.LastSeen.Before(staleThreshold) {
 			log.Printf("Removing stale connection: %s", id)
 			delete(g.connections, id)
+			if st, ok := g.streams[id]; ok && st.connID == id && st.ws != nil {
+				sockets = append(sockets, st.ws)
+			}
+			g.release(id, true, now)
+			removed = append(removed, conn)
 		}
 	}
+	
+	stale := len(removed)
+	
+	// Sessions whose resume window passed end unless a new connection
+	// picked them up without resuming
+	for _, sessionID := range g.expireStreams(now) {
+		removed = append(removed, &types.Connection{SessionID: sessionID})
+	}
+	ended := g.endedSessions(removed...)
+	g.evictKeyLimiters(now)
 	g.mutex.Unlock()
+	
+	for _, socket := range sockets {
+		socket.CloseNow()
+	}
+	if g.opts.Metrics != nil {
+		for i := 0; i < stale; i++ {
+			g.opts.Metrics.RecordDisconnection()
+			g.opts.Metrics.RecordStaleConnection("heartbeat")
+		}
+	}
+	
+	g.notifySessionEnd(ended)
 }
 
 // generateConnectionID creates a unique connection identifier
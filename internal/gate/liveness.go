@@ -0,0 +1,88 @@
+package gate
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/tabular/relay/pkg/types"
+	"nhooyr.io/websocket"
+)
+
+// pingLoop pings a connection every heartbeat interval until ctx is done.
+// A pong counts as activity, so idle clients aren't mistaken for stale
+// ones; after MaxMissedPongs pings in a row go unanswered while the client
+// sends nothing either, the socket is closed. Pongs are only read while
+// the connection's read loop runs.
+func (g *Gate) pingLoop(ctx context.Context, c *websocket.Conn, conn *types.Connection) {
+	ticker := time.NewTicker(g.opts.HeartbeatInterval)
+	defer ticker.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		pingCtx, cancel := context.WithTimeout(ctx, g.opts.HeartbeatInterval)
+		start := time.Now()
+		err := c.Ping(pingCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err == nil {
+			missed = 0
+			g.recordPong(conn, time.Since(start))
+			continue
+		}
+
+		if g.opts.Metrics != nil {
+			g.opts.Metrics.RecordMissedPong()
+		}
+		if g.seenSince(conn, start) {
+			missed = 0 // Packets still arrive; the client just doesn't answer pings
+			continue
+		}
+		missed++
+		if missed < g.opts.MaxMissedPongs {
+			continue
+		}
+
+		log.Printf("Closing %s after %d missed pongs: %v", conn.ID, missed, err)
+		if g.opts.Metrics != nil {
+			g.opts.Metrics.RecordStaleConnection("missed_pongs")
+		}
+		c.CloseNow()
+		return
+	}
+}
+
+// recordPong marks a connection as seen and records its round trip time
+func (g *Gate) recordPong(conn *types.Connection, rtt time.Duration) {
+	g.mutex.Lock()
+	conn.LastSeen = time.Now()
+	conn.RTT = rtt
+	g.mutex.Unlock()
+
+	if g.opts.Metrics != nil {
+		g.opts.Metrics.RecordPingRTT(rtt.Seconds())
+	}
+}
+
+// touch marks a connection as seen
+func (g *Gate) touch(conn *types.Connection) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	conn.LastSeen = time.Now()
+}
+
+// seenSince reports whether a connection was seen after t
+func (g *Gate) seenSince(conn *types.Connection, t time.Time) bool {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	return conn.LastSeen.After(t)
+}
@@ -0,0 +1,200 @@
+package gate
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/tabular/relay/pkg/protocol"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// maxPendingFrames bounds the frames tracked above the ack. A client that
+// leaves a gap this long is assumed to have skipped the missing frames.
+const maxPendingFrames = 4096
+
+// outbound writes control messages to one client. Nacks are sent as soon
+// as possible, acks at most once per ack interval and only when the ack
+// moved.
+type outbound struct {
+	conn         *websocket.Conn
+	connID       string
+	queue        chan protocol.ControlMessage
+	ackInterval  time.Duration
+	writeTimeout time.Duration
+	acks         *ackTracker
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+func newOutbound(conn *websocket.Conn, connID string, opts Options, acks *ackTracker) *outbound {
+	return &outbound{
+		conn:         conn,
+		connID:       connID,
+		queue:        make(chan protocol.ControlMessage, opts.OutboundQueue),
+		ackInterval:  opts.AckInterval,
+		writeTimeout: opts.WriteTimeout,
+		acks:         acks,
+		done:         make(chan struct{}),
+	}
+}
+
+// session tells the client its resume token
+func (o *outbound) session(token string) {
+	o.queue <- protocol.ControlMessage{Type: protocol.ControlSession, ResumeToken: token}
+}
+
+// ack marks a frame as accepted
+func (o *outbound) ack(frame int) {
+	o.acks.resolve(frame)
+}
+
+// nack marks a frame as rejected and tells the client why. If the queue is
+// full the notice is lost, but the frame still counts as handled.
+func (o *outbound) nack(frame int, reason string, err error) {
+	o.acks.resolve(frame)
+
+	msg := protocol.ControlMessage{Type: protocol.ControlNack, FrameNumber: frame, Reason: reason}
+	if err != nil {
+		msg.Error = err.Error()
+	}
+	select {
+	case o.queue <- msg:
+	default:
+		log.Printf("Outbound queue full, dropping nack for frame %d to %s", frame, o.connID)
+	}
+}
+
+// flow asks the client to slow down, or tells it it may send at its usual
+// rate again. The notice is lost if the queue is full.
+func (o *outbound) flow(slowDown bool) {
+	msg := protocol.ControlMessage{Type: protocol.ControlResume}
+	if slowDown {
+		msg.Type = protocol.ControlSlowDown
+	}
+	select {
+	case o.queue <- msg:
+	default:
+		log.Printf("Outbound queue full, dropping %s to %s", msg.Type, o.connID)
+	}
+}
+
+// resend asks the client to send missing frames again. frame is the frame
+// whose arrival showed they were missing.
+func (o *outbound) resend(frame int, missing []int) {
+	for len(missing) > 0 {
+		n := min(len(missing), maxResendFrames)
+		msg := protocol.ControlMessage{Type: protocol.ControlResend, FrameNumber: frame, Frames: missing[:n]}
+		missing = missing[n:]
+		select {
+		case o.queue <- msg:
+		default:
+			log.Printf("Outbound queue full, dropping resend request to %s", o.connID)
+			return
+		}
+	}
+}
+
+// run writes queued messages and periodic acks until close is called
+func (o *outbound) run() {
+	ticker := time.NewTicker(o.ackInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg := <-o.queue:
+			if !o.write(msg) {
+				return
+			}
+		case <-ticker.C:
+			if frame, changed := o.acks.take(); changed {
+				if !o.write(protocol.ControlMessage{Type: protocol.ControlAck, FrameNumber: frame}) {
+					return
+				}
+			}
+		case <-o.done:
+			return
+		}
+	}
+}
+
+func (o *outbound) write(msg protocol.ControlMessage) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), o.writeTimeout)
+	defer cancel()
+	if err := wsjson.Write(ctx, o.conn, msg); err != nil {
+		log.Printf("Failed to write %s to %s: %v", msg.Type, o.connID, err)
+		return false
+	}
+	return true
+}
+
+func (o *outbound) close() {
+	o.closeOnce.Do(func() { close(o.done) })
+}
+
+// ackTracker keeps the highest frame up to which every frame was accepted
+// or rejected, counting from the first frame seen. It belongs to a stream,
+// so a resumed connection continues from the last ack.
+type ackTracker struct {
+	mutex   sync.Mutex
+	started bool
+	acked   int
+	pending map[int]bool // Handled frames above acked
+	sent    int          // Last ack written to the client
+	sentAny bool
+}
+
+func newAckTracker() *ackTracker {
+	return &ackTracker{pending: make(map[int]bool)}
+}
+
+func (t *ackTracker) resolve(frame int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if !t.started {
+		t.started = true
+		t.acked = frame - 1
+	}
+	if frame <= t.acked {
+		return // A resend of a frame already handled
+	}
+
+	t.pending[frame] = true
+	if len(t.pending) > maxPendingFrames {
+		// Skip the gap up to the lowest handled frame
+		lowest := frame
+		for pending := range t.pending {
+			if pending < lowest {
+				lowest = pending
+			}
+		}
+		t.acked = lowest - 1
+	}
+	for t.pending[t.acked+1] {
+		delete(t.pending, t.acked+1)
+		t.acked++
+	}
+}
+
+// resend makes the next take return the current ack even if it was sent
+// before, for a new connection
+func (t *ackTracker) resend() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.sentAny = false
+}
+
+// take returns the current ack and whether it changed since the last take
+func (t *ackTracker) take() (int, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if !t.started || (t.sentAny && t.sent == t.acked) {
+		return t.acked, false
+	}
+	t.sent, t.sentAny = t.acked, true
+	return t.acked, true
+}
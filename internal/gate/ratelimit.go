@@ -0,0 +1,220 @@
+package gate
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tabular/relay/pkg/types"
+)
+
+// Rate limit policies
+const (
+	RateLimitNack  = "nack"  // Drop over-limit packets and nack them
+	RateLimitClose = "close" // Close connections that go over a limit
+)
+
+// ValidateRateLimits checks a rate limit configuration
+func ValidateRateLimits(cfg types.RateLimitConfig) error {
+	switch cfg.Policy {
+	case "", RateLimitNack, RateLimitClose:
+	default:
+		return fmt.Errorf("unknown rate limit policy %q", cfg.Policy)
+	}
+	scopes := []types.RateLimitScopes{cfg.RateLimitScopes}
+	for _, override := range cfg.Overrides {
+		if override.APIKey == "" {
+			return fmt.Errorf("rate limit override without api_key")
+		}
+		scopes = append(scopes, override.RateLimitScopes)
+	}
+	for _, scope := range scopes {
+		for _, limits := range []types.RateLimits{scope.PerConnection, scope.PerKey} {
+			for _, rb := range []types.RateBudget{limits.Pose, limits.Mesh} {
+				if rb.PacketsPerSec < 0 || rb.BytesPerSec < 0 {
+					return fmt.Errorf("negative rate limit")
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// tokenBucket refills at rate tokens per second up to one second's worth.
+// A packet costing more than that passes once the bucket is full and takes
+// it into debt, so large meshes still get through at the average rate.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: rate, last: now}
+}
+
+func (b *tokenBucket) ready(cost float64, now time.Time) bool {
+	b.tokens = min(b.rate, b.tokens+b.rate*now.Sub(b.last).Seconds())
+	b.last = now
+	return b.tokens >= min(cost, b.rate)
+}
+
+// budget holds the buckets of one packet class; nil buckets are unlimited
+type budget struct {
+	packets *tokenBucket
+	bytes   *tokenBucket
+}
+
+// limiter enforces RateLimits for one connection or API key
+type limiter struct {
+	mutex   sync.Mutex
+	budgets map[string]*budget // Packet type -> budget
+	conns   int                // Connections sharing an API key's limiter; guarded by the gate's mutex
+}
+
+// newLimiter returns nil if limits sets no budget
+func newLimiter(limits types.RateLimits, now time.Time) *limiter {
+	l := &limiter{budgets: make(map[string]*budget)}
+	for packetType, rb := range map[string]types.RateBudget{"pose": limits.Pose, "mesh": limits.Mesh} {
+		b := &budget{}
+		if rb.PacketsPerSec > 0 {
+			b.packets = newTokenBucket(rb.PacketsPerSec, now)
+		}
+		if rb.BytesPerSec > 0 {
+			b.bytes = newTokenBucket(rb.BytesPerSec, now)
+		}
+		if b.packets != nil || b.bytes != nil {
+			l.budgets[packetType] = b
+		}
+	}
+	if len(l.budgets) == 0 {
+		return nil
+	}
+	return l
+}
+
+// check reports which limit, "packets" or "bytes", a packet would exceed
+func (l *limiter) check(packetType string, size int, now time.Time) string {
+	b, ok := l.budgets[packetType]
+	if !ok {
+		return ""
+	}
+	if b.packets != nil && !b.packets.ready(1, now) {
+		return "packets"
+	}
+	if b.bytes != nil && !b.bytes.ready(float64(size), now) {
+		return "bytes"
+	}
+	return ""
+}
+
+// full reports whether every bucket has refilled, leaving the limiter no
+// different from a new one
+func (l *limiter) full(now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, b := range l.budgets {
+		for _, bucket := range []*tokenBucket{b.packets, b.bytes} {
+			if bucket != nil && bucket.tokens+bucket.rate*now.Sub(bucket.last).Seconds() < bucket.rate {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// take charges a packet to the budget of its type
+func (l *limiter) take(packetType string, size int) {
+	b, ok := l.budgets[packetType]
+	if !ok {
+		return
+	}
+	if b.packets != nil {
+		b.packets.tokens--
+	}
+	if b.bytes != nil {
+		b.bytes.tokens -= float64(size)
+	}
+}
+
+// allowPacket checks a packet against a connection's and its API key's
+// limiters, either of which may be nil, and charges both if it passes. It
+// returns the scope and limit exceeded otherwise.
+func allowPacket(conn, key *limiter, packetType string, size int, now time.Time) (scope, limit string) {
+	if conn != nil {
+		conn.mutex.Lock()
+		defer conn.mutex.Unlock()
+		if limit := conn.check(packetType, size, now); limit != "" {
+			return "connection", limit
+		}
+	}
+	if key != nil {
+		key.mutex.Lock()
+		defer key.mutex.Unlock()
+		if limit := key.check(packetType, size, now); limit != "" {
+			return "api_key", limit
+		}
+		key.take(packetType, size)
+	}
+	if conn != nil {
+		conn.take(packetType, size)
+	}
+	return "", ""
+}
+
+// rateLimits returns the limits that apply to an API key
+func (g *Gate) rateLimits(apiKey string) types.RateLimitScopes {
+	for _, override := range g.opts.RateLimits.Overrides {
+		if override.APIKey == apiKey {
+			return override.RateLimitScopes
+		}
+	}
+	return g.opts.RateLimits.RateLimitScopes
+}
+
+// keyLimiter returns the limiter shared by an API key's connections,
+// creating it on first use; nil if the key is unlimited. Connections
+// release it with releaseKeyLimiter when they go away.
+func (g *Gate) keyLimiter(apiKey string) *limiter {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	l, exists := g.keyLimiters[apiKey]
+	if !exists {
+		l = newLimiter(g.rateLimits(apiKey).PerKey, time.Now())
+		if l == nil {
+			return nil
+		}
+		g.keyLimiters[apiKey] = l
+	}
+	l.conns++
+	return l
+}
+
+// releaseKeyLimiter lets go of a connection's share of its API key's limiter
+func (g *Gate) releaseKeyLimiter(apiKey string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	l, exists := g.keyLimiters[apiKey]
+	if !exists {
+		return
+	}
+	l.conns--
+	if l.conns == 0 && l.full(time.Now()) {
+		delete(g.keyLimiters, apiKey)
+	}
+}
+
+// evictKeyLimiters forgets the limiters of API keys that have no
+// connections left. A limiter still in debt is kept until its buckets
+// refill, so a key can't reset its budget by reconnecting; callers hold
+// the lock.
+func (g *Gate) evictKeyLimiters(now time.Time) {
+	for apiKey, l := range g.keyLimiters {
+		if l.conns == 0 && l.full(now) {
+			delete(g.keyLimiters, apiKey)
+		}
+	}
+}
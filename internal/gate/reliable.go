@@ -0,0 +1,109 @@
+package gate
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxResendFrames bounds the frames named in one resend request
+const maxResendFrames = 256
+
+// frameWindow tracks the frames received on a stream in reliable mode. It
+// belongs to the stream, so a client that resumes isn't asked for, and
+// can't deliver twice, frames the relay already has, while a client that
+// starts a new stream can number its frames from scratch.
+type frameWindow struct {
+	mutex    sync.Mutex
+	started  bool
+	next     int                   // Every frame below next arrived or was given up on
+	high     int                   // One past the highest frame received
+	received map[int]bool          // Frames at or above next that arrived
+	missing  map[int]*missingFrame // Gaps below the highest frame received
+}
+
+// missingFrame counts the resend requests sent for a frame
+type missingFrame struct {
+	requests int
+	last     time.Time
+}
+
+func newFrameWindow() *frameWindow {
+	return &frameWindow{
+		received: make(map[int]bool),
+		missing:  make(map[int]*missingFrame),
+	}
+}
+
+// seen reports whether a frame already arrived or was given up on
+func (w *frameWindow) seen(frame int) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.started && (frame < w.next || w.received[frame])
+}
+
+// record marks a frame as received and returns the missing frames to ask
+// the client for. A missing frame is requested up to attempts times, at
+// least interval apart, and then given up on. With retry set, frames
+// already requested are asked for again at once, for a new connection.
+func (w *frameWindow) record(frame int, now time.Time, interval time.Duration, attempts int, retry bool) []int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if !w.started {
+		w.started = true
+		w.next, w.high = frame, frame
+	}
+	if frame >= w.next && !w.received[frame] {
+		w.received[frame] = true
+		delete(w.missing, frame)
+
+		// Frames between the previous highest and this one are new gaps. A
+		// gap longer than the window is skipped rather than tracked.
+		if frame-w.next > maxPendingFrames {
+			w.skipTo(frame - maxPendingFrames)
+		}
+		for f := max(w.high, w.next); f < frame; f++ {
+			w.missing[f] = &missingFrame{}
+		}
+		if frame >= w.high {
+			w.high = frame + 1
+		}
+	}
+
+	var resend []int
+	for f, m := range w.missing {
+		switch {
+		case m.requests == 0 || (retry && m.requests < attempts):
+		case now.Sub(m.last) < interval:
+			continue
+		case m.requests >= attempts:
+			delete(w.missing, f)
+			continue
+		}
+		m.requests++
+		m.last = now
+		resend = append(resend, f)
+	}
+	w.advance()
+
+	sort.Ints(resend)
+	return resend
+}
+
+// skipTo gives up on every frame below next
+func (w *frameWindow) skipTo(next int) {
+	for f := w.next; f < next; f++ {
+		delete(w.received, f)
+		delete(w.missing, f)
+	}
+	w.next = next
+}
+
+// advance moves next past frames that arrived or were given up on
+func (w *frameWindow) advance() {
+	for w.next < w.high && (w.received[w.next] || w.missing[w.next] == nil) {
+		delete(w.received, w.next)
+		w.next++
+	}
+}
@@ -0,0 +1,148 @@
+package gate
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"github.com/tabular/relay/pkg/types"
+	"nhooyr.io/websocket"
+)
+
+// ResumeTokenHeader carries the resume token: the relay sets it on the
+// upgrade response, and a reconnecting client sends it back. Clients that
+// can't set headers use the resume_token query parameter instead.
+const ResumeTokenHeader = "X-Resume-Token"
+
+const resumeTokenParam = "resume_token"
+
+// stream is a client's stream for a session as it moves between
+// connections. A connection that drops without closing suspends its stream
+// for the resume window; a connection presenting the stream's token takes
+// it over, along with the session and its ack state.
+type stream struct {
+	token     string
+	apiKey    string
+	sessionID string
+	connID    string          // Connection currently carrying the stream
+	ws        *websocket.Conn // nil while suspended
+	out       *outbound       // nil unless the client asked for acks
+	acks      *ackTracker
+	frames    *frameWindow // Frames received in reliable mode
+	suspended time.Time    // When the connection dropped; zero while connected
+}
+
+// newResumeToken returns a random token clients can't guess
+func newResumeToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("gate: reading random resume token: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+// resumeToken returns the token a connection will carry: the one the
+// client presented if it can resume with it, a new one otherwise
+func (g *Gate) resumeToken(presented, apiKey string) string {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+
+	if st, ok := g.tokens[presented]; ok && st.apiKey == apiKey {
+		return presented
+	}
+	if presented != "" {
+		log.Printf("Unknown or expired resume token, starting a new stream")
+	}
+	return newResumeToken()
+}
+
+// attach registers a connection and gives it the stream for token, taking
+// the stream over if it exists. It returns the stream, whether it was
+// resumed, and the superseded socket to close, if any.
+func (g *Gate) attach(conn *types.Connection, ws *websocket.Conn, token string) (*stream, bool, *websocket.Conn) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.connections[conn.ID] = conn
+
+	st, ok := g.tokens[token]
+	if !ok || st.apiKey != conn.APIKey {
+		st = &stream{
+			token:  token,
+			apiKey: conn.APIKey,
+			connID: conn.ID,
+			ws:     ws,
+			acks:   newAckTracker(),
+			frames: newFrameWindow(),
+		}
+		g.tokens[token] = st
+		g.streams[conn.ID] = st
+		return st, false, nil
+	}
+
+	superseded := st.ws
+	conn.SessionID = st.sessionID
+	st.connID = conn.ID
+	st.ws = ws
+	st.out = nil
+	st.suspended = time.Time{}
+	st.acks.resend()
+	g.streams[conn.ID] = st
+	return st, true, superseded
+}
+
+// release detaches a stream from its connection as it goes away: the
+// stream is suspended if the client may come back, and forgotten if the
+// client closed it or never identified a session; callers hold the lock
+func (g *Gate) release(connID string, suspend bool, now time.Time) {
+	st, ok := g.streams[connID]
+	if !ok || st.connID != connID {
+		return // Superseded; the stream lives on with its new connection
+	}
+	if suspend && st.sessionID != "" {
+		st.ws = nil
+		st.out = nil
+		st.suspended = now
+		return
+	}
+	g.forgetStream(st)
+}
+
+// forgetStream removes a stream's token and every connection that carried
+// it; callers hold the lock
+func (g *Gate) forgetStream(st *stream) {
+	delete(g.tokens, st.token)
+	for connID, other := range g.streams {
+		if other == st {
+			delete(g.streams, connID)
+		}
+	}
+}
+
+// expireStreams forgets streams suspended for longer than the resume
+// window and returns their sessions; callers hold the lock
+func (g *Gate) expireStreams(now time.Time) []string {
+	cutoff := now.Add(-g.opts.ResumeWindow)
+	var sessions []string
+	for _, st := range g.tokens {
+		if st.suspended.IsZero() || st.suspended.After(cutoff) {
+			continue
+		}
+		log.Printf("Resume window for session %s expired", st.sessionID)
+		g.forgetStream(st)
+		sessions = append(sessions, st.sessionID)
+	}
+	return sessions
+}
+
+// sessionSuspended reports whether a session has a stream waiting to be
+// resumed; callers hold the lock
+func (g *Gate) sessionSuspended(sessionID string) bool {
+	for _, st := range g.tokens {
+		if st.sessionID == sessionID && !st.suspended.IsZero() {
+			return true
+		}
+	}
+	return false
+}
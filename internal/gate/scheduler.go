@@ -0,0 +1,261 @@
+package gate
+
+import (
+	"sync"
+
+	"github.com/tabular/relay/internal/metrics"
+)
+
+// QueueStats describes one connection's queue
+type QueueStats struct {
+	Weight    int    `json:"weight"`
+	Depth     int    `json:"depth"`
+	Scheduled uint64 `json:"scheduled"` // Messages handed to the pipeline
+	Dropped   uint64 `json:"dropped"`   // Messages dropped because the queue was full
+}
+
+// connQueue holds the messages of one connection waiting for the pipeline
+type connQueue struct {
+	id        string
+	weight    int
+	credit    int // Messages left in the queue's current turn
+	msgs      chan MessageEvent
+	held      *MessageEvent // Taken from msgs but refused by admit
+	closed    bool          // Connection gone; removed once drained
+	throttled bool          // Told to slow down and not yet to resume
+	scheduled uint64
+	dropped   uint64
+}
+
+// scheduler moves messages from per-connection queues into the pipeline's
+// channel in weighted round-robin order: each queue with messages gets up
+// to its weight in a row before the next one's turn. A connection sending
+// faster than its share fills its own queue rather than everyone's.
+//
+// When the pipeline can't keep up, the queues fill. onPressure is called
+// when a queue passes three quarters full, and again once it has drained
+// to a quarter, so the gate can ask the client to slow down and resume.
+// A message admit refuses stays at the head of its queue, holding up that
+// connection alone, until wake is called.
+type scheduler struct {
+	mutex      sync.Mutex
+	queues     []*connQueue
+	byID       map[string]*connQueue
+	next       int
+	ready      chan struct{}
+	out        chan MessageEvent
+	metrics    *metrics.Metrics
+	onPressure func(id string, slowDown bool)
+	admit      func(MessageEvent) bool
+}
+
+func newScheduler(out chan MessageEvent, m *metrics.Metrics) *scheduler {
+	return &scheduler{
+		byID:    make(map[string]*connQueue),
+		ready:   make(chan struct{}, 1),
+		out:     out,
+		metrics: m,
+	}
+}
+
+// add creates the queue of a connection
+func (s *scheduler) add(id string, depth, weight int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	q := &connQueue{id: id, weight: weight, credit: weight, msgs: make(chan MessageEvent, depth)}
+	s.queues = append(s.queues, q)
+	s.byID[id] = q
+}
+
+// setAdmit sets the check messages must pass to leave their queue
+func (s *scheduler) setAdmit(admit func(MessageEvent) bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.admit = admit
+}
+
+// remove closes the queue of a connection. Messages already queued are
+// still delivered.
+func (s *scheduler) remove(id string) {
+	s.mutex.Lock()
+	if q, ok := s.byID[id]; ok {
+		q.closed = true
+	}
+	s.mutex.Unlock()
+	s.wake()
+}
+
+// enqueue queues a message without blocking, reporting false if the
+// connection's queue is full
+func (s *scheduler) enqueue(id string, msg MessageEvent) bool {
+	s.mutex.Lock()
+	q, ok := s.byID[id]
+	if !ok || q.closed {
+		s.mutex.Unlock()
+		return false
+	}
+	select {
+	case q.msgs <- msg:
+	default:
+		q.dropped++
+		s.mutex.Unlock()
+		if s.metrics != nil {
+			s.metrics.RecordConnectionDrop(id)
+		}
+		return false
+	}
+	depth := q.depth()
+	slowDown := !q.throttled && depth >= highWater(cap(q.msgs))
+	if slowDown {
+		q.throttled = true
+	}
+	s.mutex.Unlock()
+
+	if s.metrics != nil {
+		s.metrics.UpdateConnectionQueue(id, depth)
+	}
+	if slowDown && s.onPressure != nil {
+		s.onPressure(id, true)
+	}
+	s.wake()
+	return true
+}
+
+// depth returns the messages waiting in a queue; callers hold the lock
+func (q *connQueue) depth() int {
+	if q.held != nil {
+		return len(q.msgs) + 1
+	}
+	return len(q.msgs)
+}
+
+// highWater and lowWater are the depths at which a queue's client is told
+// to slow down and to resume
+func highWater(depth int) int {
+	return max(1, depth*3/4)
+}
+
+func lowWater(depth int) int {
+	return depth / 4
+}
+
+func (s *scheduler) wake() {
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// run feeds the pipeline until stop is closed
+func (s *scheduler) run(stop <-chan struct{}) {
+	for {
+		msg, ok := s.pick()
+		if !ok {
+			select {
+			case <-s.ready:
+				continue
+			case <-stop:
+				return
+			}
+		}
+		select {
+		case s.out <- msg:
+		case <-stop:
+			// The message may have been admitted; hand it over if there's
+			// room so the pipeline processes it when it stops
+			select {
+			case s.out <- msg:
+			default:
+			}
+			return
+		}
+	}
+}
+
+// pick takes the next message in round-robin order
+func (s *scheduler) pick() (MessageEvent, bool) {
+	msg, ok, resumed := s.take()
+	if resumed != "" && s.onPressure != nil {
+		s.onPressure(resumed, false)
+	}
+	return msg, ok
+}
+
+// take removes the next message, dropping closed queues once they are
+// empty. It also returns the connection whose queue just drained below
+// the low water mark, if any.
+func (s *scheduler) take() (MessageEvent, bool, string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for tried := 0; tried < len(s.queues); tried++ {
+		if s.next >= len(s.queues) {
+			s.next = 0
+		}
+		q := s.queues[s.next]
+		if q.held == nil && len(q.msgs) > 0 {
+			msg := <-q.msgs
+			q.held = &msg
+		}
+		if q.held == nil {
+			q.credit = q.weight
+			if q.closed {
+				s.drop(s.next)
+				tried--
+				continue
+			}
+			s.next++
+			continue
+		}
+		if s.admit != nil && !s.admit(*q.held) {
+			q.credit = q.weight
+			s.next++
+			continue
+		}
+
+		msg := *q.held
+		q.held = nil
+		q.scheduled++
+		q.credit--
+		if q.credit <= 0 {
+			q.credit = q.weight
+			s.next++
+		}
+		if s.metrics != nil {
+			s.metrics.RecordConnectionScheduled(q.id, q.depth())
+		}
+		resumed := ""
+		if q.throttled && !q.closed && q.depth() <= lowWater(cap(q.msgs)) {
+			q.throttled = false
+			resumed = q.id
+		}
+		return msg, true, resumed
+	}
+	return MessageEvent{}, false, ""
+}
+
+// drop removes the queue at i; callers hold the lock
+func (s *scheduler) drop(i int) {
+	q := s.queues[i]
+	s.queues = append(s.queues[:i], s.queues[i+1:]...)
+	delete(s.byID, q.id)
+	if s.metrics != nil {
+		s.metrics.ForgetConnection(q.id)
+	}
+}
+
+// stats returns the state of every open queue by connection
+func (s *scheduler) stats() map[string]QueueStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stats := make(map[string]QueueStats, len(s.queues))
+	for _, q := range s.queues {
+		if q.closed {
+			continue
+		}
+		stats[q.id] = QueueStats{Weight: q.weight, Depth: q.depth(), Scheduled: q.scheduled, Dropped: q.dropped}
+	}
+	return stats
+}
@@ -0,0 +1,88 @@
+package kafkasink
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// maxResponseSize bounds a single broker response
+const maxResponseSize = 64 << 20
+
+// broker is a connection to one Kafka broker. Requests are sent one at a
+// time and wait for their response, so at most one produce request per
+// partition is in flight.
+type broker struct {
+	addr          string
+	conn          net.Conn
+	reader        *bufio.Reader
+	clientID      string
+	timeout       time.Duration
+	correlationID int32
+}
+
+func dialBroker(ctx context.Context, addr, clientID string, timeout time.Duration) (*broker, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to kafka broker %s: %w", addr, err)
+	}
+	return &broker{
+		addr:     addr,
+		conn:     conn,
+		reader:   bufio.NewReader(conn),
+		clientID: clientID,
+		timeout:  timeout,
+	}, nil
+}
+
+// request sends a request and returns the response body. Without
+// expectResponse (a produce with acks=0) it returns once the request is
+// written.
+func (b *broker) request(apiKey, apiVersion int16, body []byte, expectResponse bool) ([]byte, error) {
+	b.correlationID++
+
+	header := make([]byte, 0, 16+len(b.clientID))
+	header = binary.BigEndian.AppendUint16(header, uint16(apiKey))
+	header = binary.BigEndian.AppendUint16(header, uint16(apiVersion))
+	header = binary.BigEndian.AppendUint32(header, uint32(b.correlationID))
+	header = appendString(header, b.clientID)
+
+	msg := make([]byte, 0, 4+len(header)+len(body))
+	msg = binary.BigEndian.AppendUint32(msg, uint32(len(header)+len(body)))
+	msg = append(append(msg, header...), body...)
+
+	b.conn.SetDeadline(time.Now().Add(b.timeout))
+	if _, err := b.conn.Write(msg); err != nil {
+		return nil, fmt.Errorf("failed to send to kafka broker %s: %w", b.addr, err)
+	}
+	if !expectResponse {
+		return nil, nil
+	}
+
+	var sizeBuf [8]byte
+	if _, err := io.ReadFull(b.reader, sizeBuf[:]); err != nil {
+		return nil, fmt.Errorf("failed to read from kafka broker %s: %w", b.addr, err)
+	}
+	size := int32(binary.BigEndian.Uint32(sizeBuf[:4]))
+	if size < 4 || size > maxResponseSize {
+		return nil, fmt.Errorf("invalid kafka response size %d", size)
+	}
+	if correlationID := int32(binary.BigEndian.Uint32(sizeBuf[4:])); correlationID != b.correlationID {
+		return nil, fmt.Errorf("kafka response out of order: got %d, want %d", correlationID, b.correlationID)
+	}
+
+	response := make([]byte, size-4)
+	if _, err := io.ReadFull(b.reader, response); err != nil {
+		return nil, fmt.Errorf("failed to read from kafka broker %s: %w", b.addr, err)
+	}
+	return response, nil
+}
+
+func (b *broker) close() {
+	b.conn.Close()
+}
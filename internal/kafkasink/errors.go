@@ -0,0 +1,103 @@
+package kafkasink
+
+import "fmt"
+
+// Kafka error codes the sink acts on
+const (
+	errNone                         int16 = 0
+	errCorruptMessage               int16 = 2
+	errUnknownTopicOrPartition      int16 = 3
+	errLeaderNotAvailable           int16 = 5
+	errNotLeaderOrFollower          int16 = 6
+	errRequestTimedOut              int16 = 7
+	errMessageTooLarge              int16 = 10
+	errNetworkException             int16 = 13
+	errInvalidTopic                 int16 = 17
+	errRecordListTooLarge           int16 = 18
+	errNotEnoughReplicas            int16 = 19
+	errNotEnoughReplicasAfterAppend int16 = 20
+	errInvalidRequiredAcks          int16 = 21
+	errTopicAuthorizationFailed     int16 = 29
+	errClusterAuthorizationFailed   int16 = 31
+	errOutOfOrderSequenceNumber     int16 = 45
+	errDuplicateSequenceNumber      int16 = 46
+	errInvalidProducerEpoch         int16 = 47
+	errUnknownProducerID            int16 = 59
+	errFencedLeaderEpoch            int16 = 74
+	errUnknownLeaderEpoch           int16 = 75
+	errInvalidRecord                int16 = 87
+)
+
+var errorNames = map[int16]string{
+	errCorruptMessage:               "corrupt_message",
+	errUnknownTopicOrPartition:      "unknown_topic_or_partition",
+	errLeaderNotAvailable:           "leader_not_available",
+	errNotLeaderOrFollower:          "not_leader_or_follower",
+	errRequestTimedOut:              "request_timed_out",
+	errMessageTooLarge:              "message_too_large",
+	errNetworkException:             "network_exception",
+	errInvalidTopic:                 "invalid_topic",
+	errRecordListTooLarge:           "record_list_too_large",
+	errNotEnoughReplicas:            "not_enough_replicas",
+	errNotEnoughReplicasAfterAppend: "not_enough_replicas_after_append",
+	errInvalidRequiredAcks:          "invalid_required_acks",
+	errTopicAuthorizationFailed:     "topic_authorization_failed",
+	errClusterAuthorizationFailed:   "cluster_authorization_failed",
+	errOutOfOrderSequenceNumber:     "out_of_order_sequence_number",
+	errDuplicateSequenceNumber:      "duplicate_sequence_number",
+	errInvalidProducerEpoch:         "invalid_producer_epoch",
+	errUnknownProducerID:            "unknown_producer_id",
+	errFencedLeaderEpoch:            "fenced_leader_epoch",
+	errUnknownLeaderEpoch:           "unknown_leader_epoch",
+	errInvalidRecord:                "invalid_record",
+}
+
+// kafkaError is an error code returned by a broker
+type kafkaError struct {
+	code int16
+}
+
+func (e *kafkaError) Error() string {
+	return fmt.Sprintf("kafka error %d (%s)", e.code, e.name())
+}
+
+func (e *kafkaError) name() string {
+	if name, ok := errorNames[e.code]; ok {
+		return name
+	}
+	return fmt.Sprintf("error_%d", e.code)
+}
+
+// permanent reports whether producing the same records again can't succeed
+func (e *kafkaError) permanent() bool {
+	switch e.code {
+	case errCorruptMessage, errMessageTooLarge, errInvalidTopic, errRecordListTooLarge,
+		errInvalidRequiredAcks, errTopicAuthorizationFailed, errClusterAuthorizationFailed,
+		errInvalidRecord:
+		return true
+	default:
+		return false
+	}
+}
+
+// staleMetadata reports whether the partition leaders need refreshing
+func (e *kafkaError) staleMetadata() bool {
+	switch e.code {
+	case errUnknownTopicOrPartition, errLeaderNotAvailable, errNotLeaderOrFollower,
+		errFencedLeaderEpoch, errUnknownLeaderEpoch:
+		return true
+	default:
+		return false
+	}
+}
+
+// resetProducer reports whether the idempotent producer must start over
+// with a new producer ID
+func (e *kafkaError) resetProducer() bool {
+	switch e.code {
+	case errOutOfOrderSequenceNumber, errInvalidProducerEpoch, errUnknownProducerID:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,463 @@
+// Package kafkasink produces events to a Kafka topic, keyed by session so
+// each session's events stay in order on one partition.
+package kafkasink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tabular/relay/internal/metrics"
+	"github.com/tabular/relay/pkg/sink"
+	"github.com/tabular/relay/pkg/types"
+)
+
+// Options configures a Kafka Sink
+type Options struct {
+	Name           string   // Sink name; defaults to "kafka"
+	Brokers        []string // Bootstrap brokers, "host:port"
+	Topic          string
+	ClientID       string        // Defaults to "tabular-relay"
+	Acks           string        // "all" (default), "leader" or "none"; also "-1", "1", "0"
+	Idempotent     bool          // Dedupe broker-side retries; requires acks "all"
+	BatchBytes     int           // Max record batch size per partition (default 1 MiB)
+	Timeout        time.Duration // Request timeout (default 10s)
+	MetadataMaxAge time.Duration // Refresh partition leaders this often (default 5m)
+	Metrics        *metrics.Metrics
+}
+
+// Sink produces each event as one JSON record keyed by its session ID. A
+// batch is split into one record batch per partition, and a partition's
+// batches are produced one at a time so a failure never reorders records.
+// It implements sink.Sink.
+type Sink struct {
+	opts Options
+	acks int16
+
+	brokers       map[int32]*broker // Node ID -> connection
+	metadata      *metadata
+	metadataAt    time.Time
+	metadataStale bool // Refresh before the next batch
+
+	// Idempotent producer state; producerID is -1 until initialized
+	producerID    int64
+	producerEpoch int16
+	producerStale bool            // Get a new producer ID before the next batch
+	sequences     map[int32]int32 // Partition -> next sequence number
+
+	closed bool
+	mutex  sync.Mutex
+}
+
+// pendingRecord is a record and the index of the event it came from
+type pendingRecord struct {
+	index  int
+	record record
+}
+
+// Open validates the options and creates a Kafka sink. Brokers are not
+// contacted until the first batch is sent.
+func Open(opts Options) (*Sink, error) {
+	if len(opts.Brokers) == 0 {
+		return nil, fmt.Errorf("kafka brokers are required")
+	}
+	if opts.Topic == "" {
+		return nil, fmt.Errorf("kafka topic is required")
+	}
+	if opts.Name == "" {
+		opts.Name = "kafka"
+	}
+	if opts.ClientID == "" {
+		opts.ClientID = "tabular-relay"
+	}
+	if opts.BatchBytes <= 0 {
+		opts.BatchBytes = 1 << 20
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.MetadataMaxAge <= 0 {
+		opts.MetadataMaxAge = 5 * time.Minute
+	}
+
+	acks, err := parseAcks(opts.Acks)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Idempotent && acks != -1 {
+		return nil, fmt.Errorf("idempotent kafka producer requires acks \"all\"")
+	}
+
+	return &Sink{
+		opts:       opts,
+		acks:       acks,
+		brokers:    make(map[int32]*broker),
+		producerID: -1,
+		sequences:  make(map[int32]int32),
+	}, nil
+}
+
+// Name identifies the sink
+func (s *Sink) Name() string {
+	return s.opts.Name
+}
+
+// Send produces a batch. Events of a partition whose produce failed fail
+// together, along with later events of that partition in the batch.
+func (s *Sink) Send(ctx context.Context, events []types.SpatialEvent) ([]sink.Result, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil, &sink.DeliveryError{Sink: s.opts.Name, Err: errors.New("sink closed")}
+	}
+
+	if err := s.prepare(ctx); err != nil {
+		var kerr *kafkaError
+		permanent := errors.As(err, &kerr) && kerr.permanent()
+		return nil, &sink.DeliveryError{Sink: s.opts.Name, Permanent: permanent, Err: err}
+	}
+
+	results := sink.Delivered(events)
+	now := time.Now()
+
+	// Group records by partition, keeping each session's events in order
+	queues := make(map[int32][]pendingRecord)
+	partitions := len(s.metadata.leaders)
+	for i, event := range events {
+		value, err := json.Marshal(event)
+		if err != nil {
+			results[i].Err = &sink.DeliveryError{Sink: s.opts.Name, Permanent: true, Err: err}
+			continue
+		}
+		timestamp := now
+		if event.Timestamp > 0 {
+			timestamp = time.UnixMilli(event.Timestamp)
+		}
+		key := []byte(event.SessionID)
+		partition := PartitionForKey(key, partitions)
+		queues[partition] = append(queues[partition], pendingRecord{
+			index: i,
+			record: record{
+				key:       key,
+				value:     value,
+				headers:   [][2]string{{"event_id", event.EventID}},
+				timestamp: timestamp,
+			},
+		})
+	}
+
+	// Each round produces the next record batch of every partition,
+	// grouped into one request per leader
+	for len(queues) > 0 {
+		byLeader := make(map[int32][]int32)
+		for partition := range queues {
+			leader := s.metadata.leaders[partition]
+			byLeader[leader] = append(byLeader[leader], partition)
+		}
+
+		for leader, leaderPartitions := range byLeader {
+			sort.Slice(leaderPartitions, func(i, j int) bool { return leaderPartitions[i] < leaderPartitions[j] })
+			s.produce(ctx, leader, leaderPartitions, queues, results)
+		}
+	}
+
+	return results, nil
+}
+
+// Close closes every broker connection
+func (s *Sink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+	for nodeID, b := range s.brokers {
+		b.close()
+		delete(s.brokers, nodeID)
+	}
+	return nil
+}
+
+// prepare makes sure partition leaders are known and, for an idempotent
+// producer, that it has a producer ID
+func (s *Sink) prepare(ctx context.Context) error {
+	if s.metadata == nil || s.metadataStale || time.Since(s.metadataAt) > s.opts.MetadataMaxAge {
+		if err := s.refreshMetadata(ctx); err != nil {
+			return err
+		}
+	}
+
+	if s.opts.Idempotent && (s.producerID < 0 || s.producerStale) {
+		if err := s.initProducerID(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshMetadata asks the known brokers, then the bootstrap ones, for the
+// topic's partition leaders
+func (s *Sink) refreshMetadata(ctx context.Context) error {
+	var lastErr error
+	for _, addr := range s.metadataAddrs() {
+		b, err := dialBroker(ctx, addr, s.opts.ClientID, s.opts.Timeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		response, err := b.request(apiMetadata, metadataVersion, encodeMetadataRequest(s.opts.Topic), true)
+		b.close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		md, err := decodeMetadataResponse(response, s.opts.Topic)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if md.topicError != errNone {
+			return fmt.Errorf("kafka topic %s: %w", s.opts.Topic, &kafkaError{code: md.topicError})
+		}
+		if len(md.leaders) == 0 {
+			return fmt.Errorf("kafka topic %s has no partitions", s.opts.Topic)
+		}
+
+		// Leaders may have moved, so reconnect lazily
+		for nodeID, conn := range s.brokers {
+			conn.close()
+			delete(s.brokers, nodeID)
+		}
+		s.metadata = &md
+		s.metadataAt = time.Now()
+		s.metadataStale = false
+		return nil
+	}
+	return fmt.Errorf("failed to fetch kafka metadata: %w", lastErr)
+}
+
+// metadataAddrs lists brokers to ask for metadata, known ones first
+func (s *Sink) metadataAddrs() []string {
+	var addrs []string
+	if s.metadata != nil {
+		for _, addr := range s.metadata.brokers {
+			addrs = append(addrs, addr)
+		}
+	}
+	return append(addrs, s.opts.Brokers...)
+}
+
+// initProducerID obtains a new producer ID and restarts every sequence
+func (s *Sink) initProducerID(ctx context.Context) error {
+	var nodeID int32 = -1
+	for id := range s.metadata.brokers {
+		nodeID = id
+		break
+	}
+	b, err := s.broker(ctx, nodeID)
+	if err != nil {
+		return err
+	}
+
+	response, err := b.request(apiInitProducerID, initProducerIDVersion, encodeInitProducerIDRequest(s.opts.Timeout), true)
+	if err != nil {
+		s.dropBroker(nodeID)
+		return err
+	}
+	producerID, producerEpoch, errorCode, err := decodeInitProducerIDResponse(response)
+	if err != nil {
+		return err
+	}
+	if errorCode != errNone {
+		return fmt.Errorf("failed to initialize kafka producer: %w", &kafkaError{code: errorCode})
+	}
+
+	s.producerID = producerID
+	s.producerEpoch = producerEpoch
+	s.producerStale = false
+	s.sequences = make(map[int32]int32)
+	return nil
+}
+
+// produce sends the next record batch of each partition to their leader
+// and settles the outcome in results, removing finished partitions from
+// queues
+func (s *Sink) produce(ctx context.Context, leader int32, partitions []int32, queues map[int32][]pendingRecord, results []sink.Result) {
+	request := produceRequest{
+		acks:    s.acks,
+		timeout: s.opts.Timeout,
+		topic:   s.opts.Topic,
+		batches: make(map[int32][]byte),
+	}
+	sent := make(map[int32][]pendingRecord)
+
+	for _, partition := range partitions {
+		batch := s.nextBatch(queues[partition])
+		sent[partition] = batch
+
+		records := make([]record, len(batch))
+		for i, pending := range batch {
+			records[i] = pending.record
+		}
+		producer := producerState{producerID: -1, producerEpoch: -1, baseSequence: -1}
+		if s.opts.Idempotent {
+			producer = producerState{
+				producerID:    s.producerID,
+				producerEpoch: s.producerEpoch,
+				baseSequence:  s.sequences[partition],
+			}
+		}
+		request.batches[partition] = encodeRecordBatch(records, producer)
+		request.partOrder = append(request.partOrder, partition)
+	}
+
+	responses, err := s.send(ctx, leader, request)
+	for _, partition := range partitions {
+		batch := sent[partition]
+
+		partitionErr := err
+		var baseOffset int64 = -1
+		if err == nil && s.acks != 0 {
+			resp, ok := responses[partition]
+			switch {
+			case !ok:
+				partitionErr = fmt.Errorf("kafka response is missing partition %d", partition)
+			case resp.errorCode == errDuplicateSequenceNumber:
+				// Already written by an earlier attempt, at an offset the
+				// broker doesn't repeat
+			case resp.errorCode != errNone:
+				partitionErr = &kafkaError{code: resp.errorCode}
+			default:
+				baseOffset = resp.baseOffset
+			}
+		}
+
+		if partitionErr != nil {
+			s.fail(partition, queues[partition], partitionErr, results)
+			delete(queues, partition)
+			continue
+		}
+
+		s.delivered(partition, batch, baseOffset)
+		queues[partition] = queues[partition][len(batch):]
+		if len(queues[partition]) == 0 {
+			delete(queues, partition)
+		}
+	}
+}
+
+// nextBatch takes records off a partition queue up to BatchBytes. A record
+// larger than that goes in a batch of its own.
+func (s *Sink) nextBatch(queue []pendingRecord) []pendingRecord {
+	size := 0
+	for i, pending := range queue {
+		size += pending.record.size()
+		if i > 0 && size > s.opts.BatchBytes {
+			return queue[:i]
+		}
+	}
+	return queue
+}
+
+// send delivers a produce request to a partition leader
+func (s *Sink) send(ctx context.Context, leader int32, request produceRequest) (map[int32]partitionResponse, error) {
+	b, err := s.broker(ctx, leader)
+	if err != nil {
+		s.metadataStale = true // The leader may have moved
+		return nil, err
+	}
+
+	response, err := b.request(apiProduce, produceVersion, request.encode(), s.acks != 0)
+	if err != nil {
+		s.dropBroker(leader)
+		s.metadataStale = true
+		return nil, err
+	}
+	if s.acks == 0 {
+		return nil, nil
+	}
+	return decodeProduceResponse(response)
+}
+
+// delivered records a successfully produced batch
+func (s *Sink) delivered(partition int32, batch []pendingRecord, baseOffset int64) {
+	if s.opts.Idempotent {
+		s.sequences[partition] += int32(len(batch))
+	}
+
+	if s.opts.Metrics != nil {
+		latency := time.Since(batch[0].record.timestamp).Seconds()
+		s.opts.Metrics.RecordKafkaDelivery(s.opts.Topic, partition, latency)
+		// Acks "none" and duplicates of an earlier write come back without
+		// an offset
+		if baseOffset >= 0 {
+			s.opts.Metrics.RecordKafkaOffset(s.opts.Topic, partition, baseOffset+int64(len(batch))-1)
+		}
+	}
+}
+
+// fail marks every queued record of a partition failed
+func (s *Sink) fail(partition int32, queue []pendingRecord, err error, results []sink.Result) {
+	reason := "network"
+	permanent := false
+	var kerr *kafkaError
+	if errors.As(err, &kerr) {
+		reason = kerr.name()
+		permanent = kerr.permanent()
+		s.metadataStale = s.metadataStale || kerr.staleMetadata()
+		s.producerStale = s.producerStale || kerr.resetProducer()
+	}
+
+	log.Printf("Failed to produce %d records to %s/%d: %v", len(queue), s.opts.Topic, partition, err)
+	if s.opts.Metrics != nil {
+		s.opts.Metrics.RecordKafkaFailure(s.opts.Topic, partition, reason)
+	}
+
+	deliveryErr := &sink.DeliveryError{Sink: s.opts.Name, Permanent: permanent, Err: err}
+	for _, pending := range queue {
+		results[pending.index].Err = deliveryErr
+	}
+}
+
+// broker returns a connection to a broker node, dialing it if needed
+func (s *Sink) broker(ctx context.Context, nodeID int32) (*broker, error) {
+	if b, exists := s.brokers[nodeID]; exists {
+		return b, nil
+	}
+	addr, known := s.metadata.brokers[nodeID]
+	if !known {
+		return nil, fmt.Errorf("kafka broker %d is not in the cluster metadata", nodeID)
+	}
+	b, err := dialBroker(ctx, addr, s.opts.ClientID, s.opts.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	s.brokers[nodeID] = b
+	return b, nil
+}
+
+func (s *Sink) dropBroker(nodeID int32) {
+	if b, exists := s.brokers[nodeID]; exists {
+		b.close()
+		delete(s.brokers, nodeID)
+	}
+}
+
+func parseAcks(acks string) (int16, error) {
+	switch acks {
+	case "", "all", "-1":
+		return -1, nil
+	case "leader", "1":
+		return 1, nil
+	case "none", "0":
+		return 0, nil
+	default:
+		return 0, fmt.Errorf("unknown kafka acks setting: %s", acks)
+	}
+}
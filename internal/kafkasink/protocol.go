@@ -0,0 +1,339 @@
+package kafkasink
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
+// Kafka API keys and the versions the sink speaks. These are the oldest
+// versions with record batches (magic 2), which every broker since 0.11
+// accepts.
+const (
+	apiProduce        int16 = 0
+	apiMetadata       int16 = 3
+	apiInitProducerID int16 = 22
+
+	produceVersion        int16 = 3
+	metadataVersion       int16 = 1
+	initProducerIDVersion int16 = 0
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// record is one Kafka record before encoding
+type record struct {
+	key       []byte
+	value     []byte
+	headers   [][2]string
+	timestamp time.Time
+}
+
+// size approximates a record's encoded size for batching
+func (r record) size() int {
+	n := len(r.key) + len(r.value) + 16
+	for _, header := range r.headers {
+		n += len(header[0]) + len(header[1]) + 4
+	}
+	return n
+}
+
+// producerState identifies an idempotent producer's batch; producerID -1
+// means the producer is not idempotent
+type producerState struct {
+	producerID    int64
+	producerEpoch int16
+	baseSequence  int32
+}
+
+// encodeRecordBatch encodes records as an uncompressed v2 record batch
+func encodeRecordBatch(records []record, producer producerState) []byte {
+	baseTimestamp := records[0].timestamp.UnixMilli()
+	maxTimestamp := baseTimestamp
+
+	var body []byte
+	for i, r := range records {
+		ts := r.timestamp.UnixMilli()
+		if ts > maxTimestamp {
+			maxTimestamp = ts
+		}
+
+		var rec []byte
+		rec = append(rec, 0) // Attributes
+		rec = binary.AppendVarint(rec, ts-baseTimestamp)
+		rec = binary.AppendVarint(rec, int64(i))
+		rec = appendVarBytes(rec, r.key)
+		rec = appendVarBytes(rec, r.value)
+		rec = binary.AppendVarint(rec, int64(len(r.headers)))
+		for _, header := range r.headers {
+			rec = appendVarBytes(rec, []byte(header[0]))
+			rec = appendVarBytes(rec, []byte(header[1]))
+		}
+
+		body = binary.AppendVarint(body, int64(len(rec)))
+		body = append(body, rec...)
+	}
+
+	// Everything from attributes on is covered by the CRC
+	var crcd []byte
+	crcd = binary.BigEndian.AppendUint16(crcd, 0) // Attributes: no compression
+	crcd = binary.BigEndian.AppendUint32(crcd, uint32(len(records)-1))
+	crcd = binary.BigEndian.AppendUint64(crcd, uint64(baseTimestamp))
+	crcd = binary.BigEndian.AppendUint64(crcd, uint64(maxTimestamp))
+	crcd = binary.BigEndian.AppendUint64(crcd, uint64(producer.producerID))
+	crcd = binary.BigEndian.AppendUint16(crcd, uint16(producer.producerEpoch))
+	crcd = binary.BigEndian.AppendUint32(crcd, uint32(producer.baseSequence))
+	crcd = binary.BigEndian.AppendUint32(crcd, uint32(len(records)))
+	crcd = append(crcd, body...)
+
+	batch := make([]byte, 0, 21+len(crcd))
+	batch = binary.BigEndian.AppendUint64(batch, 0)                       // Base offset
+	batch = binary.BigEndian.AppendUint32(batch, uint32(4+1+4+len(crcd))) // Batch length
+	batch = binary.BigEndian.AppendUint32(batch, 0xffffffff)              // Partition leader epoch
+	batch = append(batch, 2)                                              // Magic
+	batch = binary.BigEndian.AppendUint32(batch, crc32.Checksum(crcd, castagnoli))
+	return append(batch, crcd...)
+}
+
+// produceRequest is a Produce request for one topic
+type produceRequest struct {
+	acks      int16
+	timeout   time.Duration
+	topic     string
+	batches   map[int32][]byte // Partition -> encoded record batch
+	partOrder []int32
+}
+
+func (p produceRequest) encode() []byte {
+	var buf []byte
+	buf = appendNullableString(buf, nil) // Transactional ID
+	buf = binary.BigEndian.AppendUint16(buf, uint16(p.acks))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(p.timeout.Milliseconds()))
+	buf = binary.BigEndian.AppendUint32(buf, 1) // Topics
+	buf = appendString(buf, p.topic)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(p.partOrder)))
+	for _, partition := range p.partOrder {
+		batch := p.batches[partition]
+		buf = binary.BigEndian.AppendUint32(buf, uint32(partition))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(batch)))
+		buf = append(buf, batch...)
+	}
+	return buf
+}
+
+// partitionResponse is a Produce outcome for one partition
+type partitionResponse struct {
+	errorCode  int16
+	baseOffset int64
+}
+
+func decodeProduceResponse(data []byte) (map[int32]partitionResponse, error) {
+	d := decoder{buf: data}
+	responses := make(map[int32]partitionResponse)
+	for topics := d.arrayLen(); topics > 0; topics-- {
+		d.string()
+		for partitions := d.arrayLen(); partitions > 0; partitions-- {
+			partition := d.int32()
+			resp := partitionResponse{errorCode: d.int16(), baseOffset: d.int64()}
+			d.int64() // Log append time
+			responses[partition] = resp
+		}
+	}
+	d.int32() // Throttle time
+	return responses, d.err
+}
+
+// metadata is the part of a Metadata response the sink needs
+type metadata struct {
+	brokers    map[int32]string // Node ID -> host:port
+	topicError int16
+	leaders    map[int32]int32 // Partition -> leader node ID
+}
+
+func encodeMetadataRequest(topic string) []byte {
+	buf := binary.BigEndian.AppendUint32(nil, 1)
+	return appendString(buf, topic)
+}
+
+func decodeMetadataResponse(data []byte, topic string) (metadata, error) {
+	d := decoder{buf: data}
+	md := metadata{brokers: make(map[int32]string), leaders: make(map[int32]int32), topicError: errUnknownTopicOrPartition}
+
+	for n := d.arrayLen(); n > 0; n-- {
+		nodeID := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.nullableString() // Rack
+		md.brokers[nodeID] = fmt.Sprintf("%s:%d", host, port)
+	}
+	d.int32() // Controller ID
+
+	for n := d.arrayLen(); n > 0; n-- {
+		errorCode := d.int16()
+		name := d.string()
+		d.bool() // Internal
+		leaders := make(map[int32]int32)
+		for p := d.arrayLen(); p > 0; p-- {
+			d.int16() // Partition error
+			partition := d.int32()
+			leaders[partition] = d.int32()
+			for r := d.arrayLen(); r > 0; r-- {
+				d.int32() // Replicas
+			}
+			for r := d.arrayLen(); r > 0; r-- {
+				d.int32() // In-sync replicas
+			}
+		}
+		if name == topic {
+			md.topicError = errorCode
+			md.leaders = leaders
+		}
+	}
+	return md, d.err
+}
+
+func encodeInitProducerIDRequest(timeout time.Duration) []byte {
+	buf := appendNullableString(nil, nil) // Transactional ID
+	return binary.BigEndian.AppendUint32(buf, uint32(timeout.Milliseconds()))
+}
+
+func decodeInitProducerIDResponse(data []byte) (int64, int16, int16, error) {
+	d := decoder{buf: data}
+	d.int32() // Throttle time
+	errorCode := d.int16()
+	producerID := d.int64()
+	producerEpoch := d.int16()
+	return producerID, producerEpoch, errorCode, d.err
+}
+
+// murmur2 is Kafka's default partitioner hash
+func murmur2(data []byte) int32 {
+	const (
+		seed uint32 = 0x9747b28c
+		m    uint32 = 0x5bd1e995
+		r           = 24
+	)
+
+	length := len(data)
+	h := seed ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	tail := data[length&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+// PartitionForKey returns the partition Kafka's default partitioner picks
+// for a key, so consumers can find a session's records
+func PartitionForKey(key []byte, partitions int) int32 {
+	return (murmur2(key) & 0x7fffffff) % int32(partitions)
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(s)))
+	return append(buf, s...)
+}
+
+func appendNullableString(buf []byte, s *string) []byte {
+	if s == nil {
+		return binary.BigEndian.AppendUint16(buf, 0xffff)
+	}
+	return appendString(buf, *s)
+}
+
+func appendVarBytes(buf []byte, b []byte) []byte {
+	if b == nil {
+		return binary.AppendVarint(buf, -1)
+	}
+	buf = binary.AppendVarint(buf, int64(len(b)))
+	return append(buf, b...)
+}
+
+var errShortResponse = errors.New("kafka response too short")
+
+// decoder reads big-endian Kafka primitives, remembering the first error
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.buf) < n {
+		d.err = errShortResponse
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) bool() bool {
+	b := d.take(1)
+	return b != nil && b[0] != 0
+}
+
+func (d *decoder) int16() int16 {
+	if b := d.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *decoder) int32() int32 {
+	if b := d.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	if b := d.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *decoder) string() string {
+	n := d.int16()
+	return string(d.take(int(n)))
+}
+
+func (d *decoder) nullableString() {
+	if n := d.int16(); n > 0 {
+		d.take(int(n))
+	}
+}
+
+func (d *decoder) arrayLen() int {
+	n := d.int32()
+	if n < 0 || d.err != nil {
+		return 0
+	}
+	return int(n)
+}
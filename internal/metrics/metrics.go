@@ -2,6 +2,7 @@ package metrics
 
 import (
 	"net/http"
+	"strconv"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -12,11 +13,26 @@ type Metrics struct {
 	// Connection metrics
 	ActiveConnections prometheus.Gauge
 	TotalConnections  prometheus.Counter
+	PingRTT           prometheus.Histogram
+	MissedPongs       prometheus.Counter
+	StaleConnections  *prometheus.CounterVec
+	RateLimited       *prometheus.CounterVec
+	FlowControl       *prometheus.CounterVec
+	
+	// Gate queue metrics, labeled by connection and removed on disconnect
+	ConnectionQueueDepth *prometheus.GaugeVec
+	ConnectionScheduled  *prometheus.CounterVec
+	ConnectionDropped    *prometheus.CounterVec
 	
 	// Packet processing metrics
 	PacketsProcessed *prometheus.CounterVec
 	PacketErrors     *prometheus.CounterVec
 	
+	// Pipeline metrics, labeled by priority class
+	PipelineLatency    *prometheus.HistogramVec
+	PipelineProcessing *prometheus.HistogramVec
+	PipelineQueueDepth *prometheus.GaugeVec
+	
 	// Batch metrics
 	BatchSize        prometheus.Histogram
 	BatchProcessTime prometheus.Histogram
@@ -24,10 +40,42 @@ type Metrics struct {
 	// STAG integration metrics
 	StagRequests     *prometheus.CounterVec
 	StagLatency      prometheus.Histogram
+	StagRetries      prometheus.Counter
+	DeadLetters      prometheus.Gauge
+	
+	// Sink delivery metrics, labeled by sink name
+	SinkRequests     *prometheus.CounterVec
+	SinkLatency      *prometheus.HistogramVec
+	SinkRetries      *prometheus.CounterVec
+	SinkQueueDepth   *prometheus.GaugeVec
+	SinkInFlight     *prometheus.GaugeVec
+	SinkBackpressure *prometheus.CounterVec
+	
+	// Batching metrics, labeled by sink name
+	BatchFlushes         *prometheus.CounterVec
+	BatchBytes           *prometheus.HistogramVec
+	BatchWindowSeconds   *prometheus.GaugeVec
+	BatchWindowEvents    *prometheus.GaugeVec
+	BatchWindowDecisions *prometheus.CounterVec
+	CoalescedPoses       *prometheus.CounterVec
+	
+	// Kafka sink metrics, labeled by topic and partition
+	KafkaDeliveryLatency *prometheus.GaugeVec
+	KafkaPartitionOffset *prometheus.GaugeVec
+	KafkaFailures        *prometheus.CounterVec
+	
+	// Webhook metrics, labeled by notification type
+	WebhookDeliveries *prometheus.CounterVec
+	WebhookRetries    *prometheus.CounterVec
+	
+	// Spool metrics
+	SpoolBytes       prometheus.Gauge
+	SpoolDropped     prometheus.Counter
 	
 	// Mesh diffing metrics
 	MeshDeltaRatio   prometheus.Histogram
 	TrackedMeshes    prometheus.Gauge
+	MeshEvictions    *prometheus.CounterVec
 	
 	// Compression metrics
 	CompressionRatio prometheus.Histogram
@@ -48,6 +96,65 @@ func New() *Metrics {
 			Help: "Total number of WebSocket connections established",
 		}),
 		
+		PingRTT: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "relay_websocket_ping_rtt_seconds",
+			Help:    "Round trip time of WebSocket pings",
+			Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		}),
+		
+		MissedPongs: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "relay_websocket_missed_pongs_total",
+			Help: "Total number of WebSocket pings that went unanswered",
+		}),
+		
+		StaleConnections: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "relay_websocket_stale_closed_total",
+				Help: "Total number of WebSocket connections closed as stale, by reason",
+			},
+			[]string{"reason"},
+		),
+		
+		RateLimited: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "relay_rate_limited_total",
+				Help: "Total number of packets rejected for exceeding a rate limit",
+			},
+			[]string{"scope", "type", "limit"},
+		),
+		
+		FlowControl: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "relay_flow_control_total",
+				Help: "Flow control messages sent to clients, by type (slow_down, resume)",
+			},
+			[]string{"type"},
+		),
+		
+		ConnectionQueueDepth: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "relay_connection_queue_depth",
+				Help: "Messages waiting in a connection's gate queue",
+			},
+			[]string{"connection"},
+		),
+		
+		ConnectionScheduled: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "relay_connection_scheduled_total",
+				Help: "Messages the gate scheduler handed to the pipeline, by connection",
+			},
+			[]string{"connection"},
+		),
+		
+		ConnectionDropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "relay_connection_dropped_total",
+				Help: "Messages dropped because a connection's gate queue was full",
+			},
+			[]string{"connection"},
+		),
+		
 		PacketsProcessed: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: "relay_packets_processed_total",
@@ -64,6 +171,32 @@ func New() *Metrics {
 			[]string{"type", "error"},
 		),
 		
+		PipelineLatency: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "relay_pipeline_latency_seconds",
+				Help:    "Time from a packet arriving at the gate to the updater accepting it, by class",
+				Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+			},
+			[]string{"class"},
+		),
+		
+		PipelineProcessing: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "relay_pipeline_processing_seconds",
+				Help:    "Time a pipeline worker spent parsing, transforming and queueing a packet, by class",
+				Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+			},
+			[]string{"class"},
+		),
+		
+		PipelineQueueDepth: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "relay_pipeline_queue_depth",
+				Help: "Packets waiting for a pipeline worker, by class",
+			},
+			[]string{"class"},
+		),
+		
 		BatchSize: prometheus.NewHistogram(prometheus.HistogramOpts{
 			Name:    "relay_batch_size",
 			Help:    "Size of batches sent to STAG",
@@ -90,6 +223,164 @@ func New() *Metrics {
 			Buckets: prometheus.DefBuckets,
 		}),
 		
+		StagRetries: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "relay_stag_retries_total",
+			Help: "Total number of batch delivery retries to STAG",
+		}),
+		
+		DeadLetters: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "relay_dead_letter_batches",
+			Help: "Number of batches currently held in the dead-letter store",
+		}),
+		
+		SinkRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "relay_sink_requests_total",
+				Help: "Total number of batches sent to each sink",
+			},
+			[]string{"sink", "status"},
+		),
+		
+		SinkLatency: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "relay_sink_request_duration_seconds",
+				Help:    "Duration of sink deliveries",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"sink"},
+		),
+		
+		SinkRetries: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "relay_sink_retries_total",
+				Help: "Total number of batch delivery retries per sink",
+			},
+			[]string{"sink"},
+		),
+		
+		SinkQueueDepth: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "relay_sink_queue_depth",
+				Help: "Events waiting to be batched per sink",
+			},
+			[]string{"sink"},
+		),
+		
+		SinkInFlight: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "relay_sink_batches_in_flight",
+				Help: "Batches being delivered per sink",
+			},
+			[]string{"sink"},
+		),
+		
+		SinkBackpressure: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "relay_sink_backpressure_seconds_total",
+				Help: "Time the pipeline spent waiting for room in a sink's queue",
+			},
+			[]string{"sink"},
+		),
+		
+		BatchFlushes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "relay_batch_flushes_total",
+				Help: "Batches taken for delivery per sink, by the limit that ended them",
+			},
+			[]string{"sink", "reason"},
+		),
+		
+		BatchBytes: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "relay_batch_bytes",
+				Help:    "Serialized size of the batches taken for delivery per sink",
+				Buckets: prometheus.ExponentialBuckets(1024, 4, 8),
+			},
+			[]string{"sink"},
+		),
+		
+		BatchWindowSeconds: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "relay_batch_window_seconds",
+				Help: "Current batch timeout per adaptive sink",
+			},
+			[]string{"sink"},
+		),
+		
+		BatchWindowEvents: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "relay_batch_window_events",
+				Help: "Current batch size per adaptive sink",
+			},
+			[]string{"sink"},
+		),
+		
+		BatchWindowDecisions: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "relay_batch_window_decisions_total",
+				Help: "Adaptive batch window decisions per sink (grow, shrink, hold)",
+			},
+			[]string{"sink", "decision"},
+		),
+		
+		CoalescedPoses: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "relay_coalesced_poses_total",
+				Help: "Poses dropped by coalescing per sink and mode",
+			},
+			[]string{"sink", "mode"},
+		),
+		
+		KafkaDeliveryLatency: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "relay_kafka_delivery_latency_seconds",
+				Help: "Time from event timestamp to acknowledgement of the oldest event in the last batch a partition acknowledged",
+			},
+			[]string{"topic", "partition"},
+		),
+		
+		KafkaPartitionOffset: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "relay_kafka_partition_offset",
+				Help: "Offset of the last record a partition acknowledged",
+			},
+			[]string{"topic", "partition"},
+		),
+		
+		KafkaFailures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "relay_kafka_delivery_failures_total",
+				Help: "Failed Kafka produce attempts per partition by error",
+			},
+			[]string{"topic", "partition", "error"},
+		),
+		
+		WebhookDeliveries: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "relay_webhook_deliveries_total",
+				Help: "Webhook notifications by type and outcome",
+			},
+			[]string{"type", "status"},
+		),
+		
+		WebhookRetries: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "relay_webhook_retries_total",
+				Help: "Total number of webhook request retries by notification type",
+			},
+			[]string{"type"},
+		),
+		
+		SpoolBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "relay_spool_bytes",
+			Help: "Bytes currently held in the write-ahead spool",
+		}),
+		
+		SpoolDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "relay_spool_dropped_events_total",
+			Help: "Undelivered events discarded by the spool overflow policy",
+		}),
+		
 		MeshDeltaRatio: prometheus.NewHistogram(prometheus.HistogramOpts{
 			Name:    "relay_mesh_delta_ratio",
 			Help:    "Ratio of delta size to full mesh size",
@@ -101,6 +392,14 @@ func New() *Metrics {
 			Help: "Number of meshes being tracked for diffing",
 		}),
 		
+		MeshEvictions: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "relay_mesh_cache_evictions_total",
+				Help: "Mesh diff baselines evicted from the cache by reason",
+			},
+			[]string{"reason"},
+		),
+		
 		CompressionRatio: prometheus.NewHistogram(prometheus.HistogramOpts{
 			Name:    "relay_compression_ratio",
 			Help:    "Draco compression ratio (compressed/original)",
@@ -123,14 +422,47 @@ func New() *Metrics {
 	prometheus.MustRegister(
 		m.ActiveConnections,
 		m.TotalConnections,
+		m.PingRTT,
+		m.MissedPongs,
+		m.StaleConnections,
+		m.RateLimited,
+		m.FlowControl,
+		m.ConnectionQueueDepth,
+		m.ConnectionScheduled,
+		m.ConnectionDropped,
 		m.PacketsProcessed,
 		m.PacketErrors,
+		m.PipelineLatency,
+		m.PipelineProcessing,
+		m.PipelineQueueDepth,
 		m.BatchSize,
 		m.BatchProcessTime,
 		m.StagRequests,
 		m.StagLatency,
+		m.StagRetries,
+		m.DeadLetters,
+		m.SinkRequests,
+		m.SinkLatency,
+		m.SinkRetries,
+		m.SinkQueueDepth,
+		m.SinkInFlight,
+		m.SinkBackpressure,
+		m.BatchFlushes,
+		m.BatchBytes,
+		m.BatchWindowSeconds,
+		m.BatchWindowEvents,
+		m.BatchWindowDecisions,
+		m.CoalescedPoses,
+		m.KafkaDeliveryLatency,
+		m.KafkaPartitionOffset,
+		m.KafkaFailures,
+		m.WebhookDeliveries,
+		m.WebhookRetries,
+		m.SpoolBytes,
+		m.SpoolDropped,
 		m.MeshDeltaRatio,
 		m.TrackedMeshes,
+		m.MeshEvictions,
 		m.CompressionRatio,
 		m.BytesSaved,
 		m.CompressionTime,
@@ -155,6 +487,56 @@ func (m *Metrics) RecordDisconnection() {
 	m.ActiveConnections.Dec()
 }
 
+// RecordPingRTT records the round trip time of an answered ping
+func (m *Metrics) RecordPingRTT(seconds float64) {
+	m.PingRTT.Observe(seconds)
+}
+
+// RecordMissedPong counts a ping that went unanswered
+func (m *Metrics) RecordMissedPong() {
+	m.MissedPongs.Inc()
+}
+
+// RecordStaleConnection counts a connection closed for going quiet
+func (m *Metrics) RecordStaleConnection(reason string) {
+	m.StaleConnections.WithLabelValues(reason).Inc()
+}
+
+// RecordRateLimited counts a packet rejected by the connection or API key
+// limit on its packets or bytes per second
+func (m *Metrics) RecordRateLimited(scope, packetType, limit string) {
+	m.RateLimited.WithLabelValues(scope, packetType, limit).Inc()
+}
+
+// RecordFlowControl counts a slow_down or resume sent to a client
+func (m *Metrics) RecordFlowControl(messageType string) {
+	m.FlowControl.WithLabelValues(messageType).Inc()
+}
+
+// UpdateConnectionQueue records the depth of a connection's queue
+func (m *Metrics) UpdateConnectionQueue(connectionID string, depth int) {
+	m.ConnectionQueueDepth.WithLabelValues(connectionID).Set(float64(depth))
+}
+
+// RecordConnectionScheduled counts a message scheduled from a connection's
+// queue, which has depth messages left
+func (m *Metrics) RecordConnectionScheduled(connectionID string, depth int) {
+	m.ConnectionScheduled.WithLabelValues(connectionID).Inc()
+	m.ConnectionQueueDepth.WithLabelValues(connectionID).Set(float64(depth))
+}
+
+// RecordConnectionDrop counts a message dropped from a full queue
+func (m *Metrics) RecordConnectionDrop(connectionID string) {
+	m.ConnectionDropped.WithLabelValues(connectionID).Inc()
+}
+
+// ForgetConnection removes a closed connection's queue metrics
+func (m *Metrics) ForgetConnection(connectionID string) {
+	m.ConnectionQueueDepth.DeleteLabelValues(connectionID)
+	m.ConnectionScheduled.DeleteLabelValues(connectionID)
+	m.ConnectionDropped.DeleteLabelValues(connectionID)
+}
+
 // RecordPacket records packet processing metrics
 func (m *Metrics) RecordPacket(packetType, status string) {
 	m.PacketsProcessed.WithLabelValues(packetType, status).Inc()
@@ -165,6 +547,18 @@ func (m *Metrics) RecordPacketError(packetType, errorType string) {
 	m.PacketErrors.WithLabelValues(packetType, errorType).Inc()
 }
 
+// RecordPipelinePacket records a packet a pipeline worker finished:
+// latency since it reached the gate, and the worker's own share of it
+func (m *Metrics) RecordPipelinePacket(class string, latency, processing float64) {
+	m.PipelineLatency.WithLabelValues(class).Observe(latency)
+	m.PipelineProcessing.WithLabelValues(class).Observe(processing)
+}
+
+// UpdatePipelineQueue sets the number of packets waiting in a lane
+func (m *Metrics) UpdatePipelineQueue(class string, depth int) {
+	m.PipelineQueueDepth.WithLabelValues(class).Set(float64(depth))
+}
+
 // RecordBatch records batch processing metrics
 func (m *Metrics) RecordBatch(size int, duration float64) {
 	m.BatchSize.Observe(float64(size))
@@ -177,6 +571,98 @@ func (m *Metrics) RecordStagRequest(status string, duration float64) {
 	m.StagLatency.Observe(duration)
 }
 
+// RecordStagRetry counts a retried STAG delivery
+func (m *Metrics) RecordStagRetry() {
+	m.StagRetries.Inc()
+}
+
+// RecordSinkRequest records a delivery attempt to a sink
+func (m *Metrics) RecordSinkRequest(sink, status string, duration float64) {
+	m.SinkRequests.WithLabelValues(sink, status).Inc()
+	m.SinkLatency.WithLabelValues(sink).Observe(duration)
+}
+
+// RecordSinkRetry counts a retried delivery to a sink
+func (m *Metrics) RecordSinkRetry(sink string) {
+	m.SinkRetries.WithLabelValues(sink).Inc()
+}
+
+// UpdateSinkQueue records a sink's queued events and batches in flight
+func (m *Metrics) UpdateSinkQueue(sink string, queued, inFlight int) {
+	m.SinkQueueDepth.WithLabelValues(sink).Set(float64(queued))
+	m.SinkInFlight.WithLabelValues(sink).Set(float64(inFlight))
+}
+
+// RecordSinkBackpressure records time spent waiting for room in a sink's queue
+func (m *Metrics) RecordSinkBackpressure(sink string, seconds float64) {
+	m.SinkBackpressure.WithLabelValues(sink).Add(seconds)
+}
+
+// RecordBatchFlush records a batch taken for delivery and why it ended.
+// Batches of unsized events (no spool or byte limit) skip the histogram.
+func (m *Metrics) RecordBatchFlush(sink, reason string, bytes int) {
+	m.BatchFlushes.WithLabelValues(sink, reason).Inc()
+	if bytes > 0 {
+		m.BatchBytes.WithLabelValues(sink).Observe(float64(bytes))
+	}
+}
+
+// RecordCoalesced counts poses a sink's coalescing policy dropped
+func (m *Metrics) RecordCoalesced(sink, mode string, poses int) {
+	m.CoalescedPoses.WithLabelValues(sink, mode).Add(float64(poses))
+}
+
+// RecordBatchWindow records an adaptive batch window decision and the
+// window it left
+func (m *Metrics) RecordBatchWindow(sink, decision string, seconds float64, events int) {
+	m.BatchWindowDecisions.WithLabelValues(sink, decision).Inc()
+	m.BatchWindowSeconds.WithLabelValues(sink).Set(seconds)
+	m.BatchWindowEvents.WithLabelValues(sink).Set(float64(events))
+}
+
+// RecordKafkaDelivery records the delivery latency of a batch a Kafka
+// partition acknowledged
+func (m *Metrics) RecordKafkaDelivery(topic string, partition int32, latencySeconds float64) {
+	m.KafkaDeliveryLatency.WithLabelValues(topic, strconv.Itoa(int(partition))).Set(latencySeconds)
+}
+
+// RecordKafkaOffset records the offset of the last record a Kafka partition
+// acknowledged
+func (m *Metrics) RecordKafkaOffset(topic string, partition int32, offset int64) {
+	m.KafkaPartitionOffset.WithLabelValues(topic, strconv.Itoa(int(partition))).Set(float64(offset))
+}
+
+// RecordKafkaFailure counts a failed produce to a Kafka partition
+func (m *Metrics) RecordKafkaFailure(topic string, partition int32, reason string) {
+	m.KafkaFailures.WithLabelValues(topic, strconv.Itoa(int(partition)), reason).Inc()
+}
+
+// RecordWebhookDelivery counts a webhook notification that was delivered,
+// failed or dropped
+func (m *Metrics) RecordWebhookDelivery(notificationType, status string) {
+	m.WebhookDeliveries.WithLabelValues(notificationType, status).Inc()
+}
+
+// RecordWebhookRetry counts a retried webhook request
+func (m *Metrics) RecordWebhookRetry(notificationType string) {
+	m.WebhookRetries.WithLabelValues(notificationType).Inc()
+}
+
+// UpdateDeadLetters updates the number of dead-lettered batches
+func (m *Metrics) UpdateDeadLetters(count int) {
+	m.DeadLetters.Set(float64(count))
+}
+
+// UpdateSpoolBytes updates the current spool size
+func (m *Metrics) UpdateSpoolBytes(bytes int64) {
+	m.SpoolBytes.Set(float64(bytes))
+}
+
+// RecordSpoolDropped counts events discarded on spool overflow
+func (m *Metrics) RecordSpoolDropped(count int) {
+	m.SpoolDropped.Add(float64(count))
+}
+
 // RecordMeshDelta records mesh diffing metrics
 func (m *Metrics) RecordMeshDelta(deltaRatio float64) {
 	m.MeshDeltaRatio.Observe(deltaRatio)
@@ -187,6 +673,11 @@ func (m *Metrics) UpdateTrackedMeshes(count int) {
 	m.TrackedMeshes.Set(float64(count))
 }
 
+// RecordMeshEviction counts a mesh baseline evicted from the diff cache
+func (m *Metrics) RecordMeshEviction(reason string) {
+	m.MeshEvictions.WithLabelValues(reason).Inc()
+}
+
 // RecordCompression records compression metrics
 func (m *Metrics) RecordCompression(originalSize, compressedSize int, duration float64) {
 	ratio := float64(compressedSize) / float64(originalSize)
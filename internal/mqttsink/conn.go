@@ -0,0 +1,346 @@
+package mqttsink
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// errConnClosed is returned for publishes still waiting when the
+// connection goes away
+var errConnClosed = errors.New("mqtt connection closed")
+
+// conn is a publish-only MQTT client connection. Publishes are pipelined:
+// they are written immediately and their acknowledgements matched by packet
+// ID as they arrive.
+type conn struct {
+	netConn   net.Conn
+	version   byte
+	keepAlive time.Duration
+	timeout   time.Duration
+
+	writeMutex sync.Mutex
+	lastWrite  time.Time
+
+	mutex   sync.Mutex
+	nextID  uint16
+	pending map[uint16]*inflight
+	err     error // Set once the connection failed or was closed
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// inflight is a QoS 1 or 2 publish waiting for its acknowledgement
+type inflight struct {
+	done chan error
+}
+
+// dial connects to a broker and completes the CONNECT handshake
+func dial(ctx context.Context, opts Options) (*conn, error) {
+	address, useTLS, err := brokerAddress(opts.Broker)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: opts.Timeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", address, err)
+	}
+	if useTLS {
+		config := opts.TLS
+		if config == nil {
+			config = &tls.Config{}
+		}
+		if config.ServerName == "" {
+			config = config.Clone()
+			config.ServerName, _, _ = net.SplitHostPort(address)
+		}
+		netConn = tls.Client(netConn, config)
+	}
+
+	c := &conn{
+		netConn:   netConn,
+		version:   opts.ProtocolVersion,
+		keepAlive: opts.KeepAlive,
+		timeout:   opts.Timeout,
+		pending:   make(map[uint16]*inflight),
+		done:      make(chan struct{}),
+	}
+
+	reader := bufio.NewReader(netConn)
+	if err := c.handshake(reader, opts); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	c.wg.Add(2)
+	go c.readLoop(reader)
+	go c.pingLoop()
+
+	return c, nil
+}
+
+func (c *conn) handshake(reader *bufio.Reader, opts Options) error {
+	c.netConn.SetDeadline(time.Now().Add(c.timeout))
+	defer c.netConn.SetDeadline(time.Time{})
+
+	body := connectBody(c.version, opts.ClientID, opts.Username, opts.Password, uint16(c.keepAlive/time.Second))
+	if err := c.write(packetConnect, 0, body); err != nil {
+		return fmt.Errorf("failed to send CONNECT: %w", err)
+	}
+
+	p, err := readPacket(reader)
+	if err != nil {
+		return fmt.Errorf("failed to read CONNACK: %w", err)
+	}
+	code, err := connackCode(p)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("broker refused connection (code 0x%02x)", code)
+	}
+	return nil
+}
+
+// publish sends a message. For QoS 1 and 2 the returned channel receives
+// the outcome once the broker acknowledges it; for QoS 0 it is nil.
+func (c *conn) publish(topic string, payload []byte, qos byte, retain bool) (<-chan error, error) {
+	if err := c.failed(); err != nil {
+		return nil, err
+	}
+
+	var packetID uint16
+	var waiter *inflight
+	if qos > 0 {
+		c.mutex.Lock()
+		if c.err != nil {
+			c.mutex.Unlock()
+			return nil, c.err
+		}
+		if len(c.pending) >= 0xffff {
+			c.mutex.Unlock()
+			return nil, errors.New("too many unacknowledged publishes")
+		}
+		for {
+			c.nextID++
+			if c.nextID == 0 {
+				continue
+			}
+			if _, used := c.pending[c.nextID]; !used {
+				break
+			}
+		}
+		packetID = c.nextID
+		waiter = &inflight{done: make(chan error, 1)}
+		c.pending[packetID] = waiter
+		c.mutex.Unlock()
+	}
+
+	body := publishBody(c.version, topic, packetID, qos, payload)
+	if err := c.write(packetPublish, publishFlags(qos, retain), body); err != nil {
+		c.fail(err)
+		return nil, err
+	}
+
+	if waiter == nil {
+		return nil, nil
+	}
+	return waiter.done, nil
+}
+
+// write sends one packet, serialized with the ping loop and ack replies
+func (c *conn) write(kind, flags byte, body []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	c.netConn.SetWriteDeadline(time.Now().Add(c.timeout))
+	if err := writePacket(c.netConn, kind, flags, body); err != nil {
+		return err
+	}
+	c.lastWrite = time.Now()
+	return nil
+}
+
+// readLoop dispatches acknowledgements until the connection fails
+func (c *conn) readLoop(reader *bufio.Reader) {
+	defer c.wg.Done()
+
+	for {
+		// A ping goes out every keep alive interval, so silence for longer
+		// than that means the broker is gone
+		c.netConn.SetReadDeadline(time.Now().Add(c.keepAlive + c.timeout))
+		p, err := readPacket(reader)
+		if err != nil {
+			c.fail(fmt.Errorf("mqtt connection lost: %w", err))
+			return
+		}
+
+		switch p.kind {
+		case packetPuback, packetPubcomp:
+			packetID, reason, err := ackFields(p)
+			if err != nil {
+				c.fail(err)
+				return
+			}
+			c.complete(packetID, reason)
+		case packetPubrec:
+			packetID, reason, err := ackFields(p)
+			if err != nil {
+				c.fail(err)
+				return
+			}
+			if reason >= 0x80 {
+				c.complete(packetID, reason)
+				continue
+			}
+			// Second half of the QoS 2 handshake
+			if err := c.write(packetPubrel, 0x02, p.body[:2]); err != nil {
+				c.fail(err)
+				return
+			}
+		case packetPingresp:
+		default:
+			// Only acknowledgements are expected on a publish-only connection
+		}
+	}
+}
+
+// pingLoop keeps the connection alive while no publishes are going out
+func (c *conn) pingLoop() {
+	defer c.wg.Done()
+
+	interval := c.keepAlive / 2
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.writeMutex.Lock()
+			idle := time.Since(c.lastWrite)
+			c.writeMutex.Unlock()
+			if idle < interval {
+				continue
+			}
+			if err := c.write(packetPingreq, 0, nil); err != nil {
+				c.fail(err)
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// complete resolves an inflight publish
+func (c *conn) complete(packetID uint16, reason byte) {
+	c.mutex.Lock()
+	waiter, exists := c.pending[packetID]
+	delete(c.pending, packetID)
+	c.mutex.Unlock()
+
+	if !exists {
+		return
+	}
+	if reason >= 0x80 {
+		waiter.done <- &reasonError{code: reason}
+		return
+	}
+	waiter.done <- nil
+}
+
+// fail closes the connection and fails every inflight publish
+func (c *conn) fail(err error) {
+	c.mutex.Lock()
+	if c.err != nil {
+		c.mutex.Unlock()
+		return
+	}
+	c.err = err
+	pending := c.pending
+	c.pending = make(map[uint16]*inflight)
+	c.mutex.Unlock()
+
+	close(c.done)
+	c.netConn.Close()
+	for _, waiter := range pending {
+		waiter.done <- err
+	}
+}
+
+// failed returns the error that closed the connection, if any
+func (c *conn) failed() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.err
+}
+
+// close sends DISCONNECT and shuts the connection down
+func (c *conn) close() {
+	if c.failed() == nil {
+		c.write(packetDisconnect, 0, nil)
+	}
+	c.fail(errConnClosed)
+	c.wg.Wait()
+}
+
+// reasonError is a negative acknowledgement from an MQTT 5 broker
+type reasonError struct {
+	code byte
+}
+
+func (e *reasonError) Error() string {
+	return fmt.Sprintf("broker rejected publish (reason 0x%02x)", e.code)
+}
+
+// permanent reports whether republishing can't succeed
+func (e *reasonError) permanent() bool {
+	switch e.code {
+	case 0x87, // Not authorized
+		0x90, // Topic name invalid
+		0x95, // Packet too large
+		0x99: // Payload format invalid
+		return true
+	default:
+		return false
+	}
+}
+
+// brokerAddress turns "tcp://host:port", "ssl://host:port" or "host:port"
+// into a dial address
+func brokerAddress(broker string) (string, bool, error) {
+	if broker == "" {
+		return "", false, errors.New("mqtt broker is required")
+	}
+
+	useTLS := false
+	host := broker
+	if u, err := url.Parse(broker); err == nil && u.Host != "" {
+		switch u.Scheme {
+		case "tcp", "mqtt":
+		case "ssl", "tls", "mqtts":
+			useTLS = true
+		default:
+			return "", false, fmt.Errorf("unsupported mqtt broker scheme: %s", u.Scheme)
+		}
+		host = u.Host
+	}
+
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		port := "1883"
+		if useTLS {
+			port = "8883"
+		}
+		host = net.JoinHostPort(host, port)
+	}
+	return host, useTLS, nil
+}
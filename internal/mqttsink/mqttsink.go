@@ -0,0 +1,309 @@
+// Package mqttsink publishes anchor poses and meshes to an MQTT 3.1.1 or 5
+// broker for live dashboards.
+package mqttsink
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tabular/relay/pkg/sink"
+	"github.com/tabular/relay/pkg/types"
+)
+
+// Topic template placeholders
+const (
+	placeholderSessionID = "{session_id}"
+	placeholderAnchorID  = "{anchor_id}"
+	placeholderEventID   = "{event_id}"
+)
+
+// Options configures an MQTT Sink
+type Options struct {
+	Name            string // Sink name; defaults to "mqtt"
+	Broker          string // "tcp://host:1883", "ssl://host:8883" or "host:port"
+	ClientID        string // Defaults to a random "relay-" ID
+	Username        string
+	Password        string
+	ProtocolVersion byte          // Version311 (default) or Version5
+	KeepAlive       time.Duration // Defaults to 30s
+	Timeout         time.Duration // Connect and acknowledgement timeout; defaults to 10s
+	TLS             *tls.Config   // Used for ssl:// brokers; nil uses the system roots
+
+	// Topic templates. {session_id}, {anchor_id} and {event_id} are
+	// replaced with the event's values.
+	AnchorTopic string // Defaults to "sessions/{session_id}/anchors/{anchor_id}"
+	MeshTopic   string // Defaults to "sessions/{session_id}/meshes/{anchor_id}"
+
+	AnchorQoS     byte // 0, 1 or 2
+	MeshQoS       byte
+	RetainAnchors bool // Late subscribers get each anchor's latest pose
+	RetainMeshes  bool // Only keyframes are retained; deltas need the mesh before them
+}
+
+// AnchorMessage is the payload published for each anchor pose
+type AnchorMessage struct {
+	SessionID string `json:"session_id"`
+	EventID   string `json:"event_id"`
+	types.Anchor
+}
+
+// MeshMessage is the payload published for each mesh update
+type MeshMessage struct {
+	SessionID string `json:"session_id"`
+	EventID   string `json:"event_id"`
+	Timestamp int64  `json:"timestamp"`
+	types.MeshDiff
+}
+
+// message is one publish derived from an event
+type message struct {
+	topic   string
+	payload []byte
+	qos     byte
+	retain  bool
+}
+
+// Sink publishes every anchor and mesh of an event as its own message. It
+// connects on first use and reconnects on the next batch after the
+// connection drops. It implements sink.Sink.
+type Sink struct {
+	opts   Options
+	conn   *conn
+	closed bool
+	mutex  sync.Mutex
+}
+
+// Open validates the options and creates an MQTT sink. The broker is not
+// contacted until the first batch is sent.
+func Open(opts Options) (*Sink, error) {
+	if opts.Broker == "" {
+		return nil, fmt.Errorf("mqtt broker is required")
+	}
+	if _, _, err := brokerAddress(opts.Broker); err != nil {
+		return nil, err
+	}
+	if opts.Name == "" {
+		opts.Name = "mqtt"
+	}
+	if opts.ClientID == "" {
+		opts.ClientID = "relay-" + strings.ReplaceAll(uuid.NewString(), "-", "")[:16]
+	}
+	if opts.ProtocolVersion == 0 {
+		opts.ProtocolVersion = Version311
+	}
+	if opts.ProtocolVersion != Version311 && opts.ProtocolVersion != Version5 {
+		return nil, fmt.Errorf("unsupported mqtt protocol version: %d", opts.ProtocolVersion)
+	}
+	if opts.KeepAlive <= 0 {
+		opts.KeepAlive = 30 * time.Second
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.AnchorTopic == "" {
+		opts.AnchorTopic = "sessions/{session_id}/anchors/{anchor_id}"
+	}
+	if opts.MeshTopic == "" {
+		opts.MeshTopic = "sessions/{session_id}/meshes/{anchor_id}"
+	}
+	if opts.AnchorQoS > 2 || opts.MeshQoS > 2 {
+		return nil, fmt.Errorf("mqtt qos must be 0, 1 or 2")
+	}
+	for _, template := range []string{opts.AnchorTopic, opts.MeshTopic} {
+		if err := validateTopic(template); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Sink{opts: opts}, nil
+}
+
+// Name identifies the sink
+func (s *Sink) Name() string {
+	return s.opts.Name
+}
+
+// Send publishes a batch. An event is delivered once all of its messages
+// are; QoS 0 messages count as delivered when written to the connection.
+func (s *Sink) Send(ctx context.Context, events []types.SpatialEvent) ([]sink.Result, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil, &sink.DeliveryError{Sink: s.opts.Name, Err: errors.New("sink closed")}
+	}
+
+	c, err := s.connect(ctx)
+	if err != nil {
+		return nil, &sink.DeliveryError{Sink: s.opts.Name, Err: err}
+	}
+
+	results := sink.Delivered(events)
+	acks := make([][]<-chan error, len(events))
+	for i, event := range events {
+		messages, err := s.messages(event)
+		if err != nil {
+			results[i].Err = &sink.DeliveryError{Sink: s.opts.Name, Permanent: true, Err: err}
+			continue
+		}
+		for _, msg := range messages {
+			ack, err := c.publish(msg.topic, msg.payload, msg.qos, msg.retain)
+			if err != nil {
+				results[i].Err = s.deliveryError(err)
+				break
+			}
+			if ack != nil {
+				acks[i] = append(acks[i], ack)
+			}
+		}
+	}
+
+	// Wait for the broker to acknowledge QoS 1 and 2 publishes
+	timer := time.NewTimer(s.opts.Timeout)
+	defer timer.Stop()
+	for i := range events {
+		for _, ack := range acks[i] {
+			var err error
+			select {
+			case err = <-ack:
+			case <-timer.C:
+				c.fail(errors.New("timed out waiting for mqtt acknowledgements"))
+				err = <-ack
+			case <-ctx.Done():
+				c.fail(ctx.Err())
+				err = <-ack
+			}
+			if err != nil && results[i].Err == nil {
+				results[i].Err = s.deliveryError(err)
+			}
+		}
+	}
+
+	return results, nil
+}
+
+// Close disconnects from the broker
+func (s *Sink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+	if s.conn != nil {
+		s.conn.close()
+		s.conn = nil
+	}
+	return nil
+}
+
+// connect returns the live connection, dialing a new one if needed
+func (s *Sink) connect(ctx context.Context) (*conn, error) {
+	if s.conn != nil {
+		if s.conn.failed() == nil {
+			return s.conn, nil
+		}
+		s.conn.close()
+		s.conn = nil
+	}
+
+	c, err := dial(ctx, s.opts)
+	if err != nil {
+		return nil, err
+	}
+	s.conn = c
+	return c, nil
+}
+
+// messages maps an event to its publishes
+func (s *Sink) messages(event types.SpatialEvent) ([]message, error) {
+	var messages []message
+
+	for _, anchor := range event.Anchors {
+		payload, err := json.Marshal(AnchorMessage{
+			SessionID: event.SessionID,
+			EventID:   event.EventID,
+			Anchor:    anchor,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal anchor %s: %w", anchor.ID, err)
+		}
+		messages = append(messages, message{
+			topic:   renderTopic(s.opts.AnchorTopic, event, anchor.ID),
+			payload: payload,
+			qos:     s.opts.AnchorQoS,
+			retain:  s.opts.RetainAnchors,
+		})
+	}
+
+	for _, mesh := range event.Meshes {
+		payload, err := json.Marshal(MeshMessage{
+			SessionID: event.SessionID,
+			EventID:   event.EventID,
+			Timestamp: event.Timestamp,
+			MeshDiff:  mesh,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal mesh %s: %w", mesh.AnchorID, err)
+		}
+		messages = append(messages, message{
+			topic:   renderTopic(s.opts.MeshTopic, event, mesh.AnchorID),
+			payload: payload,
+			qos:     s.opts.MeshQoS,
+			retain:  s.opts.RetainMeshes && !mesh.IsDelta && !mesh.FacesIsDelta,
+		})
+	}
+
+	return messages, nil
+}
+
+// deliveryError wraps a publish failure, marking broker rejections that
+// can't succeed on retry as permanent
+func (s *Sink) deliveryError(err error) error {
+	var reason *reasonError
+	permanent := errors.As(err, &reason) && reason.permanent()
+	return &sink.DeliveryError{Sink: s.opts.Name, Permanent: permanent, Err: err}
+}
+
+// renderTopic fills in a topic template. Values are escaped so a client
+// can't add topic levels or wildcards.
+func renderTopic(template string, event types.SpatialEvent, anchorID string) string {
+	return strings.NewReplacer(
+		placeholderSessionID, topicSafe(event.SessionID),
+		placeholderAnchorID, topicSafe(anchorID),
+		placeholderEventID, topicSafe(event.EventID),
+	).Replace(template)
+}
+
+func topicSafe(value string) string {
+	if value == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '+', '#', 0:
+			return '_'
+		default:
+			return r
+		}
+	}, value)
+}
+
+// validateTopic rejects templates that can't produce a valid topic name
+func validateTopic(template string) error {
+	rest := strings.NewReplacer(placeholderSessionID, "", placeholderAnchorID, "", placeholderEventID, "").Replace(template)
+	switch {
+	case template == "":
+		return fmt.Errorf("mqtt topic template is empty")
+	case strings.ContainsAny(rest, "{}"):
+		return fmt.Errorf("mqtt topic template %q has an unknown placeholder", template)
+	case strings.ContainsAny(rest, "+#"):
+		return fmt.Errorf("mqtt topic template %q contains a wildcard", template)
+	}
+	return nil
+}
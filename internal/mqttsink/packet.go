@@ -0,0 +1,173 @@
+package mqttsink
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MQTT control packet types
+const (
+	packetConnect    byte = 1
+	packetConnack    byte = 2
+	packetPublish    byte = 3
+	packetPuback     byte = 4
+	packetPubrec     byte = 5
+	packetPubrel     byte = 6
+	packetPubcomp    byte = 7
+	packetPingreq    byte = 12
+	packetPingresp   byte = 13
+	packetDisconnect byte = 14
+)
+
+// Protocol levels sent in CONNECT
+const (
+	Version311 byte = 4
+	Version5   byte = 5
+)
+
+const maxRemainingLength = 268435455
+
+// packet is a decoded control packet
+type packet struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+// writePacket writes a fixed header and body
+func writePacket(w io.Writer, kind, flags byte, body []byte) error {
+	if len(body) > maxRemainingLength {
+		return fmt.Errorf("packet of %d bytes exceeds the MQTT limit", len(body))
+	}
+	header := []byte{kind<<4 | flags}
+	header = appendVarint(header, len(body))
+	buf := make([]byte, 0, len(header)+len(body))
+	buf = append(append(buf, header...), body...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readPacket reads one control packet
+func readPacket(r *bufio.Reader) (packet, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return packet{}, err
+	}
+	length, err := readVarint(r)
+	if err != nil {
+		return packet{}, err
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return packet{}, err
+	}
+	return packet{kind: first >> 4, flags: first & 0x0f, body: body}, nil
+}
+
+// connectBody builds a CONNECT packet with a clean session and no will
+func connectBody(version byte, clientID, username, password string, keepAliveSeconds uint16) []byte {
+	body := appendString(nil, "MQTT")
+	body = append(body, version)
+
+	flags := byte(0x02) // Clean session / clean start
+	if username != "" {
+		flags |= 0x80
+	}
+	if password != "" {
+		flags |= 0x40
+	}
+	body = append(body, flags)
+	body = binary.BigEndian.AppendUint16(body, keepAliveSeconds)
+	if version == Version5 {
+		body = append(body, 0) // No properties
+	}
+
+	body = appendString(body, clientID)
+	if username != "" {
+		body = appendString(body, username)
+	}
+	if password != "" {
+		body = appendString(body, password)
+	}
+	return body
+}
+
+// connackCode returns the return code (3.1.1) or reason code (5) of a CONNACK
+func connackCode(p packet) (byte, error) {
+	if p.kind != packetConnack || len(p.body) < 2 {
+		return 0, errors.New("malformed CONNACK")
+	}
+	return p.body[1], nil
+}
+
+// publishBody builds the variable header and payload of a PUBLISH
+func publishBody(version byte, topic string, packetID uint16, qos byte, payload []byte) []byte {
+	body := appendString(make([]byte, 0, len(topic)+len(payload)+8), topic)
+	if qos > 0 {
+		body = binary.BigEndian.AppendUint16(body, packetID)
+	}
+	if version == Version5 {
+		body = append(body, 0) // No properties
+	}
+	return append(body, payload...)
+}
+
+// publishFlags returns the fixed header flags of a PUBLISH
+func publishFlags(qos byte, retain bool) byte {
+	flags := qos << 1
+	if retain {
+		flags |= 0x01
+	}
+	return flags
+}
+
+// ackFields decodes PUBACK, PUBREC, PUBREL and PUBCOMP. MQTT 5 brokers may
+// add a reason code; it is 0 (success) when omitted.
+func ackFields(p packet) (packetID uint16, reason byte, err error) {
+	if len(p.body) < 2 {
+		return 0, 0, fmt.Errorf("malformed acknowledgement (type %d)", p.kind)
+	}
+	packetID = binary.BigEndian.Uint16(p.body)
+	if len(p.body) > 2 {
+		reason = p.body[2]
+	}
+	return packetID, reason, nil
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(s)))
+	return append(buf, s...)
+}
+
+func appendVarint(buf []byte, n int) []byte {
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+		if n == 0 {
+			return buf
+		}
+	}
+}
+
+func readVarint(r io.ByteReader) (int, error) {
+	n, multiplier := 0, 1
+	for i := 0; i < 4; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		n += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			return n, nil
+		}
+		multiplier *= 128
+	}
+	return 0, errors.New("malformed remaining length")
+}
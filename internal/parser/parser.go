@@ -9,7 +9,8 @@ import (
 	"github.com/tabular/relay/pkg/types"
 )
 
-// Parser handles decompression and validation of incoming packets
+// Parser handles decompression and validation of incoming packets. It
+// keeps no per-packet state, so pipeline workers share one.
 type Parser struct {
 	// Compression support (gzip-based for MVP)
 }
@@ -23,18 +24,38 @@ func New() *Parser {
 func (p *Parser) ParsePacket(packet types.StreamPacket) (*types.StreamPacket, error) {
 	// Validate basic packet structure
 	if err := p.validatePacket(packet); err != nil {
-		return nil, fmt.Errorf("invalid packet: %w", err)
+		return nil, &ValidationError{Err: fmt.Errorf("invalid packet: %w", err)}
 	}
 
 	// Process based on packet type
+	var parsed *types.StreamPacket
+	var err error
 	switch packet.Type {
 	case "pose":
-		return p.parsePosePacket(packet)
+		parsed, err = p.parsePosePacket(packet)
 	case "mesh":
-		return p.parseMeshPacket(packet)
+		parsed, err = p.parseMeshPacket(packet)
 	default:
-		return nil, fmt.Errorf("unknown packet type: %s", packet.Type)
+		err = fmt.Errorf("unknown packet type: %s", packet.Type)
 	}
+	if err != nil {
+		return nil, &ValidationError{Err: err}
+	}
+	return parsed, nil
+}
+
+// ValidationError reports a packet that decoded but whose contents the
+// relay can't accept, as opposed to one it failed to process
+type ValidationError struct {
+	Err error
+}
+
+func (e *ValidationError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
 }
 
 // validatePacket performs basic validation
@@ -83,6 +104,9 @@ func (p *Parser) parseMeshPacket(packet types.StreamPacket) (*types.StreamPacket
 	if mesh.AnchorID == "" {
 		return nil, fmt.Errorf("missing anchor_id")
 	}
+	if mesh.IndexFormat != "" && mesh.IndexFormat != "uint16" && mesh.IndexFormat != "uint32" {
+		return nil, fmt.Errorf("unknown index_format: %s", mesh.IndexFormat)
+	}
 
 	// Decompress vertices if they're Draco-compressed
 	decompressedVertices, err := p.decompressDraco(mesh.Vertices)
@@ -102,17 +126,29 @@ func (p *Parser) parseMeshPacket(packet types.StreamPacket) (*types.StreamPacket
 		}
 	}
 
-	// Update packet with decompressed data
+	// Update packet with decompressed data. Buffers passed on still
+	// encoded must not be diffed, since diffing reads them as numbers.
 	newPacket := packet
 	newPacket.Data.Mesh = &types.MeshData{
-		Vertices: decompressedVertices,
-		Faces:    decompressedFaces,
-		AnchorID: mesh.AnchorID,
+		Vertices:    decompressedVertices,
+		Faces:       decompressedFaces,
+		AnchorID:    mesh.AnchorID,
+		IndexFormat: mesh.IndexFormat,
+		Decoded:     len(decompressedVertices)%vertexSize == 0 && !isDraco(decompressedVertices) && !isDraco(decompressedFaces),
 	}
 
 	return &newPacket, nil
 }
 
+// vertexSize is the size of one float32 xyz vertex
+const vertexSize = 12
+
+// isDraco reports whether data is a Draco bitstream, which this parser
+// can't decode
+func isDraco(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("DRACO"))
+}
+
 // validatePose validates pose data structure
 func (p *Parser) validatePose(pose types.PoseData) error {
 	// Check for reasonable position bounds (adjust as needed)
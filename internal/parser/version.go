@@ -0,0 +1,71 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/tabular/relay/pkg/protocol"
+	"github.com/tabular/relay/pkg/types"
+)
+
+// upgrades convert a packet from one schema version to the next. A packet
+// of version n goes through upgrades[n], upgrades[n+1], ... until it has
+// the current schema.
+var upgrades = map[int]func(packet *types.StreamPacket) error{
+	protocol.Version1: upgradeV1,
+}
+
+// Decode decodes a JSON packet in the schema of the given protocol version.
+// Versions whose field names match types.StreamPacket decode directly; a
+// version that renames or restructures fields gets its own wire struct here.
+func Decode(version int, data []byte) (types.StreamPacket, error) {
+	var packet types.StreamPacket
+	switch version {
+	case protocol.Version1, protocol.Version2:
+		err := json.Unmarshal(data, &packet)
+		return packet, err
+	default:
+		return packet, fmt.Errorf("unsupported protocol version %d", version)
+	}
+}
+
+// Upgrade converts a packet decoded from an older schema version into the
+// current one
+func Upgrade(version int, packet types.StreamPacket) (types.StreamPacket, error) {
+	if version < protocol.Version1 || version > protocol.CurrentVersion {
+		return packet, fmt.Errorf("unsupported protocol version %d", version)
+	}
+	for v := version; v < protocol.CurrentVersion; v++ {
+		if err := upgrades[v](&packet); err != nil {
+			return packet, fmt.Errorf("upgrading from version %d: %w", v, err)
+		}
+	}
+	return packet, nil
+}
+
+// ParseVersionedPacket upgrades a packet to the current schema and parses
+// it. Version 0 means the packet already has the current schema.
+func (p *Parser) ParseVersionedPacket(version int, packet types.StreamPacket) (*types.StreamPacket, error) {
+	if version == 0 {
+		version = protocol.CurrentVersion
+	}
+	upgraded, err := Upgrade(version, packet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid packet: %w", err)
+	}
+	return p.ParsePacket(upgraded)
+}
+
+// upgradeV1 makes the implicit 32-bit index format of version 1 faces
+// explicit. The mesh is copied so the caller's packet is left as it was.
+func upgradeV1(packet *types.StreamPacket) error {
+	mesh := packet.Data.Mesh
+	if mesh == nil || len(mesh.Faces) == 0 || mesh.IndexFormat != "" {
+		return nil
+	}
+
+	upgraded := *mesh
+	upgraded.IndexFormat = "uint32"
+	packet.Data.Mesh = &upgraded
+	return nil
+}
@@ -0,0 +1,344 @@
+package pipeline
+
+import (
+	"errors"
+	"hash/fnv"
+	"log"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tabular/relay/internal/gate"
+	"github.com/tabular/relay/internal/metrics"
+	"github.com/tabular/relay/internal/parser"
+	"github.com/tabular/relay/internal/transformer"
+	"github.com/tabular/relay/pkg/protocol"
+	"github.com/tabular/relay/pkg/types"
+)
+
+// Priority classes
+const (
+	ClassFast = "fast" // Poses and other small, latency-sensitive packets
+	ClassBulk = "bulk" // Meshes and anything larger than FastMaxBytes
+)
+
+// slowFastPacket is the fast lane's latency target
+const slowFastPacket = 10 * time.Millisecond
+
+// Acker is told the outcome of every frame; *gate.Gate implements it
+type Acker interface {
+	Ack(connectionID string, frame int)
+	Nack(connectionID string, frame int, reason string, err error)
+}
+
+// Processor takes transformed events; *updater.Updater implements it
+type Processor interface {
+	ProcessEvent(event types.SpatialEvent) error
+}
+
+// Admitter keeps messages the pipeline has no room for in their
+// connection's queue; *gate.Gate implements it
+type Admitter interface {
+	SetAdmissionHandler(handler func(gate.MessageEvent) bool)
+	Readmit()
+}
+
+// Options configures a Pipeline
+type Options struct {
+	Parser      *parser.Parser
+	Transformer *transformer.Transformer
+	Processor   Processor
+	Acker       Acker            // Optional
+	Admitter    Admitter         // Optional; without it a full shard holds up every session
+	Metrics     *metrics.Metrics // Optional
+
+	Fast         types.LaneConfig // Default one worker per CPU, 256 queued per worker
+	Bulk         types.LaneConfig // Default one worker per CPU, 32 queued per worker
+	FastMaxBytes int              // Larger packets are bulk whatever their type (default 64 KiB)
+}
+
+// lane is one priority class: a worker per shard, each with its own queue.
+// A session always hashes to the same shard, so its packets are processed
+// in order while other sessions' run on the other workers.
+type lane struct {
+	class  string
+	shards []*shard
+}
+
+// shard is the queue of one worker. Room in it is reserved when a message
+// is admitted, so messages admitted can always be queued.
+type shard struct {
+	queue    chan gate.MessageEvent
+	reserved atomic.Int64 // Admitted and not yet taken by the worker
+}
+
+func newLane(class string, cfg types.LaneConfig) *lane {
+	l := &lane{class: class, shards: make([]*shard, cfg.Workers)}
+	for i := range l.shards {
+		l.shards[i] = &shard{queue: make(chan gate.MessageEvent, cfg.Queue)}
+	}
+	return l
+}
+
+// shard returns the shard of a session's worker
+func (l *lane) shard(sessionID string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(sessionID))
+	return l.shards[h.Sum32()%uint32(len(l.shards))]
+}
+
+// depth returns the packets waiting across the lane's shards
+func (l *lane) depth() int {
+	depth := 0
+	for _, s := range l.shards {
+		depth += len(s.queue)
+	}
+	return depth
+}
+
+// reserve takes a place in the shard's queue, reporting false if it is full
+func (s *shard) reserve() bool {
+	for {
+		n := s.reserved.Load()
+		if n >= int64(cap(s.queue)) {
+			return false
+		}
+		if s.reserved.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// release gives back the place of a message the worker took, reporting
+// whether the shard was full until now
+func (s *shard) release() bool {
+	return s.reserved.Add(-1) == int64(cap(s.queue))-1
+}
+
+// Pipeline parses and transforms the gate's messages and hands them to the
+// updater. Messages are split into priority lanes, each with its own
+// workers, so a pose never waits behind a mesh being decompressed. Within
+// a lane, sessions are sharded across workers: each session's packets keep
+// their order while sessions run in parallel. Lanes run independently, so
+// a session's poses and meshes may be processed out of order relative to
+// each other.
+//
+// Nothing is dropped when a shard's queue is full. With an Admitter, the
+// gate only sends a message once its shard has room, so the message waits
+// in its connection's queue, whose client is asked to slow down, while
+// other connections carry on.
+type Pipeline struct {
+	messages <-chan gate.MessageEvent
+	opts     Options
+	fast     *lane
+	bulk     *lane
+
+	stopC      chan struct{}
+	dispatcher sync.WaitGroup
+	workers    sync.WaitGroup
+}
+
+// New creates a Pipeline reading from messages, registering its admission
+// check with opts.Admitter if set
+func New(messages <-chan gate.MessageEvent, opts Options) *Pipeline {
+	if opts.Fast.Workers <= 0 {
+		opts.Fast.Workers = runtime.GOMAXPROCS(0)
+	}
+	if opts.Fast.Queue <= 0 {
+		opts.Fast.Queue = 256
+	}
+	if opts.Bulk.Workers <= 0 {
+		opts.Bulk.Workers = runtime.GOMAXPROCS(0)
+	}
+	if opts.Bulk.Queue <= 0 {
+		opts.Bulk.Queue = 32
+	}
+	if opts.FastMaxBytes <= 0 {
+		opts.FastMaxBytes = 64 << 10
+	}
+
+	p := &Pipeline{
+		messages: messages,
+		opts:     opts,
+		fast:     newLane(ClassFast, opts.Fast),
+		bulk:     newLane(ClassBulk, opts.Bulk),
+		stopC:    make(chan struct{}),
+	}
+	if opts.Admitter != nil {
+		opts.Admitter.SetAdmissionHandler(p.admit)
+	}
+	return p
+}
+
+// Start begins processing messages
+func (p *Pipeline) Start() {
+	for _, l := range []*lane{p.fast, p.bulk} {
+		for _, s := range l.shards {
+			p.workers.Add(1)
+			go p.work(l, s)
+		}
+	}
+	p.dispatcher.Add(1)
+	go p.dispatch()
+}
+
+// Stop processes the messages already sent on the gate's channel and in a
+// lane, then returns. Stop the gate first so no more arrive.
+func (p *Pipeline) Stop() {
+	close(p.stopC)
+	p.dispatcher.Wait()
+	for _, l := range []*lane{p.fast, p.bulk} {
+		for _, s := range l.shards {
+			close(s.queue)
+		}
+	}
+	p.workers.Wait()
+}
+
+// Class returns the priority class of a message
+func (p *Pipeline) Class(msg gate.MessageEvent) string {
+	if msg.Packet.Type == "mesh" || msg.Size > p.opts.FastMaxBytes {
+		return ClassBulk
+	}
+	return ClassFast
+}
+
+// lane returns the lane of a message
+func (p *Pipeline) lane(msg gate.MessageEvent) *lane {
+	if p.Class(msg) == ClassFast {
+		return p.fast
+	}
+	return p.bulk
+}
+
+// admit is the gate's admission check: it reserves room for a message in
+// its shard, or refuses it if the shard is full
+func (p *Pipeline) admit(msg gate.MessageEvent) bool {
+	return p.lane(msg).shard(msg.Packet.SessionID).reserve()
+}
+
+// dispatch moves messages into their session's shard of their lane.
+// Admitted messages have room reserved, so this only waits on a full
+// shard without an Admitter.
+func (p *Pipeline) dispatch() {
+	defer p.dispatcher.Done()
+
+	for {
+		select {
+		case msg := <-p.messages:
+			p.queue(msg)
+		case <-p.stopC:
+			p.drain()
+			return
+		}
+	}
+}
+
+// drain queues the messages left on the gate's channel at Stop; the gate
+// admitted them, so they must be processed like any other
+func (p *Pipeline) drain() {
+	for {
+		select {
+		case msg := <-p.messages:
+			p.queue(msg)
+		default:
+			return
+		}
+	}
+}
+
+// queue puts a message on its session's shard of its lane
+func (p *Pipeline) queue(msg gate.MessageEvent) {
+	l := p.lane(msg)
+	l.shard(msg.Packet.SessionID).queue <- msg
+	p.updateDepth(l)
+}
+
+// work processes the messages of one shard of a lane until it is closed
+func (p *Pipeline) work(l *lane, s *shard) {
+	defer p.workers.Done()
+
+	for msg := range s.queue {
+		if p.opts.Admitter != nil && s.release() {
+			p.opts.Admitter.Readmit()
+		}
+		p.updateDepth(l)
+		start := time.Now()
+		p.process(msg)
+
+		received := msg.Timestamp
+		if received.IsZero() {
+			received = start
+		}
+		latency := time.Since(received)
+		if p.opts.Metrics != nil {
+			p.opts.Metrics.RecordPipelinePacket(l.class, latency.Seconds(), time.Since(start).Seconds())
+		}
+		if l.class == ClassFast && latency > slowFastPacket {
+			log.Printf("Slow packet processing: %v for type %s", latency, msg.Packet.Type)
+		}
+	}
+}
+
+// process parses, transforms and hands on one message, acking or nacking
+// its frame
+func (p *Pipeline) process(msg gate.MessageEvent) {
+	packetType := msg.Packet.Type
+
+	// Parse packet
+	parsedPacket, err := p.opts.Parser.ParseVersionedPacket(msg.ProtocolVersion, msg.Packet)
+	if err != nil {
+		log.Printf("Failed to parse packet: %v", err)
+		p.recordError(packetType, "parse_error")
+		var invalid *parser.ValidationError
+		if errors.As(err, &invalid) {
+			p.nack(msg, protocol.NackValidationError, err)
+		} else {
+			p.nack(msg, protocol.NackParseError, err)
+		}
+		return
+	}
+
+	// Transform to event
+	event, err := p.opts.Transformer.Transform(*parsedPacket)
+	if err != nil {
+		log.Printf("Failed to transform packet: %v", err)
+		p.recordError(packetType, "transform_error")
+		p.nack(msg, protocol.NackParseError, err)
+		return
+	}
+
+	// Process in updater
+	if err := p.opts.Processor.ProcessEvent(*event); err != nil {
+		log.Printf("Failed to process event: %v", err)
+		p.recordError(packetType, "update_error")
+		p.nack(msg, protocol.NackRejected, err)
+		return
+	}
+
+	if p.opts.Metrics != nil {
+		p.opts.Metrics.RecordPacket(packetType, "success")
+	}
+	if p.opts.Acker != nil {
+		p.opts.Acker.Ack(msg.ConnectionID, msg.Packet.FrameNumber)
+	}
+}
+
+func (p *Pipeline) nack(msg gate.MessageEvent, reason string, err error) {
+	if p.opts.Acker != nil {
+		p.opts.Acker.Nack(msg.ConnectionID, msg.Packet.FrameNumber, reason, err)
+	}
+}
+
+func (p *Pipeline) recordError(packetType, errorType string) {
+	if p.opts.Metrics != nil {
+		p.opts.Metrics.RecordPacketError(packetType, errorType)
+	}
+}
+
+func (p *Pipeline) updateDepth(l *lane) {
+	if p.opts.Metrics != nil {
+		p.opts.Metrics.UpdatePipelineQueue(l.class, l.depth())
+	}
+}
@@ -0,0 +1,451 @@
+package spool
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// OverflowPolicy decides what happens when the spool reaches its size cap
+type OverflowPolicy string
+
+const (
+	// OverflowReject refuses new records until space is freed by acks
+	OverflowReject OverflowPolicy = "reject"
+	// OverflowDropOldest discards the oldest segments to make room
+	OverflowDropOldest OverflowPolicy = "drop_oldest"
+)
+
+// ErrFull is returned by Append when the spool is at capacity
+var ErrFull = errors.New("spool full")
+
+const (
+	segmentExt   = ".seg"
+	ackExt       = ".ack" // Sidecar of a segment listing its acked sequence numbers
+	headerSize   = 8      // uint32 length + uint32 CRC32
+	ackSize      = 8      // uint64 sequence number
+	maxRecordLen = 256 << 20
+)
+
+// Options configures a Spool
+type Options struct {
+	Dir          string
+	SegmentBytes int64          // Roll to a new segment after this many bytes
+	MaxBytes     int64          // Total size cap across all segments (0 = unlimited)
+	Overflow     OverflowPolicy // Behaviour when MaxBytes would be exceeded
+	Fsync        bool           // fsync after every append
+}
+
+// Record is a single spooled payload with its sequence number
+type Record struct {
+	Seq  uint64
+	Data []byte
+}
+
+// segment is one append-only file holding records [firstSeq, nextSeq).
+// Acks are appended to a sidecar file, so a restart replays only the
+// records that were never acknowledged.
+type segment struct {
+	path     string
+	firstSeq uint64
+	nextSeq  uint64
+	size     int64
+	acked    uint64
+	ackFile  *os.File // Opened on the first ack
+}
+
+func (s *segment) records() uint64 {
+	return s.nextSeq - s.firstSeq
+}
+
+// Spool is a disk-backed, append-only write-ahead log split into segments.
+// Records are acknowledged individually; a segment is deleted once every
+// record in it has been acknowledged and it is no longer being written.
+type Spool struct {
+	opts     Options
+	segments []*segment // Oldest first; the last one is active
+	active   *os.File
+	size     int64
+	dropped  uint64
+	mutex    sync.Mutex
+}
+
+// Open opens (or creates) a spool and returns the records left over from a
+// previous run, in append order, so the caller can replay them.
+func Open(opts Options) (*Spool, []Record, error) {
+	if opts.Dir == "" {
+		return nil, nil, fmt.Errorf("spool dir is required")
+	}
+	if opts.SegmentBytes <= 0 {
+		opts.SegmentBytes = 8 << 20
+	}
+	if opts.MaxBytes > 0 && opts.SegmentBytes > opts.MaxBytes/4 {
+		// Keep several segments under the cap so drop_oldest has something to drop
+		opts.SegmentBytes = opts.MaxBytes / 4
+	}
+	if opts.Overflow == "" {
+		opts.Overflow = OverflowReject
+	}
+	if opts.Overflow != OverflowReject && opts.Overflow != OverflowDropOldest {
+		return nil, nil, fmt.Errorf("unknown spool overflow policy: %s", opts.Overflow)
+	}
+
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, nil, fmt.Errorf("failed to create spool dir: %w", err)
+	}
+
+	s := &Spool{opts: opts}
+
+	replay, err := s.load()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Always start writing into a fresh segment so replayed ones stay immutable
+	next := uint64(1)
+	if n := len(s.segments); n > 0 {
+		next = s.segments[n-1].nextSeq
+	}
+	if err := s.roll(next); err != nil {
+		return nil, nil, err
+	}
+
+	return s, replay, nil
+}
+
+// load scans existing segments, truncating any torn tail from a crash
+func (s *Spool) load() ([]Record, error) {
+	paths, err := filepath.Glob(filepath.Join(s.opts.Dir, "*"+segmentExt))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list spool segments: %w", err)
+	}
+	sort.Strings(paths)
+
+	// Sidecars left behind by a crash between deleting a segment and its acks
+	sidecars, err := filepath.Glob(filepath.Join(s.opts.Dir, "*"+segmentExt+ackExt))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list spool acks: %w", err)
+	}
+	for _, sidecar := range sidecars {
+		if _, err := os.Stat(strings.TrimSuffix(sidecar, ackExt)); os.IsNotExist(err) {
+			os.Remove(sidecar)
+		}
+	}
+
+	var replay []Record
+	for _, path := range paths {
+		firstSeq, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), segmentExt), 10, 64)
+		if err != nil {
+			log.Printf("Ignoring unexpected file in spool: %s", path)
+			continue
+		}
+
+		records, validSize, err := readSegment(path, firstSeq)
+		if err != nil {
+			return nil, err
+		}
+		acked, err := readAcks(path+ackExt, firstSeq, firstSeq+uint64(len(records)))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(records) == 0 || len(acked) == len(records) {
+			os.Remove(path)
+			os.Remove(path + ackExt)
+			continue
+		}
+
+		if info, err := os.Stat(path); err == nil && info.Size() > validSize {
+			log.Printf("Truncating torn tail of spool segment %s at %d bytes", path, validSize)
+			if err := os.Truncate(path, validSize); err != nil {
+				return nil, fmt.Errorf("failed to truncate spool segment: %w", err)
+			}
+		}
+
+		s.segments = append(s.segments, &segment{
+			path:     path,
+			firstSeq: firstSeq,
+			nextSeq:  firstSeq + uint64(len(records)),
+			size:     validSize,
+			acked:    uint64(len(acked)),
+		})
+		s.size += validSize
+		for _, record := range records {
+			if !acked[record.Seq] {
+				replay = append(replay, record)
+			}
+		}
+	}
+
+	return replay, nil
+}
+
+// readAcks returns the sequence numbers in [firstSeq, nextSeq) listed in
+// a segment's ack sidecar. A missing sidecar means nothing was acked, and
+// a torn last entry is ignored.
+func readAcks(path string, firstSeq, nextSeq uint64) (map[uint64]bool, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool acks: %w", err)
+	}
+
+	acked := make(map[uint64]bool)
+	for ; len(data) >= ackSize; data = data[ackSize:] {
+		seq := binary.LittleEndian.Uint64(data)
+		if seq >= firstSeq && seq < nextSeq {
+			acked[seq] = true
+		}
+	}
+	return acked, nil
+}
+
+// readSegment returns every intact record in a segment and the byte offset
+// just past the last one
+func readSegment(path string, firstSeq uint64) ([]Record, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open spool segment: %w", err)
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	var records []Record
+	var offset int64
+	header := make([]byte, headerSize)
+
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			break
+		}
+		length := binary.LittleEndian.Uint32(header[0:4])
+		checksum := binary.LittleEndian.Uint32(header[4:8])
+		if length > maxRecordLen {
+			break
+		}
+
+		data := make([]byte, length)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(data) != checksum {
+			break
+		}
+
+		records = append(records, Record{Seq: firstSeq + uint64(len(records)), Data: data})
+		offset += headerSize + int64(length)
+	}
+
+	return records, offset, nil
+}
+
+// Append durably writes a record and returns its sequence number
+func (s *Spool) Append(data []byte) (uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.active == nil {
+		return 0, fmt.Errorf("spool closed")
+	}
+
+	recordSize := int64(headerSize + len(data))
+	if s.opts.MaxBytes > 0 && s.size+recordSize > s.opts.MaxBytes {
+		if s.opts.Overflow != OverflowDropOldest || !s.dropOldest(recordSize) {
+			return 0, ErrFull
+		}
+	}
+
+	current := s.segments[len(s.segments)-1]
+	if current.size > 0 && current.size+recordSize > s.opts.SegmentBytes {
+		if err := s.roll(current.nextSeq); err != nil {
+			return 0, err
+		}
+		current = s.segments[len(s.segments)-1]
+	}
+
+	frame := make([]byte, recordSize)
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(len(data)))
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(data))
+	copy(frame[headerSize:], data)
+
+	if _, err := s.active.Write(frame); err != nil {
+		return 0, fmt.Errorf("failed to write spool record: %w", err)
+	}
+	if s.opts.Fsync {
+		if err := s.active.Sync(); err != nil {
+			return 0, fmt.Errorf("failed to sync spool: %w", err)
+		}
+	}
+
+	seq := current.nextSeq
+	current.nextSeq++
+	current.size += recordSize
+	s.size += recordSize
+	return seq, nil
+}
+
+// Ack marks a record as delivered. Fully acknowledged segments other than
+// the active one are deleted; otherwise the ack is recorded in the
+// segment's sidecar so the record isn't replayed after a restart.
+func (s *Spool) Ack(seq uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i, seg := range s.segments {
+		if seq < seg.firstSeq || seq >= seg.nextSeq {
+			continue
+		}
+
+		seg.acked++
+		if seg.acked >= seg.records() && i < len(s.segments)-1 {
+			s.removeSegment(i)
+			return
+		}
+		if err := s.writeAck(seg, seq); err != nil {
+			// The record is replayed again after a restart; at-least-once still holds
+			log.Printf("Failed to record spool ack %d: %v", seq, err)
+		}
+		return
+	}
+}
+
+// writeAck appends seq to a segment's ack sidecar; callers hold the lock
+func (s *Spool) writeAck(seg *segment, seq uint64) error {
+	if seg.ackFile == nil {
+		f, err := os.OpenFile(seg.path+ackExt, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		seg.ackFile = f
+	}
+
+	entry := make([]byte, ackSize)
+	binary.LittleEndian.PutUint64(entry, seq)
+	if _, err := seg.ackFile.Write(entry); err != nil {
+		return err
+	}
+	if s.opts.Fsync {
+		return seg.ackFile.Sync()
+	}
+	return nil
+}
+
+// dropOldest deletes sealed segments until need bytes fit; callers hold the lock
+func (s *Spool) dropOldest(need int64) bool {
+	for s.size+need > s.opts.MaxBytes && len(s.segments) > 1 {
+		seg := s.segments[0]
+		lost := seg.records() - seg.acked
+		s.dropped += lost
+		log.Printf("Spool full, dropping segment %s with %d undelivered records", seg.path, lost)
+		s.removeSegment(0)
+	}
+	return s.size+need <= s.opts.MaxBytes
+}
+
+// removeSegment deletes the segment at index i; callers hold the lock
+func (s *Spool) removeSegment(i int) {
+	seg := s.segments[i]
+	if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove spool segment %s: %v", seg.path, err)
+	}
+	seg.closeAcks()
+	os.Remove(seg.path + ackExt)
+	s.size -= seg.size
+	s.segments = append(s.segments[:i], s.segments[i+1:]...)
+}
+
+// roll seals the active segment and starts a new one at firstSeq
+func (s *Spool) roll(firstSeq uint64) error {
+	if s.active != nil {
+		if err := s.active.Close(); err != nil {
+			return fmt.Errorf("failed to close spool segment: %w", err)
+		}
+
+		// The sealed segment may already be fully acknowledged
+		last := len(s.segments) - 1
+		if seg := s.segments[last]; seg.acked >= seg.records() {
+			s.removeSegment(last)
+		}
+	}
+
+	path := filepath.Join(s.opts.Dir, fmt.Sprintf("%020d%s", firstSeq, segmentExt))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create spool segment: %w", err)
+	}
+
+	s.active = f
+	s.segments = append(s.segments, &segment{
+		path:     path,
+		firstSeq: firstSeq,
+		nextSeq:  firstSeq,
+	})
+	return nil
+}
+
+// FirstSeq returns the lowest sequence number still retained on disk
+func (s *Spool) FirstSeq() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.segments) == 0 {
+		return 0
+	}
+	return s.segments[0].firstSeq
+}
+
+// Size returns the number of bytes currently spooled
+func (s *Spool) Size() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.size
+}
+
+// Dropped returns how many undelivered records were discarded by overflow
+func (s *Spool) Dropped() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.dropped
+}
+
+// Close flushes and closes the active segment. Unacknowledged records are
+// kept on disk and returned by the next Open.
+func (s *Spool) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.active == nil {
+		return nil
+	}
+
+	err := s.active.Close()
+	s.active = nil
+
+	// Don't leave an empty trailing segment behind
+	last := s.segments[len(s.segments)-1]
+	if last.records() == 0 || last.acked >= last.records() {
+		s.removeSegment(len(s.segments) - 1)
+	}
+	for _, seg := range s.segments {
+		seg.closeAcks()
+	}
+	return err
+}
+
+func (seg *segment) closeAcks() {
+	if seg.ackFile != nil {
+		seg.ackFile.Close()
+		seg.ackFile = nil
+	}
+}
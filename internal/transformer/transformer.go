@@ -2,15 +2,18 @@ package transformer
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/tabular/relay/pkg/types"
 )
 
-// Transformer converts StreamPackets to SpatialEvents
+// Transformer converts StreamPackets to SpatialEvents. It is safe for use
+// by concurrent pipeline workers.
 type Transformer struct {
 	// Track anchors for generating consistent IDs
+	mutex     sync.RWMutex
 	anchorMap map[string]string // sessionID -> anchorID mapping
 }
 
@@ -80,6 +83,8 @@ func (t *Transformer) transformMesh(event *types.SpatialEvent, packet types.Stre
 		VerticesDelta: mesh.Vertices,
 		FacesDelta:    mesh.Faces,
 		IsDelta:       false, // Full mesh initially
+		IndexFormat:   mesh.IndexFormat,
+		Decoded:       mesh.Decoded,
 	}
 
 	event.Meshes = append(event.Meshes, meshDiff)
@@ -88,12 +93,21 @@ func (t *Transformer) transformMesh(event *types.SpatialEvent, packet types.Stre
 
 // getOrCreateAnchorID generates or retrieves an anchor ID for a session
 func (t *Transformer) getOrCreateAnchorID(sessionID string) string {
+	t.mutex.RLock()
+	anchorID, exists := t.anchorMap[sessionID]
+	t.mutex.RUnlock()
+	if exists {
+		return anchorID
+	}
+	
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
 	if anchorID, exists := t.anchorMap[sessionID]; exists {
 		return anchorID
 	}
 	
 	// Generate new anchor ID
-	anchorID := "anchor_" + uuid.New().String()
+	anchorID = "anchor_" + uuid.New().String()
 	t.anchorMap[sessionID] = anchorID
 	return anchorID
 }
@@ -131,13 +145,22 @@ func (t *Transformer) ValidateEvent(event *types.SpatialEvent) error {
 
 // GetStats returns transformer statistics
 func (t *Transformer) GetStats() map[string]interface{} {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	
+	anchors := make(map[string]string, len(t.anchorMap))
+	for sessionID, anchorID := range t.anchorMap {
+		anchors[sessionID] = anchorID
+	}
 	return map[string]interface{}{
-		"active_sessions": len(t.anchorMap),
-		"anchor_mappings": t.anchorMap,
+		"active_sessions": len(anchors),
+		"anchor_mappings": anchors,
 	}
 }
 
 // ClearStaleSession removes old session mappings
 func (t *Transformer) ClearStaleSession(sessionID string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
 	delete(t.anchorMap, sessionID)
 }
\ No newline at end of file
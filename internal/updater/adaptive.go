@@ -0,0 +1,112 @@
+package updater
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Batch window decisions
+const (
+	WindowGrow   = "grow"
+	WindowShrink = "shrink"
+	WindowHold   = "hold"
+)
+
+// AdaptiveBatching tunes each sink's batch window from the latency and
+// error rate of its requests. A slow or failing sink gets fewer, larger
+// batches; a fast healthy one gets smaller batches sent sooner. The batch
+// size scales with the timeout, from the route's configured pair.
+type AdaptiveBatching struct {
+	MinTimeout    time.Duration // Default 10ms
+	MaxTimeout    time.Duration // Default 2s
+	TargetLatency time.Duration // Grow above it, shrink below half of it (default 250ms)
+	MaxErrorRate  float64       // Grow above this share of failed requests (default 0.05)
+}
+
+func (a AdaptiveBatching) normalize() (AdaptiveBatching, error) {
+	if a.MinTimeout <= 0 {
+		a.MinTimeout = 10 * time.Millisecond
+	}
+	if a.MaxTimeout <= 0 {
+		a.MaxTimeout = 2 * time.Second
+	}
+	if a.TargetLatency <= 0 {
+		a.TargetLatency = 250 * time.Millisecond
+	}
+	if a.MaxErrorRate <= 0 {
+		a.MaxErrorRate = 0.05
+	}
+	if a.MinTimeout > a.MaxTimeout {
+		return a, fmt.Errorf("adaptive batching min timeout %v is above max timeout %v", a.MinTimeout, a.MaxTimeout)
+	}
+	return a, nil
+}
+
+// Smoothing of the latency and error rate averages, and how far one
+// decision moves the window
+const (
+	windowSmoothing = 0.3
+	windowGrowth    = 1.5
+	windowShrink    = 0.8
+)
+
+// batchWindow is the adaptive state of one route
+type batchWindow struct {
+	cfg         AdaptiveBatching
+	baseSize    int
+	baseTimeout time.Duration
+	timeout     time.Duration
+	latency     float64 // Moving average, seconds
+	errorRate   float64 // Moving average of failed requests
+	observed    bool
+}
+
+func newBatchWindow(cfg AdaptiveBatching, size int, timeout time.Duration) *batchWindow {
+	return &batchWindow{
+		cfg:         cfg,
+		baseSize:    size,
+		baseTimeout: timeout,
+		timeout:     min(max(timeout, cfg.MinTimeout), cfg.MaxTimeout),
+	}
+}
+
+// observe records a request and moves the window
+func (w *batchWindow) observe(latency time.Duration, failed bool) string {
+	failure := 0.0
+	if failed {
+		failure = 1
+	}
+	if !w.observed {
+		w.latency, w.errorRate, w.observed = latency.Seconds(), failure, true
+	} else {
+		w.latency += windowSmoothing * (latency.Seconds() - w.latency)
+		w.errorRate += windowSmoothing * (failure - w.errorRate)
+	}
+
+	target := w.cfg.TargetLatency.Seconds()
+	next := w.timeout
+	switch {
+	case w.errorRate > w.cfg.MaxErrorRate || w.latency > target:
+		next = time.Duration(float64(w.timeout) * windowGrowth)
+	case w.latency < target/2:
+		next = time.Duration(float64(w.timeout) * windowShrink)
+	}
+	next = min(max(next, w.cfg.MinTimeout), w.cfg.MaxTimeout)
+
+	decision := WindowHold
+	switch {
+	case next > w.timeout:
+		decision = WindowGrow
+	case next < w.timeout:
+		decision = WindowShrink
+	}
+	w.timeout = next
+	return decision
+}
+
+// size returns the batch size for the current timeout
+func (w *batchWindow) size() int {
+	scaled := float64(w.baseSize) * float64(w.timeout) / float64(w.baseTimeout)
+	return max(1, int(math.Round(scaled)))
+}
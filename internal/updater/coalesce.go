@@ -0,0 +1,180 @@
+package updater
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/tabular/relay/pkg/types"
+)
+
+// Coalescing modes
+const (
+	CoalesceNone   = "none"
+	CoalesceLatest = "latest"    // Keep each anchor's last pose in a batch
+	CoalesceEveryN = "every_nth" // Keep every Nth pose of each anchor
+	CoalesceMotion = "motion"    // Keep poses that moved far enough from the last one kept
+)
+
+// CoalescePolicy thins out the poses a sink receives. It applies to each
+// batch as it is taken for delivery, so with "latest" the batch window is
+// the coalescing window. Only pose events are coalesced; an event carrying
+// a mesh is always sent whole.
+type CoalescePolicy struct {
+	Mode        string  // Empty or "none" sends every pose
+	EveryN      int     // every_nth: keep one pose in this many (default 3)
+	MinDistance float64 // motion: meters moved to keep a pose (default 0.01)
+	MinAngle    float64 // motion: degrees turned to keep a pose (default 1)
+}
+
+func (p CoalescePolicy) normalize() (CoalescePolicy, error) {
+	if p.Mode == "" {
+		p.Mode = CoalesceNone
+	}
+	if p.EveryN <= 0 {
+		p.EveryN = 3
+	}
+	if p.MinDistance <= 0 {
+		p.MinDistance = 0.01
+	}
+	if p.MinAngle <= 0 {
+		p.MinAngle = 1
+	}
+	switch p.Mode {
+	case CoalesceNone, CoalesceLatest, CoalesceEveryN, CoalesceMotion:
+		return p, nil
+	}
+	return p, fmt.Errorf("unknown coalesce mode: %s", p.Mode)
+}
+
+// anchorKey identifies an anchor within its session
+type anchorKey struct {
+	session string
+	anchor  string
+}
+
+// coalescer applies a CoalescePolicy, remembering what it kept of each
+// anchor across batches
+type coalescer struct {
+	policy CoalescePolicy
+	mutex  sync.Mutex
+	seen   map[anchorKey]int            // every_nth: poses since the last one kept
+	kept   map[anchorKey]types.PoseData // motion: last pose kept
+}
+
+func newCoalescer(policy CoalescePolicy) *coalescer {
+	return &coalescer{
+		policy: policy,
+		seen:   make(map[anchorKey]int),
+		kept:   make(map[anchorKey]types.PoseData),
+	}
+}
+
+// apply returns the events of a batch left after coalescing, and the
+// number of poses dropped. Events left without poses are dropped.
+func (c *coalescer) apply(events []types.SpatialEvent) ([]types.SpatialEvent, int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Where each anchor's last pose in the batch is
+	var last map[anchorKey]int
+	if c.policy.Mode == CoalesceLatest {
+		last = make(map[anchorKey]int)
+		for i, event := range events {
+			if !poseOnly(event) {
+				continue
+			}
+			for _, anchor := range event.Anchors {
+				last[anchorKey{event.SessionID, anchor.ID}] = i
+			}
+		}
+	}
+
+	kept := make([]types.SpatialEvent, 0, len(events))
+	dropped := 0
+	for i, event := range events {
+		if !poseOnly(event) {
+			kept = append(kept, event)
+			continue
+		}
+
+		// Events are shared between sinks, so filter into a new slice
+		anchors := make([]types.Anchor, 0, len(event.Anchors))
+		for _, anchor := range event.Anchors {
+			key := anchorKey{event.SessionID, anchor.ID}
+			if c.keep(key, anchor.Pose, i, last) {
+				anchors = append(anchors, anchor)
+			} else {
+				dropped++
+			}
+		}
+		if len(anchors) == 0 {
+			continue
+		}
+		event.Anchors = anchors
+		kept = append(kept, event)
+	}
+	return kept, dropped
+}
+
+// keep decides whether a pose of the event at index i is sent
+func (c *coalescer) keep(key anchorKey, pose types.PoseData, i int, last map[anchorKey]int) bool {
+	switch c.policy.Mode {
+	case CoalesceLatest:
+		return last[key] == i
+	case CoalesceEveryN:
+		n := c.seen[key]
+		c.seen[key] = (n + 1) % c.policy.EveryN
+		return n == 0
+	case CoalesceMotion:
+		prev, ok := c.kept[key]
+		if ok && !c.moved(prev, pose) {
+			return false
+		}
+		c.kept[key] = pose
+		return true
+	}
+	return true
+}
+
+// moved reports whether a pose is far enough from prev to be worth sending
+func (c *coalescer) moved(prev, pose types.PoseData) bool {
+	dx, dy, dz := pose.X-prev.X, pose.Y-prev.Y, pose.Z-prev.Z
+	if math.Sqrt(dx*dx+dy*dy+dz*dz) >= c.policy.MinDistance {
+		return true
+	}
+	return rotationDegrees(prev.Rotation, pose.Rotation) >= c.policy.MinAngle
+}
+
+// rotationDegrees returns the angle between two orientations
+func rotationDegrees(a, b [4]float64) float64 {
+	na := math.Sqrt(a[0]*a[0] + a[1]*a[1] + a[2]*a[2] + a[3]*a[3])
+	nb := math.Sqrt(b[0]*b[0] + b[1]*b[1] + b[2]*b[2] + b[3]*b[3])
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	dot := math.Abs(a[0]*b[0]+a[1]*b[1]+a[2]*b[2]+a[3]*b[3]) / (na * nb)
+	return 2 * math.Acos(math.Min(dot, 1)) * 180 / math.Pi
+}
+
+// endSession forgets the anchors of a session
+func (c *coalescer) endSession(sessionID string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for key := range c.seen {
+		if key.session == sessionID {
+			delete(c.seen, key)
+		}
+	}
+	for key := range c.kept {
+		if key.session == sessionID {
+			delete(c.kept, key)
+		}
+	}
+}
+
+// poseOnly reports whether an event carries poses and nothing else
+func poseOnly(event types.SpatialEvent) bool {
+	return len(event.Anchors) > 0 && len(event.Meshes) == 0
+}
@@ -0,0 +1,226 @@
+package updater
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tabular/relay/pkg/types"
+)
+
+var (
+	// ErrDeadLetterNotFound is returned for an id the store doesn't hold
+	ErrDeadLetterNotFound = errors.New("dead letter not found")
+	// ErrRedriveInProgress is returned when claiming a dead letter that is
+	// already being redriven
+	ErrRedriveInProgress = errors.New("dead letter redrive already in progress")
+)
+
+// DeadLetter is a batch that exhausted its delivery attempts
+type DeadLetter struct {
+	ID           string               `json:"id"`
+	Sink         string               `json:"sink,omitempty"` // Route the batch failed on
+	Events       []types.SpatialEvent `json:"events"`
+	Attempts     int                  `json:"attempts"`
+	LastError    string               `json:"last_error"`
+	FirstFailure time.Time            `json:"first_failure"`
+	LastFailure  time.Time            `json:"last_failure"`
+}
+
+// DeadLetterStore keeps failed batches for inspection and redelivery.
+// When dir is empty entries live in memory only; otherwise each entry is
+// persisted as <dir>/<id>.json and reloaded on startup.
+type DeadLetterStore struct {
+	dir      string
+	entries  map[string]*DeadLetter
+	inFlight map[string]bool // Entries claimed for redrive
+	mutex    sync.RWMutex
+}
+
+// NewDeadLetterStore opens a dead-letter store, loading any persisted entries
+func NewDeadLetterStore(dir string) (*DeadLetterStore, error) {
+	s := &DeadLetterStore{
+		dir:      dir,
+		entries:  make(map[string]*DeadLetter),
+		inFlight: make(map[string]bool),
+	}
+
+	if dir == "" {
+		return s, nil
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create dead-letter dir: %w", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list dead letters: %w", err)
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read dead letter %s: %w", file, err)
+		}
+
+		var entry DeadLetter
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return nil, fmt.Errorf("corrupt dead letter %s: %w", file, err)
+		}
+		s.entries[entry.ID] = &entry
+	}
+
+	return s, nil
+}
+
+// Put stores a new dead letter for a sink and returns it
+func (s *DeadLetterStore) Put(sinkName string, events []types.SpatialEvent, attempts int, lastErr error, firstFailure time.Time) (*DeadLetter, error) {
+	entry := &DeadLetter{
+		ID:           uuid.New().String(),
+		Sink:         sinkName,
+		Events:       events,
+		Attempts:     attempts,
+		FirstFailure: firstFailure,
+		LastFailure:  time.Now(),
+	}
+	if lastErr != nil {
+		entry.LastError = lastErr.Error()
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.persist(entry); err != nil {
+		return nil, err
+	}
+	s.entries[entry.ID] = entry
+	return entry, nil
+}
+
+// Get returns a copy of a single dead letter
+func (s *DeadLetterStore) Get(id string) (DeadLetter, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	entry, ok := s.entries[id]
+	if !ok {
+		return DeadLetter{}, false
+	}
+	return *entry, true
+}
+
+// List returns all dead letters, oldest first
+func (s *DeadLetterStore) List() []DeadLetter {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	list := make([]DeadLetter, 0, len(s.entries))
+	for _, entry := range s.entries {
+		list = append(list, *entry)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].FirstFailure.Before(list[j].FirstFailure)
+	})
+	return list
+}
+
+// Claim marks a dead letter as being redriven and returns a copy of it.
+// Only one claim on an entry can be held at a time; Release gives it up.
+func (s *DeadLetterStore) Claim(id string) (DeadLetter, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry, ok := s.entries[id]
+	if !ok {
+		return DeadLetter{}, fmt.Errorf("%w: %s", ErrDeadLetterNotFound, id)
+	}
+	if s.inFlight[id] {
+		return DeadLetter{}, fmt.Errorf("%w: %s", ErrRedriveInProgress, id)
+	}
+	s.inFlight[id] = true
+	return *entry, nil
+}
+
+// Release gives up a claim taken by Claim
+func (s *DeadLetterStore) Release(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.inFlight, id)
+}
+
+// Len returns the number of stored dead letters
+func (s *DeadLetterStore) Len() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return len(s.entries)
+}
+
+// RecordFailure updates an entry after another failed redelivery
+func (s *DeadLetterStore) RecordFailure(id string, err error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry, ok := s.entries[id]
+	if !ok {
+		return fmt.Errorf("dead letter %s not found", id)
+	}
+
+	entry.Attempts++
+	entry.LastFailure = time.Now()
+	if err != nil {
+		entry.LastError = err.Error()
+	}
+	return s.persist(entry)
+}
+
+// Remove deletes a dead letter, typically after successful redelivery
+func (s *DeadLetterStore) Remove(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.entries[id]; !ok {
+		return fmt.Errorf("dead letter %s not found", id)
+	}
+	delete(s.entries, id)
+
+	if s.dir == "" {
+		return nil
+	}
+	if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove dead letter %s: %w", id, err)
+	}
+	return nil
+}
+
+// persist writes an entry to disk atomically; callers hold the lock
+func (s *DeadLetterStore) persist(entry *DeadLetter) error {
+	if s.dir == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal dead letter: %w", err)
+	}
+
+	tmp := s.path(entry.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write dead letter: %w", err)
+	}
+	if err := os.Rename(tmp, s.path(entry.ID)); err != nil {
+		return fmt.Errorf("failed to commit dead letter: %w", err)
+	}
+	return nil
+}
+
+// path returns the on-disk location of an entry
+func (s *DeadLetterStore) path(id string) string {
+	return filepath.Join(s.dir, filepath.Base(id)+".json")
+}
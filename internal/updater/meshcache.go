@@ -0,0 +1,176 @@
+package updater
+
+import (
+	"container/list"
+	"time"
+)
+
+// Mesh cache eviction reasons, used as metric labels
+const (
+	evictCapacity   = "capacity"
+	evictIdle       = "idle"
+	evictSessionEnd = "session_end"
+)
+
+// meshBaselineOverhead approximates the bookkeeping cost of one cache entry
+const meshBaselineOverhead = 256
+
+// meshCache holds diff baselines within a byte budget. The least recently
+// used baselines are evicted first, and any not used for idleTTL are dropped
+// by evictIdle. An evicted anchor's next update goes out as a keyframe.
+// The last version sent for each anchor outlives its baseline, so that
+// keyframe carries on the anchor's version count instead of restarting it.
+// meshCache is not safe for concurrent use; the Updater guards it with
+// meshMutex.
+type meshCache struct {
+	maxBytes int64
+	idleTTL  time.Duration
+	bytes    int64
+	entries  map[string]*list.Element // anchorID -> element holding *meshCacheEntry
+	versions map[string]uint64        // anchorID -> last version sent, kept on eviction
+	order    *list.List               // Most recently used at the front
+	onEvict  func(reason string)      // Optional
+}
+
+type meshCacheEntry struct {
+	anchorID  string
+	sessionID string
+	baseline  *meshBaseline
+	size      int64
+	lastUsed  time.Time
+}
+
+func newMeshCache(maxBytes int64, idleTTL time.Duration) *meshCache {
+	return &meshCache{
+		maxBytes: maxBytes,
+		idleTTL:  idleTTL,
+		entries:  make(map[string]*list.Element),
+		versions: make(map[string]uint64),
+		order:    list.New(),
+	}
+}
+
+// get returns an anchor's baseline and marks it used. Baselines idle for
+// longer than idleTTL are evicted instead of returned.
+func (c *meshCache) get(anchorID string, now time.Time) (*meshBaseline, bool) {
+	elem, exists := c.entries[anchorID]
+	if !exists {
+		return nil, false
+	}
+
+	entry := elem.Value.(*meshCacheEntry)
+	if now.Sub(entry.lastUsed) > c.idleTTL {
+		c.evict(elem, evictIdle)
+		return nil, false
+	}
+
+	entry.lastUsed = now
+	c.order.MoveToFront(elem)
+	return entry.baseline, true
+}
+
+// peek returns an anchor's baseline without marking it used
+func (c *meshCache) peek(anchorID string) (*meshBaseline, bool) {
+	elem, exists := c.entries[anchorID]
+	if !exists {
+		return nil, false
+	}
+	return elem.Value.(*meshCacheEntry).baseline, true
+}
+
+// version returns the last version sent for an anchor, whether or not its
+// baseline is still cached, or 0 if none was
+func (c *meshCache) version(anchorID string) uint64 {
+	return c.versions[anchorID]
+}
+
+// setVersion records a version sent for an anchor outside the cache, such
+// as a client delta passed through; versions never go backwards
+func (c *meshCache) setVersion(anchorID string, version uint64) {
+	if version > c.versions[anchorID] {
+		c.versions[anchorID] = version
+	}
+}
+
+// put stores an anchor's baseline, evicting least recently used ones until
+// the cache fits its budget
+func (c *meshCache) put(anchorID, sessionID string, baseline *meshBaseline, now time.Time) {
+	if elem, exists := c.entries[anchorID]; exists {
+		c.remove(elem)
+	}
+
+	entry := &meshCacheEntry{
+		anchorID:  anchorID,
+		sessionID: sessionID,
+		baseline:  baseline,
+		size:      int64(len(baseline.vertices)+len(baseline.faces)) + meshBaselineOverhead,
+		lastUsed:  now,
+	}
+	c.entries[anchorID] = c.order.PushFront(entry)
+	c.bytes += entry.size
+	c.setVersion(anchorID, baseline.version)
+
+	// A baseline larger than the whole budget evicts itself last
+	for c.bytes > c.maxBytes && c.order.Len() > 0 {
+		c.evict(c.order.Back(), evictCapacity)
+	}
+}
+
+// delete drops an anchor's baseline without counting it as an eviction.
+// Its version is kept.
+func (c *meshCache) delete(anchorID string) {
+	if elem, exists := c.entries[anchorID]; exists {
+		c.remove(elem)
+	}
+}
+
+// evictIdle drops every baseline unused for longer than idleTTL
+func (c *meshCache) evictIdle(now time.Time) int {
+	evicted := 0
+	for elem := c.order.Back(); elem != nil; {
+		entry := elem.Value.(*meshCacheEntry)
+		if now.Sub(entry.lastUsed) <= c.idleTTL {
+			break // Everything closer to the front was used more recently
+		}
+		prev := elem.Prev()
+		c.evict(elem, evictIdle)
+		elem = prev
+		evicted++
+	}
+	return evicted
+}
+
+// evictSession drops every baseline belonging to a session
+func (c *meshCache) evictSession(sessionID string) int {
+	evicted := 0
+	for elem := c.order.Front(); elem != nil; {
+		next := elem.Next()
+		if elem.Value.(*meshCacheEntry).sessionID == sessionID {
+			c.evict(elem, evictSessionEnd)
+			evicted++
+		}
+		elem = next
+	}
+	return evicted
+}
+
+func (c *meshCache) len() int {
+	return len(c.entries)
+}
+
+func (c *meshCache) size() int64 {
+	return c.bytes
+}
+
+func (c *meshCache) evict(elem *list.Element, reason string) {
+	c.remove(elem)
+	if c.onEvict != nil {
+		c.onEvict(reason)
+	}
+}
+
+func (c *meshCache) remove(elem *list.Element) {
+	entry := c.order.Remove(elem).(*meshCacheEntry)
+	delete(c.entries, entry.anchorID)
+	c.bytes -= entry.size
+}
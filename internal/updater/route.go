@@ -0,0 +1,561 @@
+package updater
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tabular/relay/pkg/client"
+	"github.com/tabular/relay/pkg/sink"
+	"github.com/tabular/relay/pkg/types"
+)
+
+// Route sends the events matching Filter to a Sink with its own batching,
+// retries and dead letters
+type Route struct {
+	Name         string // Defaults to Sink.Name(); must be unique
+	Sink         sink.Sink
+	BatchSize    int               // 0 uses the updater's batch size
+	BatchTimeout time.Duration     // 0 uses the updater's batch timeout
+	BatchBytes   int               // 0 uses Options.BatchBytes
+	Retry        *sink.RetryPolicy // Nil uses Options.Retry
+	Coalesce     *CoalescePolicy   // Nil uses Options.Coalesce
+	Filter       Filter
+}
+
+// Filter selects the events a route receives
+type Filter struct {
+	Types []string // "pose" and/or "mesh"; empty matches every event
+}
+
+// Match reports whether an event passes the filter
+func (f Filter) Match(event types.SpatialEvent) bool {
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, eventType := range f.Types {
+		switch eventType {
+		case "pose":
+			if len(event.Anchors) > 0 {
+				return true
+			}
+		case "mesh":
+			if len(event.Meshes) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (f Filter) validate() error {
+	for _, eventType := range f.Types {
+		if eventType != "pose" && eventType != "mesh" {
+			return fmt.Errorf("unknown event type in filter: %s", eventType)
+		}
+	}
+	return nil
+}
+
+// route is a running Route
+type route struct {
+	name         string
+	sink         sink.Sink
+	batchSize    int // Moved with batchTimeout by window
+	batchTimeout time.Duration
+	batchBytes   int          // Serialized bytes per batch; 0 for no limit
+	window       *batchWindow // Nil unless batching is adaptive
+	retryPolicy  sink.RetryPolicy
+	filter       Filter
+	legacyStag   bool       // Also report the relay_stag_* metrics
+	coalescer    *coalescer // Nil unless poses are coalesced
+	coalesced    atomic.Uint64
+
+	queue       []queuedEvent
+	queuedBytes int
+	maxQueued   int           // Events queued before ProcessEvent waits
+	room        chan struct{} // Closed and replaced when queued events are taken
+	mutex       sync.Mutex
+	flushC      chan struct{}
+
+	inFlight chan struct{} // One slot per batch being delivered
+	flights  sync.WaitGroup
+}
+
+// sendFailure is an event a sink did not accept
+type sendFailure struct {
+	event types.SpatialEvent
+	err   error
+}
+
+// newRoute validates a Route and fills in the updater's defaults
+func newRoute(cfg Route, batchSize int, batchTimeout time.Duration, retry sink.RetryPolicy, opts Options) (*route, error) {
+	if cfg.Sink == nil {
+		return nil, fmt.Errorf("route %q has no sink", cfg.Name)
+	}
+	if err := cfg.Filter.validate(); err != nil {
+		return nil, err
+	}
+
+	r := &route{
+		name:         cfg.Name,
+		sink:         cfg.Sink,
+		batchSize:    cfg.BatchSize,
+		batchTimeout: cfg.BatchTimeout,
+		batchBytes:   cfg.BatchBytes,
+		retryPolicy:  retry,
+		filter:       cfg.Filter,
+		maxQueued:    opts.MaxQueued,
+		room:         make(chan struct{}),
+		flushC:       make(chan struct{}, 1),
+		inFlight:     make(chan struct{}, opts.MaxInFlight),
+	}
+	if r.name == "" {
+		r.name = cfg.Sink.Name()
+	}
+	if r.batchSize <= 0 {
+		r.batchSize = batchSize
+	}
+	if r.batchTimeout <= 0 {
+		r.batchTimeout = batchTimeout
+	}
+	if r.batchBytes <= 0 {
+		r.batchBytes = opts.BatchBytes
+	}
+	if opts.Adaptive != nil {
+		r.window = newBatchWindow(*opts.Adaptive, r.batchSize, r.batchTimeout)
+		r.batchTimeout = r.window.timeout
+		r.batchSize = r.window.size()
+	}
+	if cfg.Retry != nil {
+		r.retryPolicy = cfg.Retry.Normalize()
+	}
+	coalesce := opts.Coalesce
+	if cfg.Coalesce != nil {
+		coalesce = *cfg.Coalesce
+	}
+	coalesce, err := coalesce.normalize()
+	if err != nil {
+		return nil, fmt.Errorf("sink %s: %w", r.name, err)
+	}
+	if coalesce.Mode != CoalesceNone {
+		r.coalescer = newCoalescer(coalesce)
+	}
+	_, r.legacyStag = cfg.Sink.(*client.StagClient)
+
+	return r, nil
+}
+
+// enqueue adds an event and signals a flush once a batch is full
+func (r *route) enqueue(queued queuedEvent) {
+	r.mutex.Lock()
+	r.queue = append(r.queue, queued)
+	r.queuedBytes += queued.size
+	full := len(r.queue) >= r.batchSize || (r.batchBytes > 0 && r.queuedBytes >= r.batchBytes)
+	r.mutex.Unlock()
+
+	if full {
+		select {
+		case r.flushC <- struct{}{}:
+		default:
+			// A flush is already pending
+		}
+	}
+}
+
+// waitRoom blocks while the route has maxQueued events waiting and
+// returns how long it blocked, or false if stop was closed first
+func (r *route) waitRoom(stop <-chan struct{}) (time.Duration, bool) {
+	var start time.Time
+	for {
+		r.mutex.Lock()
+		if len(r.queue) < r.maxQueued {
+			r.mutex.Unlock()
+			if start.IsZero() {
+				return 0, true
+			}
+			return time.Since(start), true
+		}
+		room := r.room
+		r.mutex.Unlock()
+
+		if start.IsZero() {
+			start = time.Now()
+		}
+		select {
+		case <-room:
+		case <-stop:
+			return time.Since(start), false
+		}
+	}
+}
+
+// freed wakes everything waiting for room; callers hold mutex
+func (r *route) freed() {
+	close(r.room)
+	r.room = make(chan struct{})
+}
+
+// take removes and returns up to a batch of the oldest queued events,
+// with the limit that ended the batch: "count", "bytes", or "timeout" if
+// it took everything queued. A batch holds at least one event, however
+// large.
+func (r *route) take() ([]queuedEvent, string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if len(r.queue) == 0 {
+		return nil, ""
+	}
+	n, size := 0, 0
+	reason := "timeout"
+	for ; n < len(r.queue); n++ {
+		if n == r.batchSize {
+			reason = "count"
+			break
+		}
+		if r.batchBytes > 0 && n > 0 && size+r.queue[n].size > r.batchBytes {
+			reason = "bytes"
+			break
+		}
+		size += r.queue[n].size
+	}
+	batch := make([]queuedEvent, n)
+	copy(batch, r.queue)
+	r.queue = append(r.queue[:0], r.queue[n:]...)
+	r.queuedBytes -= size
+	r.freed()
+	return batch, reason
+}
+
+// observe feeds a request to the adaptive window and applies its decision
+func (r *route) observe(latency time.Duration, failed bool) (decision string, timeout time.Duration, size int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	decision = r.window.observe(latency, failed)
+	r.batchTimeout = r.window.timeout
+	r.batchSize = r.window.size()
+	return decision, r.batchTimeout, r.batchSize
+}
+
+// limits returns the current batch size and timeout
+func (r *route) limits() (int, time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.batchSize, r.batchTimeout
+}
+
+// dropBefore removes queued events the spool no longer holds and returns them
+func (r *route) dropBefore(seq uint64) []queuedEvent {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var dropped []queuedEvent
+	kept := r.queue[:0]
+	for _, queued := range r.queue {
+		if queued.seq >= seq {
+			kept = append(kept, queued)
+		} else {
+			dropped = append(dropped, queued)
+			r.queuedBytes -= queued.size
+		}
+	}
+	r.queue = kept
+	if len(dropped) > 0 {
+		r.freed()
+	}
+	return dropped
+}
+
+func (r *route) length() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.queue)
+}
+
+// runRoute handles periodic batch flushing for one route
+func (u *Updater) runRoute(r *route) {
+	defer u.wg.Done()
+
+	_, timeout := r.limits()
+	ticker := time.NewTicker(timeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			u.flushRoute(r)
+		case <-r.flushC:
+			u.flushRoute(r)
+		case <-u.stopC:
+			// Final flush before stopping
+			r.flights.Wait()
+			for batch, reason := r.take(); len(batch) > 0; batch, reason = r.take() {
+				u.recordFlush(r, batch, reason)
+				u.deliverQueued(r, batch)
+			}
+			u.updateRouteMetrics(r)
+			return
+		}
+
+		// Follow the adaptive window
+		if _, next := r.limits(); next != timeout {
+			timeout = next
+			ticker.Reset(timeout)
+		}
+	}
+}
+
+// flushRoute sends a route's queued events in batches, with up to
+// MaxInFlight batches being delivered at once. It waits for a free slot
+// before taking each batch, so a slow sink leaves events queued, where
+// they push back on ProcessEvent. With one slot, the default, events reach
+// the sink in the order they arrived.
+func (u *Updater) flushRoute(r *route) {
+	for {
+		select {
+		case r.inFlight <- struct{}{}:
+		case <-u.stopC:
+			return
+		}
+
+		batch, reason := r.take()
+		if len(batch) == 0 {
+			<-r.inFlight
+			return
+		}
+		u.recordFlush(r, batch, reason)
+		u.updateRouteMetrics(r)
+
+		r.flights.Add(1)
+		go func() {
+			defer r.flights.Done()
+			u.deliverQueued(r, batch)
+			<-r.inFlight
+			u.updateRouteMetrics(r)
+		}()
+	}
+}
+
+// deliverQueued coalesces and sends one batch and releases it from the
+// spool. Poses coalesced away are released with the rest of their batch.
+func (u *Updater) deliverQueued(r *route, batch []queuedEvent) {
+	events := make([]types.SpatialEvent, len(batch))
+	for i, queued := range batch {
+		events[i] = queued.event
+	}
+	if r.coalescer != nil {
+		var coalesced int
+		events, coalesced = r.coalescer.apply(events)
+		u.recordCoalesced(r, coalesced)
+		if len(events) == 0 {
+			u.release(batch)
+			return
+		}
+	}
+
+	// Spooled events stay on disk until every route has delivered or
+	// dead-lettered them
+	if u.deliverBatch(r, events) {
+		u.release(batch)
+	}
+}
+
+// deliverBatch sends a batch with retries, dead-lettering whatever still
+// fails. It returns false if the batch is neither delivered nor dead-lettered.
+func (u *Updater) deliverBatch(r *route, events []types.SpatialEvent) bool {
+	var firstFailure time.Time
+	var lastErr error
+	var rejected []types.SpatialEvent // Failures retrying can't fix
+
+	pending := events
+	attempt := 1
+	for ; attempt <= r.retryPolicy.MaxAttempts; attempt++ {
+		failures := u.send(r, pending)
+		if len(failures) == 0 {
+			pending = nil
+			break
+		}
+
+		if firstFailure.IsZero() {
+			firstFailure = time.Now()
+		}
+
+		pending = pending[:0:0]
+		for _, failure := range failures {
+			lastErr = failure.err
+			if sink.IsRetryable(failure.err) {
+				pending = append(pending, failure.event)
+			} else {
+				rejected = append(rejected, failure.event)
+			}
+		}
+		log.Printf("Failed to send %d of %d events to %s (attempt %d/%d): %v",
+			len(failures), len(events), r.name, attempt, r.retryPolicy.MaxAttempts, lastErr)
+
+		if len(pending) == 0 || attempt == r.retryPolicy.MaxAttempts {
+			break
+		}
+
+		// Wait before retrying, but don't hold up shutdown
+		delay := r.retryPolicy.RetryDelay(attempt, lastErr)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-u.stopC:
+			timer.Stop()
+			u.notifyDelivered(r, events, append(rejected, pending...))
+			if u.spool != nil {
+				// Leave it in the spool to be replayed on the next start
+				log.Printf("Shutting down with %d undelivered events for %s left in spool", len(pending), r.name)
+				return false
+			}
+			return u.deadLetter(r, append(rejected, pending...), attempt, lastErr, firstFailure)
+		}
+
+		if u.metrics != nil {
+			u.metrics.RecordSinkRetry(r.name)
+			if r.legacyStag {
+				u.metrics.RecordStagRetry()
+			}
+		}
+	}
+
+	failed := append(rejected, pending...)
+	u.notifyDelivered(r, events, failed)
+	if len(failed) == 0 {
+		return true
+	}
+	return u.deadLetter(r, failed, attempt, lastErr, firstFailure)
+}
+
+// notifyDelivered passes the events of a batch that were not in failed to
+// the OnDelivered hook
+func (u *Updater) notifyDelivered(r *route, events, failed []types.SpatialEvent) {
+	if u.onDelivered == nil {
+		return
+	}
+
+	delivered := events
+	if len(failed) > 0 {
+		skip := make(map[string]int, len(failed))
+		for _, event := range failed {
+			skip[event.EventID]++
+		}
+		delivered = make([]types.SpatialEvent, 0, len(events))
+		for _, event := range events {
+			if skip[event.EventID] > 0 {
+				skip[event.EventID]--
+				continue
+			}
+			delivered = append(delivered, event)
+		}
+	}
+	if len(delivered) > 0 {
+		u.onDelivered(r.name, delivered)
+	}
+}
+
+// send delivers events to a route's sink once and returns those it did not
+// accept
+func (u *Updater) send(r *route, events []types.SpatialEvent) []sendFailure {
+	if len(events) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	results, err := r.sink.Send(context.Background(), events)
+	if err == nil && len(results) != len(events) {
+		err = fmt.Errorf("%s returned %d results for %d events", r.name, len(results), len(events))
+	}
+
+	if resyncer, ok := r.sink.(sink.Resyncer); ok {
+		for _, anchorID := range resyncer.Resync() {
+			u.RequestKeyframe(anchorID)
+		}
+	}
+
+	var failures []sendFailure
+	if err != nil {
+		for _, event := range events {
+			failures = append(failures, sendFailure{event: event, err: err})
+		}
+	} else {
+		for i, result := range results {
+			if result.Err != nil {
+				failures = append(failures, sendFailure{event: events[i], err: result.Err})
+			}
+		}
+	}
+
+	u.recordSinkRequest(r, err, start)
+	if r.window != nil {
+		u.adaptWindow(r, time.Since(start), len(failures) > 0)
+	}
+	if len(failures) == 0 {
+		log.Printf("Successfully sent batch of %d events to %s", len(events), r.name)
+	}
+	return failures
+}
+
+// adaptWindow moves an adaptive route's batch window after a request
+func (u *Updater) adaptWindow(r *route, latency time.Duration, failed bool) {
+	decision, timeout, size := r.observe(latency, failed)
+	if decision != WindowHold {
+		log.Printf("Batch window for %s: %s to %v, %d events", r.name, decision, timeout, size)
+	}
+	if u.metrics != nil {
+		u.metrics.RecordBatchWindow(r.name, decision, timeout.Seconds(), size)
+	}
+}
+
+// recordCoalesced counts the poses a route dropped from a batch
+func (u *Updater) recordCoalesced(r *route, poses int) {
+	if poses == 0 {
+		return
+	}
+	r.coalesced.Add(uint64(poses))
+	if u.metrics != nil {
+		u.metrics.RecordCoalesced(r.name, r.coalescer.policy.Mode, poses)
+	}
+}
+
+// recordFlush reports a batch taken for delivery if metrics are enabled
+func (u *Updater) recordFlush(r *route, batch []queuedEvent, reason string) {
+	if u.metrics == nil {
+		return
+	}
+	size := 0
+	for _, queued := range batch {
+		size += queued.size
+	}
+	u.metrics.RecordBatchFlush(r.name, reason, size)
+}
+
+// recordSinkRequest reports a sink request outcome if metrics are enabled
+func (u *Updater) recordSinkRequest(r *route, err error, start time.Time) {
+	if u.metrics == nil {
+		return
+	}
+
+	status := "success"
+	if err != nil {
+		status = "error"
+		// Sinks wrap delivery errors with context
+		var de *sink.DeliveryError
+		if errors.As(err, &de) && de.StatusCode != 0 {
+			status = fmt.Sprintf("%d", de.StatusCode)
+		}
+	}
+
+	duration := time.Since(start).Seconds()
+	u.metrics.RecordSinkRequest(r.name, status, duration)
+	if r.legacyStag {
+		u.metrics.RecordStagRequest(status, duration)
+	}
+}
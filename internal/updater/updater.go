@@ -1,86 +1,440 @@
 package updater
 
 import (
-	"bytes"
-	"compress/gzip"
-	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"net/http"
 	"sync"
 	"time"
 
+	"github.com/tabular/relay/internal/metrics"
+	"github.com/tabular/relay/internal/spool"
+	"github.com/tabular/relay/pkg/client"
+	"github.com/tabular/relay/pkg/meshdelta"
+	"github.com/tabular/relay/pkg/sink"
 	"github.com/tabular/relay/pkg/types"
 )
 
-// Updater handles batching, diffing, and forwarding to STAG
+// Updater handles diffing, batching, and fan-out to sinks
 type Updater struct {
-	stagURL     string
-	httpClient  *http.Client
-	
-	// Batching
+	// Delivery routes, one per sink
+	routes       []*route
 	batchSize    int
 	batchTimeout time.Duration
-	eventQueue   []types.SpatialEvent
-	queueMutex   sync.Mutex
+	sizeEvents   bool // Some route limits batches by bytes
+	
+	// Write-ahead spool (nil when disabled)
+	spool        *spool.Spool
+	spoolDropped uint64         // Overflow drops already reported to metrics
+	pending      map[uint64]int // Spool seq -> routes yet to finish with it
+	queueMutex   sync.Mutex     // Guards spool appends and pending
 	
 	// Diffing state
-	lastMeshes   map[string][]byte // anchorID -> last mesh vertices
-	meshMutex    sync.RWMutex
+	meshes          *meshCache // anchorID -> last mesh sent
+	meshMutex       sync.RWMutex
+	vertexTolerance float32 // Per-axis distance under which a vertex is unchanged
+	maxDeltaRatio   float64 // Send a delta only if smaller than this share of the full buffer
+	keyframeInterval int           // Deltas allowed before a full keyframe is forced
+	keyframeMaxAge   time.Duration // Age after which the next update is a keyframe
 	
 	// Compression state (Draco encoder not available in this library)
 	compressionEnabled bool
 	
+	// Delivery
+	deadLetters  *DeadLetterStore
+	metrics      *metrics.Metrics
+	onDelivered  func(sinkName string, events []types.SpatialEvent)
+	
 	// Control
 	stopC        chan struct{}
 	wg           sync.WaitGroup
 }
 
+// meshBaseline is the last version of a mesh as a consumer will have
+// reconstructed it, used as the base for the next delta
+type meshBaseline struct {
+	vertices    []byte
+	faces       []byte
+	indexFormat string
+	decoded     bool // Plain buffers that later updates may be diffed against
+	
+	version       uint64    // Version of this mesh in the anchor's delta chain
+	deltas        int       // Deltas sent since the last keyframe
+	keyframeAt    time.Time // When the last keyframe was sent
+	forceKeyframe bool      // Send the next update in full (resync requested)
+}
+
+// queuedEvent is a processed event waiting for delivery, with its spool
+// sequence number when spooling is enabled
+type queuedEvent struct {
+	event types.SpatialEvent
+	seq   uint64
+	size  int // Serialized bytes, when spooling or a route limits bytes
+}
+
+// Options holds optional Updater settings
+type Options struct {
+	Sinks         []Route          // Empty sends everything to STAG at the updater's URL
+	Retry         sink.RetryPolicy // Default for routes without their own
+	DeadLetterDir string           // Empty keeps dead letters in memory only
+	Spool         *spool.Options   // Nil disables the write-ahead spool; needs DeadLetterDir
+	Metrics       *metrics.Metrics // Optional
+	
+	// Called with the events a sink accepted after each batch or redrive.
+	// It runs on the route's goroutine and must not block.
+	OnDelivered func(sinkName string, events []types.SpatialEvent)
+	
+	VertexTolerance float32 // Vertices that moved less than this on every axis count as unchanged
+	MaxDeltaRatio   float64 // Largest delta/full size ratio worth sending as a delta
+	
+	KeyframeInterval int           // Force a keyframe after this many consecutive deltas
+	KeyframeMaxAge   time.Duration // Force a keyframe once the last one is this old
+	
+	MeshCacheBytes int64         // Memory budget for diff baselines
+	MeshIdleTTL    time.Duration // Drop baselines of anchors not updated for this long
+	
+	// Backpressure: ProcessEvent waits while a sink has MaxQueued events
+	// waiting, and each sink delivers at most MaxInFlight batches at once
+	MaxQueued   int
+	MaxInFlight int
+	
+	BatchBytes int               // Default limit on a batch's serialized events; 0 for none
+	Adaptive   *AdaptiveBatching // Nil keeps every batch window fixed
+	
+	Coalesce CoalescePolicy // Default for routes without their own; zero sends every pose
+}
+
+// DefaultOptions returns the options used by New
+func DefaultOptions() Options {
+	return Options{
+		Retry:            sink.DefaultRetryPolicy(),
+		VertexTolerance:  0.001, // 1mm in meters
+		MaxDeltaRatio:    0.7,
+		KeyframeInterval: 30,
+		KeyframeMaxAge:   10 * time.Second,
+		MeshCacheBytes:   256 << 20,
+		MeshIdleTTL:      10 * time.Minute,
+		MaxQueued:        4096,
+		MaxInFlight:      1,
+	}
+}
+
 // New creates a new Updater instance
 func New(stagURL string, batchSize int, batchTimeout time.Duration) *Updater {
-	return &Updater{
-		stagURL:            stagURL,
-		httpClient:         &http.Client{Timeout: 10 * time.Second},
+	u, err := NewWithOptions(stagURL, batchSize, batchTimeout, DefaultOptions())
+	if err != nil {
+		// Only on-disk stores can fail, and the defaults don't use any
+		panic(err)
+	}
+	return u
+}
+
+// NewWithOptions creates a new Updater instance with explicit options.
+// stagURL is only used when opts.Sinks is empty.
+func NewWithOptions(stagURL string, batchSize int, batchTimeout time.Duration, opts Options) (*Updater, error) {
+	// Dead-lettered events leave the spool, so they must be on disk too
+	if opts.Spool != nil && opts.DeadLetterDir == "" {
+		return nil, fmt.Errorf("the spool needs a dead-letter dir, or dead-lettered events are lost on restart")
+	}
+	
+	deadLetters, err := NewDeadLetterStore(opts.DeadLetterDir)
+	if err != nil {
+		return nil, err
+	}
+	
+	if opts.VertexTolerance < 0 {
+		return nil, fmt.Errorf("vertex tolerance must not be negative")
+	}
+	if opts.MaxDeltaRatio <= 0 {
+		opts.MaxDeltaRatio = DefaultOptions().MaxDeltaRatio
+	}
+	if opts.KeyframeInterval <= 0 {
+		opts.KeyframeInterval = DefaultOptions().KeyframeInterval
+	}
+	if opts.KeyframeMaxAge <= 0 {
+		opts.KeyframeMaxAge = DefaultOptions().KeyframeMaxAge
+	}
+	if opts.MeshCacheBytes <= 0 {
+		opts.MeshCacheBytes = DefaultOptions().MeshCacheBytes
+	}
+	if opts.MeshIdleTTL <= 0 {
+		opts.MeshIdleTTL = DefaultOptions().MeshIdleTTL
+	}
+	if opts.MaxQueued <= 0 {
+		opts.MaxQueued = DefaultOptions().MaxQueued
+	}
+	if opts.MaxInFlight <= 0 {
+		opts.MaxInFlight = DefaultOptions().MaxInFlight
+	}
+	if opts.Adaptive != nil {
+		adaptive, err := opts.Adaptive.normalize()
+		if err != nil {
+			return nil, err
+		}
+		opts.Adaptive = &adaptive
+	}
+	
+	u := &Updater{
 		batchSize:          batchSize,
 		batchTimeout:       batchTimeout,
-		eventQueue:         make([]types.SpatialEvent, 0, batchSize),
-		lastMeshes:         make(map[string][]byte),
+		pending:            make(map[uint64]int),
+		meshes:             newMeshCache(opts.MeshCacheBytes, opts.MeshIdleTTL),
 		compressionEnabled: true, // Enable simple compression
+		vertexTolerance:    opts.VertexTolerance,
+		maxDeltaRatio:      opts.MaxDeltaRatio,
+		keyframeInterval:   opts.KeyframeInterval,
+		keyframeMaxAge:     opts.KeyframeMaxAge,
+		deadLetters:        deadLetters,
+		metrics:            opts.Metrics,
+		onDelivered:        opts.OnDelivered,
 		stopC:              make(chan struct{}),
 	}
+	
+	if u.metrics != nil {
+		u.metrics.UpdateDeadLetters(deadLetters.Len())
+		u.meshes.onEvict = u.metrics.RecordMeshEviction
+	}
+	
+	routes := opts.Sinks
+	if len(routes) == 0 {
+		routes = []Route{{Sink: client.NewStagClient(stagURL, "", 10*time.Second)}}
+	}
+	names := make(map[string]bool)
+	for _, cfg := range routes {
+		r, err := newRoute(cfg, batchSize, batchTimeout, opts.Retry.Normalize(), opts)
+		if err != nil {
+			return nil, err
+		}
+		if names[r.name] {
+			return nil, fmt.Errorf("duplicate sink name: %s", r.name)
+		}
+		names[r.name] = true
+		u.routes = append(u.routes, r)
+		u.sizeEvents = u.sizeEvents || r.batchBytes > 0
+	}
+	
+	if opts.Spool != nil {
+		if err := u.openSpool(*opts.Spool); err != nil {
+			return nil, err
+		}
+	}
+	
+	return u, nil
+}
+
+// openSpool opens the write-ahead spool and queues anything left from a
+// previous run ahead of new events
+func (u *Updater) openSpool(opts spool.Options) error {
+	sp, records, err := spool.Open(opts)
+	if err != nil {
+		return fmt.Errorf("failed to open spool: %w", err)
+	}
+	u.spool = sp
+	
+	u.queueMutex.Lock()
+	defer u.queueMutex.Unlock()
+	
+	replayed := 0
+	for _, record := range records {
+		var event types.SpatialEvent
+		if err := json.Unmarshal(record.Data, &event); err != nil {
+			log.Printf("Skipping unreadable spool record %d: %v", record.Seq, err)
+			sp.Ack(record.Seq)
+			continue
+		}
+		u.fanOut(queuedEvent{event: event, seq: record.Seq, size: len(record.Data)})
+		replayed++
+	}
+	
+	if len(records) > 0 {
+		log.Printf("Replaying %d spooled events from %s", replayed, opts.Dir)
+	}
+	u.updateSpoolMetrics()
+	return nil
 }
 
 // Start begins the updater operations
 func (u *Updater) Start() {
-	u.wg.Add(1)
-	go u.batchProcessor()
+	u.wg.Add(len(u.routes) + 1)
+	for _, r := range u.routes {
+		go u.runRoute(r)
+	}
+	go u.meshJanitor()
 }
 
 // Stop gracefully shuts down the updater
 func (u *Updater) Stop() {
 	close(u.stopC)
 	u.wg.Wait()
+	
+	for _, r := range u.routes {
+		if err := r.sink.Close(); err != nil {
+			log.Printf("Failed to close sink %s: %v", r.name, err)
+		}
+	}
+	
+	if u.spool != nil {
+		if err := u.spool.Close(); err != nil {
+			log.Printf("Failed to close spool: %v", err)
+		}
+	}
 }
 
-// ProcessEvent adds an event to the processing queue
+// ProcessEvent adds an event to the queue of every sink whose filter it
+// matches, first waiting while any of those queues is full. With spooling
+// enabled the event is on disk before ProcessEvent returns.
 func (u *Updater) ProcessEvent(event types.SpatialEvent) error {
-	// Apply diffing to meshes
-	processedEvent := u.applyMeshDiffing(event)
+	if err := u.waitForRoom(event); err != nil {
+		return err
+	}
+	
+	// Apply diffing to meshes, then compress once for every sink
+	processedEvent := u.compressEvent(u.applyMeshDiffing(event))
 	
 	u.queueMutex.Lock()
 	defer u.queueMutex.Unlock()
 	
-	u.eventQueue = append(u.eventQueue, processedEvent)
-	
-	// Trigger immediate batch if queue is full
-	if len(u.eventQueue) >= u.batchSize {
-		go u.flushBatch()
+	queued := queuedEvent{event: processedEvent}
+	var data []byte
+	if u.spool != nil || u.sizeEvents {
+		var err error
+		if data, err = json.Marshal(processedEvent); err != nil {
+			return fmt.Errorf("failed to marshal event: %w", err)
+		}
+		queued.size = len(data)
+	}
+	if u.spool != nil {
+		seq, err := u.spoolEvent(data)
+		if err != nil {
+			// The event is lost, so later deltas must not be based on it
+			for _, mesh := range processedEvent.Meshes {
+				u.ClearMeshHistory(mesh.AnchorID)
+			}
+			return err
+		}
+		queued.seq = seq
 	}
 	
+	u.fanOut(queued)
+	return nil
+}
+
+// waitForRoom blocks until every route an event goes to has room for it.
+// Waiting happens before queueMutex is taken, since delivered batches need
+// it to be released.
+func (u *Updater) waitForRoom(event types.SpatialEvent) error {
+	for _, r := range u.routes {
+		if !r.filter.Match(event) {
+			continue
+		}
+		waited, ok := r.waitRoom(u.stopC)
+		if waited > 0 && u.metrics != nil {
+			u.metrics.RecordSinkBackpressure(r.name, waited.Seconds())
+		}
+		if !ok {
+			return fmt.Errorf("updater stopped")
+		}
+	}
 	return nil
 }
 
+// fanOut queues an event on every matching route; callers hold queueMutex
+func (u *Updater) fanOut(queued queuedEvent) {
+	routes := 0
+	for _, r := range u.routes {
+		if r.filter.Match(queued.event) {
+			r.enqueue(queued)
+			u.updateRouteMetrics(r)
+			routes++
+		}
+	}
+	
+	if u.spool == nil {
+		return
+	}
+	if routes == 0 {
+		u.spool.Ack(queued.seq)
+		return
+	}
+	u.pending[queued.seq] = routes
+}
+
+// spoolEvent appends a serialized event to the spool; callers hold
+// queueMutex
+func (u *Updater) spoolEvent(data []byte) (uint64, error) {
+	seq, err := u.spool.Append(data)
+	if err != nil {
+		return 0, fmt.Errorf("failed to spool event: %w", err)
+	}
+	
+	// drop_oldest may have discarded records still waiting in memory
+	first := u.spool.FirstSeq()
+	for _, r := range u.routes {
+		for _, queued := range r.dropBefore(first) {
+			// Deltas after the dropped event can't be applied without it
+			u.requestKeyframes(queued.event)
+		}
+	}
+	for pendingSeq := range u.pending {
+		if pendingSeq < first {
+			delete(u.pending, pendingSeq)
+		}
+	}
+	
+	u.updateSpoolMetrics()
+	return seq, nil
+}
+
+// release records that a route is done with a batch, acknowledging spooled
+// events once every route they were queued on is done with them
+func (u *Updater) release(batch []queuedEvent) {
+	if u.spool == nil {
+		return
+	}
+	
+	u.queueMutex.Lock()
+	defer u.queueMutex.Unlock()
+	
+	for _, queued := range batch {
+		remaining, tracked := u.pending[queued.seq]
+		if !tracked {
+			continue // Dropped by spool overflow
+		}
+		if remaining > 1 {
+			u.pending[queued.seq] = remaining - 1
+			continue
+		}
+		delete(u.pending, queued.seq)
+		u.spool.Ack(queued.seq)
+	}
+	if u.metrics != nil {
+		u.metrics.UpdateSpoolBytes(u.spool.Size())
+	}
+}
+
+// updateRouteMetrics reports a route's queue and batches in flight if
+// metrics are enabled
+func (u *Updater) updateRouteMetrics(r *route) {
+	if u.metrics != nil {
+		u.metrics.UpdateSinkQueue(r.name, r.length(), len(r.inFlight))
+	}
+}
+
+// updateSpoolMetrics reports spool usage if metrics are enabled; callers
+// hold queueMutex
+func (u *Updater) updateSpoolMetrics() {
+	if u.metrics == nil || u.spool == nil {
+		return
+	}
+	
+	u.metrics.UpdateSpoolBytes(u.spool.Size())
+	if dropped := u.spool.Dropped(); dropped > u.spoolDropped {
+		u.metrics.RecordSpoolDropped(int(dropped - u.spoolDropped))
+		u.spoolDropped = dropped
+	}
+}
+
 // applyMeshDiffing converts full meshes to diffs when possible
 func (u *Updater) applyMeshDiffing(event types.SpatialEvent) types.SpatialEvent {
 	if len(event.Meshes) == 0 {
@@ -90,49 +444,52 @@ func (u *Updater) applyMeshDiffing(event types.SpatialEvent) types.SpatialEvent
 	u.meshMutex.Lock()
 	defer u.meshMutex.Unlock()
 	
+	now := time.Now()
 	processedMeshes := make([]types.MeshDiff, 0, len(event.Meshes))
 	
 	for _, mesh := range event.Meshes {
-		if mesh.IsDelta {
-			// Already a delta, keep as-is
+		if mesh.IsDelta || mesh.FacesIsDelta {
+			// Already a delta against the client's own chain, keep as-is.
+			// Our chain no longer matches what consumers hold, so restart it.
+			u.meshes.delete(mesh.AnchorID)
+			u.meshes.setVersion(mesh.AnchorID, mesh.Version)
 			processedMeshes = append(processedMeshes, mesh)
 			continue
 		}
 		
-		// Check if we have a previous version
-		lastVertices, exists := u.lastMeshes[mesh.AnchorID]
-		if !exists || len(lastVertices) == 0 {
-			// First mesh for this anchor, store as full mesh
-			u.lastMeshes[mesh.AnchorID] = mesh.VerticesDelta
-			processedMeshes = append(processedMeshes, mesh)
-			continue
+		processedMesh := mesh
+		next := &meshBaseline{
+			vertices:    mesh.VerticesDelta,
+			faces:       mesh.FacesDelta,
+			indexFormat: mesh.IndexFormat,
+			decoded:     mesh.Decoded,
 		}
 		
-		// Calculate similarity
-		similarity := u.calculateVertexSimilarity(lastVertices, mesh.VerticesDelta)
+		// Still-encoded buffers are sent in full; diffing would corrupt them
+		last, exists := u.meshes.get(mesh.AnchorID, now)
+		if exists && !u.needsKeyframe(last, now) && last.decoded && next.decoded {
+			u.diffVertices(last, &processedMesh, next)
+			u.diffFaces(last, &processedMesh, next)
+		}
 		
-		if similarity > 0.8 { // More than 80% similar
-			// Create delta
-			delta := u.createVertexDelta(lastVertices, mesh.VerticesDelta)
-			if len(delta) < int(float64(len(mesh.VerticesDelta))*0.7) { // Delta is smaller
-				processedMesh := types.MeshDiff{
-					AnchorID:      mesh.AnchorID,
-					VerticesDelta: delta,
-					FacesDelta:    mesh.FacesDelta, // Faces deltas are more complex, defer for MVP
-					IsDelta:       true,
-				}
-				processedMeshes = append(processedMeshes, processedMesh)
-				
-				// Update stored mesh
-				u.lastMeshes[mesh.AnchorID] = mesh.VerticesDelta
-				continue
-			}
+		if processedMesh.IsDelta || processedMesh.FacesIsDelta {
+			next.version = last.version + 1
+			next.deltas = last.deltas + 1
+			next.keyframeAt = last.keyframeAt
+			processedMesh.BaseVersion = last.version
+		} else {
+			// Sent in full, so this starts a new chain. The version carries
+			// on from the last one sent even if the baseline was evicted.
+			next.version = u.meshes.version(mesh.AnchorID) + 1
+			next.keyframeAt = now
 		}
+		processedMesh.Version = next.version
+		processedMesh.Hash = meshdelta.Hash(next.vertices, next.faces)
 		
-		// Send as full mesh if delta isn't beneficial
-		u.lastMeshes[mesh.AnchorID] = mesh.VerticesDelta
-		processedMeshes = append(processedMeshes, mesh)
+		u.meshes.put(mesh.AnchorID, event.SessionID, next, now)
+		processedMeshes = append(processedMeshes, processedMesh)
 	}
+	u.updateTrackedMeshes()
 	
 	// Create new event with processed meshes
 	processedEvent := event
@@ -140,163 +497,194 @@ func (u *Updater) applyMeshDiffing(event types.SpatialEvent) types.SpatialEvent
 	return processedEvent
 }
 
-// calculateVertexSimilarity computes similarity between two vertex buffers
-func (u *Updater) calculateVertexSimilarity(a, b []byte) float64 {
-	if len(a) != len(b) {
-		return 0.0
-	}
-	
-	if len(a) == 0 {
-		return 1.0
+// needsKeyframe reports whether the next update must be sent in full so
+// consumers that missed part of the chain can recover
+func (u *Updater) needsKeyframe(last *meshBaseline, now time.Time) bool {
+	return last.forceKeyframe ||
+		last.deltas >= u.keyframeInterval ||
+		now.Sub(last.keyframeAt) >= u.keyframeMaxAge
+}
+
+// RequestKeyframe makes the next update for an anchor a full keyframe
+func (u *Updater) RequestKeyframe(anchorID string) {
+	u.meshMutex.Lock()
+	defer u.meshMutex.Unlock()
+	if last, exists := u.meshes.peek(anchorID); exists {
+		last.forceKeyframe = true
 	}
-	
-	// Simple byte-wise comparison for MVP
-	// In production, should compare as float32 vertices with spatial tolerance
-	matches := 0
-	for i := 0; i < len(a); i++ {
-		if a[i] == b[i] {
-			matches++
+}
+
+// requestKeyframes forces keyframes for every anchor with a mesh in events
+// that consumers will not receive
+func (u *Updater) requestKeyframes(events ...types.SpatialEvent) {
+	for _, event := range events {
+		for _, mesh := range event.Meshes {
+			u.RequestKeyframe(mesh.AnchorID)
 		}
 	}
-	
-	return float64(matches) / float64(len(a))
 }
 
-// createVertexDelta creates a simple delta between vertex buffers
-func (u *Updater) createVertexDelta(old, new []byte) []byte {
-	// Simple XOR delta for MVP
-	// In production, should use proper vertex diffing algorithms
-	if len(old) != len(new) {
-		return new // Return full mesh if sizes don't match
+// diffVertices replaces the vertex buffer with a float-aware delta if that is
+// worthwhile, updating the baseline to what a decoder will reconstruct
+func (u *Updater) diffVertices(last *meshBaseline, mesh *types.MeshDiff, next *meshBaseline) {
+	if len(last.vertices) == 0 || len(mesh.VerticesDelta) == 0 {
+		return
 	}
 	
-	delta := make([]byte, len(new))
-	for i := 0; i < len(new); i++ {
-		delta[i] = old[i] ^ new[i]
+	delta, reconstructed, err := meshdelta.EncodeVertices(last.vertices, mesh.VerticesDelta, u.vertexTolerance)
+	if err != nil || len(delta) >= int(float64(len(mesh.VerticesDelta))*u.maxDeltaRatio) {
+		// Send as full mesh if delta isn't beneficial
+		return
 	}
 	
-	return delta
-}
-
-// batchProcessor handles periodic batch flushing
-func (u *Updater) batchProcessor() {
-	defer u.wg.Done()
-	
-	ticker := time.NewTicker(u.batchTimeout)
-	defer ticker.Stop()
-	
-	for {
-		select {
-		case <-ticker.C:
-			u.flushBatch()
-		case <-u.stopC:
-			// Final flush before stopping
-			u.flushBatch()
-			return
-		}
+	if u.metrics != nil {
+		u.metrics.RecordMeshDelta(float64(len(delta)) / float64(len(mesh.VerticesDelta)))
 	}
+	mesh.VerticesDelta = delta
+	mesh.IsDelta = true
+	next.vertices = reconstructed
 }
 
-// flushBatch sends the current batch to STAG
-func (u *Updater) flushBatch() {
-	u.queueMutex.Lock()
-	if len(u.eventQueue) == 0 {
-		u.queueMutex.Unlock()
+// diffFaces replaces the index buffer with a triangle delta when that is
+// smaller than the full buffer
+func (u *Updater) diffFaces(last *meshBaseline, mesh *types.MeshDiff, next *meshBaseline) {
+	if len(last.faces) == 0 || len(mesh.FacesDelta) == 0 || last.indexFormat != mesh.IndexFormat {
 		return
 	}
 	
-	// Copy events and clear queue
-	events := make([]types.SpatialEvent, len(u.eventQueue))
-	copy(events, u.eventQueue)
-	u.eventQueue = u.eventQueue[:0]
-	u.queueMutex.Unlock()
-	
-	// Send to STAG
-	if err := u.sendToSTAG(events); err != nil {
-		log.Printf("Failed to send batch to STAG: %v", err)
-		// TODO: Implement retry logic or dead letter queue
-	}
-}
-
-// sendToSTAG sends events to the STAG service
-func (u *Updater) sendToSTAG(events []types.SpatialEvent) error {
-	if len(events) == 0 {
-		return nil
-	}
-	
-	// Compress mesh data in events before sending
-	compressedEvents := make([]types.SpatialEvent, len(events))
-	copy(compressedEvents, events)
-	
-	for i := range compressedEvents {
-		for j := range compressedEvents[i].Meshes {
-			mesh := &compressedEvents[i].Meshes[j]
-			
-			// Compress vertices if present
-			if len(mesh.VerticesDelta) > 0 {
-				compressed, bytesSaved, err := u.compressMeshData(mesh.VerticesDelta)
-				if err != nil {
-					log.Printf("Failed to compress mesh vertices: %v", err)
-					// Continue with uncompressed data
-				} else {
-					mesh.VerticesDelta = compressed
-					// Note: metrics recording would need to be passed in via dependency injection
-					// For now, we log the savings
-					if bytesSaved > 0 {
-						log.Printf("Compression saved %d bytes", bytesSaved)
-					}
-				}
-			}
-			
-			// Compress faces if present (similar process)
-			if len(mesh.FacesDelta) > 0 {
-				// For MVP, faces are kept as-is since they're typically indices
-				// In production, faces could also be compressed or encoded differently
-			}
-		}
+	width := meshdelta.IndexWidth(mesh.IndexFormat, mesh.FacesDelta)
+	if width == 0 || width != meshdelta.IndexWidth(last.indexFormat, last.faces) {
+		return
 	}
 	
-	// Create batch payload
-	batch := map[string]interface{}{
-		"events":    compressedEvents,
-		"timestamp": time.Now().UnixMilli(),
-		"count":     len(compressedEvents),
+	delta, reconstructed, err := meshdelta.EncodeFaces(last.faces, mesh.FacesDelta, width)
+	if err != nil || len(delta) >= len(mesh.FacesDelta) {
+		return
 	}
 	
-	// Marshal to JSON
-	payload, err := json.Marshal(batch)
+	mesh.FacesDelta = delta
+	mesh.FacesIsDelta = true
+	next.faces = reconstructed
+}
+
+// deadLetter parks a batch a route could not deliver
+func (u *Updater) deadLetter(r *route, events []types.SpatialEvent, attempts int, lastErr error, firstFailure time.Time) bool {
+	entry, err := u.deadLetters.Put(r.name, events, attempts, lastErr, firstFailure)
 	if err != nil {
-		return fmt.Errorf("failed to marshal batch: %w", err)
+		log.Printf("Failed to dead-letter batch of %d events for %s: %v", len(events), r.name, err)
+		return false
 	}
 	
-	// Create request
-	req, err := http.NewRequestWithContext(
-		context.Background(),
-		"POST",
-		u.stagURL+"/ingest",
-		bytes.NewReader(payload),
-	)
+	log.Printf("Dead-lettered batch %s (%d events) for %s after %d attempts: %v", entry.ID, len(events), r.name, attempts, lastErr)
+	u.requestKeyframes(events...)
+	if u.metrics != nil {
+		u.metrics.UpdateDeadLetters(u.deadLetters.Len())
+	}
+	return true
+}
+
+// DeadLetters returns the store of batches that exhausted their retries
+func (u *Updater) DeadLetters() *DeadLetterStore {
+	return u.deadLetters
+}
+
+// Redrive attempts to send a dead-lettered batch again to the sink it
+// failed on, removing it on success. It fails with ErrRedriveInProgress if
+// the batch is already being redriven.
+func (u *Updater) Redrive(id string) error {
+	entry, err := u.deadLetters.Claim(id)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return err
 	}
+	defer u.deadLetters.Release(id)
 	
-	req.Header.Set("Content-Type", "application/json")
-	
-	// Send request
-	resp, err := u.httpClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to send request: %w", err)
+	r := u.route(entry.Sink)
+	if r == nil {
+		return fmt.Errorf("dead letter %s belongs to sink %s, which is not configured", id, entry.Sink)
 	}
-	defer resp.Body.Close()
 	
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("STAG returned status %d", resp.StatusCode)
+	if failures := u.send(r, entry.Events); len(failures) > 0 {
+		err := failures[len(failures)-1].err
+		if recordErr := u.deadLetters.RecordFailure(id, err); recordErr != nil {
+			log.Printf("Failed to update dead letter %s: %v", id, recordErr)
+		}
+		return fmt.Errorf("redrive of %s failed: %w", id, err)
 	}
 	
-	log.Printf("Successfully sent batch of %d events to STAG", len(events))
+	if err := u.deadLetters.Remove(id); err != nil {
+		return err
+	}
+	if u.metrics != nil {
+		u.metrics.UpdateDeadLetters(u.deadLetters.Len())
+	}
+	u.notifyDelivered(r, entry.Events, nil)
 	return nil
 }
 
+// RedriveAll attempts every dead letter once, oldest first. A failed
+// redrive doesn't stop the rest; it returns how many were redriven along
+// with every failure.
+func (u *Updater) RedriveAll() (int, error) {
+	redriven := 0
+	var errs []error
+	for _, entry := range u.deadLetters.List() {
+		if err := u.Redrive(entry.ID); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		redriven++
+	}
+	return redriven, errors.Join(errs...)
+}
+
+// route returns the route with the given name. Dead letters from before
+// sinks were configurable have no name and belong to the first route.
+func (u *Updater) route(name string) *route {
+	if name == "" {
+		return u.routes[0]
+	}
+	for _, r := range u.routes {
+		if r.name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+// compressEvent compresses mesh vertex data so every sink gets the same payload
+func (u *Updater) compressEvent(event types.SpatialEvent) types.SpatialEvent {
+	if len(event.Meshes) == 0 {
+		return event
+	}
+	
+	meshes := make([]types.MeshDiff, len(event.Meshes))
+	copy(meshes, event.Meshes)
+	
+	for i := range meshes {
+		mesh := &meshes[i]
+		
+		// Compress vertices if present
+		if u.compressionEnabled && len(mesh.VerticesDelta) > 0 && mesh.VerticesEncoding == "" {
+			compressed, bytesSaved, err := u.compressMeshData(mesh.VerticesDelta)
+			if err != nil {
+				log.Printf("Failed to compress mesh vertices: %v", err)
+				// Continue with uncompressed data
+			} else {
+				mesh.VerticesDelta = compressed
+				mesh.VerticesEncoding = meshdelta.EncodingGzip
+				if bytesSaved > 0 {
+					log.Printf("Compression saved %d bytes", bytesSaved)
+				}
+			}
+		}
+		
+		// Faces are typically indices and kept as-is
+	}
+	
+	event.Meshes = meshes
+	return event
+}
+
 // compressMeshData compresses vertex data using simple compression
 // Note: Draco encoder not available in qmuntal/draco-go (decode-only library)
 // Implementing simple gzip compression for MVP
@@ -309,22 +697,12 @@ func (u *Updater) compressMeshData(vertices []byte) ([]byte, int, error) {
 	originalSize := len(vertices)
 
 	// Use simple gzip compression as fallback
-	var compressed bytes.Buffer
-	gzWriter := gzip.NewWriter(&compressed)
-	
-	_, err := gzWriter.Write(vertices)
-	if err != nil {
-		gzWriter.Close()
-		return nil, 0, fmt.Errorf("gzip compression failed: %w", err)
-	}
-	
-	err = gzWriter.Close()
+	compressedData, err := meshdelta.Compress(vertices)
 	if err != nil {
-		return nil, 0, fmt.Errorf("gzip close failed: %w", err)
+		return nil, 0, err
 	}
 
 	compressionTime := time.Since(startTime).Seconds()
-	compressedData := compressed.Bytes()
 	compressedSize := len(compressedData)
 	compressionRatio := float64(compressedSize) / float64(originalSize)
 	bytesSaved := originalSize - compressedSize
@@ -337,25 +715,94 @@ func (u *Updater) compressMeshData(vertices []byte) ([]byte, int, error) {
 
 // GetStats returns updater statistics
 func (u *Updater) GetStats() map[string]interface{} {
-	u.queueMutex.Lock()
-	queueLength := len(u.eventQueue)
-	u.queueMutex.Unlock()
+	queueLength := 0
+	sinks := make(map[string]interface{}, len(u.routes))
+	for _, r := range u.routes {
+		length := r.length()
+		queueLength += length
+		size, timeout := r.limits()
+		sinks[r.name] = map[string]interface{}{
+			"queue_length":  length,
+			"in_flight":     len(r.inFlight),
+			"batch_size":    size,
+			"batch_timeout": timeout.String(),
+			"batch_bytes":   r.batchBytes,
+			"adaptive":      r.window != nil,
+			"coalesced":     r.coalesced.Load(),
+		}
+	}
 	
 	u.meshMutex.RLock()
-	trackedMeshes := len(u.lastMeshes)
+	trackedMeshes := u.meshes.len()
+	meshCacheBytes := u.meshes.size()
 	u.meshMutex.RUnlock()
 	
-	return map[string]interface{}{
-		"queue_length":   queueLength,
-		"tracked_meshes": trackedMeshes,
-		"batch_size":     u.batchSize,
-		"batch_timeout":  u.batchTimeout.String(),
+	stats := map[string]interface{}{
+		"queue_length":     queueLength,
+		"tracked_meshes":   trackedMeshes,
+		"mesh_cache_bytes": meshCacheBytes,
+		"dead_letters":     u.deadLetters.Len(),
+		"batch_size":       u.batchSize,
+		"batch_timeout":    u.batchTimeout.String(),
+		"sinks":            sinks,
 	}
+	if u.spool != nil {
+		stats["spool_bytes"] = u.spool.Size()
+		stats["spool_dropped"] = u.spool.Dropped()
+	}
+	return stats
 }
 
-// ClearMeshHistory removes old mesh data to free memory
+// ClearMeshHistory removes old mesh data to free memory. The anchor's next
+// update is a keyframe that carries on its version count.
 func (u *Updater) ClearMeshHistory(anchorID string) {
 	u.meshMutex.Lock()
 	defer u.meshMutex.Unlock()
-	delete(u.lastMeshes, anchorID)
+	u.meshes.delete(anchorID)
+	u.updateTrackedMeshes()
+}
+
+// EndSession drops the diff baselines and coalescing state of a finished
+// session's anchors
+func (u *Updater) EndSession(sessionID string) {
+	u.meshMutex.Lock()
+	defer u.meshMutex.Unlock()
+	if evicted := u.meshes.evictSession(sessionID); evicted > 0 {
+		log.Printf("Dropped %d mesh baselines for ended session %s", evicted, sessionID)
+	}
+	u.updateTrackedMeshes()
+	
+	for _, r := range u.routes {
+		if r.coalescer != nil {
+			r.coalescer.endSession(sessionID)
+		}
+	}
+}
+
+// meshJanitor periodically drops baselines of anchors that stopped updating
+func (u *Updater) meshJanitor() {
+	defer u.wg.Done()
+	
+	ticker := time.NewTicker(u.meshes.idleTTL / 4)
+	defer ticker.Stop()
+	
+	for {
+		select {
+		case <-ticker.C:
+			u.meshMutex.Lock()
+			u.meshes.evictIdle(time.Now())
+			u.updateTrackedMeshes()
+			u.meshMutex.Unlock()
+		case <-u.stopC:
+			return
+		}
+	}
+}
+
+// updateTrackedMeshes reports the cache size if metrics are enabled; callers
+// hold meshMutex
+func (u *Updater) updateTrackedMeshes() {
+	if u.metrics != nil {
+		u.metrics.UpdateTrackedMeshes(u.meshes.len())
+	}
 }
\ No newline at end of file
@@ -0,0 +1,419 @@
+// Package webhook notifies third-party systems of session lifecycle and
+// batch delivery with signed HTTP callbacks.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/tabular/relay/internal/metrics"
+	"github.com/tabular/relay/pkg/sink"
+	"github.com/tabular/relay/pkg/types"
+)
+
+// Notification types
+const (
+	SessionStarted = "session.started"
+	SessionEnded   = "session.ended"
+	BatchDelivered = "batch.delivered"
+)
+
+// Headers set on every webhook request
+const (
+	SignatureHeader = "X-Relay-Signature" // "sha256=" + hex HMAC of "<timestamp>.<body>"
+	TimestampHeader = "X-Relay-Timestamp" // Unix seconds the request was signed at
+	DeliveryHeader  = "X-Relay-Delivery"  // Same for every retry of a notification
+	EventHeader     = "X-Relay-Event"     // Notification type
+)
+
+// maxFailures bounds the failures kept for inspection
+const maxFailures = 100
+
+// Subscriber receives notifications for the sessions streamed with one API key
+type Subscriber struct {
+	APIKey string
+	URL    string
+	Secret string   // HMAC-SHA256 signing key
+	Events []string // Notification types to send; empty sends all
+}
+
+// Options configures a Notifier
+type Options struct {
+	Subscribers  []Subscriber
+	Timeout      time.Duration    // Per request (default 5s)
+	Retry        sink.RetryPolicy // Zero MaxAttempts uses sink.DefaultRetryPolicy
+	QueueSize    int              // Notifications buffered per subscriber (default 1024)
+	SessionGrace time.Duration    // How long an ended session still maps to its API key (default 5m)
+	Metrics      *metrics.Metrics // Optional
+}
+
+// Notification is the JSON body of a webhook request
+type Notification struct {
+	ID        string `json:"id"` // Delivery ID
+	Type      string `json:"type"`
+	Timestamp int64  `json:"timestamp"` // Unix milliseconds
+	SessionID string `json:"session_id"`
+
+	// batch.delivered only
+	Sink         string `json:"sink,omitempty"`
+	Events       int    `json:"events,omitempty"`
+	FirstEventID string `json:"first_event_id,omitempty"`
+	LastEventID  string `json:"last_event_id,omitempty"`
+}
+
+// Failure is a notification a subscriber never accepted
+type Failure struct {
+	Notification Notification `json:"notification"`
+	URL          string       `json:"url"`
+	Attempts     int          `json:"attempts"`
+	Error        string       `json:"error"`
+	Time         time.Time    `json:"time"`
+}
+
+// Notifier queues notifications per subscriber and delivers them in order,
+// retrying failed requests with backoff. A slow subscriber only delays its
+// own notifications.
+type Notifier struct {
+	opts       Options
+	httpClient *http.Client
+
+	subscribers map[string][]*subscriber // API key -> subscribers
+	sessions    map[string]*session      // Session ID -> API key
+	failures    []Failure
+	closed      bool
+	mutex       sync.Mutex
+
+	stopC chan struct{}
+	wg    sync.WaitGroup
+}
+
+type subscriber struct {
+	Subscriber
+	events map[string]bool
+	queue  chan Notification
+}
+
+type session struct {
+	apiKey  string
+	endedAt time.Time // Zero while the session is active
+}
+
+// New validates the subscribers and starts a delivery worker for each
+func New(opts Options) (*Notifier, error) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	if opts.Retry.MaxAttempts <= 0 {
+		opts.Retry = sink.DefaultRetryPolicy()
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 1024
+	}
+	if opts.SessionGrace <= 0 {
+		opts.SessionGrace = 5 * time.Minute
+	}
+
+	n := &Notifier{
+		opts:        opts,
+		httpClient:  &http.Client{Timeout: opts.Timeout},
+		subscribers: make(map[string][]*subscriber),
+		sessions:    make(map[string]*session),
+		stopC:       make(chan struct{}),
+	}
+
+	var subs []*subscriber
+	for i, cfg := range opts.Subscribers {
+		sub, err := newSubscriber(cfg, opts.QueueSize)
+		if err != nil {
+			return nil, fmt.Errorf("webhook %d: %w", i, err)
+		}
+		n.subscribers[cfg.APIKey] = append(n.subscribers[cfg.APIKey], sub)
+		subs = append(subs, sub)
+	}
+
+	n.wg.Add(len(subs))
+	for _, sub := range subs {
+		go n.run(sub)
+	}
+	return n, nil
+}
+
+func newSubscriber(cfg Subscriber, queueSize int) (*subscriber, error) {
+	if cfg.APIKey == "" {
+		return nil, fmt.Errorf("api key is required")
+	}
+	if cfg.Secret == "" {
+		return nil, fmt.Errorf("secret is required")
+	}
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid url: %q", cfg.URL)
+	}
+
+	sub := &subscriber{
+		Subscriber: cfg,
+		events:     make(map[string]bool),
+		queue:      make(chan Notification, queueSize),
+	}
+	for _, eventType := range cfg.Events {
+		switch eventType {
+		case SessionStarted, SessionEnded, BatchDelivered:
+			sub.events[eventType] = true
+		default:
+			return nil, fmt.Errorf("unknown notification type: %s", eventType)
+		}
+	}
+	return sub, nil
+}
+
+// SessionStarted notifies the API key's subscribers that a session began
+// streaming, and remembers the key for the session's later notifications
+func (n *Notifier) SessionStarted(sessionID, apiKey string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.sessions[sessionID] = &session{apiKey: apiKey}
+	n.enqueue(apiKey, Notification{Type: SessionStarted, SessionID: sessionID})
+}
+
+// SessionEnded notifies the subscribers of a session that it stopped
+// streaming. The session's API key is kept for SessionGrace so batches
+// delivered after the session ended are still reported.
+func (n *Notifier) SessionEnded(sessionID string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	now := time.Now()
+	n.pruneSessions(now)
+
+	s, ok := n.sessions[sessionID]
+	if !ok {
+		return
+	}
+	s.endedAt = now
+	n.enqueue(s.apiKey, Notification{Type: SessionEnded, SessionID: sessionID})
+}
+
+// BatchDelivered notifies subscribers that a sink accepted events, with one
+// notification per session in the batch. It matches updater.Options.OnDelivered.
+func (n *Notifier) BatchDelivered(sinkName string, events []types.SpatialEvent) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	var order []string
+	bySession := make(map[string]*Notification)
+	for _, event := range events {
+		notification, ok := bySession[event.SessionID]
+		if !ok {
+			notification = &Notification{
+				Type:         BatchDelivered,
+				SessionID:    event.SessionID,
+				Sink:         sinkName,
+				FirstEventID: event.EventID,
+			}
+			bySession[event.SessionID] = notification
+			order = append(order, event.SessionID)
+		}
+		notification.Events++
+		notification.LastEventID = event.EventID
+	}
+
+	for _, sessionID := range order {
+		s, ok := n.sessions[sessionID]
+		if !ok {
+			continue
+		}
+		n.enqueue(s.apiKey, *bySession[sessionID])
+	}
+}
+
+// Failures returns the most recent notifications that could not be
+// delivered, oldest first
+func (n *Notifier) Failures() []Failure {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return append([]Failure(nil), n.failures...)
+}
+
+// Close stops accepting notifications and waits for the queued ones to be
+// sent. Queued notifications get a single attempt once Close was called.
+func (n *Notifier) Close() error {
+	n.mutex.Lock()
+	if n.closed {
+		n.mutex.Unlock()
+		return nil
+	}
+	n.closed = true
+	close(n.stopC)
+	for _, subs := range n.subscribers {
+		for _, sub := range subs {
+			close(sub.queue)
+		}
+	}
+	n.mutex.Unlock()
+
+	n.wg.Wait()
+	n.httpClient.CloseIdleConnections()
+	return nil
+}
+
+// enqueue queues a notification for every subscriber of an API key that
+// wants its type; callers hold the lock
+func (n *Notifier) enqueue(apiKey string, notification Notification) {
+	if n.closed {
+		return
+	}
+
+	notification.Timestamp = time.Now().UnixMilli()
+	for _, sub := range n.subscribers[apiKey] {
+		if len(sub.events) > 0 && !sub.events[notification.Type] {
+			continue
+		}
+
+		notification.ID = newDeliveryID()
+		select {
+		case sub.queue <- notification:
+		default:
+			n.recordFailure(sub, notification, 0, fmt.Errorf("queue full"))
+			n.recordDelivery(notification.Type, "dropped")
+		}
+	}
+}
+
+// pruneSessions forgets sessions that ended more than SessionGrace ago;
+// callers hold the lock
+func (n *Notifier) pruneSessions(now time.Time) {
+	for sessionID, s := range n.sessions {
+		if !s.endedAt.IsZero() && now.Sub(s.endedAt) > n.opts.SessionGrace {
+			delete(n.sessions, sessionID)
+		}
+	}
+}
+
+// run delivers a subscriber's notifications one at a time, in order
+func (n *Notifier) run(sub *subscriber) {
+	defer n.wg.Done()
+	for notification := range sub.queue {
+		n.deliver(sub, notification)
+	}
+}
+
+// deliver sends a notification with retries and records the outcome
+func (n *Notifier) deliver(sub *subscriber, notification Notification) {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		n.fail(sub, notification, 0, fmt.Errorf("failed to marshal notification: %w", err))
+		return
+	}
+
+	var lastErr error
+	attempt := 1
+	for ; attempt <= n.opts.Retry.MaxAttempts; attempt++ {
+		lastErr = n.post(sub, notification, body)
+		if lastErr == nil {
+			n.recordDelivery(notification.Type, "delivered")
+			return
+		}
+		if !sink.IsRetryable(lastErr) || attempt == n.opts.Retry.MaxAttempts {
+			break
+		}
+
+		// Retries stop once the notifier is closing
+		timer := time.NewTimer(n.opts.Retry.RetryDelay(attempt, lastErr))
+		select {
+		case <-timer.C:
+		case <-n.stopC:
+			timer.Stop()
+			n.fail(sub, notification, attempt, lastErr)
+			return
+		}
+		if n.opts.Metrics != nil {
+			n.opts.Metrics.RecordWebhookRetry(notification.Type)
+		}
+	}
+	n.fail(sub, notification, attempt, lastErr)
+}
+
+// post sends one signed request. Non-2xx responses become sink delivery
+// errors, so the same statuses are retried as for STAG.
+func (n *Notifier) post(sub *subscriber, notification Notification, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), n.opts.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return &sink.DeliveryError{Sink: "webhook", Permanent: true, Err: err}
+	}
+
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "tabular-relay/1.0")
+	req.Header.Set(SignatureHeader, Sign(sub.Secret, timestamp, body))
+	req.Header.Set(TimestampHeader, fmt.Sprintf("%d", timestamp))
+	req.Header.Set(DeliveryHeader, notification.ID)
+	req.Header.Set(EventHeader, notification.Type)
+
+	resp, err := n.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &sink.DeliveryError{
+			Sink:       "webhook",
+			StatusCode: resp.StatusCode,
+			RetryAfter: sink.ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
+	}
+	return nil
+}
+
+// fail records a notification that exhausted its attempts
+func (n *Notifier) fail(sub *subscriber, notification Notification, attempts int, err error) {
+	log.Printf("Failed to deliver %s webhook %s to %s after %d attempts: %v",
+		notification.Type, notification.ID, sub.URL, attempts, err)
+
+	n.mutex.Lock()
+	n.recordFailure(sub, notification, attempts, err)
+	n.mutex.Unlock()
+	n.recordDelivery(notification.Type, "failed")
+}
+
+// recordFailure keeps a failure for inspection; callers hold the lock
+func (n *Notifier) recordFailure(sub *subscriber, notification Notification, attempts int, err error) {
+	n.failures = append(n.failures, Failure{
+		Notification: notification,
+		URL:          sub.URL,
+		Attempts:     attempts,
+		Error:        err.Error(),
+		Time:         time.Now(),
+	})
+	if len(n.failures) > maxFailures {
+		n.failures = n.failures[len(n.failures)-maxFailures:]
+	}
+}
+
+func (n *Notifier) recordDelivery(notificationType, status string) {
+	if n.opts.Metrics != nil {
+		n.opts.Metrics.RecordWebhookDelivery(notificationType, status)
+	}
+}
+
+// newDeliveryID returns a random delivery identifier
+func newDeliveryID() string {
+	var b [12]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("dlv_%d", time.Now().UnixNano())
+	}
+	return "dlv_" + hex.EncodeToString(b[:])
+}
@@ -5,17 +5,30 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"sync"
 	"time"
 
+	"github.com/tabular/relay/pkg/sink"
 	"github.com/tabular/relay/pkg/types"
 )
 
-// StagClient handles communication with STAG service
+// StagClient handles communication with STAG service. It implements
+// sink.Sink and sink.Resyncer.
 type StagClient struct {
 	baseURL    string
 	httpClient *http.Client
 	apiKey     string
+	
+	// Anchors STAG asked keyframes for, drained by Resync
+	resync      []string
+	resyncMutex sync.Mutex
+}
+
+// ingestResponse is the optional body STAG answers /ingest with
+type ingestResponse struct {
+	Resync []string `json:"resync"` // Anchors whose delta chain STAG lost
 }
 
 // NewStagClient creates a new STAG client
@@ -29,6 +42,35 @@ func NewStagClient(baseURL, apiKey string, timeout time.Duration) *StagClient {
 	}
 }
 
+// Name identifies STAG as a sink
+func (c *StagClient) Name() string {
+	return "stag"
+}
+
+// Send delivers a batch to STAG. STAG accepts or rejects a batch as a
+// whole, so every event shares the outcome.
+func (c *StagClient) Send(ctx context.Context, events []types.SpatialEvent) ([]sink.Result, error) {
+	if err := c.IngestEvents(ctx, events); err != nil {
+		return nil, err
+	}
+	return sink.Delivered(events), nil
+}
+
+// Resync returns and clears the anchors STAG asked keyframes for
+func (c *StagClient) Resync() []string {
+	c.resyncMutex.Lock()
+	defer c.resyncMutex.Unlock()
+	anchors := c.resync
+	c.resync = nil
+	return anchors
+}
+
+// Close releases idle connections
+func (c *StagClient) Close() error {
+	c.httpClient.CloseIdleConnections()
+	return nil
+}
+
 // IngestEvents sends a batch of events to STAG
 func (c *StagClient) IngestEvents(ctx context.Context, events []types.SpatialEvent) error {
 	if len(events) == 0 {
@@ -42,7 +84,18 @@ func (c *StagClient) IngestEvents(ctx context.Context, events []types.SpatialEve
 		"count":     len(events),
 	}
 	
-	return c.postJSON(ctx, "/ingest", batch)
+	body, err := c.postJSON(ctx, "/ingest", batch)
+	if err != nil {
+		return err
+	}
+	
+	var response ingestResponse
+	if err := json.Unmarshal(body, &response); err == nil && len(response.Resync) > 0 {
+		c.resyncMutex.Lock()
+		c.resync = append(c.resync, response.Resync...)
+		c.resyncMutex.Unlock()
+	}
+	return nil
 }
 
 // HealthCheck verifies STAG service availability
@@ -67,11 +120,11 @@ func (c *StagClient) HealthCheck(ctx context.Context) error {
 	return nil
 }
 
-// postJSON sends a JSON POST request to STAG
-func (c *StagClient) postJSON(ctx context.Context, endpoint string, payload interface{}) error {
+// postJSON sends a JSON POST request to STAG and returns the response body
+func (c *StagClient) postJSON(ctx context.Context, endpoint string, payload interface{}) ([]byte, error) {
 	jsonData, err := json.Marshal(payload)
 	if err != nil {
-		return fmt.Errorf("failed to marshal payload: %w", err)
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
 	}
 	
 	req, err := http.NewRequestWithContext(
@@ -81,7 +134,7 @@ func (c *StagClient) postJSON(ctx context.Context, endpoint string, payload inte
 		bytes.NewReader(jsonData),
 	)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 	
 	c.addHeaders(req)
@@ -89,15 +142,23 @@ func (c *StagClient) postJSON(ctx context.Context, endpoint string, payload inte
 	
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("request failed: %w", err)
+		return nil, fmt.Errorf("request failed: %w", err)
 	}
 	defer resp.Body.Close()
 	
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("STAG returned status %d", resp.StatusCode)
+		return nil, &sink.DeliveryError{
+			Sink:       "STAG",
+			StatusCode: resp.StatusCode,
+			RetryAfter: sink.ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
 	}
 	
-	return nil
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	return body, nil
 }
 
 // addHeaders adds common headers to requests
@@ -106,4 +167,4 @@ func (c *StagClient) addHeaders(req *http.Request) {
 		req.Header.Set("X-API-Key", c.apiKey)
 	}
 	req.Header.Set("User-Agent", "tabular-relay/1.0")
-}
\ No newline at end of file
+}
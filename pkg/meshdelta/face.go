@@ -0,0 +1,201 @@
+package meshdelta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Face delta wire format (version 1):
+//
+//	"TXFD" | version (1 byte) | index width (1 byte: 2 or 4) | uvarint oldTriangles
+//	uvarint removed | removed triangle positions (uvarint, gap-encoded ascending)
+//	uvarint appended | appended triangles (3 little-endian indices each)
+//
+// The new index buffer is the old triangle list with the removed positions
+// dropped, order otherwise preserved, followed by the appended triangles.
+const (
+	faceDeltaMagic   = "TXFD"
+	faceDeltaVersion = 1
+)
+
+// IndexWidth returns the byte width of one index for a triangle list, or 0
+// if the buffer can't be a list of that format. An empty format is inferred
+// from the buffer length, preferring uint32.
+func IndexWidth(format string, faces []byte) int {
+	switch format {
+	case "uint16":
+		if len(faces)%6 == 0 {
+			return 2
+		}
+	case "uint32":
+		if len(faces)%12 == 0 {
+			return 4
+		}
+	case "":
+		if len(faces)%12 == 0 {
+			return 4
+		}
+		if len(faces)%6 == 0 {
+			return 2
+		}
+	}
+	return 0
+}
+
+// triangle holds one triangle's indices rotated so the smallest comes first;
+// rotation keeps the winding order, so both forms render identically
+type triangle [3]uint32
+
+func readTriangle(buf []byte, width int) triangle {
+	var t triangle
+	for i := 0; i < 3; i++ {
+		if width == 2 {
+			t[i] = uint32(binary.LittleEndian.Uint16(buf[i*2:]))
+		} else {
+			t[i] = binary.LittleEndian.Uint32(buf[i*4:])
+		}
+	}
+	switch {
+	case t[1] < t[0] && t[1] <= t[2]:
+		t = triangle{t[1], t[2], t[0]}
+	case t[2] < t[0] && t[2] < t[1]:
+		t = triangle{t[2], t[0], t[1]}
+	}
+	return t
+}
+
+// EncodeFaces diffs two index buffers of the same width as triangle
+// multisets. Like EncodeVertices it returns the buffer a decoder will
+// rebuild, which keeps surviving triangles in their old order.
+func EncodeFaces(prev, next []byte, width int) (delta, reconstructed []byte, err error) {
+	stride := 3 * width
+	if width != 2 && width != 4 || len(prev)%stride != 0 || len(next)%stride != 0 {
+		return nil, nil, fmt.Errorf("index buffers are not %d-byte triangle lists", width)
+	}
+
+	oldCount := len(prev) / stride
+	newCount := len(next) / stride
+
+	// Old triangle positions by shape, consumed as new triangles match them
+	available := make(map[triangle][]int, oldCount)
+	for i := 0; i < oldCount; i++ {
+		t := readTriangle(prev[i*stride:], width)
+		available[t] = append(available[t], i)
+	}
+
+	kept := make([]bool, oldCount)
+	var appended []byte
+	for j := 0; j < newCount; j++ {
+		raw := next[j*stride : (j+1)*stride]
+		t := readTriangle(raw, width)
+		if positions := available[t]; len(positions) > 0 {
+			kept[positions[0]] = true
+			available[t] = positions[1:]
+			continue
+		}
+		appended = append(appended, raw...)
+	}
+
+	var buf bytes.Buffer
+	var tmp [binary.MaxVarintLen64]byte
+	uvarint := func(v uint64) {
+		buf.Write(tmp[:binary.PutUvarint(tmp[:], v)])
+	}
+
+	buf.WriteString(faceDeltaMagic)
+	buf.WriteByte(faceDeltaVersion)
+	buf.WriteByte(byte(width))
+	uvarint(uint64(oldCount))
+
+	removed := 0
+	for _, k := range kept {
+		if !k {
+			removed++
+		}
+	}
+	uvarint(uint64(removed))
+	last := 0
+	for i, k := range kept {
+		if !k {
+			uvarint(uint64(i - last))
+			last = i
+		}
+	}
+
+	uvarint(uint64(len(appended) / stride))
+	buf.Write(appended)
+
+	delta = buf.Bytes()
+	reconstructed, err = ApplyFaces(prev, delta)
+	if err != nil {
+		return nil, nil, fmt.Errorf("face delta self-check failed: %w", err)
+	}
+	return delta, reconstructed, nil
+}
+
+// ApplyFaces rebuilds the new index buffer from the previous one
+func ApplyFaces(prev, delta []byte) ([]byte, error) {
+	headerLen := len(faceDeltaMagic) + 2
+	if len(delta) < headerLen || string(delta[:len(faceDeltaMagic)]) != faceDeltaMagic {
+		return nil, fmt.Errorf("not a face delta")
+	}
+	if version := delta[len(faceDeltaMagic)]; version != faceDeltaVersion {
+		return nil, fmt.Errorf("unsupported face delta version %d", version)
+	}
+	width := int(delta[len(faceDeltaMagic)+1])
+	if width != 2 && width != 4 {
+		return nil, fmt.Errorf("invalid face delta index width %d", width)
+	}
+	stride := 3 * width
+
+	r := bytes.NewReader(delta[headerLen:])
+	oldCount, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("truncated face delta header: %w", err)
+	}
+	if uint64(len(prev)) != oldCount*uint64(stride) {
+		return nil, fmt.Errorf("face delta expects %d base triangles, have %d", oldCount, len(prev)/stride)
+	}
+
+	removedCount, err := binary.ReadUvarint(r)
+	if err != nil || removedCount > oldCount {
+		return nil, fmt.Errorf("invalid face delta removal count")
+	}
+	removed := make([]bool, oldCount)
+	position := uint64(0)
+	for i := uint64(0); i < removedCount; i++ {
+		gap, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, fmt.Errorf("truncated face delta removals: %w", err)
+		}
+		if i > 0 && gap == 0 {
+			return nil, fmt.Errorf("face delta removes a triangle twice")
+		}
+		position += gap
+		if position >= oldCount {
+			return nil, fmt.Errorf("face delta removes triangle %d of %d", position, oldCount)
+		}
+		removed[position] = true
+	}
+
+	appendedCount, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("truncated face delta appends: %w", err)
+	}
+	if uint64(r.Len()) != appendedCount*uint64(stride) {
+		return nil, fmt.Errorf("face delta appends %d triangles but carries %d bytes", appendedCount, r.Len())
+	}
+
+	out := make([]byte, 0, len(prev)-int(removedCount)*stride+r.Len())
+	for i := uint64(0); i < oldCount; i++ {
+		if !removed[i] {
+			out = append(out, prev[i*uint64(stride):(i+1)*uint64(stride)]...)
+		}
+	}
+	start := len(out)
+	out = append(out, make([]byte, r.Len())...)
+	r.Read(out[start:])
+
+	return out, nil
+}
@@ -0,0 +1,55 @@
+// Package meshdelta encodes and decodes the mesh deltas the relay sends to
+// STAG, and rebuilds meshes from a stream of types.MeshDiff records.
+package meshdelta
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+// EncodingGzip marks a gzip-compressed MeshDiff.VerticesDelta
+const EncodingGzip = "gzip"
+
+// Compress gzips a mesh payload
+func Compress(data []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+	gzWriter := gzip.NewWriter(&compressed)
+	
+	if _, err := gzWriter.Write(data); err != nil {
+		gzWriter.Close()
+		return nil, fmt.Errorf("gzip compression failed: %w", err)
+	}
+	if err := gzWriter.Close(); err != nil {
+		return nil, fmt.Errorf("gzip close failed: %w", err)
+	}
+	
+	return compressed.Bytes(), nil
+}
+
+// Decompress reverses Compress
+func Decompress(data []byte) ([]byte, error) {
+	gzReader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("gzip reader failed: %w", err)
+	}
+	defer gzReader.Close()
+	
+	out, err := io.ReadAll(gzReader)
+	if err != nil {
+		return nil, fmt.Errorf("gzip decompression failed: %w", err)
+	}
+	return out, nil
+}
+
+// Hash returns the content hash carried in MeshDiff.Hash: the hex SHA-256
+// of the uncompressed vertex buffer followed by the face buffer
+func Hash(vertices, faces []byte) string {
+	h := sha256.New()
+	h.Write(vertices)
+	h.Write(faces)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,173 @@
+package meshdelta
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/tabular/relay/pkg/types"
+)
+
+var (
+	// ErrGap is returned for a delta whose base version the Reconstructor
+	// doesn't hold; deltas for the anchor fail until the next keyframe
+	ErrGap = errors.New("mesh delta chain broken")
+	// ErrStale is returned for an update older than the current version,
+	// such as a redriven batch; the current mesh is kept
+	ErrStale = errors.New("mesh update is older than current version")
+	// ErrHashMismatch is returned when a rebuilt mesh doesn't match its hash
+	ErrHashMismatch = errors.New("mesh hash mismatch")
+)
+
+// Mesh is the current state of an anchor's mesh
+type Mesh struct {
+	AnchorID    string
+	Vertices    []byte // Little-endian float32 xyz triples
+	Faces       []byte // Triangle list in IndexFormat
+	IndexFormat string
+	Version     uint64
+	Hash        string
+}
+
+// Reconstructor rebuilds meshes per anchor from a stream of MeshDiff
+// records in the order the relay sent them
+type Reconstructor struct {
+	meshes map[string]*Mesh
+	mutex  sync.RWMutex
+}
+
+// NewReconstructor creates an empty Reconstructor
+func NewReconstructor() *Reconstructor {
+	return &Reconstructor{
+		meshes: make(map[string]*Mesh),
+	}
+}
+
+// ApplyEvent applies every mesh in an event, returning the first error
+func (r *Reconstructor) ApplyEvent(event types.SpatialEvent) error {
+	var firstErr error
+	for _, diff := range event.Meshes {
+		if _, err := r.Apply(diff); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Apply rebuilds an anchor's mesh from one update and returns a copy of the
+// result. Updates older than the version currently held are rejected as
+// stale; a keyframe may repeat the current version. A delta must apply to
+// the version currently held; if it doesn't, or the result fails its hash
+// check, the anchor is dropped until the next keyframe.
+func (r *Reconstructor) Apply(diff types.MeshDiff) (*Mesh, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	current := r.meshes[diff.AnchorID]
+	isDelta := diff.IsDelta || diff.FacesIsDelta
+
+	if current != nil && diff.Version != 0 && isStale(diff.Version, current.Version, isDelta) {
+		return nil, fmt.Errorf("%w: %s version %d, have %d", ErrStale, diff.AnchorID, diff.Version, current.Version)
+	}
+	if isDelta {
+		if current == nil {
+			return nil, fmt.Errorf("%w: %s has no base for version %d", ErrGap, diff.AnchorID, diff.Version)
+		}
+		if diff.Version != 0 && diff.BaseVersion != current.Version {
+			delete(r.meshes, diff.AnchorID)
+			return nil, fmt.Errorf("%w: %s delta applies to version %d, have %d", ErrGap, diff.AnchorID, diff.BaseVersion, current.Version)
+		}
+	}
+
+	next, err := rebuild(current, diff)
+	if err != nil {
+		delete(r.meshes, diff.AnchorID)
+		return nil, fmt.Errorf("failed to apply %s version %d: %w", diff.AnchorID, diff.Version, err)
+	}
+
+	if diff.Hash != "" && next.Hash != diff.Hash {
+		delete(r.meshes, diff.AnchorID)
+		return nil, fmt.Errorf("%w: %s version %d", ErrHashMismatch, diff.AnchorID, diff.Version)
+	}
+
+	r.meshes[diff.AnchorID] = next
+	return next.clone(), nil
+}
+
+// isStale reports whether an update at version is older than the current
+// one. A keyframe at the current version is a resend and still applies.
+func isStale(version, current uint64, isDelta bool) bool {
+	if isDelta {
+		return version <= current
+	}
+	return version < current
+}
+
+// rebuild produces the mesh after diff from current, which may be nil for
+// a keyframe
+func rebuild(current *Mesh, diff types.MeshDiff) (*Mesh, error) {
+	vertices := diff.VerticesDelta
+	switch diff.VerticesEncoding {
+	case "":
+	case EncodingGzip:
+		decompressed, err := Decompress(vertices)
+		if err != nil {
+			return nil, err
+		}
+		vertices = decompressed
+	default:
+		return nil, fmt.Errorf("unsupported vertices encoding: %s", diff.VerticesEncoding)
+	}
+
+	if diff.IsDelta {
+		applied, err := ApplyVertices(current.Vertices, vertices)
+		if err != nil {
+			return nil, err
+		}
+		vertices = applied
+	}
+
+	faces := diff.FacesDelta
+	if diff.FacesIsDelta {
+		applied, err := ApplyFaces(current.Faces, faces)
+		if err != nil {
+			return nil, err
+		}
+		faces = applied
+	}
+
+	return &Mesh{
+		AnchorID:    diff.AnchorID,
+		Vertices:    vertices,
+		Faces:       faces,
+		IndexFormat: diff.IndexFormat,
+		Version:     diff.Version,
+		Hash:        Hash(vertices, faces),
+	}, nil
+}
+
+// Mesh returns a copy of an anchor's current mesh
+func (r *Reconstructor) Mesh(anchorID string) (*Mesh, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	mesh, exists := r.meshes[anchorID]
+	if !exists {
+		return nil, false
+	}
+	return mesh.clone(), true
+}
+
+// Forget drops an anchor's mesh
+func (r *Reconstructor) Forget(anchorID string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.meshes, anchorID)
+}
+
+func (m *Mesh) clone() *Mesh {
+	c := *m
+	c.Vertices = append([]byte(nil), m.Vertices...)
+	c.Faces = append([]byte(nil), m.Faces...)
+	return &c
+}
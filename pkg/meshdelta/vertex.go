@@ -0,0 +1,252 @@
+package meshdelta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Vertex delta wire format (version 1):
+//
+//	"TXVD" | version (1 byte) | uvarint oldCount | uvarint newCount | ops...
+//
+// Each op is a 1-byte opcode followed by a uvarint vertex count n:
+//
+//	vertexOpCopy   keep the next n old vertices
+//	vertexOpChange replace the next n old vertices with n*12 bytes of xyz float32
+//	vertexOpAdd    insert n*12 bytes of new xyz float32 vertices
+//	vertexOpRemove skip the next n old vertices
+//
+// Vertices are little-endian float32 xyz triples. Applying the ops to the
+// old buffer in order yields the new buffer.
+const (
+	vertexDeltaMagic   = "TXVD"
+	vertexDeltaVersion = 1
+	vertexStride       = 12
+
+	vertexOpCopy   byte = 0x01
+	vertexOpChange byte = 0x02
+	vertexOpAdd    byte = 0x03
+	vertexOpRemove byte = 0x04
+)
+
+// ErrNotVertexBuffer is returned when a buffer isn't a whole number of vertices
+var ErrNotVertexBuffer = errors.New("buffer is not a list of float32 xyz vertices")
+
+// EncodeVertices diffs two raw vertex buffers. Vertices within tolerance
+// of their previous position on every axis are treated as unchanged, so the
+// returned reconstruction (what a decoder will see) can differ slightly from
+// next and must be used as the baseline for the following delta. Both
+// buffers must be decoded float32 vertices: anything else, such as Draco
+// bytes that happen to be a multiple of 12 long, is corrupted by the
+// tolerance.
+func EncodeVertices(prev, next []byte, tolerance float32) (delta, reconstructed []byte, err error) {
+	if len(prev)%vertexStride != 0 || len(next)%vertexStride != 0 {
+		return nil, nil, ErrNotVertexBuffer
+	}
+
+	oldCount := len(prev) / vertexStride
+	newCount := len(next) / vertexStride
+	match := func(i, j int) bool {
+		return vertexWithin(prev[i*vertexStride:], next[j*vertexStride:], tolerance)
+	}
+
+	// Common prefix and suffix handle appends, truncation and a single
+	// inserted or removed run without shifting every later vertex
+	common := oldCount
+	if newCount < common {
+		common = newCount
+	}
+	prefix := 0
+	for prefix < common && match(prefix, prefix) {
+		prefix++
+	}
+	suffix := 0
+	for suffix < common-prefix && match(oldCount-1-suffix, newCount-1-suffix) {
+		suffix++
+	}
+
+	enc := &vertexDeltaWriter{}
+	enc.header(oldCount, newCount)
+	enc.copy(prefix)
+
+	oldMid := oldCount - prefix - suffix
+	newMid := newCount - prefix - suffix
+	overlap := oldMid
+	if newMid < overlap {
+		overlap = newMid
+	}
+
+	// Compare the overlapping middle position by position
+	for k := 0; k < overlap; {
+		start := k
+		if match(prefix+k, prefix+k) {
+			for k < overlap && match(prefix+k, prefix+k) {
+				k++
+			}
+			enc.copy(k - start)
+			continue
+		}
+		for k < overlap && !match(prefix+k, prefix+k) {
+			k++
+		}
+		enc.change(next[(prefix+start)*vertexStride : (prefix+k)*vertexStride])
+	}
+
+	if newMid > overlap {
+		enc.add(next[(prefix+overlap)*vertexStride : (prefix+newMid)*vertexStride])
+	} else if oldMid > overlap {
+		enc.remove(oldMid - overlap)
+	}
+	enc.copy(suffix)
+
+	delta = enc.buf.Bytes()
+	reconstructed, err = ApplyVertices(prev, delta)
+	if err != nil {
+		return nil, nil, fmt.Errorf("vertex delta self-check failed: %w", err)
+	}
+	return delta, reconstructed, nil
+}
+
+// ApplyVertices rebuilds the new vertex buffer from the previous one
+func ApplyVertices(prev, delta []byte) ([]byte, error) {
+	if len(delta) < len(vertexDeltaMagic)+1 || string(delta[:len(vertexDeltaMagic)]) != vertexDeltaMagic {
+		return nil, fmt.Errorf("not a vertex delta")
+	}
+	if version := delta[len(vertexDeltaMagic)]; version != vertexDeltaVersion {
+		return nil, fmt.Errorf("unsupported vertex delta version %d", version)
+	}
+
+	r := bytes.NewReader(delta[len(vertexDeltaMagic)+1:])
+	oldCount, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("truncated vertex delta header: %w", err)
+	}
+	newCount, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("truncated vertex delta header: %w", err)
+	}
+	if uint64(len(prev)) != oldCount*vertexStride {
+		return nil, fmt.Errorf("vertex delta expects %d base vertices, have %d", oldCount, len(prev)/vertexStride)
+	}
+	if newCount > uint64(len(delta))+oldCount {
+		// Every new vertex is either copied from the base or spelled out in the delta
+		return nil, fmt.Errorf("vertex delta claims implausible vertex count %d", newCount)
+	}
+
+	out := make([]byte, 0, newCount*vertexStride)
+	cursor := 0 // Position in prev, in bytes
+
+	for r.Len() > 0 {
+		op, _ := r.ReadByte()
+		n64, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, fmt.Errorf("truncated vertex delta op: %w", err)
+		}
+		if n64 > uint64(len(delta))+oldCount {
+			return nil, fmt.Errorf("vertex delta op count %d out of range", n64)
+		}
+		size := int(n64) * vertexStride
+
+		switch op {
+		case vertexOpCopy, vertexOpChange, vertexOpRemove:
+			if cursor+size > len(prev) {
+				return nil, fmt.Errorf("vertex delta runs past end of base buffer")
+			}
+		}
+
+		switch op {
+		case vertexOpCopy:
+			out = append(out, prev[cursor:cursor+size]...)
+			cursor += size
+		case vertexOpChange, vertexOpAdd:
+			if r.Len() < size {
+				return nil, fmt.Errorf("truncated vertex delta payload")
+			}
+			start := len(out)
+			out = append(out, make([]byte, size)...)
+			r.Read(out[start:])
+			if op == vertexOpChange {
+				cursor += size
+			}
+		case vertexOpRemove:
+			cursor += size
+		default:
+			return nil, fmt.Errorf("unknown vertex delta op 0x%02x", op)
+		}
+	}
+
+	if cursor != len(prev) {
+		return nil, fmt.Errorf("vertex delta left %d base vertices unaccounted for", (len(prev)-cursor)/vertexStride)
+	}
+	if uint64(len(out)) != newCount*vertexStride {
+		return nil, fmt.Errorf("vertex delta produced %d vertices, expected %d", len(out)/vertexStride, newCount)
+	}
+	return out, nil
+}
+
+// vertexWithin reports whether two xyz vertices match within tolerance
+func vertexWithin(a, b []byte, tolerance float32) bool {
+	for axis := 0; axis < 3; axis++ {
+		ab := binary.LittleEndian.Uint32(a[axis*4:])
+		bb := binary.LittleEndian.Uint32(b[axis*4:])
+		if ab == bb {
+			continue
+		}
+		diff := math.Abs(float64(math.Float32frombits(ab)) - float64(math.Float32frombits(bb)))
+		if !(diff <= float64(tolerance)) { // NaN never matches
+			return false
+		}
+	}
+	return true
+}
+
+// vertexDeltaWriter accumulates an encoded vertex delta
+type vertexDeltaWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *vertexDeltaWriter) header(oldCount, newCount int) {
+	w.buf.WriteString(vertexDeltaMagic)
+	w.buf.WriteByte(vertexDeltaVersion)
+	w.uvarint(uint64(oldCount))
+	w.uvarint(uint64(newCount))
+}
+
+func (w *vertexDeltaWriter) copy(n int) {
+	if n > 0 {
+		w.op(vertexOpCopy, n)
+	}
+}
+
+func (w *vertexDeltaWriter) remove(n int) {
+	if n > 0 {
+		w.op(vertexOpRemove, n)
+	}
+}
+
+func (w *vertexDeltaWriter) change(vertices []byte) {
+	if len(vertices) > 0 {
+		w.op(vertexOpChange, len(vertices)/vertexStride)
+		w.buf.Write(vertices)
+	}
+}
+
+func (w *vertexDeltaWriter) add(vertices []byte) {
+	if len(vertices) > 0 {
+		w.op(vertexOpAdd, len(vertices)/vertexStride)
+		w.buf.Write(vertices)
+	}
+}
+
+func (w *vertexDeltaWriter) op(code byte, n int) {
+	w.buf.WriteByte(code)
+	w.uvarint(uint64(n))
+}
+
+func (w *vertexDeltaWriter) uvarint(v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	w.buf.Write(tmp[:binary.PutUvarint(tmp[:], v)])
+}
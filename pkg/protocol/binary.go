@@ -0,0 +1,237 @@
+// Package protocol implements the StreamKit wire formats the gate accepts
+// besides plain JSON.
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/tabular/relay/pkg/types"
+)
+
+// BinarySubprotocol is the WebSocket subprotocol clients request to send
+// binary frames instead of JSON packets
+const BinarySubprotocol = "streamkit.bin.v1"
+
+// Binary frame layout, all integers big-endian:
+//
+//	version      uint8  (1)
+//	type         uint8  (1 pose, 2 mesh)
+//	flags        uint8  (reserved, 0)
+//	session len  uint8, session ID bytes
+//	frame number uint32
+//	timestamp    int64  (Unix milliseconds)
+//
+// A pose is followed by x, y, z and the rotation quaternion as seven
+// float64s. A mesh is followed by:
+//
+//	anchor len   uint8, anchor ID bytes
+//	index format uint8  (0 unset, 1 uint16, 2 uint32)
+//	attr count   uint8
+//	per attribute: id uint8 (1 vertices, 2 faces), length uint32, raw bytes
+//
+// Attributes with unknown IDs are skipped so later versions can add them.
+const (
+	binaryVersion = 1
+
+	frameTypePose = 1
+	frameTypeMesh = 2
+
+	attrVertices = 1
+	attrFaces    = 2
+
+	headerSize = 4 + 4 + 8 // Fixed header fields around the session ID
+	poseSize   = 7 * 8
+)
+
+var indexFormats = []string{"", "uint16", "uint32"}
+
+// ErrTruncated is returned for frames that end before their declared fields
+var ErrTruncated = errors.New("binary frame truncated")
+
+// EncodeBinary encodes a pose or mesh packet as a binary frame
+func EncodeBinary(packet types.StreamPacket) ([]byte, error) {
+	if len(packet.SessionID) > math.MaxUint8 {
+		return nil, fmt.Errorf("session ID longer than %d bytes", math.MaxUint8)
+	}
+	if packet.FrameNumber < 0 || int64(packet.FrameNumber) > math.MaxUint32 {
+		return nil, fmt.Errorf("frame number %d out of range", packet.FrameNumber)
+	}
+
+	var frameType byte
+	size := headerSize + len(packet.SessionID)
+	switch packet.Type {
+	case "pose":
+		if packet.Data.Pose == nil {
+			return nil, fmt.Errorf("pose packet without pose data")
+		}
+		frameType = frameTypePose
+		size += poseSize
+	case "mesh":
+		mesh := packet.Data.Mesh
+		if mesh == nil {
+			return nil, fmt.Errorf("mesh packet without mesh data")
+		}
+		if len(mesh.AnchorID) > math.MaxUint8 {
+			return nil, fmt.Errorf("anchor ID longer than %d bytes", math.MaxUint8)
+		}
+		if int64(len(mesh.Vertices)) > math.MaxUint32 || int64(len(mesh.Faces)) > math.MaxUint32 {
+			return nil, fmt.Errorf("mesh attribute larger than 4 GiB")
+		}
+		frameType = frameTypeMesh
+		size += 3 + len(mesh.AnchorID) + 2*5 + len(mesh.Vertices) + len(mesh.Faces)
+	default:
+		return nil, fmt.Errorf("unsupported packet type for binary frames: %q", packet.Type)
+	}
+
+	buf := make([]byte, 0, size)
+	buf = append(buf, binaryVersion, frameType, 0, byte(len(packet.SessionID)))
+	buf = append(buf, packet.SessionID...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(packet.FrameNumber))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(packet.Timestamp))
+
+	if frameType == frameTypePose {
+		pose := packet.Data.Pose
+		for _, v := range []float64{pose.X, pose.Y, pose.Z, pose.Rotation[0], pose.Rotation[1], pose.Rotation[2], pose.Rotation[3]} {
+			buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(v))
+		}
+		return buf, nil
+	}
+
+	mesh := packet.Data.Mesh
+	indexFormat, err := encodeIndexFormat(mesh.IndexFormat)
+	if err != nil {
+		return nil, err
+	}
+	buf = append(buf, byte(len(mesh.AnchorID)))
+	buf = append(buf, mesh.AnchorID...)
+	buf = append(buf, indexFormat, 2)
+	buf = appendAttribute(buf, attrVertices, mesh.Vertices)
+	buf = appendAttribute(buf, attrFaces, mesh.Faces)
+	return buf, nil
+}
+
+// DecodeBinary decodes a binary frame. Mesh attributes alias data rather
+// than being copied, so data must not be reused while the packet is live.
+func DecodeBinary(data []byte) (types.StreamPacket, error) {
+	var packet types.StreamPacket
+	r := reader{buf: data}
+
+	version, frameType, _ := r.u8(), r.u8(), r.u8()
+	if r.err != nil {
+		return packet, r.err
+	}
+	if version != binaryVersion {
+		return packet, fmt.Errorf("unsupported binary frame version %d", version)
+	}
+
+	packet.SessionID = string(r.take(int(r.u8())))
+	packet.FrameNumber = int(r.u32())
+	packet.Timestamp = int64(r.u64())
+
+	switch frameType {
+	case frameTypePose:
+		packet.Type = "pose"
+		pose := &types.PoseData{X: r.f64(), Y: r.f64(), Z: r.f64()}
+		for i := range pose.Rotation {
+			pose.Rotation[i] = r.f64()
+		}
+		packet.Data.Pose = pose
+	case frameTypeMesh:
+		packet.Type = "mesh"
+		mesh := &types.MeshData{AnchorID: string(r.take(int(r.u8())))}
+		indexFormat := r.u8()
+		if int(indexFormat) >= len(indexFormats) {
+			return packet, fmt.Errorf("unknown index format %d", indexFormat)
+		}
+		mesh.IndexFormat = indexFormats[indexFormat]
+
+		attributes := int(r.u8())
+		for i := 0; i < attributes && r.err == nil; i++ {
+			id := r.u8()
+			payload := r.take(int(r.u32()))
+			if len(payload) == 0 {
+				payload = nil
+			}
+			switch id {
+			case attrVertices:
+				mesh.Vertices = payload
+			case attrFaces:
+				mesh.Faces = payload
+			}
+		}
+		packet.Data.Mesh = mesh
+	default:
+		return packet, fmt.Errorf("unknown binary frame type %d", frameType)
+	}
+
+	if r.err != nil {
+		return packet, r.err
+	}
+	if len(r.buf) > 0 {
+		return packet, fmt.Errorf("%d trailing bytes after binary frame", len(r.buf))
+	}
+	return packet, nil
+}
+
+func encodeIndexFormat(format string) (byte, error) {
+	for i, name := range indexFormats {
+		if name == format {
+			return byte(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown index format %q", format)
+}
+
+func appendAttribute(buf []byte, id byte, payload []byte) []byte {
+	buf = append(buf, id)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(payload)))
+	return append(buf, payload...)
+}
+
+// reader consumes a frame, remembering the first short read
+type reader struct {
+	buf []byte
+	err error
+}
+
+func (r *reader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.buf) < n {
+		r.err = ErrTruncated
+		r.buf = nil
+		return nil
+	}
+	b := r.buf[:n:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *reader) u8() byte {
+	if b := r.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) u32() uint32 {
+	if b := r.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *reader) u64() uint64 {
+	if b := r.take(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *reader) f64() float64 {
+	return math.Float64frombits(r.u64())
+}
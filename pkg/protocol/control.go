@@ -0,0 +1,33 @@
+package protocol
+
+// Control message types the relay sends to clients
+const (
+	ControlAck     = "ack"     // Every frame up to FrameNumber was accepted or nacked
+	ControlNack    = "nack"    // FrameNumber was dropped for Reason
+	ControlResend  = "resend"  // Frames never arrived; reliable clients send them again
+	ControlSession = "session" // First message; ResumeToken resumes the stream after a drop
+
+	// Flow control: the relay is falling behind, and has caught up again
+	ControlSlowDown = "slow_down"
+	ControlResume   = "resume"
+)
+
+// Nack reasons
+const (
+	NackBufferFull      = "buffer_full"      // The relay was too busy to queue the frame
+	NackParseError      = "parse_error"      // The frame couldn't be decoded or processed
+	NackValidationError = "validation_error" // The frame decoded but its contents are invalid
+	NackRejected        = "rejected"         // Delivery refused it, e.g. a full spool
+	NackRateLimited     = "rate_limited"     // The client sent more than its budget
+)
+
+// ControlMessage is a JSON text message from the relay to a client. It is
+// sent as text on binary connections too.
+type ControlMessage struct {
+	Type        string `json:"type"`
+	FrameNumber int    `json:"frame_number"`
+	Reason      string `json:"reason,omitempty"`
+	Error       string `json:"error,omitempty"`
+	Frames      []int  `json:"frames,omitempty"`       // Missing frames, for resend
+	ResumeToken string `json:"resume_token,omitempty"` // For session
+}
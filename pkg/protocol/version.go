@@ -0,0 +1,40 @@
+package protocol
+
+import "strings"
+
+// Packet schema versions. Version 1 is the JSON schema headsets sent before
+// versions were negotiated; its mesh faces were always 32-bit triangle
+// lists. Version 2 added 16-bit lists, told apart by index_format.
+const (
+	Version1       = 1
+	Version2       = 2
+	CurrentVersion = Version2
+)
+
+// JSON subprotocols, one per packet schema version
+const (
+	SubprotocolV1 = "streamkit.v1"
+	SubprotocolV2 = "streamkit.v2"
+)
+
+// Subprotocols lists the subprotocols the gate accepts, most preferred first
+var Subprotocols = []string{BinarySubprotocol, SubprotocolV2, SubprotocolV1}
+
+// Version returns the packet schema version spoken over a subprotocol.
+// Clients that don't request a subprotocol speak version 1.
+func Version(subprotocol string) (int, bool) {
+	switch subprotocol {
+	case "", SubprotocolV1:
+		return Version1, true
+	case SubprotocolV2, BinarySubprotocol:
+		return Version2, true
+	default:
+		return 0, false
+	}
+}
+
+// Supported returns the accepted subprotocols as a comma-separated list,
+// for error messages
+func Supported() string {
+	return strings.Join(Subprotocols, ", ")
+}
@@ -0,0 +1,86 @@
+package sink
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy controls how failed deliveries are retried
+type RetryPolicy struct {
+	MaxAttempts    int           // Total delivery attempts, including the first
+	InitialBackoff time.Duration // Delay before the first retry
+	MaxBackoff     time.Duration // Upper bound for any computed delay, jitter included
+	Multiplier     float64       // Growth factor between retries
+	Jitter         float64       // Fraction of the delay randomised (0-1)
+	MaxRetryAfter  time.Duration // Upper bound for a delay a server asked for with Retry-After
+}
+
+// DefaultRetryPolicy returns the retry policy used when none is configured
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: 200 * time.Millisecond,
+		MaxBackoff:     10 * time.Second,
+		Multiplier:     2.0,
+		Jitter:         0.2,
+		MaxRetryAfter:  5 * time.Minute,
+	}
+}
+
+// Normalize fills in zero values with defaults
+func (p RetryPolicy) Normalize() RetryPolicy {
+	defaults := DefaultRetryPolicy()
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = defaults.MaxAttempts
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = defaults.InitialBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = defaults.MaxBackoff
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = defaults.Multiplier
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		p.Jitter = defaults.Jitter
+	}
+	if p.MaxRetryAfter <= 0 {
+		p.MaxRetryAfter = defaults.MaxRetryAfter
+	}
+	return p
+}
+
+// Backoff returns the delay before the given retry (1 = first retry)
+func (p RetryPolicy) Backoff(retry int) time.Duration {
+	if retry < 1 {
+		retry = 1
+	}
+
+	delay := float64(p.InitialBackoff) * math.Pow(p.Multiplier, float64(retry-1))
+	delay = math.Min(delay, float64(p.MaxBackoff))
+
+	// Spread retries from many relays so they don't hit a destination in lockstep
+	if p.Jitter > 0 {
+		delta := delay * p.Jitter
+		delay = delay - delta + rand.Float64()*2*delta
+	}
+
+	// Jitter must not take the delay past the documented maximum
+	return time.Duration(math.Min(delay, float64(p.MaxBackoff)))
+}
+
+// RetryDelay picks the wait before the next attempt. A Retry-After from
+// the server is honored in full, up to MaxRetryAfter, so the relay never
+// comes back sooner than it was asked to.
+func (p RetryPolicy) RetryDelay(retry int, err error) time.Duration {
+	if after := RetryAfter(err); after > 0 {
+		limit := p.MaxRetryAfter
+		if limit <= 0 {
+			limit = DefaultRetryPolicy().MaxRetryAfter
+		}
+		return min(after, limit)
+	}
+	return p.Backoff(retry)
+}
@@ -0,0 +1,125 @@
+// Package sink defines the destinations the relay delivers events to.
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tabular/relay/pkg/types"
+)
+
+// Sink is a destination for batches of processed events
+type Sink interface {
+	// Name identifies the sink in logs, metrics and dead letters
+	Name() string
+
+	// Send delivers a batch and returns one Result per event, in batch
+	// order. A non-nil error means nothing in the batch was delivered.
+	Send(ctx context.Context, events []types.SpatialEvent) ([]Result, error)
+
+	// Close releases the sink's resources once no more batches will be sent
+	Close() error
+}
+
+// Resyncer is implemented by sinks whose destination can ask for mesh
+// keyframes, such as STAG losing track of a delta chain
+type Resyncer interface {
+	// Resync returns and clears the anchors that need a keyframe
+	Resync() []string
+}
+
+// Result is the outcome of delivering a single event
+type Result struct {
+	EventID string
+	Err     error // Nil when the event was delivered
+}
+
+// Delivered returns a successful Result for every event
+func Delivered(events []types.SpatialEvent) []Result {
+	results := make([]Result, len(events))
+	for i, event := range events {
+		results[i] = Result{EventID: event.EventID}
+	}
+	return results
+}
+
+// DeliveryError describes a failure reported by a destination
+type DeliveryError struct {
+	Sink       string
+	StatusCode int           // HTTP-style status; 0 if the destination has none
+	RetryAfter time.Duration // Wait requested by the destination, if any
+	Permanent  bool          // Retrying can't succeed, regardless of status
+	Err        error         // Optional underlying cause
+}
+
+func (e *DeliveryError) Error() string {
+	msg := fmt.Sprintf("%s returned status %d", e.Sink, e.StatusCode)
+	if e.StatusCode == 0 {
+		msg = fmt.Sprintf("%s rejected delivery", e.Sink)
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *DeliveryError) Unwrap() error {
+	return e.Err
+}
+
+// IsRetryable reports whether a delivery error is worth retrying
+func IsRetryable(err error) bool {
+	var de *DeliveryError
+	if !errors.As(err, &de) {
+		// Transport errors (timeouts, refused connections) are transient
+		return true
+	}
+	if de.Permanent {
+		return false
+	}
+
+	switch {
+	case de.StatusCode == 0,
+		de.StatusCode == http.StatusTooManyRequests,
+		de.StatusCode == http.StatusRequestTimeout,
+		de.StatusCode >= 500:
+		return true
+	default:
+		return false
+	}
+}
+
+// RetryAfter returns the wait a destination asked for, or 0
+func RetryAfter(err error) time.Duration {
+	var de *DeliveryError
+	if errors.As(err, &de) {
+		return de.RetryAfter
+	}
+	return 0
+}
+
+// ParseRetryAfter parses a Retry-After header in either seconds or HTTP-date form
+func ParseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+
+	if when, err := http.ParseTime(value); err == nil {
+		if d := when.Sub(now); d > 0 {
+			return d
+		}
+	}
+
+	return 0
+}
@@ -27,9 +27,14 @@ type PoseData struct {
 
 // MeshData represents 3D mesh geometry
 type MeshData struct {
-	Vertices []byte `json:"vertices"` // Draco-compressed
-	Faces    []byte `json:"faces"`    // Draco-compressed
-	AnchorID string `json:"anchor_id"`
+	Vertices    []byte `json:"vertices"` // Draco-compressed
+	Faces       []byte `json:"faces"`    // Draco-compressed
+	AnchorID    string `json:"anchor_id"`
+	IndexFormat string `json:"index_format,omitempty"` // "uint16" | "uint32" triangle list
+	
+	// Set by the parser when Vertices are plain float32 xyz and Faces a
+	// plain index list, rather than still-encoded (e.g. Draco) bytes
+	Decoded bool `json:"-"`
 }
 
 // SpatialEvent represents processed data sent to STAG
@@ -53,15 +58,31 @@ type MeshDiff struct {
 	AnchorID      string  `json:"anchor_id"`
 	VerticesDelta []byte  `json:"vertices_delta,omitempty"`
 	FacesDelta    []byte  `json:"faces_delta,omitempty"`
-	IsDelta       bool    `json:"is_delta"`
+	IsDelta       bool    `json:"is_delta"`                 // VerticesDelta is relative to the previous version
+	FacesIsDelta  bool    `json:"faces_is_delta,omitempty"` // FacesDelta is relative to the previous version
+	IndexFormat   string  `json:"index_format,omitempty"`   // "uint16" | "uint32" triangle list
+	Decoded       bool    `json:"-"`                        // Plain float32 vertices and indices, safe to diff
+	
+	VerticesEncoding string `json:"vertices_encoding,omitempty"` // "gzip" when VerticesDelta is compressed
+	
+	// Delta chain. Version increases with every update of an anchor's mesh;
+	// BaseVersion is the version a delta applies to, and 0 for a keyframe.
+	// Hash is the hex SHA-256 of the reconstructed vertices followed by faces.
+	Version     uint64 `json:"version,omitempty"`
+	BaseVersion uint64 `json:"base_version,omitempty"`
+	Hash        string `json:"hash,omitempty"`
 }
 
 // Connection represents a WebSocket client
 type Connection struct {
-	ID        string
-	SessionID string
-	LastSeen  time.Time
-	APIKey    string
+	ID          string
+	SessionID   string
+	LastSeen    time.Time     // Last packet or pong
+	RTT         time.Duration // Round trip time of the last answered ping
+	APIKey      string
+	Subprotocol string // Negotiated WebSocket subprotocol; empty for JSON
+	
+	ProtocolVersion int // Packet schema version the client speaks
 }
 
 // Config holds application configuration
@@ -69,6 +90,10 @@ type Config struct {
 	Server struct {
 		Port string `mapstructure:"port"`
 		Host string `mapstructure:"host"`
+		
+		// X-API-Key values allowed on the dead-letter and webhook failure
+		// endpoints; empty serves them to loopback clients only
+		AdminKeys []string `mapstructure:"admin_keys"`
 	} `mapstructure:"server"`
 	
 	STAG struct {
@@ -78,11 +103,227 @@ type Config struct {
 	
 	WebSocket struct {
 		BufferSize        int           `mapstructure:"buffer_size"`
+		QueueDepth        int           `mapstructure:"queue_depth"`
+		QueueWeights      []QueueWeight `mapstructure:"queue_weights"`
 		HeartbeatInterval time.Duration `mapstructure:"heartbeat_interval"`
+		MaxMissedPongs    int           `mapstructure:"max_missed_pongs"`
+		AckInterval       time.Duration `mapstructure:"ack_interval"`
+		WriteTimeout      time.Duration `mapstructure:"write_timeout"`
+		ResumeWindow      time.Duration `mapstructure:"resume_window"`
+		
+		ResendInterval time.Duration `mapstructure:"resend_interval"`
+		ResendAttempts int           `mapstructure:"resend_attempts"`
+		
+		RateLimits RateLimitConfig `mapstructure:"rate_limits"`
 	} `mapstructure:"websocket"`
 	
+	Pipeline struct {
+		Fast         LaneConfig `mapstructure:"fast"`           // Pose and other small packets
+		Bulk         LaneConfig `mapstructure:"bulk"`           // Meshes
+		FastMaxBytes int        `mapstructure:"fast_max_bytes"` // Larger packets go to the bulk lane
+	} `mapstructure:"pipeline"`
+	
 	Batch struct {
-		MaxSize int           `mapstructure:"max_size"`
-		Timeout time.Duration `mapstructure:"timeout"`
+		MaxSize     int           `mapstructure:"max_size"`
+		Timeout     time.Duration `mapstructure:"timeout"`
+		MaxQueued   int           `mapstructure:"max_queued"`    // Events waiting per sink before the pipeline is held up
+		MaxInFlight int           `mapstructure:"max_in_flight"` // Batches delivered at once per sink
+		MaxBytes    int           `mapstructure:"max_bytes"`     // Serialized bytes per batch; 0 for no limit
+		
+		Adaptive AdaptiveBatchConfig `mapstructure:"adaptive"`
 	} `mapstructure:"batch"`
+	
+	Retry RetryConfig `mapstructure:"retry"`
+	
+	// Thinning of pose updates; sinks may set their own
+	Coalesce CoalesceConfig `mapstructure:"coalesce"`
+	
+	// Destinations for processed events; empty sends everything to STAG
+	Sinks []SinkConfig `mapstructure:"sinks"`
+	
+	// Signed notifications to third-party systems, per API key
+	Webhooks WebhookConfig `mapstructure:"webhooks"`
+	
+	DeadLetter struct {
+		Dir string `mapstructure:"dir"`
+	} `mapstructure:"dead_letter"`
+	
+	Diff struct {
+		VertexTolerance  float32       `mapstructure:"vertex_tolerance"`
+		MaxDeltaRatio    float64       `mapstructure:"max_delta_ratio"`
+		KeyframeInterval int           `mapstructure:"keyframe_interval"` // Deltas between forced keyframes
+		KeyframeMaxAge   time.Duration `mapstructure:"keyframe_max_age"`
+	} `mapstructure:"diff"`
+	
+	MeshCache struct {
+		MaxBytes int64         `mapstructure:"max_bytes"`
+		IdleTTL  time.Duration `mapstructure:"idle_ttl"`
+	} `mapstructure:"mesh_cache"`
+	
+	Spool struct {
+		Dir          string `mapstructure:"dir"`
+		SegmentBytes int64  `mapstructure:"segment_bytes"`
+		MaxBytes     int64  `mapstructure:"max_bytes"`
+		Overflow     string `mapstructure:"overflow"` // "reject" | "drop_oldest"
+		Fsync        bool   `mapstructure:"fsync"`
+	} `mapstructure:"spool"`
+}
+
+// LaneConfig sizes one priority class of the processing pipeline
+type LaneConfig struct {
+	Workers int `mapstructure:"workers"`
+	Queue   int `mapstructure:"queue"`
+}
+
+// AdaptiveBatchConfig moves each sink's batch window with its latency and
+// error rate
+type AdaptiveBatchConfig struct {
+	Enabled       bool          `mapstructure:"enabled"`
+	MinTimeout    time.Duration `mapstructure:"min_timeout"`
+	MaxTimeout    time.Duration `mapstructure:"max_timeout"`
+	TargetLatency time.Duration `mapstructure:"target_latency"`
+	MaxErrorRate  float64       `mapstructure:"max_error_rate"`
+}
+
+// RetryConfig controls how failed batches are retried
+type RetryConfig struct {
+	MaxAttempts    int           `mapstructure:"max_attempts"`
+	InitialBackoff time.Duration `mapstructure:"initial_backoff"`
+	MaxBackoff     time.Duration `mapstructure:"max_backoff"`
+	Multiplier     float64       `mapstructure:"multiplier"`
+	Jitter         float64       `mapstructure:"jitter"`
+	MaxRetryAfter  time.Duration `mapstructure:"max_retry_after"` // Longest Retry-After honored
+}
+
+// CoalesceConfig selects how a sink's poses are thinned out per batch
+type CoalesceConfig struct {
+	Mode        string  `mapstructure:"mode"`         // "none" | "latest" | "every_nth" | "motion"
+	EveryN      int     `mapstructure:"every_n"`      // every_nth
+	MinDistance float64 `mapstructure:"min_distance"` // motion, meters
+	MinAngle    float64 `mapstructure:"min_angle"`    // motion, degrees
+}
+
+// QueueWeight gives the connections of an API key more turns from the
+// gate's scheduler
+type QueueWeight struct {
+	APIKey string `mapstructure:"api_key"`
+	Weight int    `mapstructure:"weight"`
+}
+
+// RateLimitConfig configures token bucket limits on incoming packets
+type RateLimitConfig struct {
+	Policy          string `mapstructure:"policy"` // "nack" | "close"; what happens to over-limit traffic
+	RateLimitScopes `mapstructure:",squash"`
+	
+	// Replace both scopes for particular API keys
+	Overrides []RateLimitOverride `mapstructure:"overrides"`
+}
+
+// RateLimitScopes holds the limits of each connection and of each API key
+// across all its connections
+type RateLimitScopes struct {
+	PerConnection RateLimits `mapstructure:"per_connection"`
+	PerKey        RateLimits `mapstructure:"per_key"`
+}
+
+// RateLimitOverride sets the limits of one API key
+type RateLimitOverride struct {
+	APIKey          string `mapstructure:"api_key"`
+	RateLimitScopes `mapstructure:",squash"`
+}
+
+// RateLimits holds separate budgets for pose and mesh packets
+type RateLimits struct {
+	Pose RateBudget `mapstructure:"pose"`
+	Mesh RateBudget `mapstructure:"mesh"`
+}
+
+// RateBudget is a sustained rate; bursts of up to one second's worth pass.
+// Zero means unlimited.
+type RateBudget struct {
+	PacketsPerSec float64 `mapstructure:"packets_per_sec"`
+	BytesPerSec   float64 `mapstructure:"bytes_per_sec"`
+}
+
+// WebhookConfig configures webhook notifications
+type WebhookConfig struct {
+	Timeout     time.Duration       `mapstructure:"timeout"`
+	QueueSize   int                 `mapstructure:"queue_size"` // Notifications buffered per subscriber
+	Retry       *RetryConfig        `mapstructure:"retry"`      // Unset fields fall back to the top-level retry settings
+	Subscribers []WebhookSubscriber `mapstructure:"subscribers"`
+}
+
+// WebhookSubscriber receives notifications for sessions streamed with an API key
+type WebhookSubscriber struct {
+	APIKey string   `mapstructure:"api_key"`
+	URL    string   `mapstructure:"url"`
+	Secret string   `mapstructure:"secret"`
+	Events []string `mapstructure:"events"` // "session.started" | "session.ended" | "batch.delivered"; empty sends all
+}
+
+// SinkConfig configures one destination for processed events
+type SinkConfig struct {
+	Name    string        `mapstructure:"name"`
+	Type    string        `mapstructure:"type"` // "stag" | "file" | "mqtt" | "kafka"
+	URL     string        `mapstructure:"url"`  // STAG URL or MQTT broker
+	APIKey  string        `mapstructure:"api_key"`
+	Timeout time.Duration `mapstructure:"timeout"`
+	
+	// Zero values fall back to the top-level batch and retry settings
+	Batch struct {
+		MaxSize  int           `mapstructure:"max_size"`
+		Timeout  time.Duration `mapstructure:"timeout"`
+		MaxBytes int           `mapstructure:"max_bytes"`
+	} `mapstructure:"batch"`
+	Retry    *RetryConfig    `mapstructure:"retry"`
+	Coalesce *CoalesceConfig `mapstructure:"coalesce"` // Replaces the top-level policy
+	
+	Filter struct {
+		Types []string `mapstructure:"types"` // "pose" | "mesh"; empty matches all
+	} `mapstructure:"filter"`
+	
+	File  FileSinkConfig  `mapstructure:"file"`
+	MQTT  MQTTSinkConfig  `mapstructure:"mqtt"`
+	Kafka KafkaSinkConfig `mapstructure:"kafka"`
+}
+
+// FileSinkConfig configures a "file" sink
+type FileSinkConfig struct {
+	Dir         string        `mapstructure:"dir"`
+	Compression string        `mapstructure:"compression"` // "none" | "gzip" | "zstd"
+	MaxBytes    int64         `mapstructure:"max_bytes"`   // Rotate after this many uncompressed bytes
+	MaxAge      time.Duration `mapstructure:"max_age"`     // Rotate segments open this long
+	Fsync       bool          `mapstructure:"fsync"`
+}
+
+// KafkaSinkConfig configures a "kafka" sink
+type KafkaSinkConfig struct {
+	Brokers    []string `mapstructure:"brokers"`
+	Topic      string   `mapstructure:"topic"`
+	ClientID   string   `mapstructure:"client_id"`
+	Acks       string   `mapstructure:"acks"` // "all" | "leader" | "none"
+	Idempotent bool     `mapstructure:"idempotent"`
+	BatchBytes int      `mapstructure:"batch_bytes"` // Max record batch size per partition
+}
+
+// MQTTSinkConfig configures an "mqtt" sink
+type MQTTSinkConfig struct {
+	ClientID  string        `mapstructure:"client_id"`
+	Username  string        `mapstructure:"username"`
+	Password  string        `mapstructure:"password"`
+	Version   string        `mapstructure:"version"` // "3.1.1" | "5"
+	KeepAlive time.Duration `mapstructure:"keep_alive"`
+	
+	Topics struct {
+		Anchors string `mapstructure:"anchors"` // e.g. "sessions/{session_id}/anchors/{anchor_id}"
+		Meshes  string `mapstructure:"meshes"`
+	} `mapstructure:"topics"`
+	QoS struct {
+		Anchors int `mapstructure:"anchors"`
+		Meshes  int `mapstructure:"meshes"`
+	} `mapstructure:"qos"`
+	Retain struct {
+		Anchors bool `mapstructure:"anchors"`
+		Meshes  bool `mapstructure:"meshes"`
+	} `mapstructure:"retain"`
 }
\ No newline at end of file
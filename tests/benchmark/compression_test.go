@@ -5,7 +5,7 @@ import (
 	"testing"
 
 	"github.com/tabular/relay/internal/parser"
-	"github.com/tabular/relay/internal/updater"
+	"github.com/tabular/relay/pkg/meshdelta"
 	"github.com/tabular/relay/pkg/types"
 	"github.com/tabular/relay/tests/testdata"
 )
@@ -78,8 +78,6 @@ func BenchmarkDracoDecompression(b *testing.B) {
 }
 
 func BenchmarkDracoCompression(b *testing.B) {
-	updater := updater.New("http://test", 1, 0)
-	generator := testdata.NewDracoTestDataGenerator()
 	
 	// Generate raw vertex data for compression testing
 	smallVertices := testdata.CreateRawVertexData([]float32{
@@ -96,7 +94,7 @@ func BenchmarkDracoCompression(b *testing.B) {
 		b.ResetTimer()
 		b.ReportAllocs()
 		for i := 0; i < b.N; i++ {
-			_, _, err := updater.compressMeshData(smallVertices)
+			_, err := meshdelta.Compress(smallVertices)
 			if err != nil {
 				b.Fatalf("Compression failed: %v", err)
 			}
@@ -108,7 +106,7 @@ func BenchmarkDracoCompression(b *testing.B) {
 		b.ResetTimer()
 		b.ReportAllocs()
 		for i := 0; i < b.N; i++ {
-			_, _, err := updater.compressMeshData(rawSphereData)
+			_, err := meshdelta.Compress(rawSphereData)
 			if err != nil {
 				b.Fatalf("Compression failed: %v", err)
 			}
@@ -120,7 +118,7 @@ func BenchmarkDracoCompression(b *testing.B) {
 		b.ResetTimer()
 		b.ReportAllocs()
 		for i := 0; i < b.N; i++ {
-			_, _, err := updater.compressMeshData(rawLargeData)
+			_, err := meshdelta.Compress(rawLargeData)
 			if err != nil {
 				b.Fatalf("Compression failed: %v", err)
 			}
@@ -130,8 +128,6 @@ func BenchmarkDracoCompression(b *testing.B) {
 }
 
 func TestCompressionRatios(t *testing.T) {
-	updater := updater.New("http://test", 1, 0)
-	generator := testdata.NewDracoTestDataGenerator()
 	
 	testCases := []struct {
 		name     string
@@ -158,7 +154,8 @@ func TestCompressionRatios(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			rawData := testdata.CreateRawVertexData(tc.vertices)
-			compressed, bytesSaved, err := updater.compressMeshData(rawData)
+			compressed, err := meshdelta.Compress(rawData)
+			bytesSaved := len(rawData) - len(compressed)
 			
 			if err != nil {
 				t.Fatalf("Compression failed: %v", err)
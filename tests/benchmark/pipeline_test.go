@@ -0,0 +1,109 @@
+package benchmark
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tabular/relay/internal/gate"
+	"github.com/tabular/relay/internal/parser"
+	"github.com/tabular/relay/internal/pipeline"
+	"github.com/tabular/relay/internal/transformer"
+	"github.com/tabular/relay/pkg/types"
+)
+
+// discardProcessor accepts every event
+type discardProcessor struct{}
+
+func (discardProcessor) ProcessEvent(event types.SpatialEvent) error {
+	return nil
+}
+
+// countingAcker marks each frame done once the pipeline acks or nacks it
+type countingAcker struct {
+	done *sync.WaitGroup
+}
+
+func (a countingAcker) Ack(connectionID string, frame int) {
+	a.done.Done()
+}
+
+func (a countingAcker) Nack(connectionID string, frame int, reason string, err error) {
+	a.done.Done()
+}
+
+// gzipMeshMessages returns gzip-compressed mesh messages spread over
+// sessions, so parsing does real decompression work
+func gzipMeshMessages(b *testing.B, sessions int) []gate.MessageEvent {
+	vertices := make([]byte, 64<<10)
+	for i := range vertices {
+		vertices[i] = byte(i * 31)
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(vertices); err != nil {
+		b.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		b.Fatal(err)
+	}
+
+	messages := make([]gate.MessageEvent, sessions)
+	for i := range messages {
+		messages[i] = gate.MessageEvent{
+			ConnectionID: fmt.Sprintf("conn-%d", i),
+			Packet: types.StreamPacket{
+				SessionID: fmt.Sprintf("session-%d", i),
+				Timestamp: time.Now().UnixMilli(),
+				Type:      "mesh",
+				Data: types.PacketData{Mesh: &types.MeshData{
+					AnchorID: fmt.Sprintf("anchor-%d", i),
+					Vertices: buf.Bytes(),
+				}},
+			},
+		}
+	}
+	return messages
+}
+
+// BenchmarkPipeline measures mesh throughput across 64 sessions with 1 to
+// 8 bulk workers. Throughput scales with workers up to the number of CPUs.
+func BenchmarkPipeline(b *testing.B) {
+	messages := gzipMeshMessages(b, 64)
+	log.SetOutput(io.Discard) // The parser logs every decompression
+	defer log.SetOutput(os.Stderr)
+
+	run := func(b *testing.B, workers int) {
+		var done sync.WaitGroup
+		in := make(chan gate.MessageEvent, 256)
+		p := pipeline.New(in, pipeline.Options{
+			Parser:      parser.New(),
+			Transformer: transformer.New(),
+			Processor:   discardProcessor{},
+			Acker:       countingAcker{done: &done},
+			Bulk:        types.LaneConfig{Workers: workers, Queue: 1024},
+		})
+		p.Start()
+		defer p.Stop()
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		start := time.Now()
+		done.Add(b.N)
+		for i := 0; i < b.N; i++ {
+			in <- messages[i%len(messages)]
+		}
+		done.Wait()
+		b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "packets/s")
+	}
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("Workers-%d", workers), func(b *testing.B) { run(b, workers) })
+	}
+}
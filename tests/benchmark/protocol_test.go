@@ -0,0 +1,62 @@
+package benchmark
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/tabular/relay/pkg/protocol"
+	"github.com/tabular/relay/pkg/types"
+)
+
+func benchmarkMeshPacket() types.StreamPacket {
+	vertices := make([]byte, 256<<10)
+	for i := range vertices {
+		vertices[i] = byte(i * 31)
+	}
+	return types.StreamPacket{
+		SessionID:   "bench-session",
+		FrameNumber: 1,
+		Timestamp:   1634567890123,
+		Type:        "mesh",
+		Data: types.PacketData{Mesh: &types.MeshData{
+			AnchorID: "bench-anchor",
+			Vertices: vertices,
+			Faces:    vertices[:64<<10],
+		}},
+	}
+}
+
+func BenchmarkPacketDecoding(b *testing.B) {
+	packet := benchmarkMeshPacket()
+	
+	b.Run("JSON", func(b *testing.B) {
+		data, err := json.Marshal(packet)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.SetBytes(int64(len(data)))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			var decoded types.StreamPacket
+			if err := json.Unmarshal(data, &decoded); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	
+	b.Run("Binary", func(b *testing.B) {
+		data, err := protocol.EncodeBinary(packet)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.SetBytes(int64(len(data)))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := protocol.DecodeBinary(data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,402 @@
+package testdata
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// KafkaRecord is a record stored by KafkaBroker
+type KafkaRecord struct {
+	Partition int32
+	Offset    int64
+	Key       string
+	Value     []byte
+	Headers   map[string]string
+}
+
+// KafkaBroker is an in-process single-node Kafka stand-in for tests. It
+// answers Metadata v1, InitProducerId v0 and Produce v3 for one topic,
+// checks record batch CRCs and enforces idempotent producer sequences.
+type KafkaBroker struct {
+	listener   net.Listener
+	topic      string
+	partitions int32
+
+	mutex     sync.Mutex
+	records   map[int32][]KafkaRecord
+	batches   map[int32]int
+	failures  map[int32][]int16     // Partition -> error codes to answer next produces with
+	sequences map[[2]int64]int32    // {producer ID, partition} -> next sequence
+	lastBatch map[[2]int64][2]int32 // {producer ID, partition} -> last {base sequence, count}
+	nextPID   int64
+	conns     map[net.Conn]bool
+	wg        sync.WaitGroup
+}
+
+// NewKafkaBroker starts a broker serving topic with the given partitions
+func NewKafkaBroker(topic string, partitions int32) (*KafkaBroker, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	b := &KafkaBroker{
+		listener:   listener,
+		topic:      topic,
+		partitions: partitions,
+		records:    make(map[int32][]KafkaRecord),
+		batches:    make(map[int32]int),
+		failures:   make(map[int32][]int16),
+		sequences:  make(map[[2]int64]int32),
+		lastBatch:  make(map[[2]int64][2]int32),
+		nextPID:    1000,
+		conns:      make(map[net.Conn]bool),
+	}
+	b.wg.Add(1)
+	go b.accept()
+	return b, nil
+}
+
+// Addr returns the broker's "host:port"
+func (b *KafkaBroker) Addr() string {
+	return b.listener.Addr().String()
+}
+
+// Records returns the records written to a partition
+func (b *KafkaBroker) Records(partition int32) []KafkaRecord {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]KafkaRecord(nil), b.records[partition]...)
+}
+
+// AllRecords returns the records of every partition
+func (b *KafkaBroker) AllRecords() []KafkaRecord {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var all []KafkaRecord
+	for p := int32(0); p < b.partitions; p++ {
+		all = append(all, b.records[p]...)
+	}
+	return all
+}
+
+// Batches returns how many record batches a partition accepted
+func (b *KafkaBroker) Batches(partition int32) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.batches[partition]
+}
+
+// FailNext answers the next produce to a partition with an error code
+func (b *KafkaBroker) FailNext(partition int32, code int16) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures[partition] = append(b.failures[partition], code)
+}
+
+// DropConnections closes every client connection
+func (b *KafkaBroker) DropConnections() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for conn := range b.conns {
+		conn.Close()
+	}
+}
+
+// Close stops the broker
+func (b *KafkaBroker) Close() {
+	b.listener.Close()
+	b.DropConnections()
+	b.wg.Wait()
+}
+
+func (b *KafkaBroker) accept() {
+	defer b.wg.Done()
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		b.mutex.Lock()
+		b.conns[conn] = true
+		b.mutex.Unlock()
+
+		b.wg.Add(1)
+		go b.serve(conn)
+	}
+}
+
+func (b *KafkaBroker) serve(conn net.Conn) {
+	defer b.wg.Done()
+	defer func() {
+		b.mutex.Lock()
+		delete(b.conns, conn)
+		b.mutex.Unlock()
+		conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+	for {
+		var sizeBuf [4]byte
+		if _, err := io.ReadFull(reader, sizeBuf[:]); err != nil {
+			return
+		}
+		request := make([]byte, binary.BigEndian.Uint32(sizeBuf[:]))
+		if _, err := io.ReadFull(reader, request); err != nil {
+			return
+		}
+
+		d := kafkaDecoder{buf: request}
+		apiKey := d.int16()
+		d.int16() // API version
+		correlationID := d.int32()
+		d.string() // Client ID
+		if d.err != nil {
+			return
+		}
+
+		var response []byte
+		switch apiKey {
+		case 0:
+			var acks int16
+			response, acks = b.produce(&d)
+			if acks == 0 {
+				continue
+			}
+		case 3:
+			response = b.metadata()
+		case 22:
+			response = b.initProducerID()
+		default:
+			return
+		}
+		if d.err != nil {
+			return
+		}
+
+		out := binary.BigEndian.AppendUint32(nil, uint32(4+len(response)))
+		out = binary.BigEndian.AppendUint32(out, uint32(correlationID))
+		if _, err := conn.Write(append(out, response...)); err != nil {
+			return
+		}
+	}
+}
+
+func (b *KafkaBroker) metadata() []byte {
+	host, portText, _ := net.SplitHostPort(b.Addr())
+	port, _ := strconv.Atoi(portText)
+
+	buf := binary.BigEndian.AppendUint32(nil, 1) // Brokers
+	buf = binary.BigEndian.AppendUint32(buf, 1)  // Node ID
+	buf = appendKafkaString(buf, host)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(port))
+	buf = binary.BigEndian.AppendUint16(buf, 0xffff) // Rack
+	buf = binary.BigEndian.AppendUint32(buf, 1)      // Controller ID
+
+	buf = binary.BigEndian.AppendUint32(buf, 1) // Topics
+	buf = binary.BigEndian.AppendUint16(buf, 0)
+	buf = appendKafkaString(buf, b.topic)
+	buf = append(buf, 0) // Internal
+	buf = binary.BigEndian.AppendUint32(buf, uint32(b.partitions))
+	for p := int32(0); p < b.partitions; p++ {
+		buf = binary.BigEndian.AppendUint16(buf, 0)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(p))
+		buf = binary.BigEndian.AppendUint32(buf, 1) // Leader
+		buf = binary.BigEndian.AppendUint32(buf, 1) // Replicas
+		buf = binary.BigEndian.AppendUint32(buf, 1)
+		buf = binary.BigEndian.AppendUint32(buf, 1) // ISR
+		buf = binary.BigEndian.AppendUint32(buf, 1)
+	}
+	return buf
+}
+
+func (b *KafkaBroker) initProducerID() []byte {
+	b.mutex.Lock()
+	b.nextPID++
+	pid := b.nextPID
+	b.mutex.Unlock()
+
+	buf := binary.BigEndian.AppendUint32(nil, 0) // Throttle
+	buf = binary.BigEndian.AppendUint16(buf, 0)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(pid))
+	return binary.BigEndian.AppendUint16(buf, 0) // Epoch
+}
+
+func (b *KafkaBroker) produce(d *kafkaDecoder) ([]byte, int16) {
+	d.nullableString() // Transactional ID
+	acks := d.int16()
+	d.int32() // Timeout
+
+	buf := binary.BigEndian.AppendUint32(nil, 1)
+	for topics := d.int32(); topics > 0 && d.err == nil; topics-- {
+		topic := d.string()
+		buf = appendKafkaString(buf, topic)
+		partitions := d.int32()
+		buf = binary.BigEndian.AppendUint32(buf, uint32(partitions))
+		for ; partitions > 0 && d.err == nil; partitions-- {
+			partition := d.int32()
+			batch := d.take(int(d.int32()))
+			code, offset := b.append(partition, batch)
+			buf = binary.BigEndian.AppendUint32(buf, uint32(partition))
+			buf = binary.BigEndian.AppendUint16(buf, uint16(code))
+			buf = binary.BigEndian.AppendUint64(buf, uint64(offset))
+			buf = binary.BigEndian.AppendUint64(buf, 0xffffffffffffffff) // Log append time
+		}
+	}
+	return binary.BigEndian.AppendUint32(buf, 0), acks // Throttle
+}
+
+// append validates and stores a record batch, returning an error code and
+// the base offset
+func (b *KafkaBroker) append(partition int32, batch []byte) (int16, int64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if partition < 0 || partition >= b.partitions {
+		return 3, -1 // Unknown topic or partition
+	}
+	if queued := b.failures[partition]; len(queued) > 0 {
+		b.failures[partition] = queued[1:]
+		return queued[0], -1
+	}
+
+	header := kafkaDecoder{buf: batch}
+	header.int64() // Base offset
+	header.int32() // Batch length
+	header.int32() // Leader epoch
+	if magic := header.take(1); magic == nil || magic[0] != 2 {
+		return 2, -1 // Corrupt message
+	}
+	crc := uint32(header.int32())
+	if header.err != nil || crc32.Checksum(header.buf, crc32.MakeTable(crc32.Castagnoli)) != crc {
+		return 2, -1
+	}
+	header.int16() // Attributes
+	header.int32() // Last offset delta
+	header.int64() // Base timestamp
+	header.int64() // Max timestamp
+	producerID := header.int64()
+	header.int16() // Epoch
+	baseSequence := header.int32()
+	count := header.int32()
+
+	if producerID >= 0 {
+		key := [2]int64{producerID, int64(partition)}
+		if last, ok := b.lastBatch[key]; ok && last == [2]int32{baseSequence, count} {
+			return 46, -1 // Duplicate sequence number
+		}
+		if baseSequence != b.sequences[key] {
+			return 45, -1 // Out of order sequence number
+		}
+		b.sequences[key] += count
+		b.lastBatch[key] = [2]int32{baseSequence, count}
+	}
+
+	base := int64(len(b.records[partition]))
+	for i := int32(0); i < count; i++ {
+		rec, err := decodeKafkaRecord(&header)
+		if err != nil {
+			return 87, -1 // Invalid record
+		}
+		rec.Partition = partition
+		rec.Offset = base + int64(i)
+		b.records[partition] = append(b.records[partition], rec)
+	}
+	b.batches[partition]++
+	return 0, base
+}
+
+func decodeKafkaRecord(d *kafkaDecoder) (KafkaRecord, error) {
+	length := d.varint()
+	body := kafkaDecoder{buf: d.take(int(length))}
+	body.take(1)  // Attributes
+	body.varint() // Timestamp delta
+	body.varint() // Offset delta
+	rec := KafkaRecord{Key: string(body.varBytes()), Value: body.varBytes(), Headers: map[string]string{}}
+	for headers := body.varint(); headers > 0; headers-- {
+		key := string(body.varBytes())
+		rec.Headers[key] = string(body.varBytes())
+	}
+	if d.err != nil || body.err != nil {
+		return rec, errors.New("malformed record")
+	}
+	return rec, nil
+}
+
+func appendKafkaString(buf []byte, s string) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(s)))
+	return append(buf, s...)
+}
+
+type kafkaDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *kafkaDecoder) take(n int) []byte {
+	if d.err != nil || n < 0 || len(d.buf) < n {
+		d.err = errors.New("short read")
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if b := d.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if b := d.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if b := d.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) string() string {
+	return string(d.take(int(d.int16())))
+}
+
+func (d *kafkaDecoder) nullableString() {
+	if n := d.int16(); n > 0 {
+		d.take(int(n))
+	}
+}
+
+func (d *kafkaDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = errors.New("malformed varint")
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *kafkaDecoder) varBytes() []byte {
+	n := d.varint()
+	if n < 0 {
+		return nil
+	}
+	return d.take(int(n))
+}
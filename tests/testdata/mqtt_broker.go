@@ -0,0 +1,313 @@
+package testdata
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// MQTTMessage is a message received by MQTTBroker
+type MQTTMessage struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+	Retain  bool
+}
+
+// MQTTConnect describes a client connection accepted by MQTTBroker
+type MQTTConnect struct {
+	Version  byte
+	ClientID string
+	Username string
+}
+
+// MQTTBroker is a minimal in-process MQTT 3.1.1/5 broker for tests. It
+// accepts publishes at any QoS, keeps retained messages and can be told to
+// reject topics (MQTT 5 only) or drop its connections.
+type MQTTBroker struct {
+	listener net.Listener
+
+	mutex    sync.Mutex
+	connects []MQTTConnect
+	messages []MQTTMessage
+	retained map[string]MQTTMessage
+	reject   map[string]byte // Topic -> MQTT 5 reason code
+	conns    map[net.Conn]bool
+	wg       sync.WaitGroup
+}
+
+// NewMQTTBroker starts a broker on a random local port
+func NewMQTTBroker() (*MQTTBroker, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	b := &MQTTBroker{
+		listener: listener,
+		retained: make(map[string]MQTTMessage),
+		reject:   make(map[string]byte),
+		conns:    make(map[net.Conn]bool),
+	}
+	b.wg.Add(1)
+	go b.accept()
+	return b, nil
+}
+
+// Addr returns the broker URL, e.g. "tcp://127.0.0.1:1883"
+func (b *MQTTBroker) Addr() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+// Messages returns every message published so far
+func (b *MQTTBroker) Messages() []MQTTMessage {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]MQTTMessage(nil), b.messages...)
+}
+
+// Retained returns the retained message of a topic
+func (b *MQTTBroker) Retained(topic string) (MQTTMessage, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	msg, ok := b.retained[topic]
+	return msg, ok
+}
+
+// Connects returns every accepted connection
+func (b *MQTTBroker) Connects() []MQTTConnect {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]MQTTConnect(nil), b.connects...)
+}
+
+// Reject makes publishes to a topic fail with an MQTT 5 reason code
+func (b *MQTTBroker) Reject(topic string, reason byte) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.reject[topic] = reason
+}
+
+// DropConnections closes every client connection
+func (b *MQTTBroker) DropConnections() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for conn := range b.conns {
+		conn.Close()
+	}
+}
+
+// Close stops the broker
+func (b *MQTTBroker) Close() {
+	b.listener.Close()
+	b.DropConnections()
+	b.wg.Wait()
+}
+
+func (b *MQTTBroker) accept() {
+	defer b.wg.Done()
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		b.mutex.Lock()
+		b.conns[conn] = true
+		b.mutex.Unlock()
+
+		b.wg.Add(1)
+		go b.serve(conn)
+	}
+}
+
+func (b *MQTTBroker) serve(conn net.Conn) {
+	defer b.wg.Done()
+	defer func() {
+		b.mutex.Lock()
+		delete(b.conns, conn)
+		b.mutex.Unlock()
+		conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+	var version byte
+	for {
+		header, body, err := readMQTTPacket(reader)
+		if err != nil {
+			return
+		}
+
+		switch header >> 4 {
+		case 1: // CONNECT
+			connect, err := parseMQTTConnect(body)
+			if err != nil {
+				return
+			}
+			version = connect.Version
+			b.mutex.Lock()
+			b.connects = append(b.connects, connect)
+			b.mutex.Unlock()
+			connack := []byte{0, 0}
+			if version == 5 {
+				connack = append(connack, 0) // No properties
+			}
+			writeMQTTPacket(conn, 0x20, connack)
+		case 3: // PUBLISH
+			msg, packetID, err := parseMQTTPublish(header, body, version)
+			if err != nil {
+				return
+			}
+			reason := b.receive(msg)
+			ack := binary.BigEndian.AppendUint16(nil, packetID)
+			if version == 5 && reason != 0 {
+				ack = append(ack, reason)
+			}
+			switch msg.QoS {
+			case 1:
+				writeMQTTPacket(conn, 0x40, ack) // PUBACK
+			case 2:
+				writeMQTTPacket(conn, 0x50, ack) // PUBREC
+			}
+		case 6: // PUBREL
+			writeMQTTPacket(conn, 0x70, body[:2]) // PUBCOMP
+		case 12: // PINGREQ
+			writeMQTTPacket(conn, 0xd0, nil)
+		case 14: // DISCONNECT
+			return
+		}
+	}
+}
+
+// receive stores a publish and returns its reason code
+func (b *MQTTBroker) receive(msg MQTTMessage) byte {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if reason, rejected := b.reject[msg.Topic]; rejected {
+		return reason
+	}
+	b.messages = append(b.messages, msg)
+	if msg.Retain {
+		b.retained[msg.Topic] = msg
+	}
+	return 0
+}
+
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
+
+func writeMQTTPacket(w io.Writer, header byte, body []byte) {
+	packet := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	w.Write(append(packet, body...))
+}
+
+func parseMQTTConnect(body []byte) (MQTTConnect, error) {
+	var connect MQTTConnect
+	protocol, rest, err := readMQTTString(body)
+	if err != nil || protocol != "MQTT" || len(rest) < 4 {
+		return connect, errors.New("malformed CONNECT")
+	}
+	connect.Version = rest[0]
+	flags := rest[1]
+	rest = rest[4:] // Level, flags, keep alive
+	if connect.Version == 5 {
+		if rest, err = skipMQTTProperties(rest); err != nil {
+			return connect, err
+		}
+	}
+	if connect.ClientID, rest, err = readMQTTString(rest); err != nil {
+		return connect, err
+	}
+	if flags&0x80 != 0 {
+		connect.Username, _, err = readMQTTString(rest)
+	}
+	return connect, err
+}
+
+func parseMQTTPublish(header byte, body []byte, version byte) (MQTTMessage, uint16, error) {
+	msg := MQTTMessage{QoS: (header >> 1) & 0x03, Retain: header&0x01 != 0}
+	topic, rest, err := readMQTTString(body)
+	if err != nil {
+		return msg, 0, err
+	}
+	msg.Topic = topic
+
+	var packetID uint16
+	if msg.QoS > 0 {
+		if len(rest) < 2 {
+			return msg, 0, errors.New("malformed PUBLISH")
+		}
+		packetID = binary.BigEndian.Uint16(rest)
+		rest = rest[2:]
+	}
+	if version == 5 {
+		if rest, err = skipMQTTProperties(rest); err != nil {
+			return msg, 0, err
+		}
+	}
+	msg.Payload = append([]byte(nil), rest...)
+	return msg, packetID, nil
+}
+
+func readMQTTString(buf []byte) (string, []byte, error) {
+	if len(buf) < 2 {
+		return "", nil, errors.New("malformed string")
+	}
+	n := int(binary.BigEndian.Uint16(buf))
+	if len(buf) < 2+n {
+		return "", nil, errors.New("malformed string")
+	}
+	return string(buf[2 : 2+n]), buf[2+n:], nil
+}
+
+func skipMQTTProperties(buf []byte) ([]byte, error) {
+	length, multiplier, i := 0, 1, 0
+	for ; i < len(buf) && i < 4; i++ {
+		length += int(buf[i]&0x7f) * multiplier
+		if buf[i]&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+	if i >= len(buf) || len(buf) < i+1+length {
+		return nil, errors.New("malformed properties")
+	}
+	return buf[i+1+length:], nil
+}
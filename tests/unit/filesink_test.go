@@ -0,0 +1,220 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tabular/relay/internal/filesink"
+	"github.com/tabular/relay/pkg/sink"
+	"github.com/tabular/relay/pkg/types"
+)
+
+func archiveEvent(sessionID string, n int, at time.Time) types.SpatialEvent {
+	event := testPoseEvent(sessionID)
+	event.EventID = sessionID + "-" + string(rune('a'+n))
+	event.Timestamp = at.UnixMilli()
+	return event
+}
+
+func TestFileSink_WritesPartitionedIndexedSegments(t *testing.T) {
+	for _, compression := range []filesink.Compression{filesink.CompressionNone, filesink.CompressionGzip, filesink.CompressionZstd} {
+		t.Run(string(compression), func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := filesink.Open(filesink.Options{Dir: dir, Compression: compression})
+			require.NoError(t, err)
+
+			day := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+			events := []types.SpatialEvent{
+				archiveEvent("session-a", 0, day),
+				archiveEvent("session-b", 0, day),
+				archiveEvent("session-a", 1, day.Add(time.Second)),
+			}
+			mesh := meshEvent("anchor-archive", gridVertices(4, 0))
+			mesh.SessionID = "session-a"
+			mesh.Timestamp = day.Add(2 * time.Second).UnixMilli()
+			events = append(events, mesh)
+
+			results, err := s.Send(context.Background(), events)
+			require.NoError(t, err)
+			require.Len(t, results, len(events))
+			for _, result := range results {
+				assert.NoError(t, result.Err)
+			}
+			require.NoError(t, s.Close())
+
+			entries, err := filesink.ReadIndex(dir)
+			require.NoError(t, err)
+			require.Len(t, entries, 2)
+
+			bySession := map[string]filesink.IndexEntry{}
+			for _, entry := range entries {
+				bySession[entry.SessionID] = entry
+			}
+			a := bySession["session-a"]
+			assert.Equal(t, 3, a.Events)
+			assert.Equal(t, 2, a.Poses)
+			assert.Equal(t, 1, a.Meshes)
+			assert.Equal(t, "2026-10-16", a.Date)
+			assert.Equal(t, compression, a.Compression)
+			assert.Equal(t, "session-a-a", a.FirstEventID)
+			assert.True(t, strings.HasPrefix(a.Path, "date=2026-10-16/session=session-a/"), a.Path)
+
+			archived, err := filesink.ReadSegment(filepath.Join(dir, a.Path))
+			require.NoError(t, err)
+			require.Len(t, archived, 3)
+			assert.Equal(t, []string{"session-a-a", "session-a-b", "anchor-archive"}, eventIDs(archived))
+			assert.Equal(t, mesh.Meshes[0].VerticesDelta, archived[2].Meshes[0].VerticesDelta)
+		})
+	}
+}
+
+func TestFileSink_RotatesBySizeAndAge(t *testing.T) {
+	dir := t.TempDir()
+	s, err := filesink.Open(filesink.Options{Dir: dir, MaxBytes: 1, MaxAge: 50 * time.Millisecond})
+	require.NoError(t, err)
+	defer s.Close()
+
+	now := time.Now()
+	// MaxBytes of 1 closes the segment after every batch
+	for i := 0; i < 3; i++ {
+		_, err := s.Send(context.Background(), []types.SpatialEvent{archiveEvent("size-session", i, now)})
+		require.NoError(t, err)
+	}
+	entries, err := filesink.ReadIndex(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 3)
+
+	ageDir := t.TempDir()
+	s2, err := filesink.Open(filesink.Options{Dir: ageDir, MaxAge: 50 * time.Millisecond})
+	require.NoError(t, err)
+	defer s2.Close()
+
+	_, err = s2.Send(context.Background(), []types.SpatialEvent{archiveEvent("age-session", 0, now)})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		entries, _ := filesink.ReadIndex(ageDir)
+		return len(entries) == 1
+	}, time.Second, 10*time.Millisecond, "segment should be closed once it reaches MaxAge")
+}
+
+func TestFileSink_FailsOnlyEventsNotWritten(t *testing.T) {
+	dir := t.TempDir()
+	s, err := filesink.Open(filesink.Options{Dir: dir, Compression: filesink.CompressionGzip})
+	require.NoError(t, err)
+
+	day := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	unencodable := archiveEvent("partial", 1, day)
+	unencodable.Anchors[0].Pose.X = math.NaN()
+	results, err := s.Send(context.Background(), []types.SpatialEvent{
+		archiveEvent("partial", 0, day),
+		unencodable,
+		archiveEvent("partial", 2, day),
+	})
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+	assert.NoError(t, results[0].Err)
+	assert.NoError(t, results[2].Err)
+	var deliveryErr *sink.DeliveryError
+	require.True(t, errors.As(results[1].Err, &deliveryErr))
+	assert.True(t, deliveryErr.Permanent)
+
+	results, err = s.Send(context.Background(), []types.SpatialEvent{archiveEvent("partial", 3, day)})
+	require.NoError(t, err)
+	assert.NoError(t, results[0].Err)
+	require.NoError(t, s.Close())
+
+	entries, err := filesink.ReadIndex(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, 3, entries[0].Events)
+	archived, err := filesink.ReadSegment(filepath.Join(dir, entries[0].Path))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"partial-a", "partial-c", "partial-d"}, eventIDs(archived))
+}
+
+func TestFileSink_RecoversUnclosedSegments(t *testing.T) {
+	dir := t.TempDir()
+	partitionDir := filepath.Join(dir, "date=2026-10-16", "session=crashed")
+	require.NoError(t, os.MkdirAll(partitionDir, 0o755))
+
+	var data []byte
+	for i := 0; i < 2; i++ {
+		line, err := json.Marshal(archiveEvent("crashed", i, time.Now()))
+		require.NoError(t, err)
+		data = append(append(data, line...), '\n')
+	}
+	data = append(data, []byte(`{"session_id":"crashed","event_`)...) // Torn write
+	require.NoError(t, os.WriteFile(filepath.Join(partitionDir, "20261016T120000.000000000Z.ndjson"), data, 0o644))
+
+	s, err := filesink.Open(filesink.Options{Dir: dir})
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	entries, err := filesink.ReadIndex(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.True(t, entries[0].Recovered)
+	assert.Equal(t, 2, entries[0].Events)
+	assert.Equal(t, "crashed", entries[0].SessionID)
+	assert.Equal(t, "2026-10-16", entries[0].Date)
+
+	// Reopening doesn't index it twice
+	s, err = filesink.Open(filesink.Options{Dir: dir})
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+	entries, err = filesink.ReadIndex(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestFileSink_RepairsTornIndex(t *testing.T) {
+	dir := t.TempDir()
+	entry, err := json.Marshal(filesink.IndexEntry{Path: "date=2026-10-16/session=old/old.ndjson", SessionID: "old", Events: 1})
+	require.NoError(t, err)
+	torn := append(append(entry, '\n'), []byte(`{"path":"date=2026-10-16/sess`)...)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "index.ndjson"), torn, 0o644))
+
+	s, err := filesink.Open(filesink.Options{Dir: dir})
+	require.NoError(t, err)
+	results, err := s.Send(context.Background(), []types.SpatialEvent{archiveEvent("after-crash", 0, time.Now())})
+	require.NoError(t, err)
+	require.NoError(t, results[0].Err)
+	require.NoError(t, s.Close())
+
+	// The next entry starts on its own line, so the sink opens again
+	s, err = filesink.Open(filesink.Options{Dir: dir})
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	entries, err := filesink.ReadIndex(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "old", entries[0].SessionID)
+	assert.Equal(t, "after-crash", entries[1].SessionID)
+}
+
+func TestFileSink_KeepsSessionIDsInsideDir(t *testing.T) {
+	dir := t.TempDir()
+	s, err := filesink.Open(filesink.Options{Dir: dir})
+	require.NoError(t, err)
+
+	_, err = s.Send(context.Background(), []types.SpatialEvent{archiveEvent("../../escape", 0, time.Now())})
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	entries, err := filesink.ReadIndex(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Len(t, strings.Split(entries[0].Path, "/"), 3, "session ID must stay one path element")
+	assert.FileExists(t, filepath.Join(dir, entries[0].Path))
+	assert.Equal(t, "../../escape", entries[0].SessionID)
+}
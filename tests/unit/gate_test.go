@@ -2,15 +2,20 @@ package unit
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/tabular/relay/internal/gate"
+	"github.com/tabular/relay/pkg/protocol"
+	"github.com/tabular/relay/pkg/types"
 	"nhooyr.io/websocket"
 	"nhooyr.io/websocket/wsjson"
 )
@@ -184,4 +189,905 @@ func TestGate_GetConnectionsBySession(t *testing.T) {
 	connections := g.GetConnectionsBySession("test-session")
 	assert.Len(t, connections, 1)
 	assert.Equal(t, "test-session", connections[0].SessionID)
-}
\ No newline at end of file
+}
+func TestGate_SessionEndHandler(t *testing.T) {
+	g := gate.New(10, 1*time.Second)
+	ended := make(chan string, 2)
+	g.SetSessionEndHandler(func(sessionID string) {
+		ended <- sessionID
+	})
+	g.Start()
+	defer g.Stop()
+	
+	server := httptest.NewServer(http.HandlerFunc(g.HandleWebSocket))
+	defer server.Close()
+	
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	opts := &websocket.DialOptions{
+		HTTPHeader: http.Header{
+			"X-API-Key": []string{"test-key"},
+		},
+	}
+	
+	// Two connections stream for the same session
+	ctx := context.Background()
+	var conns []*websocket.Conn
+	for i := 0; i < 2; i++ {
+		conn, _, err := websocket.Dial(ctx, wsURL, opts)
+		require.NoError(t, err)
+		require.NoError(t, wsjson.Write(ctx, conn, map[string]interface{}{
+			"session_id": "ending-session",
+			"type":       "pose",
+			"timestamp":  time.Now().UnixMilli(),
+		}))
+		conns = append(conns, conn)
+	}
+	time.Sleep(20 * time.Millisecond)
+	
+	conns[0].Close(websocket.StatusNormalClosure, "")
+	select {
+	case sessionID := <-ended:
+		t.Fatalf("session %s ended while a connection was still open", sessionID)
+	case <-time.After(50 * time.Millisecond):
+	}
+	
+	conns[1].Close(websocket.StatusNormalClosure, "")
+	select {
+	case sessionID := <-ended:
+		assert.Equal(t, "ending-session", sessionID)
+	case <-time.After(time.Second):
+		t.Fatal("session end handler was not called")
+	}
+}
+
+func TestGate_SessionStartHandler(t *testing.T) {
+	g := gate.New(10, 1*time.Second)
+	started := make(chan [2]string, 2)
+	g.SetSessionStartHandler(func(sessionID, apiKey string) {
+		started <- [2]string{sessionID, apiKey}
+	})
+	g.Start()
+	defer g.Stop()
+	
+	server := httptest.NewServer(http.HandlerFunc(g.HandleWebSocket))
+	defer server.Close()
+	
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	opts := &websocket.DialOptions{
+		HTTPHeader: http.Header{
+			"X-API-Key": []string{"start-key"},
+		},
+	}
+	
+	// A second connection joining the session doesn't start it again
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		conn, _, err := websocket.Dial(ctx, wsURL, opts)
+		require.NoError(t, err)
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		require.NoError(t, wsjson.Write(ctx, conn, map[string]interface{}{
+			"session_id": "starting-session",
+			"type":       "pose",
+			"timestamp":  time.Now().UnixMilli(),
+		}))
+	}
+	
+	select {
+	case start := <-started:
+		assert.Equal(t, [2]string{"starting-session", "start-key"}, start)
+	case <-time.After(time.Second):
+		t.Fatal("session start handler was not called")
+	}
+	select {
+	case start := <-started:
+		t.Fatalf("session %s started twice", start[0])
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestGate_BinarySubprotocol(t *testing.T) {
+	g := gate.New(10, 1*time.Second)
+	g.Start()
+	defer g.Stop()
+	
+	server := httptest.NewServer(http.HandlerFunc(g.HandleWebSocket))
+	defer server.Close()
+	
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	opts := &websocket.DialOptions{
+		HTTPHeader: http.Header{
+			"X-API-Key": []string{"test-key"},
+		},
+		Subprotocols: []string{protocol.BinarySubprotocol},
+	}
+	
+	ctx := context.Background()
+	conn, _, err := websocket.Dial(ctx, wsURL, opts)
+	require.NoError(t, err)
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	assert.Equal(t, protocol.BinarySubprotocol, conn.Subprotocol())
+	
+	packet := binaryMeshPacket()
+	frame, err := protocol.EncodeBinary(packet)
+	require.NoError(t, err)
+	require.NoError(t, conn.Write(ctx, websocket.MessageBinary, frame))
+	
+	select {
+	case msg := <-g.Messages():
+		assert.Equal(t, packet, msg.Packet)
+	case <-time.After(time.Second):
+		t.Fatal("binary frame was not forwarded")
+	}
+	
+	connections := g.GetConnectionsBySession(packet.SessionID)
+	require.Len(t, connections, 1)
+	assert.Equal(t, protocol.BinarySubprotocol, connections[0].Subprotocol)
+	
+	// JSON text on a binary connection closes it
+	require.NoError(t, wsjson.Write(ctx, conn, map[string]interface{}{"type": "pose"}))
+	_, _, err = conn.Read(ctx)
+	assert.Equal(t, websocket.StatusUnsupportedData, websocket.CloseStatus(err))
+}
+
+func TestGate_NegotiatesProtocolVersion(t *testing.T) {
+	g := gate.New(10, 1*time.Second)
+	g.Start()
+	defer g.Stop()
+	
+	server := httptest.NewServer(http.HandlerFunc(g.HandleWebSocket))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	ctx := context.Background()
+	
+	for _, tc := range []struct {
+		offered     []string
+		subprotocol string
+		version     int
+	}{
+		{nil, "", protocol.Version1},
+		{[]string{protocol.SubprotocolV1}, protocol.SubprotocolV1, protocol.Version1},
+		{[]string{"streamkit.v9", protocol.SubprotocolV1, protocol.SubprotocolV2}, protocol.SubprotocolV2, protocol.Version2},
+	} {
+		conn, _, err := websocket.Dial(ctx, wsURL, &websocket.DialOptions{
+			HTTPHeader:   http.Header{"X-API-Key": []string{"test-key"}},
+			Subprotocols: tc.offered,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, tc.subprotocol, conn.Subprotocol())
+		
+		sessionID := "negotiated-" + tc.subprotocol
+		require.NoError(t, wsjson.Write(ctx, conn, map[string]interface{}{
+			"session_id": sessionID,
+			"type":       "pose",
+			"timestamp":  time.Now().UnixMilli(),
+		}))
+		select {
+		case msg := <-g.Messages():
+			assert.Equal(t, tc.version, msg.ProtocolVersion, tc.offered)
+		case <-time.After(time.Second):
+			t.Fatal("packet was not forwarded")
+		}
+		
+		connections := g.GetConnectionsBySession(sessionID)
+		require.Len(t, connections, 1)
+		assert.Equal(t, tc.version, connections[0].ProtocolVersion)
+		conn.Close(websocket.StatusNormalClosure, "")
+	}
+}
+
+func TestGate_RejectsUnsupportedProtocolVersion(t *testing.T) {
+	g := gate.New(10, 1*time.Second)
+	g.Start()
+	defer g.Stop()
+	
+	server := httptest.NewServer(http.HandlerFunc(g.HandleWebSocket))
+	defer server.Close()
+	
+	ctx := context.Background()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), &websocket.DialOptions{
+		HTTPHeader:   http.Header{"X-API-Key": []string{"test-key"}},
+		Subprotocols: []string{"streamkit.v9"},
+	})
+	require.NoError(t, err)
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	
+	_, _, err = conn.Read(ctx)
+	var closeErr websocket.CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, websocket.StatusProtocolError, closeErr.Code)
+	assert.Contains(t, closeErr.Reason, "streamkit.v9")
+	assert.Contains(t, closeErr.Reason, protocol.SubprotocolV2)
+	assert.LessOrEqual(t, len(closeErr.Reason), 123)
+	assert.Equal(t, 0, g.GetActiveConnections())
+}
+
+func TestGate_AcksAndNacksFrames(t *testing.T) {
+	g := gate.NewWithOptions(gate.Options{BufferSize: 10, HeartbeatInterval: time.Second, AckInterval: 10 * time.Millisecond})
+	g.Start()
+	defer g.Stop()
+	
+	server := httptest.NewServer(http.HandlerFunc(g.HandleWebSocket))
+	defer server.Close()
+	
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _ := dialControl(ctx, t, server.URL, "acks=true", "")
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	
+	for frame := 1; frame <= 3; frame++ {
+		require.NoError(t, wsjson.Write(ctx, conn, ackTestPacket(frame)))
+	}
+	var connectionID string
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-g.Messages():
+			connectionID = msg.ConnectionID
+		case <-time.After(time.Second):
+			t.Fatal("Message not received within timeout")
+		}
+	}
+	
+	// Frame 2 is still outstanding, so the ack stops at 1
+	g.Ack(connectionID, 1)
+	g.Ack(connectionID, 3)
+	var msg protocol.ControlMessage
+	require.NoError(t, wsjson.Read(ctx, conn, &msg))
+	assert.Equal(t, protocol.ControlMessage{Type: protocol.ControlAck, FrameNumber: 1}, msg)
+	
+	// Nacking it sends the reason and lets the ack move past it
+	g.Nack(connectionID, 2, protocol.NackValidationError, errors.New("pose position out of bounds"))
+	received := make([]protocol.ControlMessage, 2)
+	for i := range received {
+		require.NoError(t, wsjson.Read(ctx, conn, &received[i]))
+	}
+	assert.ElementsMatch(t, []protocol.ControlMessage{
+		{Type: protocol.ControlNack, FrameNumber: 2, Reason: protocol.NackValidationError, Error: "pose position out of bounds"},
+		{Type: protocol.ControlAck, FrameNumber: 3},
+	}, received)
+	
+	// Resends of handled frames don't move the ack back
+	g.Ack(connectionID, 2)
+	readCtx, readCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer readCancel()
+	_, _, err := conn.Read(readCtx)
+	assert.Error(t, err)
+}
+
+func TestGate_NacksFramesWhenBufferFull(t *testing.T) {
+	g := gate.NewWithOptions(gate.Options{BufferSize: 1, QueueDepth: 1, HeartbeatInterval: time.Second, AckInterval: 10 * time.Millisecond})
+	g.Start()
+	defer g.Stop()
+	
+	server := httptest.NewServer(http.HandlerFunc(g.HandleWebSocket))
+	defer server.Close()
+	
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _ := dialControl(ctx, t, server.URL, "acks=true", "")
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	
+	// Nothing reads Messages, so once the pipeline channel, the scheduler
+	// and the connection's queue hold a frame each, the next one is dropped
+	for frame := 1; frame <= 4; frame++ {
+		require.NoError(t, wsjson.Write(ctx, conn, ackTestPacket(frame)))
+	}
+	
+	// Skip the flow control messages of the filling queue
+	var msg protocol.ControlMessage
+	for msg.Type == "" || msg.Type == protocol.ControlSlowDown || msg.Type == protocol.ControlResume {
+		require.NoError(t, wsjson.Read(ctx, conn, &msg))
+	}
+	assert.Equal(t, protocol.ControlNack, msg.Type)
+	assert.GreaterOrEqual(t, msg.FrameNumber, 3)
+	assert.Equal(t, protocol.NackBufferFull, msg.Reason)
+	
+	connectionID := (<-g.Messages()).ConnectionID
+	assert.NotZero(t, g.QueueStats()[connectionID].Dropped)
+}
+
+func TestGate_SignalsSlowDownAndResume(t *testing.T) {
+	g := gate.NewWithOptions(gate.Options{BufferSize: 1, QueueDepth: 8, HeartbeatInterval: time.Second, AckInterval: time.Hour})
+	g.Start()
+	defer g.Stop()
+	
+	server := httptest.NewServer(http.HandlerFunc(g.HandleWebSocket))
+	defer server.Close()
+	
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _ := dialControl(ctx, t, server.URL, "acks=true", "")
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	
+	// Nothing reads Messages, so the connection's queue fills past three
+	// quarters
+	for frame := 1; frame <= 8; frame++ {
+		require.NoError(t, wsjson.Write(ctx, conn, ackTestPacket(frame)))
+	}
+	var msg protocol.ControlMessage
+	require.NoError(t, wsjson.Read(ctx, conn, &msg))
+	assert.Equal(t, protocol.ControlSlowDown, msg.Type)
+	
+	// Draining it to a quarter lets the client resume
+	receiveFrames(t, g, 7)
+	require.NoError(t, wsjson.Read(ctx, conn, &msg))
+	assert.Equal(t, protocol.ControlResume, msg.Type)
+}
+
+func ackTestPacket(frame int) map[string]interface{} {
+	return map[string]interface{}{
+		"session_id":   "test-session",
+		"frame_number": frame,
+		"timestamp":    time.Now().UnixMilli(),
+		"type":         "pose",
+		"data": map[string]interface{}{
+			"pose": map[string]interface{}{
+				"x":        1.0,
+				"y":        2.0,
+				"z":        3.0,
+				"rotation": []float64{0, 0, 0, 1},
+			},
+		},
+	}
+}
+
+func meshTestPacket(frame int) map[string]interface{} {
+	packet := ackTestPacket(frame)
+	packet["type"] = "mesh"
+	packet["data"] = map[string]interface{}{"mesh": map[string]interface{}{"vertices": "AAAA", "anchor_id": "anchor"}}
+	return packet
+}
+
+func TestGate_ReliableModeRequestsMissingFrames(t *testing.T) {
+	g := gate.NewWithOptions(gate.Options{BufferSize: 10, HeartbeatInterval: time.Second, AckInterval: time.Hour})
+	g.Start()
+	defer g.Stop()
+	
+	server := httptest.NewServer(http.HandlerFunc(g.HandleWebSocket))
+	defer server.Close()
+	
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn := dialReliable(ctx, t, server.URL)
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	
+	for _, frame := range []int{1, 2, 5} {
+		require.NoError(t, wsjson.Write(ctx, conn, meshTestPacket(frame)))
+	}
+	var msg protocol.ControlMessage
+	require.NoError(t, wsjson.Read(ctx, conn, &msg))
+	assert.Equal(t, protocol.ControlMessage{Type: protocol.ControlResend, FrameNumber: 5, Frames: []int{3, 4}}, msg)
+	
+	// The resent frames go through, a second copy of one doesn't
+	for _, frame := range []int{3, 4, 4} {
+		require.NoError(t, wsjson.Write(ctx, conn, meshTestPacket(frame)))
+	}
+	assert.Equal(t, []int{1, 2, 5, 3, 4}, receiveFrames(t, g, 5))
+	assertNoMessage(t, g)
+	
+	// Poses are never resent, so they aren't taken for duplicates
+	require.NoError(t, wsjson.Write(ctx, conn, ackTestPacket(2)))
+	assert.Equal(t, []int{2}, receiveFrames(t, g, 1))
+}
+
+func TestGate_ReliableModeDropsDuplicatesAfterResume(t *testing.T) {
+	g := gate.NewWithOptions(gate.Options{BufferSize: 10, HeartbeatInterval: time.Second, AckInterval: time.Hour})
+	g.Start()
+	defer g.Stop()
+	
+	server := httptest.NewServer(http.HandlerFunc(g.HandleWebSocket))
+	defer server.Close()
+	
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	first, token := dialControl(ctx, t, server.URL, "reliable=true", "")
+	for _, frame := range []int{1, 2, 4} {
+		require.NoError(t, wsjson.Write(ctx, first, meshTestPacket(frame)))
+	}
+	var msg protocol.ControlMessage
+	require.NoError(t, wsjson.Read(ctx, first, &msg))
+	assert.Equal(t, []int{3}, msg.Frames)
+	assert.Equal(t, []int{1, 2, 4}, receiveFrames(t, g, 3))
+	first.CloseNow()
+	
+	// The client doesn't know what arrived before the drop and resends it;
+	// the resumed connection is asked for the frame still missing
+	second, resumed := dialControl(ctx, t, server.URL, "reliable=true", token)
+	defer second.Close(websocket.StatusNormalClosure, "")
+	require.Equal(t, token, resumed)
+	for _, frame := range []int{2, 4, 5} {
+		require.NoError(t, wsjson.Write(ctx, second, meshTestPacket(frame)))
+	}
+	require.NoError(t, wsjson.Read(ctx, second, &msg))
+	assert.Equal(t, protocol.ControlMessage{Type: protocol.ControlResend, FrameNumber: 5, Frames: []int{3}}, msg)
+	assert.Equal(t, []int{5}, receiveFrames(t, g, 1))
+	assertNoMessage(t, g)
+}
+
+func TestGate_ReliableModeStartsOverOnNewStream(t *testing.T) {
+	g := gate.NewWithOptions(gate.Options{BufferSize: 10, HeartbeatInterval: time.Second, AckInterval: time.Hour})
+	g.Start()
+	defer g.Stop()
+	
+	server := httptest.NewServer(http.HandlerFunc(g.HandleWebSocket))
+	defer server.Close()
+	
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	first := dialReliable(ctx, t, server.URL)
+	for _, frame := range []int{1, 2, 3} {
+		require.NoError(t, wsjson.Write(ctx, first, meshTestPacket(frame)))
+	}
+	assert.Equal(t, []int{1, 2, 3}, receiveFrames(t, g, 3))
+	first.Close(websocket.StatusNormalClosure, "")
+	
+	// A restarted client of the same session numbers its frames from the
+	// start again without a resume token
+	second := dialReliable(ctx, t, server.URL)
+	defer second.Close(websocket.StatusNormalClosure, "")
+	for _, frame := range []int{1, 2} {
+		require.NoError(t, wsjson.Write(ctx, second, meshTestPacket(frame)))
+	}
+	assert.Equal(t, []int{1, 2}, receiveFrames(t, g, 2))
+}
+
+func dialReliable(ctx context.Context, t *testing.T, serverURL string) *websocket.Conn {
+	conn, _ := dialControl(ctx, t, serverURL, "reliable=true", "")
+	return conn
+}
+
+// dialControl connects with a control channel and reads the session
+// message, returning the resume token it carries
+func dialControl(ctx context.Context, t *testing.T, serverURL, query, resumeToken string) (*websocket.Conn, string) {
+	header := http.Header{"X-API-Key": []string{"test-key"}}
+	if resumeToken != "" {
+		header.Set(gate.ResumeTokenHeader, resumeToken)
+	}
+	conn, resp, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(serverURL, "http")+"?"+query, &websocket.DialOptions{
+		HTTPHeader: header,
+	})
+	require.NoError(t, err)
+	
+	var msg protocol.ControlMessage
+	require.NoError(t, wsjson.Read(ctx, conn, &msg))
+	require.Equal(t, protocol.ControlSession, msg.Type)
+	require.NotEmpty(t, msg.ResumeToken)
+	require.Equal(t, resp.Header.Get(gate.ResumeTokenHeader), msg.ResumeToken)
+	return conn, msg.ResumeToken
+}
+
+func receiveFrames(t *testing.T, g *gate.Gate, n int) []int {
+	var frames []int
+	for i := 0; i < n; i++ {
+		select {
+		case msg := <-g.Messages():
+			frames = append(frames, msg.Packet.FrameNumber)
+		case <-time.After(time.Second):
+			t.Fatalf("Received %d of %d messages", i, n)
+		}
+	}
+	return frames
+}
+
+func assertNoMessage(t *testing.T, g *gate.Gate) {
+	select {
+	case msg := <-g.Messages():
+		t.Errorf("Unexpected message for frame %d", msg.Packet.FrameNumber)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestGate_ResumesSessionAfterDrop(t *testing.T) {
+	g := gate.NewWithOptions(gate.Options{BufferSize: 10, HeartbeatInterval: time.Second, AckInterval: 10 * time.Millisecond})
+	started := make(chan string, 2)
+	ended := make(chan string, 2)
+	g.SetSessionStartHandler(func(sessionID, apiKey string) { started <- sessionID })
+	g.SetSessionEndHandler(func(sessionID string) { ended <- sessionID })
+	g.Start()
+	defer g.Stop()
+	
+	server := httptest.NewServer(http.HandlerFunc(g.HandleWebSocket))
+	defer server.Close()
+	
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	first, token := dialControl(ctx, t, server.URL, "acks=true", "")
+	for _, frame := range []int{1, 2} {
+		require.NoError(t, wsjson.Write(ctx, first, ackTestPacket(frame)))
+	}
+	var connectionID string
+	for i := 0; i < 2; i++ {
+		msg := <-g.Messages()
+		connectionID = msg.ConnectionID
+	}
+	g.Ack(connectionID, 1)
+	g.Ack(connectionID, 2)
+	var msg protocol.ControlMessage
+	require.NoError(t, wsjson.Read(ctx, first, &msg))
+	assert.Equal(t, protocol.ControlMessage{Type: protocol.ControlAck, FrameNumber: 2}, msg)
+	
+	// The socket dies without a close handshake, as when Wi-Fi roams
+	first.CloseNow()
+	select {
+	case sessionID := <-ended:
+		t.Fatalf("session %s ended while it could still be resumed", sessionID)
+	case <-time.After(50 * time.Millisecond):
+	}
+	
+	second, resumed := dialControl(ctx, t, server.URL, "acks=true", token)
+	defer second.Close(websocket.StatusNormalClosure, "")
+	assert.Equal(t, token, resumed)
+	
+	// The new connection carries the session before sending anything, is
+	// told the last ack again and gets acks for frames of the old one
+	require.Eventually(t, func() bool { return len(g.GetConnectionsBySession("test-session")) == 1 }, time.Second, 10*time.Millisecond)
+	require.NoError(t, wsjson.Read(ctx, second, &msg))
+	assert.Equal(t, protocol.ControlMessage{Type: protocol.ControlAck, FrameNumber: 2}, msg)
+	require.NoError(t, wsjson.Write(ctx, second, ackTestPacket(4)))
+	<-g.Messages()
+	g.Nack(connectionID, 3, protocol.NackBufferFull, nil)
+	require.NoError(t, wsjson.Read(ctx, second, &msg))
+	assert.Equal(t, protocol.ControlMessage{Type: protocol.ControlNack, FrameNumber: 3, Reason: protocol.NackBufferFull}, msg)
+	
+	assert.Equal(t, "test-session", <-started)
+	assert.Empty(t, started, "resuming must not start the session again")
+	assert.Empty(t, ended)
+}
+
+func TestGate_ResumeSupersedesLiveConnection(t *testing.T) {
+	g := gate.NewWithOptions(gate.Options{BufferSize: 10, HeartbeatInterval: time.Second})
+	ended := make(chan string, 1)
+	g.SetSessionEndHandler(func(sessionID string) { ended <- sessionID })
+	g.Start()
+	defer g.Stop()
+	
+	server := httptest.NewServer(http.HandlerFunc(g.HandleWebSocket))
+	defer server.Close()
+	
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	first, token := dialControl(ctx, t, server.URL, "acks=true", "")
+	require.NoError(t, wsjson.Write(ctx, first, ackTestPacket(1)))
+	<-g.Messages()
+	
+	second, _ := dialControl(ctx, t, server.URL, "acks=true", token)
+	defer second.Close(websocket.StatusNormalClosure, "")
+	
+	_, _, err := first.Read(ctx)
+	var closeErr websocket.CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, websocket.StatusNormalClosure, closeErr.Code)
+	assert.Contains(t, closeErr.Reason, "superseded")
+	
+	require.Eventually(t, func() bool { return g.GetActiveConnections() == 1 }, time.Second, 10*time.Millisecond)
+	assert.Len(t, g.GetConnectionsBySession("test-session"), 1)
+	assert.Empty(t, ended)
+}
+
+func TestGate_ResumeWindowExpires(t *testing.T) {
+	g := gate.NewWithOptions(gate.Options{BufferSize: 10, HeartbeatInterval: 20 * time.Millisecond, ResumeWindow: 50 * time.Millisecond})
+	ended := make(chan string, 1)
+	g.SetSessionEndHandler(func(sessionID string) { ended <- sessionID })
+	g.Start()
+	defer g.Stop()
+	
+	server := httptest.NewServer(http.HandlerFunc(g.HandleWebSocket))
+	defer server.Close()
+	
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	first, token := dialControl(ctx, t, server.URL, "acks=true", "")
+	require.NoError(t, wsjson.Write(ctx, first, ackTestPacket(1)))
+	<-g.Messages()
+	first.CloseNow()
+	
+	select {
+	case sessionID := <-ended:
+		assert.Equal(t, "test-session", sessionID)
+	case <-time.After(time.Second):
+		t.Fatal("session end handler was not called after the resume window")
+	}
+	
+	// The token is no longer valid, so a new one is issued
+	second, fresh := dialControl(ctx, t, server.URL, "acks=true", token)
+	defer second.Close(websocket.StatusNormalClosure, "")
+	assert.NotEqual(t, token, fresh)
+}
+
+func TestGate_PingsKeepIdleConnectionsAlive(t *testing.T) {
+	m := testMetrics()
+	active := testutil.ToFloat64(m.ActiveConnections)
+	g := gate.NewWithOptions(gate.Options{BufferSize: 10, HeartbeatInterval: 30 * time.Millisecond, Metrics: m})
+	g.Start()
+	defer g.Stop()
+	
+	server := httptest.NewServer(http.HandlerFunc(g.HandleWebSocket))
+	defer server.Close()
+	
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), &websocket.DialOptions{
+		HTTPHeader: http.Header{"X-API-Key": []string{"test-key"}},
+	})
+	require.NoError(t, err)
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	require.NoError(t, wsjson.Write(ctx, conn, ackTestPacket(1)))
+	connectionID := (<-g.Messages()).ConnectionID
+	
+	// The client answers pings but sends nothing for well over the stale
+	// threshold of three intervals
+	readCtx := conn.CloseRead(ctx)
+	time.Sleep(300 * time.Millisecond)
+	require.NoError(t, readCtx.Err())
+	
+	assert.Equal(t, 1, g.GetActiveConnections())
+	assert.Equal(t, active+1, testutil.ToFloat64(m.ActiveConnections))
+	rtt, ok := g.GetConnectionRTT(connectionID)
+	require.True(t, ok)
+	assert.Greater(t, rtt, time.Duration(0))
+}
+
+func TestGate_ClosesConnectionsThatMissPongs(t *testing.T) {
+	m := testMetrics()
+	active := testutil.ToFloat64(m.ActiveConnections)
+	missed := testutil.ToFloat64(m.MissedPongs)
+	g := gate.NewWithOptions(gate.Options{
+		BufferSize:        10,
+		HeartbeatInterval: 30 * time.Millisecond,
+		MaxMissedPongs:    2,
+		Metrics:           m,
+	})
+	g.Start()
+	defer g.Stop()
+	
+	server := httptest.NewServer(http.HandlerFunc(g.HandleWebSocket))
+	defer server.Close()
+	
+	// The client never reads, so it never answers a ping
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), &websocket.DialOptions{
+		HTTPHeader: http.Header{"X-API-Key": []string{"test-key"}},
+	})
+	require.NoError(t, err)
+	defer conn.CloseNow()
+	require.Eventually(t, func() bool { return g.GetActiveConnections() == 1 }, time.Second, 5*time.Millisecond)
+	
+	require.Eventually(t, func() bool { return g.GetActiveConnections() == 0 }, 2*time.Second, 10*time.Millisecond)
+	assert.Greater(t, testutil.ToFloat64(m.MissedPongs), missed)
+	assert.Eventually(t, func() bool { return testutil.ToFloat64(m.ActiveConnections) == active }, time.Second, 5*time.Millisecond)
+	
+	// The socket itself is gone, not just the registry entry
+	_, _, err = conn.Read(ctx)
+	assert.Error(t, err)
+}
+
+func TestGate_RateLimitsNackOverLimitPackets(t *testing.T) {
+	m := testMetrics()
+	limited := testutil.ToFloat64(m.RateLimited.WithLabelValues("connection", "pose", "packets"))
+	g := gate.NewWithOptions(gate.Options{
+		BufferSize:        10,
+		HeartbeatInterval: time.Second,
+		AckInterval:       time.Hour,
+		Metrics:           m,
+		RateLimits: types.RateLimitConfig{RateLimitScopes: types.RateLimitScopes{
+			PerConnection: types.RateLimits{Pose: types.RateBudget{PacketsPerSec: 2}},
+		}},
+	})
+	g.Start()
+	defer g.Stop()
+	
+	server := httptest.NewServer(http.HandlerFunc(g.HandleWebSocket))
+	defer server.Close()
+	
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _ := dialControl(ctx, t, server.URL, "acks=true", "")
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	
+	// The burst is one second's worth, so the third pose in a row is over
+	for frame := 1; frame <= 3; frame++ {
+		require.NoError(t, wsjson.Write(ctx, conn, ackTestPacket(frame)))
+	}
+	var msg protocol.ControlMessage
+	require.NoError(t, wsjson.Read(ctx, conn, &msg))
+	assert.Equal(t, protocol.ControlNack, msg.Type)
+	assert.Equal(t, 3, msg.FrameNumber)
+	assert.Equal(t, protocol.NackRateLimited, msg.Reason)
+	assert.Equal(t, limited+1, testutil.ToFloat64(m.RateLimited.WithLabelValues("connection", "pose", "packets")))
+	
+	// Meshes have their own budget, unlimited here
+	require.NoError(t, wsjson.Write(ctx, conn, map[string]interface{}{
+		"session_id":   "test-session",
+		"frame_number": 4,
+		"timestamp":    time.Now().UnixMilli(),
+		"type":         "mesh",
+		"data":         map[string]interface{}{"mesh": map[string]interface{}{"vertices": "AAAA", "anchor_id": "anchor"}},
+	}))
+	assert.Equal(t, []int{1, 2, 4}, receiveFrames(t, g, 3))
+}
+
+func TestGate_RateLimitsPerKeyAcrossConnections(t *testing.T) {
+	g := gate.NewWithOptions(gate.Options{
+		BufferSize:        10,
+		HeartbeatInterval: time.Second,
+		RateLimits: types.RateLimitConfig{
+			Policy: gate.RateLimitClose,
+			RateLimitScopes: types.RateLimitScopes{
+				PerKey: types.RateLimits{Pose: types.RateBudget{PacketsPerSec: 3}},
+			},
+			Overrides: []types.RateLimitOverride{{APIKey: "unlimited-key"}},
+		},
+	})
+	g.Start()
+	defer g.Stop()
+	
+	server := httptest.NewServer(http.HandlerFunc(g.HandleWebSocket))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dial := func(apiKey string) *websocket.Conn {
+		conn, _, err := websocket.Dial(ctx, wsURL, &websocket.DialOptions{
+			HTTPHeader: http.Header{"X-API-Key": []string{apiKey}},
+		})
+		require.NoError(t, err)
+		return conn
+	}
+	
+	// Two connections of one key share its budget; the one that goes over
+	// is closed
+	first, second := dial("test-key"), dial("test-key")
+	defer first.CloseNow()
+	defer second.CloseNow()
+	for frame := 1; frame <= 2; frame++ {
+		require.NoError(t, wsjson.Write(ctx, first, ackTestPacket(frame)))
+	}
+	receiveFrames(t, g, 2)
+	require.NoError(t, wsjson.Write(ctx, second, ackTestPacket(3)))
+	receiveFrames(t, g, 1)
+	require.NoError(t, wsjson.Write(ctx, second, ackTestPacket(4)))
+	
+	_, _, err := second.Read(ctx)
+	var closeErr websocket.CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, websocket.StatusPolicyViolation, closeErr.Code)
+	assert.Contains(t, closeErr.Reason, "api_key pose packets")
+	
+	// An override without budgets lifts the limits for its key
+	other := dial("unlimited-key")
+	defer other.CloseNow()
+	for frame := 1; frame <= 10; frame++ {
+		require.NoError(t, wsjson.Write(ctx, other, ackTestPacket(frame)))
+	}
+	assert.Len(t, receiveFrames(t, g, 10), 10)
+}
+
+func TestGate_RateLimitsKeepKeyBudgetAcrossReconnects(t *testing.T) {
+	g := gate.NewWithOptions(gate.Options{
+		BufferSize:        10,
+		HeartbeatInterval: time.Second,
+		AckInterval:       time.Hour,
+		RateLimits: types.RateLimitConfig{RateLimitScopes: types.RateLimitScopes{
+			PerKey: types.RateLimits{Pose: types.RateBudget{PacketsPerSec: 3}},
+		}},
+	})
+	g.Start()
+	defer g.Stop()
+	
+	server := httptest.NewServer(http.HandlerFunc(g.HandleWebSocket))
+	defer server.Close()
+	
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	first, _ := dialControl(ctx, t, server.URL, "acks=true", "")
+	for frame := 1; frame <= 3; frame++ {
+		require.NoError(t, wsjson.Write(ctx, first, ackTestPacket(frame)))
+	}
+	receiveFrames(t, g, 3)
+	first.Close(websocket.StatusNormalClosure, "")
+	require.Eventually(t, func() bool { return g.GetActiveConnections() == 0 }, time.Second, 5*time.Millisecond)
+	
+	// The key's spent budget outlives its last connection
+	second, _ := dialControl(ctx, t, server.URL, "acks=true", "")
+	defer second.Close(websocket.StatusNormalClosure, "")
+	require.NoError(t, wsjson.Write(ctx, second, ackTestPacket(4)))
+	var msg protocol.ControlMessage
+	require.NoError(t, wsjson.Read(ctx, second, &msg))
+	assert.Equal(t, protocol.ControlNack, msg.Type)
+	assert.Equal(t, protocol.NackRateLimited, msg.Reason)
+	assert.Contains(t, msg.Error, "api_key pose packets")
+}
+
+func TestGate_ValidateRateLimits(t *testing.T) {
+	assert.NoError(t, gate.ValidateRateLimits(types.RateLimitConfig{}))
+	assert.Error(t, gate.ValidateRateLimits(types.RateLimitConfig{Policy: "throttle"}))
+	assert.Error(t, gate.ValidateRateLimits(types.RateLimitConfig{Overrides: []types.RateLimitOverride{{}}}))
+	assert.Error(t, gate.ValidateRateLimits(types.RateLimitConfig{RateLimitScopes: types.RateLimitScopes{
+		PerKey: types.RateLimits{Mesh: types.RateBudget{BytesPerSec: -1}},
+	}}))
+}
+
+func TestGate_SchedulesConnectionsRoundRobin(t *testing.T) {
+	m := testMetrics()
+	g := gate.NewWithOptions(gate.Options{
+		BufferSize:        1,
+		HeartbeatInterval: time.Second,
+		QueueWeights:      map[string]int{"light-key": 2},
+		Metrics:           m,
+	})
+	g.Start()
+	defer g.Stop()
+	
+	server := httptest.NewServer(http.HandlerFunc(g.HandleWebSocket))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dial := func(apiKey string) *websocket.Conn {
+		conn, _, err := websocket.Dial(ctx, wsURL, &websocket.DialOptions{
+			HTTPHeader: http.Header{"X-API-Key": []string{apiKey}},
+		})
+		require.NoError(t, err)
+		return conn
+	}
+	
+	// One device floods the gate before another sends anything
+	heavy, light := dial("heavy-key"), dial("light-key")
+	defer light.Close(websocket.StatusNormalClosure, "")
+	for frame := 1; frame <= 30; frame++ {
+		require.NoError(t, wsjson.Write(ctx, heavy, ackTestPacket(frame)))
+	}
+	for frame := 101; frame <= 106; frame++ {
+		require.NoError(t, wsjson.Write(ctx, light, ackTestPacket(frame)))
+	}
+	require.Eventually(t, func() bool {
+		total := 0
+		for _, stats := range g.QueueStats() {
+			total += stats.Depth
+		}
+		return total >= 33
+	}, time.Second, 5*time.Millisecond)
+	
+	// Instead of waiting behind the flood, the second device gets two
+	// turns for each of the first one's
+	frames := receiveFrames(t, g, 12)
+	lightFrames := 0
+	for _, frame := range frames {
+		if frame > 100 {
+			lightFrames++
+		}
+	}
+	assert.Equal(t, 6, lightFrames, "frames in scheduling order: %v", frames)
+	
+	// Queue metrics go away with the connection once its queue drains
+	var heavyID string
+	for id, stats := range g.QueueStats() {
+		if stats.Weight == 1 {
+			heavyID = id
+		}
+	}
+	require.NotEmpty(t, heavyID)
+	heavy.Close(websocket.StatusNormalClosure, "")
+	receiveFrames(t, g, 24)
+	assert.Eventually(t, func() bool { return !hasConnectionMetric(t, heavyID) }, time.Second, 10*time.Millisecond)
+}
+
+func hasConnectionMetric(t *testing.T, connectionID string) bool {
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if !strings.HasPrefix(family.GetName(), "relay_connection_") {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "connection" && label.GetValue() == connectionID {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,212 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tabular/relay/internal/kafkasink"
+	"github.com/tabular/relay/internal/metrics"
+	"github.com/tabular/relay/pkg/sink"
+	"github.com/tabular/relay/pkg/types"
+	"github.com/tabular/relay/tests/testdata"
+)
+
+var (
+	sharedMetrics     *metrics.Metrics
+	sharedMetricsOnce sync.Once
+)
+
+// testMetrics returns a process-wide Metrics; metrics.New registers with the
+// default Prometheus registry and can only run once
+func testMetrics() *metrics.Metrics {
+	sharedMetricsOnce.Do(func() {
+		sharedMetrics = metrics.New()
+	})
+	return sharedMetrics
+}
+
+func newKafkaBroker(t *testing.T, topic string, partitions int32) *testdata.KafkaBroker {
+	t.Helper()
+	broker, err := testdata.NewKafkaBroker(topic, partitions)
+	require.NoError(t, err)
+	t.Cleanup(broker.Close)
+	return broker
+}
+
+func openKafkaSink(t *testing.T, opts kafkasink.Options) *kafkasink.Sink {
+	t.Helper()
+	if opts.Timeout == 0 {
+		opts.Timeout = time.Second
+	}
+	s, err := kafkasink.Open(opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func sessionEvents(sessions []string, perSession int) []types.SpatialEvent {
+	var events []types.SpatialEvent
+	for i := 0; i < perSession; i++ {
+		for _, sessionID := range sessions {
+			event := testPoseEvent(sessionID)
+			event.EventID = sessionID + "-" + strconv.Itoa(i)
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+func TestKafkaSink_PartitionerMatchesKafka(t *testing.T) {
+	// murmur2 values from Kafka's own partitioner tests
+	assert.Equal(t, int32(-973932308&0x7fffffff), kafkasink.PartitionForKey([]byte("21"), 1<<31-1))
+	assert.Equal(t, int32(-790332482&0x7fffffff), kafkasink.PartitionForKey([]byte("foobar"), 1<<31-1))
+}
+
+func TestKafkaSink_KeysRecordsBySession(t *testing.T) {
+	broker := newKafkaBroker(t, "spatial", 4)
+	s := openKafkaSink(t, kafkasink.Options{Brokers: []string{broker.Addr()}, Topic: "spatial"})
+
+	sessions := []string{"session-a", "session-b", "session-c"}
+	events := sessionEvents(sessions, 5)
+	results, err := s.Send(context.Background(), events)
+	requireDelivered(t, results, err)
+
+	assert.Len(t, broker.AllRecords(), len(events))
+	for _, sessionID := range sessions {
+		partition := kafkasink.PartitionForKey([]byte(sessionID), 4)
+
+		var ids []string
+		for _, rec := range broker.Records(partition) {
+			if rec.Key == sessionID {
+				ids = append(ids, rec.Headers["event_id"])
+
+				var event types.SpatialEvent
+				require.NoError(t, json.Unmarshal(rec.Value, &event))
+				assert.Equal(t, sessionID, event.SessionID)
+			}
+		}
+		assert.Equal(t, []string{sessionID + "-0", sessionID + "-1", sessionID + "-2", sessionID + "-3", sessionID + "-4"}, ids,
+			"a session's records should be on one partition, in order")
+	}
+}
+
+func TestKafkaSink_SplitsBatchesByBytes(t *testing.T) {
+	broker := newKafkaBroker(t, "spatial", 1)
+	s := openKafkaSink(t, kafkasink.Options{Brokers: []string{broker.Addr()}, Topic: "spatial", BatchBytes: 600})
+
+	events := sessionEvents([]string{"big-session"}, 10)
+	results, err := s.Send(context.Background(), events)
+	requireDelivered(t, results, err)
+
+	assert.Greater(t, broker.Batches(0), 1)
+	var ids []string
+	for _, rec := range broker.Records(0) {
+		ids = append(ids, rec.Headers["event_id"])
+	}
+	assert.Equal(t, eventIDs(events), ids)
+}
+
+func TestKafkaSink_PartitionFailuresAndMetrics(t *testing.T) {
+	m := testMetrics()
+	broker := newKafkaBroker(t, "failing", 4)
+	s := openKafkaSink(t, kafkasink.Options{Brokers: []string{broker.Addr()}, Topic: "failing", Metrics: m})
+
+	failing := kafkasink.PartitionForKey([]byte("session-a"), 4)
+	label := strconv.Itoa(int(failing))
+	broker.FailNext(failing, 6) // Not leader or follower
+
+	events := []types.SpatialEvent{testPoseEvent("session-a"), testPoseEvent("session-b"), testPoseEvent("session-c")}
+	results, err := s.Send(context.Background(), events)
+	require.NoError(t, err)
+
+	for i, event := range events {
+		if kafkasink.PartitionForKey([]byte(event.SessionID), 4) == failing {
+			require.Error(t, results[i].Err)
+			assert.True(t, sink.IsRetryable(results[i].Err))
+		} else {
+			assert.NoError(t, results[i].Err)
+		}
+	}
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.KafkaFailures.WithLabelValues("failing", label, "not_leader_or_follower")))
+
+	// The retry goes through and is reflected in the partition gauges
+	results, err = s.Send(context.Background(), events[:1])
+	requireDelivered(t, results, err)
+	assert.Equal(t, float64(len(broker.Records(failing))-1), testutil.ToFloat64(m.KafkaPartitionOffset.WithLabelValues("failing", label)))
+	assert.Greater(t, testutil.ToFloat64(m.KafkaDeliveryLatency.WithLabelValues("failing", label)), 0.0)
+
+	broker.FailNext(failing, 10) // Message too large
+	results, err = s.Send(context.Background(), events[:1])
+	require.NoError(t, err)
+	require.Error(t, results[0].Err)
+	assert.False(t, sink.IsRetryable(results[0].Err))
+}
+
+func TestKafkaSink_DuplicateKeepsLastOffset(t *testing.T) {
+	m := testMetrics()
+	broker := newKafkaBroker(t, "duplicates", 1)
+	s := openKafkaSink(t, kafkasink.Options{Brokers: []string{broker.Addr()}, Topic: "duplicates", Metrics: m})
+
+	results, err := s.Send(context.Background(), sessionEvents([]string{"session-a"}, 3))
+	requireDelivered(t, results, err)
+	offset := m.KafkaPartitionOffset.WithLabelValues("duplicates", "0")
+	require.Equal(t, 2.0, testutil.ToFloat64(offset))
+
+	// A duplicate counts as delivered but carries no offset
+	broker.FailNext(0, 46)
+	results, err = s.Send(context.Background(), sessionEvents([]string{"session-a"}, 1))
+	requireDelivered(t, results, err)
+	assert.Equal(t, 2.0, testutil.ToFloat64(offset))
+}
+
+func TestKafkaSink_IdempotentProducerRecoversSequence(t *testing.T) {
+	broker := newKafkaBroker(t, "idempotent", 2)
+	s := openKafkaSink(t, kafkasink.Options{Brokers: []string{broker.Addr()}, Topic: "idempotent", Idempotent: true})
+
+	events := sessionEvents([]string{"session-a", "session-b"}, 2)
+	results, err := s.Send(context.Background(), events)
+	requireDelivered(t, results, err)
+
+	// The broker enforces sequences, so a second batch only lands if the
+	// producer continued them correctly
+	results, err = s.Send(context.Background(), events)
+	requireDelivered(t, results, err)
+
+	partition := kafkasink.PartitionForKey([]byte("session-a"), 2)
+	broker.FailNext(partition, 45) // Out of order sequence number
+	results, err = s.Send(context.Background(), events[:1])
+	require.NoError(t, err)
+	require.Error(t, results[0].Err)
+
+	// A new producer ID restarts the sequences
+	results, err = s.Send(context.Background(), events[:1])
+	requireDelivered(t, results, err)
+	assert.Len(t, broker.AllRecords(), 2*len(events)+1)
+}
+
+func TestKafkaSink_Options(t *testing.T) {
+	_, err := kafkasink.Open(kafkasink.Options{Brokers: []string{"localhost:9092"}, Topic: "t", Acks: "leader", Idempotent: true})
+	assert.Error(t, err, "idempotence needs acks=all")
+	_, err = kafkasink.Open(kafkasink.Options{Brokers: []string{"localhost:9092"}})
+	assert.Error(t, err, "topic is required")
+	_, err = kafkasink.Open(kafkasink.Options{Brokers: []string{"localhost:9092"}, Topic: "t", Acks: "some"})
+	assert.Error(t, err)
+}
+
+func TestKafkaSink_AcksNone(t *testing.T) {
+	broker := newKafkaBroker(t, "fire-and-forget", 1)
+	s := openKafkaSink(t, kafkasink.Options{Brokers: []string{broker.Addr()}, Topic: "fire-and-forget", Acks: "none"})
+
+	results, err := s.Send(context.Background(), sessionEvents([]string{"session-a"}, 3))
+	requireDelivered(t, results, err)
+	require.Eventually(t, func() bool {
+		return len(broker.Records(0)) == 3
+	}, time.Second, 5*time.Millisecond)
+}
@@ -0,0 +1,227 @@
+package unit
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tabular/relay/internal/updater"
+	"github.com/tabular/relay/pkg/meshdelta"
+	"github.com/tabular/relay/pkg/types"
+	"github.com/tabular/relay/tests/testdata"
+)
+
+func decodeVertices(buf []byte) []float32 {
+	vertices := make([]float32, len(buf)/4)
+	for i := range vertices {
+		vertices[i] = math.Float32frombits(binary.LittleEndian.Uint32(buf[i*4:]))
+	}
+	return vertices
+}
+
+// editVertices applies a random mix of jitter, moves, inserts and removals
+func editVertices(rng *rand.Rand, vertices []float32) []float32 {
+	out := append([]float32(nil), vertices...)
+	for i := range out {
+		out[i] += (rng.Float32() - 0.5) * 0.001
+	}
+	for i := 0; i < 5; i++ {
+		out[rng.Intn(len(out))] += rng.Float32()
+	}
+
+	at := rng.Intn(len(out)/3) * 3
+	switch rng.Intn(3) {
+	case 0:
+		inserted := []float32{rng.Float32(), rng.Float32(), rng.Float32()}
+		out = append(out[:at], append(inserted, out[at:]...)...)
+	case 1:
+		out = append(out[:at], out[at+3:]...)
+	}
+	return out
+}
+
+func TestMeshDelta_VertexRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	prev := testdata.CreateRawVertexData(gridVertices(300, 0))
+	vertices := gridVertices(300, 0)
+
+	for i := 0; i < 50; i++ {
+		vertices = editVertices(rng, vertices)
+		next := testdata.CreateRawVertexData(vertices)
+
+		delta, reconstructed, err := meshdelta.EncodeVertices(prev, next, 0.001)
+		require.NoError(t, err)
+
+		applied, err := meshdelta.ApplyVertices(prev, delta)
+		require.NoError(t, err)
+		assert.Equal(t, reconstructed, applied)
+		assert.Len(t, applied, len(next))
+
+		exact, _, err := meshdelta.EncodeVertices(prev, next, 0)
+		require.NoError(t, err)
+		applied, err = meshdelta.ApplyVertices(prev, exact)
+		require.NoError(t, err)
+		assert.Equal(t, next, applied, "zero tolerance must be lossless")
+
+		prev = reconstructed
+	}
+}
+
+func TestMeshDelta_FaceRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+
+	for _, format := range []string{"uint16", "uint32"} {
+		triangles := stripTriangles(200, 0)
+		prev := triangleList(format, triangles)
+
+		for i := 0; i < 20; i++ {
+			// Remove some triangles, rotate one and append duplicates
+			at := rng.Intn(len(triangles) - 3)
+			triangles = append(triangles[:at], triangles[at+3:]...)
+			tri := triangles[rng.Intn(len(triangles))]
+			triangles[0] = [3]uint32{tri[2], tri[0], tri[1]}
+			triangles = append(triangles, triangles[1], [3]uint32{uint32(i), 500, 501})
+			next := triangleList(format, triangles)
+
+			width := meshdelta.IndexWidth(format, next)
+			delta, reconstructed, err := meshdelta.EncodeFaces(prev, next, width)
+			require.NoError(t, err)
+
+			applied, err := meshdelta.ApplyFaces(prev, delta)
+			require.NoError(t, err)
+			assert.Equal(t, reconstructed, applied)
+			assert.Len(t, applied, len(next))
+
+			prev = reconstructed
+		}
+	}
+}
+
+func TestMeshDelta_RejectsCorruptDeltas(t *testing.T) {
+	prev := testdata.CreateRawVertexData(gridVertices(10, 0))
+	next := testdata.CreateRawVertexData(gridVertices(12, 1))
+	delta, _, err := meshdelta.EncodeVertices(prev, next, 0)
+	require.NoError(t, err)
+
+	for cut := 0; cut < len(delta); cut++ {
+		_, err := meshdelta.ApplyVertices(prev, delta[:cut])
+		assert.Error(t, err, "truncated at %d bytes", cut)
+	}
+	_, err = meshdelta.ApplyVertices(prev[:len(prev)-12], delta)
+	assert.Error(t, err, "wrong base buffer")
+}
+
+func TestReconstructor_RebuildsUpdaterStream(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	opts := updater.DefaultOptions()
+	opts.KeyframeInterval = 4
+
+	vertices := gridVertices(400, 0)
+	triangles := stripTriangles(300, 0)
+	var events []types.SpatialEvent
+	var expected [][]float32
+	for i := 0; i < 12; i++ {
+		vertices = editVertices(rng, vertices)
+		triangles = append(triangles[1:], [3]uint32{uint32(i), 398, 399})
+		event := meshEvent("anchor-rebuild", vertices)
+		event.Meshes[0].FacesDelta = triangleList("uint32", triangles)
+		event.Meshes[0].IndexFormat = "uint32"
+		events = append(events, event)
+		expected = append(expected, vertices)
+	}
+
+	diffs := sendMeshEventsWithOptions(t, opts, events...)
+
+	r := meshdelta.NewReconstructor()
+	for i, diff := range diffs {
+		assert.Equal(t, meshdelta.EncodingGzip, diff.VerticesEncoding)
+		mesh, err := r.Apply(diff)
+		require.NoError(t, err, "update %d", i)
+		assert.Equal(t, diff.Version, mesh.Version)
+
+		// Vertices within tolerance of what was sent, faces exact
+		got := decodeVertices(mesh.Vertices)
+		require.Len(t, got, len(expected[i]))
+		for j := range got {
+			assert.InDelta(t, expected[i][j], got[j], 0.001)
+		}
+		assert.Equal(t, len(events[i].Meshes[0].FacesDelta), len(mesh.Faces))
+	}
+}
+
+func TestReconstructor_DetectsGapsAndRecovers(t *testing.T) {
+	opts := updater.DefaultOptions()
+	opts.KeyframeInterval = 3
+
+	var events []types.SpatialEvent
+	for i := 0; i < 5; i++ {
+		vertices := gridVertices(400, 0)
+		vertices[i*3] += 0.5
+		events = append(events, meshEvent("anchor-gap", vertices))
+	}
+	diffs := sendMeshEventsWithOptions(t, opts, events...)
+	require.True(t, diffs[1].IsDelta)
+	require.False(t, diffs[4].IsDelta, "keyframe after three deltas")
+
+	r := meshdelta.NewReconstructor()
+	_, err := r.Apply(diffs[0])
+	require.NoError(t, err)
+
+	// Missing diffs[1] breaks the chain until the next keyframe
+	_, err = r.Apply(diffs[2])
+	assert.ErrorIs(t, err, meshdelta.ErrGap)
+	_, err = r.Apply(diffs[3])
+	assert.ErrorIs(t, err, meshdelta.ErrGap)
+
+	mesh, err := r.Apply(diffs[4])
+	require.NoError(t, err)
+	assert.Equal(t, diffs[4].Hash, mesh.Hash)
+
+	// A redelivered old delta must not overwrite the current mesh
+	_, err = r.Apply(diffs[2])
+	assert.ErrorIs(t, err, meshdelta.ErrStale)
+	current, ok := r.Mesh("anchor-gap")
+	require.True(t, ok)
+	assert.Equal(t, diffs[4].Version, current.Version)
+}
+
+func TestReconstructor_RejectsStaleKeyframes(t *testing.T) {
+	base := gridVertices(400, 0)
+	moved := gridVertices(400, 0)
+	moved[0] += 0.5
+	diffs := sendMeshes(t, base, moved)
+	require.False(t, diffs[0].IsDelta)
+	require.True(t, diffs[1].IsDelta)
+
+	r := meshdelta.NewReconstructor()
+	for _, diff := range diffs {
+		_, err := r.Apply(diff)
+		require.NoError(t, err)
+	}
+
+	// The old keyframe arriving late, e.g. from a redriven batch
+	_, err := r.Apply(diffs[0])
+	assert.ErrorIs(t, err, meshdelta.ErrStale)
+	current, ok := r.Mesh("anchor-delta")
+	require.True(t, ok)
+	assert.Equal(t, diffs[1].Version, current.Version)
+	assert.Equal(t, diffs[1].Hash, current.Hash)
+}
+
+func TestReconstructor_RejectsHashMismatch(t *testing.T) {
+	vertices := testdata.CreateRawVertexData(gridVertices(10, 0))
+	r := meshdelta.NewReconstructor()
+
+	_, err := r.Apply(types.MeshDiff{
+		AnchorID:      "anchor-hash",
+		VerticesDelta: vertices,
+		Version:       1,
+		Hash:          meshdelta.Hash(vertices[12:], nil),
+	})
+	assert.ErrorIs(t, err, meshdelta.ErrHashMismatch)
+	_, ok := r.Mesh("anchor-hash")
+	assert.False(t, ok)
+}
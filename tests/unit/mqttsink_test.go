@@ -0,0 +1,179 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tabular/relay/internal/mqttsink"
+	"github.com/tabular/relay/pkg/sink"
+	"github.com/tabular/relay/pkg/types"
+	"github.com/tabular/relay/tests/testdata"
+)
+
+func newMQTTBroker(t *testing.T) *testdata.MQTTBroker {
+	t.Helper()
+	broker, err := testdata.NewMQTTBroker()
+	require.NoError(t, err)
+	t.Cleanup(broker.Close)
+	return broker
+}
+
+func openMQTTSink(t *testing.T, opts mqttsink.Options) *mqttsink.Sink {
+	t.Helper()
+	if opts.Timeout == 0 {
+		opts.Timeout = time.Second
+	}
+	s, err := mqttsink.Open(opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func requireDelivered(t *testing.T, results []sink.Result, err error) {
+	t.Helper()
+	require.NoError(t, err)
+	for _, result := range results {
+		require.NoError(t, result.Err)
+	}
+}
+
+// waitMessages waits for QoS 0 publishes, which Send doesn't wait for
+func waitMessages(t *testing.T, broker *testdata.MQTTBroker, n int) []testdata.MQTTMessage {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		return len(broker.Messages()) >= n
+	}, time.Second, 5*time.Millisecond)
+	return broker.Messages()
+}
+
+func TestMQTTSink_PublishesToTopicTemplates(t *testing.T) {
+	broker := newMQTTBroker(t)
+	s := openMQTTSink(t, mqttsink.Options{
+		Broker:        broker.Addr(),
+		ClientID:      "relay-test",
+		AnchorQoS:     1,
+		RetainAnchors: true,
+		RetainMeshes:  true,
+	})
+
+	mesh := meshEvent("anchor-mesh", gridVertices(4, 0))
+	mesh.SessionID = "mqtt-session"
+	results, err := s.Send(context.Background(), []types.SpatialEvent{testPoseEvent("mqtt-session"), mesh})
+	requireDelivered(t, results, err)
+
+	messages := waitMessages(t, broker, 2)
+	require.Len(t, messages, 2)
+
+	assert.Equal(t, "sessions/mqtt-session/anchors/anchor-1", messages[0].Topic)
+	assert.Equal(t, byte(1), messages[0].QoS)
+	var anchor mqttsink.AnchorMessage
+	require.NoError(t, json.Unmarshal(messages[0].Payload, &anchor))
+	assert.Equal(t, "mqtt-session", anchor.SessionID)
+	assert.Equal(t, 1.0, anchor.Pose.X)
+
+	assert.Equal(t, "sessions/mqtt-session/meshes/anchor-mesh", messages[1].Topic)
+	assert.Equal(t, byte(0), messages[1].QoS)
+	var meshMsg mqttsink.MeshMessage
+	require.NoError(t, json.Unmarshal(messages[1].Payload, &meshMsg))
+	assert.Equal(t, mesh.Meshes[0].VerticesDelta, meshMsg.VerticesDelta)
+
+	// Late subscribers get the latest pose and the mesh keyframe
+	retained, ok := broker.Retained("sessions/mqtt-session/anchors/anchor-1")
+	require.True(t, ok)
+	assert.Equal(t, messages[0].Payload, retained.Payload)
+	_, ok = broker.Retained("sessions/mqtt-session/meshes/anchor-mesh")
+	assert.True(t, ok)
+
+	connects := broker.Connects()
+	require.Len(t, connects, 1)
+	assert.Equal(t, mqttsink.Version311, connects[0].Version)
+	assert.Equal(t, "relay-test", connects[0].ClientID)
+}
+
+func TestMQTTSink_DoesNotRetainMeshDeltas(t *testing.T) {
+	broker := newMQTTBroker(t)
+	s := openMQTTSink(t, mqttsink.Options{Broker: broker.Addr(), RetainMeshes: true})
+
+	delta := meshEvent("anchor-delta", gridVertices(4, 0))
+	delta.Meshes[0].IsDelta = true
+	results, err := s.Send(context.Background(), []types.SpatialEvent{delta})
+	requireDelivered(t, results, err)
+
+	messages := waitMessages(t, broker, 1)
+	require.Len(t, messages, 1)
+	assert.False(t, messages[0].Retain)
+}
+
+func TestMQTTSink_MQTT5ReasonCodes(t *testing.T) {
+	broker := newMQTTBroker(t)
+	broker.Reject("sessions/denied/anchors/anchor-1", 0x87) // Not authorized
+
+	s := openMQTTSink(t, mqttsink.Options{
+		Broker:          broker.Addr(),
+		ProtocolVersion: mqttsink.Version5,
+		AnchorQoS:       2,
+	})
+
+	results, err := s.Send(context.Background(), []types.SpatialEvent{
+		testPoseEvent("allowed"),
+		testPoseEvent("denied"),
+	})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.NoError(t, results[0].Err)
+	require.Error(t, results[1].Err)
+	assert.False(t, sink.IsRetryable(results[1].Err), "not authorized is permanent")
+
+	messages := broker.Messages()
+	require.Len(t, messages, 1)
+	assert.Equal(t, byte(2), messages[0].QoS)
+	assert.Equal(t, mqttsink.Version5, broker.Connects()[0].Version)
+}
+
+func TestMQTTSink_ReconnectsAfterConnectionLoss(t *testing.T) {
+	broker := newMQTTBroker(t)
+	s := openMQTTSink(t, mqttsink.Options{Broker: broker.Addr(), AnchorQoS: 1})
+
+	results, err := s.Send(context.Background(), []types.SpatialEvent{testPoseEvent("before")})
+	requireDelivered(t, results, err)
+
+	broker.DropConnections()
+
+	// A batch caught by the drop fails as retryable; a later one reconnects
+	require.Eventually(t, func() bool {
+		results, err := s.Send(context.Background(), []types.SpatialEvent{testPoseEvent("after")})
+		if err != nil {
+			return false
+		}
+		if results[0].Err != nil {
+			assert.True(t, sink.IsRetryable(results[0].Err))
+			return false
+		}
+		return true
+	}, 2*time.Second, 20*time.Millisecond)
+
+	assert.Len(t, broker.Connects(), 2)
+	assert.Len(t, broker.Messages(), 2)
+}
+
+func TestMQTTSink_EscapesTopicValues(t *testing.T) {
+	broker := newMQTTBroker(t)
+	s := openMQTTSink(t, mqttsink.Options{Broker: broker.Addr(), AnchorTopic: "live/{session_id}/{anchor_id}"})
+
+	event := testPoseEvent("site/+/#")
+	results, err := s.Send(context.Background(), []types.SpatialEvent{event})
+	requireDelivered(t, results, err)
+
+	messages := waitMessages(t, broker, 1)
+	require.Len(t, messages, 1)
+	assert.Equal(t, "live/site____/anchor-1", messages[0].Topic)
+
+	_, err = mqttsink.Open(mqttsink.Options{Broker: broker.Addr(), AnchorTopic: "live/{sesion_id}"})
+	assert.Error(t, err, "unknown placeholders should be rejected")
+	_, err = mqttsink.Open(mqttsink.Options{Broker: broker.Addr(), MeshTopic: "live/#"})
+	assert.Error(t, err, "wildcards should be rejected")
+}
@@ -1,12 +1,14 @@
 package unit
 
 import (
+	"errors"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/tabular/relay/internal/parser"
+	"github.com/tabular/relay/pkg/protocol"
 	"github.com/tabular/relay/pkg/types"
 )
 
@@ -67,6 +69,27 @@ func TestParser_ParseMeshPacket(t *testing.T) {
 	assert.Equal(t, "mesh", result.Type)
 	assert.Equal(t, "anchor-123", result.Data.Mesh.AnchorID)
 	assert.NotEmpty(t, result.Data.Mesh.Vertices)
+	assert.True(t, result.Data.Mesh.Decoded)
+}
+
+func TestParser_MarksEncodedMeshesAsNotDecoded(t *testing.T) {
+	p := parser.New()
+	
+	for name, vertices := range map[string][]byte{
+		"draco":      append([]byte("DRACO"), make([]byte, 19)...), // 24 bytes, a multiple of 12
+		"odd length": make([]byte, 13),
+	} {
+		packet := types.StreamPacket{
+			SessionID:   "test-session",
+			FrameNumber: 1,
+			Timestamp:   time.Now().UnixMilli(),
+			Type:        "mesh",
+			Data:        types.PacketData{Mesh: &types.MeshData{Vertices: vertices, AnchorID: "anchor-123"}},
+		}
+		result, err := p.ParsePacket(packet)
+		require.NoError(t, err, name)
+		assert.False(t, result.Data.Mesh.Decoded, name)
+	}
 }
 
 func TestParser_ValidatePacket(t *testing.T) {
@@ -138,6 +161,8 @@ func TestParser_InvalidPacketType(t *testing.T) {
 	_, err := p.ParsePacket(packet)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "unknown packet type")
+	var invalid *parser.ValidationError
+	assert.ErrorAs(t, err, &invalid)
 }
 
 func TestParser_PoseValidation(t *testing.T) {
@@ -211,4 +236,49 @@ func TestParser_GetStats(t *testing.T) {
 	assert.True(t, stats["compression_support"].(bool))
 	assert.Contains(t, stats, "gzip_support")
 	assert.True(t, stats["gzip_support"].(bool))
-}
\ No newline at end of file
+}
+
+func TestParser_UpgradesVersion1Packets(t *testing.T) {
+	p := parser.New()
+	
+	data := []byte(`{"session_id":"legacy","frame_number":3,"timestamp":1634567890123,"type":"mesh",
+		"data":{"mesh":{"anchor_id":"anchor-1","vertices":"AAAAAAAAAAAAAAAA","faces":"AAAAAQAAAAIAAAAD"}}}`)
+	packet, err := parser.Decode(protocol.Version1, data)
+	require.NoError(t, err)
+	assert.Empty(t, packet.Data.Mesh.IndexFormat)
+	
+	// Version 1 faces were always 32-bit
+	parsed, err := p.ParseVersionedPacket(protocol.Version1, packet)
+	require.NoError(t, err)
+	assert.Equal(t, "uint32", parsed.Data.Mesh.IndexFormat)
+	assert.Empty(t, packet.Data.Mesh.IndexFormat, "the caller's packet is not modified")
+	
+	// Version 2 leaves a missing format to be inferred downstream
+	parsed, err = p.ParseVersionedPacket(protocol.Version2, packet)
+	require.NoError(t, err)
+	assert.Empty(t, parsed.Data.Mesh.IndexFormat)
+	
+	// An explicit format is kept
+	packet.Data.Mesh.IndexFormat = "uint16"
+	parsed, err = p.ParseVersionedPacket(protocol.Version1, packet)
+	require.NoError(t, err)
+	assert.Equal(t, "uint16", parsed.Data.Mesh.IndexFormat)
+}
+
+func TestParser_RejectsUnsupportedVersions(t *testing.T) {
+	p := parser.New()
+	
+	_, err := parser.Decode(protocol.CurrentVersion+1, []byte(`{}`))
+	assert.Error(t, err)
+	_, err = parser.Upgrade(-1, types.StreamPacket{})
+	assert.Error(t, err)
+	_, err = p.ParseVersionedPacket(protocol.CurrentVersion+1, types.StreamPacket{
+		SessionID: "future",
+		Timestamp: time.Now().UnixMilli(),
+		Type:      "pose",
+		Data:      types.PacketData{Pose: &types.PoseData{Rotation: [4]float64{0, 0, 0, 1}}},
+	})
+	assert.Error(t, err)
+	var invalid *parser.ValidationError
+	assert.False(t, errors.As(err, &invalid), "an unsupported version is not a validation error")
+}
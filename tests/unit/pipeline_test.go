@@ -0,0 +1,413 @@
+package unit
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tabular/relay/internal/gate"
+	"github.com/tabular/relay/internal/parser"
+	"github.com/tabular/relay/internal/pipeline"
+	"github.com/tabular/relay/internal/transformer"
+	"github.com/tabular/relay/pkg/protocol"
+	"github.com/tabular/relay/pkg/types"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// frameOutcome is an ack or nack a pipeline reported
+type frameOutcome struct {
+	frame  int
+	reason string // Empty for acks
+}
+
+// recordingAcker collects frame outcomes in the order they were reported
+type recordingAcker struct {
+	outcomes chan frameOutcome
+}
+
+func newRecordingAcker() *recordingAcker {
+	return &recordingAcker{outcomes: make(chan frameOutcome, 64)}
+}
+
+func (a *recordingAcker) Ack(connectionID string, frame int) {
+	a.outcomes <- frameOutcome{frame: frame}
+}
+
+func (a *recordingAcker) Nack(connectionID string, frame int, reason string, err error) {
+	a.outcomes <- frameOutcome{frame: frame, reason: reason}
+}
+
+func (a *recordingAcker) next(t *testing.T) frameOutcome {
+	t.Helper()
+	select {
+	case outcome := <-a.outcomes:
+		return outcome
+	case <-time.After(2 * time.Second):
+		t.Fatal("no frame outcome reported")
+		return frameOutcome{}
+	}
+}
+
+// blockingProcessor holds mesh events, of one session if set, until released
+type blockingProcessor struct {
+	session string
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func newBlockingProcessor() *blockingProcessor {
+	return &blockingProcessor{started: make(chan struct{}, 16), release: make(chan struct{})}
+}
+
+func (p *blockingProcessor) ProcessEvent(event types.SpatialEvent) error {
+	if len(event.Meshes) > 0 && (p.session == "" || p.session == event.SessionID) {
+		p.started <- struct{}{}
+		<-p.release
+	}
+	return nil
+}
+
+func (p *blockingProcessor) unblock() {
+	p.once.Do(func() { close(p.release) })
+}
+
+// sessionCounter counts the events of each session once next has taken them
+type sessionCounter struct {
+	next   pipeline.Processor
+	mutex  sync.Mutex
+	counts map[string]int
+}
+
+func (p *sessionCounter) ProcessEvent(event types.SpatialEvent) error {
+	if err := p.next.ProcessEvent(event); err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.counts[event.SessionID]++
+	return nil
+}
+
+func (p *sessionCounter) count(sessionID string) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.counts[sessionID]
+}
+
+// orderProcessor records the timestamps of each session's events in the
+// order they were processed
+type orderProcessor struct {
+	mutex      sync.Mutex
+	timestamps map[string][]int64
+}
+
+func (p *orderProcessor) ProcessEvent(event types.SpatialEvent) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.timestamps[event.SessionID] = append(p.timestamps[event.SessionID], event.Timestamp)
+	return nil
+}
+
+func pipelineMessage(frame int, packetType string) gate.MessageEvent {
+	return sessionMessage("pipeline-session", frame, packetType)
+}
+
+func sessionMessage(sessionID string, frame int, packetType string) gate.MessageEvent {
+	packet := types.StreamPacket{
+		SessionID:   sessionID,
+		FrameNumber: frame,
+		Timestamp:   time.Now().UnixMilli() + int64(frame),
+		Type:        packetType,
+	}
+	switch packetType {
+	case "pose":
+		packet.Data.Pose = &types.PoseData{Rotation: [4]float64{0, 0, 0, 1}}
+	case "mesh":
+		packet.Data.Mesh = &types.MeshData{Vertices: []byte{1, 2, 3, 4}, AnchorID: "anchor-1"}
+	}
+	return gate.MessageEvent{ConnectionID: "conn-1", Packet: packet, Timestamp: time.Now()}
+}
+
+func startPipeline(t *testing.T, messages <-chan gate.MessageEvent, processor pipeline.Processor, acker pipeline.Acker, opts pipeline.Options) *pipeline.Pipeline {
+	t.Helper()
+	opts.Parser = parser.New()
+	opts.Transformer = transformer.New()
+	opts.Processor = processor
+	opts.Acker = acker
+	opts.Metrics = testMetrics()
+	p := pipeline.New(messages, opts)
+	p.Start()
+	return p
+}
+
+// otherShardSession returns a session that hashes to a different one of
+// shards workers than session
+func otherShardSession(session string, shards uint32) string {
+	shard := func(session string) uint32 {
+		h := fnv.New32a()
+		h.Write([]byte(session))
+		return h.Sum32() % shards
+	}
+	for i := 1; ; i++ {
+		if candidate := fmt.Sprintf("%s-%d", session, i); shard(candidate) != shard(session) {
+			return candidate
+		}
+	}
+}
+
+// startGatePipeline runs a pipeline fed and admitted by a gate, returning
+// the gate's server
+func startGatePipeline(t *testing.T, g *gate.Gate, processor pipeline.Processor, opts pipeline.Options) *httptest.Server {
+	t.Helper()
+	opts.Admitter = g
+	p := startPipeline(t, g.Messages(), processor, g, opts)
+	g.Start()
+	server := httptest.NewServer(http.HandlerFunc(g.HandleWebSocket))
+	t.Cleanup(func() {
+		server.Close()
+		g.Stop()
+		p.Stop()
+	})
+	return server
+}
+
+func sessionMeshPacket(sessionID string, frame int) map[string]interface{} {
+	packet := meshTestPacket(frame)
+	packet["session_id"] = sessionID
+	return packet
+}
+
+func TestPipeline_PosesBypassQueuedMeshes(t *testing.T) {
+	messages := make(chan gate.MessageEvent, 16)
+	processor := newBlockingProcessor()
+	acker := newRecordingAcker()
+	p := startPipeline(t, messages, processor, acker, pipeline.Options{
+		Fast: types.LaneConfig{Workers: 1},
+		Bulk: types.LaneConfig{Workers: 1},
+	})
+	defer p.Stop()
+	defer processor.unblock()
+
+	messages <- pipelineMessage(1, "mesh")
+	messages <- pipelineMessage(2, "mesh")
+	<-processor.started
+	for frame := 3; frame <= 5; frame++ {
+		messages <- pipelineMessage(frame, "pose")
+	}
+
+	// Poses are processed while the bulk worker is stuck on a mesh
+	for frame := 3; frame <= 5; frame++ {
+		assert.Equal(t, frameOutcome{frame: frame}, acker.next(t))
+	}
+
+	processor.unblock()
+	assert.Equal(t, frameOutcome{frame: 1}, acker.next(t))
+	assert.Equal(t, frameOutcome{frame: 2}, acker.next(t))
+}
+
+func TestPipeline_HoldsMeshesInGateQueueWhileSinkStalls(t *testing.T) {
+	g := gate.NewWithOptions(gate.Options{BufferSize: 1, QueueDepth: 8, HeartbeatInterval: time.Second, AckInterval: time.Hour})
+	processor := newBlockingProcessor()
+	counter := &sessionCounter{next: processor, counts: make(map[string]int)}
+	server := startGatePipeline(t, g, counter, pipeline.Options{
+		Bulk: types.LaneConfig{Workers: 1, Queue: 1},
+	})
+	defer processor.unblock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _ := dialControl(ctx, t, server.URL, "acks=true", "")
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	// One mesh is stuck in the updater and one waits for the worker; the
+	// rest back up in the connection's queue instead of being dropped
+	for frame := 1; frame <= 10; frame++ {
+		require.NoError(t, wsjson.Write(ctx, conn, sessionMeshPacket("stalled", frame)))
+	}
+	var msg protocol.ControlMessage
+	require.NoError(t, wsjson.Read(ctx, conn, &msg))
+	assert.Equal(t, protocol.ControlSlowDown, msg.Type)
+
+	processor.unblock()
+	require.NoError(t, wsjson.Read(ctx, conn, &msg))
+	assert.Equal(t, protocol.ControlResume, msg.Type)
+	require.Eventually(t, func() bool { return counter.count("stalled") == 10 }, 2*time.Second, time.Millisecond)
+	for _, stats := range g.QueueStats() {
+		assert.Zero(t, stats.Dropped)
+	}
+}
+
+func TestPipeline_FullShardHoldsUpOnlyItsConnection(t *testing.T) {
+	slow := "held-up"
+	other := otherShardSession(slow, 2)
+
+	g := gate.NewWithOptions(gate.Options{BufferSize: 1, HeartbeatInterval: time.Second, AckInterval: time.Hour})
+	processor := newBlockingProcessor()
+	processor.session = slow
+	counter := &sessionCounter{next: processor, counts: make(map[string]int)}
+	server := startGatePipeline(t, g, counter, pipeline.Options{
+		Bulk: types.LaneConfig{Workers: 2, Queue: 1},
+	})
+	defer processor.unblock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	first, _ := dialControl(ctx, t, server.URL, "acks=true", "")
+	defer first.Close(websocket.StatusNormalClosure, "")
+	second, _ := dialControl(ctx, t, server.URL, "acks=true", "")
+	defer second.Close(websocket.StatusNormalClosure, "")
+
+	// The first session fills its worker's queue and more
+	for frame := 1; frame <= 4; frame++ {
+		require.NoError(t, wsjson.Write(ctx, first, sessionMeshPacket(slow, frame)))
+	}
+	<-processor.started
+	require.Eventually(t, func() bool { return totalDepth(g) == 2 }, time.Second, time.Millisecond)
+
+	// The other session's mesh still gets through
+	require.NoError(t, wsjson.Write(ctx, second, sessionMeshPacket(other, 1)))
+	require.Eventually(t, func() bool { return counter.count(other) == 1 }, time.Second, time.Millisecond)
+
+	processor.unblock()
+	require.Eventually(t, func() bool { return counter.count(slow) == 4 }, time.Second, time.Millisecond)
+}
+
+// totalDepth returns the messages waiting across a gate's connection queues
+func totalDepth(g *gate.Gate) int {
+	depth := 0
+	for _, stats := range g.QueueStats() {
+		depth += stats.Depth
+	}
+	return depth
+}
+
+func TestPipeline_ClassifiesBySizeAndType(t *testing.T) {
+	p := pipeline.New(make(chan gate.MessageEvent), pipeline.Options{FastMaxBytes: 1024})
+
+	pose := pipelineMessage(1, "pose")
+	assert.Equal(t, pipeline.ClassFast, p.Class(pose))
+
+	pose.Size = 4096
+	assert.Equal(t, pipeline.ClassBulk, p.Class(pose), "large packets use the bulk lane")
+
+	assert.Equal(t, pipeline.ClassBulk, p.Class(pipelineMessage(2, "mesh")))
+}
+
+func TestPipeline_NacksInvalidPackets(t *testing.T) {
+	messages := make(chan gate.MessageEvent, 16)
+	acker := newRecordingAcker()
+	p := startPipeline(t, messages, newBlockingProcessor(), acker, pipeline.Options{})
+	defer p.Stop()
+
+	invalid := pipelineMessage(1, "pose")
+	invalid.Packet.Data.Pose.X = 5000
+	messages <- invalid
+	messages <- pipelineMessage(2, "pose")
+
+	assert.Equal(t, frameOutcome{frame: 1, reason: protocol.NackValidationError}, acker.next(t))
+	assert.Equal(t, frameOutcome{frame: 2}, acker.next(t))
+}
+
+func TestPipeline_StopFinishesQueuedMessages(t *testing.T) {
+	messages := make(chan gate.MessageEvent, 16)
+	acker := newRecordingAcker()
+	p := startPipeline(t, messages, newBlockingProcessor(), acker, pipeline.Options{})
+
+	for frame := 1; frame <= 3; frame++ {
+		messages <- pipelineMessage(frame, "pose")
+	}
+	require.Eventually(t, func() bool { return len(messages) == 0 }, time.Second, time.Millisecond)
+	p.Stop()
+
+	assert.Len(t, acker.outcomes, 3)
+}
+
+func TestPipeline_StopDrainsMessagesLeftByTheGate(t *testing.T) {
+	messages := make(chan gate.MessageEvent, 16)
+	processor := newBlockingProcessor()
+	acker := newRecordingAcker()
+	p := startPipeline(t, messages, processor, acker, pipeline.Options{
+		Bulk: types.LaneConfig{Workers: 1, Queue: 1},
+	})
+
+	// One mesh is stuck in the updater, one fills the worker's queue and
+	// the rest are still on the gate's channel when Stop is called
+	for frame := 1; frame <= 10; frame++ {
+		messages <- pipelineMessage(frame, "mesh")
+	}
+	<-processor.started
+	stopped := make(chan struct{})
+	go func() {
+		p.Stop()
+		close(stopped)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	processor.unblock()
+
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stop did not return")
+	}
+	assert.Empty(t, messages)
+	assert.Len(t, acker.outcomes, 10)
+}
+
+func TestPipeline_KeepsSessionOrderAcrossWorkers(t *testing.T) {
+	messages := make(chan gate.MessageEvent, 64)
+	processor := &orderProcessor{timestamps: make(map[string][]int64)}
+	p := startPipeline(t, messages, processor, nil, pipeline.Options{
+		Fast: types.LaneConfig{Workers: 4, Queue: 8},
+	})
+
+	sessions := 8
+	for frame := 1; frame <= 50; frame++ {
+		for i := 0; i < sessions; i++ {
+			messages <- sessionMessage(fmt.Sprintf("order-%d", i), frame, "pose")
+		}
+	}
+	require.Eventually(t, func() bool { return len(messages) == 0 }, 2*time.Second, time.Millisecond)
+	p.Stop()
+
+	require.Len(t, processor.timestamps, sessions)
+	for session, timestamps := range processor.timestamps {
+		assert.Len(t, timestamps, 50, session)
+		assert.True(t, sort.SliceIsSorted(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] }), session)
+	}
+}
+
+func TestPipeline_RunsSessionsInParallel(t *testing.T) {
+	// Two sessions that hash to different workers
+	slow := "parallel-0"
+	other := otherShardSession(slow, 2)
+
+	messages := make(chan gate.MessageEvent, 16)
+	processor := newBlockingProcessor()
+	processor.session = slow
+	acker := newRecordingAcker()
+	p := startPipeline(t, messages, processor, acker, pipeline.Options{
+		Bulk: types.LaneConfig{Workers: 2},
+	})
+	defer p.Stop()
+	defer processor.unblock()
+
+	messages <- sessionMessage(slow, 1, "mesh")
+	<-processor.started
+	messages <- sessionMessage(other, 2, "mesh")
+
+	// The other session's mesh goes through while the first is held up
+	assert.Equal(t, frameOutcome{frame: 2}, acker.next(t))
+
+	processor.unblock()
+	assert.Equal(t, frameOutcome{frame: 1}, acker.next(t))
+}
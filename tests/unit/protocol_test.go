@@ -0,0 +1,108 @@
+package unit
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tabular/relay/pkg/protocol"
+	"github.com/tabular/relay/pkg/types"
+)
+
+func binaryMeshPacket() types.StreamPacket {
+	vertices := make([]byte, 4096)
+	for i := range vertices {
+		vertices[i] = byte(i * 7)
+	}
+	return types.StreamPacket{
+		SessionID:   "binary-session",
+		FrameNumber: 42,
+		Timestamp:   1634567890123,
+		Type:        "mesh",
+		Data: types.PacketData{Mesh: &types.MeshData{
+			AnchorID:    "anchor-1",
+			Vertices:    vertices,
+			Faces:       []byte{0, 1, 2, 2, 3, 0},
+			IndexFormat: "uint16",
+		}},
+	}
+}
+
+func TestProtocol_BinaryRoundTrip(t *testing.T) {
+	pose := types.StreamPacket{
+		SessionID:   "binary-session",
+		FrameNumber: 7,
+		Timestamp:   1634567890123,
+		Type:        "pose",
+		Data:        types.PacketData{Pose: &types.PoseData{X: 1.5, Y: -2, Z: 3.25, Rotation: [4]float64{0, 0.7071, 0, 0.7071}}},
+	}
+	for _, packet := range []types.StreamPacket{pose, binaryMeshPacket()} {
+		frame, err := protocol.EncodeBinary(packet)
+		require.NoError(t, err)
+
+		decoded, err := protocol.DecodeBinary(frame)
+		require.NoError(t, err)
+		assert.Equal(t, packet, decoded)
+	}
+}
+
+func TestProtocol_BinaryIsSmallerThanJSON(t *testing.T) {
+	packet := binaryMeshPacket()
+	frame, err := protocol.EncodeBinary(packet)
+	require.NoError(t, err)
+	encoded, err := json.Marshal(packet)
+	require.NoError(t, err)
+
+	// Raw attributes instead of base64, plus a header of a few dozen bytes
+	assert.Less(t, len(frame), len(packet.Data.Mesh.Vertices)+len(packet.Data.Mesh.Faces)+64)
+	assert.Less(t, float64(len(frame)), float64(len(encoded))*0.8)
+}
+
+func TestProtocol_BinaryRejectsMalformedFrames(t *testing.T) {
+	frame, err := protocol.EncodeBinary(binaryMeshPacket())
+	require.NoError(t, err)
+
+	for _, n := range []int{0, 3, 10, len(frame) - 1} {
+		_, err := protocol.DecodeBinary(frame[:n])
+		assert.ErrorIs(t, err, protocol.ErrTruncated, "frame cut at %d bytes", n)
+	}
+
+	_, err = protocol.DecodeBinary(append(frame, 0))
+	assert.Error(t, err, "trailing bytes")
+
+	badVersion := append([]byte(nil), frame...)
+	badVersion[0] = 9
+	_, err = protocol.DecodeBinary(badVersion)
+	assert.Error(t, err)
+
+	badType := append([]byte(nil), frame...)
+	badType[1] = 9
+	_, err = protocol.DecodeBinary(badType)
+	assert.Error(t, err)
+
+	_, err = protocol.EncodeBinary(types.StreamPacket{Type: "mesh"})
+	assert.Error(t, err, "mesh packet without data")
+	_, err = protocol.EncodeBinary(types.StreamPacket{Type: "audio"})
+	assert.Error(t, err)
+}
+
+func TestProtocol_Versions(t *testing.T) {
+	for subprotocol, want := range map[string]int{
+		"":                         protocol.Version1,
+		protocol.SubprotocolV1:     protocol.Version1,
+		protocol.SubprotocolV2:     protocol.Version2,
+		protocol.BinarySubprotocol: protocol.CurrentVersion,
+	} {
+		version, ok := protocol.Version(subprotocol)
+		assert.True(t, ok, subprotocol)
+		assert.Equal(t, want, version, subprotocol)
+	}
+	
+	_, ok := protocol.Version("streamkit.v9")
+	assert.False(t, ok)
+	for _, subprotocol := range protocol.Subprotocols {
+		_, ok := protocol.Version(subprotocol)
+		assert.True(t, ok, "every accepted subprotocol maps to a version")
+	}
+}
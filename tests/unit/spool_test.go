@@ -0,0 +1,202 @@
+package unit
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tabular/relay/internal/spool"
+	"github.com/tabular/relay/internal/updater"
+	"github.com/tabular/relay/pkg/sink"
+)
+
+func TestSpool_ReplaysUnackedRecords(t *testing.T) {
+	dir := t.TempDir()
+
+	s, replay, err := spool.Open(spool.Options{Dir: dir, SegmentBytes: 64})
+	require.NoError(t, err)
+	assert.Empty(t, replay)
+
+	var seqs []uint64
+	for i := 0; i < 10; i++ {
+		seq, err := s.Append([]byte(fmt.Sprintf("record-%02d", i)))
+		require.NoError(t, err)
+		seqs = append(seqs, seq)
+	}
+
+	// Ack the first half; their segments should be removed
+	for _, seq := range seqs[:5] {
+		s.Ack(seq)
+	}
+	require.NoError(t, s.Close())
+
+	s, replay, err = spool.Open(spool.Options{Dir: dir, SegmentBytes: 64})
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.NotEmpty(t, replay)
+	assert.Equal(t, "record-09", string(replay[len(replay)-1].Data))
+	// 17-byte records, three per segment: the second segment is partly acked
+	assert.Equal(t, seqs[5], replay[0].Seq, "acked records must not be replayed")
+	assert.Len(t, replay, 5)
+	for i := 1; i < len(replay); i++ {
+		assert.Equal(t, replay[i-1].Seq+1, replay[i].Seq, "replay must be in order")
+	}
+
+	// New records continue the sequence
+	seq, err := s.Append([]byte("after-restart"))
+	require.NoError(t, err)
+	assert.Greater(t, seq, seqs[len(seqs)-1])
+}
+
+func TestSpool_SkipsAckedRecordsOfPartlyAckedSegment(t *testing.T) {
+	dir := t.TempDir()
+	s, _, err := spool.Open(spool.Options{Dir: dir})
+	require.NoError(t, err)
+
+	var seqs []uint64
+	for i := 0; i < 4; i++ {
+		seq, err := s.Append([]byte(fmt.Sprintf("record-%d", i)))
+		require.NoError(t, err)
+		seqs = append(seqs, seq)
+	}
+
+	// Acked out of order, as routes finish at different times
+	s.Ack(seqs[2])
+	s.Ack(seqs[0])
+	require.NoError(t, s.Close())
+
+	s, replay, err := spool.Open(spool.Options{Dir: dir})
+	require.NoError(t, err)
+	require.Len(t, replay, 2)
+	assert.Equal(t, "record-1", string(replay[0].Data))
+	assert.Equal(t, "record-3", string(replay[1].Data))
+
+	// Acking the rest removes the segment and its acks
+	s.Ack(replay[0].Seq)
+	s.Ack(replay[1].Seq)
+	require.NoError(t, s.Close())
+	_, replay, err = spool.Open(spool.Options{Dir: dir})
+	require.NoError(t, err)
+	assert.Empty(t, replay)
+	acks, err := filepath.Glob(filepath.Join(dir, "*.ack"))
+	require.NoError(t, err)
+	assert.Empty(t, acks)
+}
+
+func TestSpool_TruncatesTornTail(t *testing.T) {
+	dir := t.TempDir()
+
+	s, _, err := spool.Open(spool.Options{Dir: dir})
+	require.NoError(t, err)
+	_, err = s.Append([]byte("complete"))
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	// Simulate a crash halfway through writing a second record
+	segments, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	require.NoError(t, err)
+	require.Len(t, segments, 1)
+	f, err := os.OpenFile(segments[0], os.O_APPEND|os.O_WRONLY, 0o644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{42, 0, 0, 0, 1, 2})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	s, replay, err := spool.Open(spool.Options{Dir: dir})
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.Len(t, replay, 1)
+	assert.Equal(t, "complete", string(replay[0].Data))
+}
+
+func TestSpool_OverflowPolicies(t *testing.T) {
+	payload := make([]byte, 100)
+
+	reject, _, err := spool.Open(spool.Options{Dir: t.TempDir(), MaxBytes: 1000})
+	require.NoError(t, err)
+	defer reject.Close()
+
+	var rejectErr error
+	for i := 0; i < 20 && rejectErr == nil; i++ {
+		_, rejectErr = reject.Append(payload)
+	}
+	assert.ErrorIs(t, rejectErr, spool.ErrFull)
+	assert.LessOrEqual(t, reject.Size(), int64(1000))
+
+	dropOldest, _, err := spool.Open(spool.Options{Dir: t.TempDir(), MaxBytes: 1000, Overflow: spool.OverflowDropOldest})
+	require.NoError(t, err)
+	defer dropOldest.Close()
+
+	for i := 0; i < 20; i++ {
+		_, err := dropOldest.Append(payload)
+		require.NoError(t, err)
+	}
+	assert.LessOrEqual(t, dropOldest.Size(), int64(1000))
+	assert.Greater(t, dropOldest.Dropped(), uint64(0))
+	assert.Greater(t, dropOldest.FirstSeq(), uint64(1))
+}
+
+func TestUpdater_SpoolRequiresDeadLetterDir(t *testing.T) {
+	opts := updater.Options{Spool: &spool.Options{Dir: t.TempDir()}}
+	_, err := updater.NewWithOptions("", 1, time.Second, opts)
+	assert.Error(t, err, "in-memory dead letters would be lost with the spool records")
+}
+
+func TestUpdater_SpoolSurvivesOutageAndRestart(t *testing.T) {
+	var healthy int32
+	var received int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		atomic.AddInt32(&received, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	opts := updater.Options{
+		Retry: sink.RetryPolicy{
+			MaxAttempts:    100,
+			InitialBackoff: 10 * time.Millisecond,
+			MaxBackoff:     20 * time.Millisecond,
+		},
+		DeadLetterDir: t.TempDir(),
+		Spool:         &spool.Options{Dir: dir},
+	}
+
+	// STAG is down for the whole lifetime of the first relay process
+	u, err := updater.NewWithOptions(server.URL, 1, 20*time.Millisecond, opts)
+	require.NoError(t, err)
+	u.Start()
+	require.NoError(t, u.ProcessEvent(testPoseEvent("spooled-session")))
+	time.Sleep(100 * time.Millisecond)
+	u.Stop()
+
+	assert.Equal(t, 0, u.DeadLetters().Len(), "shutdown should leave the batch in the spool")
+
+	// After restart the spooled event is replayed once STAG is back
+	atomic.StoreInt32(&healthy, 1)
+	restarted, err := updater.NewWithOptions(server.URL, 1, 20*time.Millisecond, opts)
+	require.NoError(t, err)
+	assert.Equal(t, 1, restarted.GetStats()["queue_length"])
+	restarted.Start()
+	time.Sleep(100 * time.Millisecond)
+	restarted.Stop()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&received))
+
+	segments, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	require.NoError(t, err)
+	assert.Empty(t, segments, "delivered events must be truncated from the spool")
+}
@@ -1,6 +1,8 @@
 package unit
 
 import (
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -334,4 +336,38 @@ func TestTransformer_ClearStaleSession(t *testing.T) {
 	// Verify session is cleared
 	stats = tr.GetStats()
 	assert.Equal(t, 0, stats["active_sessions"])
-}
\ No newline at end of file
+}
+
+func TestTransformer_ConcurrentSessions(t *testing.T) {
+	tr := transformer.New()
+	
+	// Workers transforming the same sessions at once agree on their anchors
+	anchors := make([][]string, 8)
+	var wg sync.WaitGroup
+	for w := range anchors {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 16; i++ {
+				event, err := tr.Transform(types.StreamPacket{
+					SessionID: fmt.Sprintf("session-%d", i),
+					Timestamp: time.Now().UnixMilli(),
+					Type:      "pose",
+					Data: types.PacketData{
+						Pose: &types.PoseData{Rotation: [4]float64{0, 0, 0, 1}},
+					},
+				})
+				if !assert.NoError(t, err) {
+					return
+				}
+				anchors[w] = append(anchors[w], event.Anchors[0].ID)
+			}
+		}(w)
+	}
+	wg.Wait()
+	
+	for w := 1; w < len(anchors); w++ {
+		assert.Equal(t, anchors[0], anchors[w])
+	}
+	assert.Equal(t, 16, tr.GetStats()["active_sessions"])
+}
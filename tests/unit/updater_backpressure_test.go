@@ -0,0 +1,149 @@
+package unit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tabular/relay/internal/updater"
+	"github.com/tabular/relay/pkg/sink"
+	"github.com/tabular/relay/pkg/types"
+)
+
+// gatedSink holds every Send until released, counting the batches it has
+// in flight
+type gatedSink struct {
+	release     chan struct{}
+	once        sync.Once
+	inFlight    int32
+	maxInFlight int32
+	delivered   int32
+}
+
+func newGatedSink() *gatedSink {
+	return &gatedSink{release: make(chan struct{})}
+}
+
+func (s *gatedSink) Name() string {
+	return "gated"
+}
+
+func (s *gatedSink) Send(ctx context.Context, events []types.SpatialEvent) ([]sink.Result, error) {
+	n := atomic.AddInt32(&s.inFlight, 1)
+	for {
+		peak := atomic.LoadInt32(&s.maxInFlight)
+		if n <= peak || atomic.CompareAndSwapInt32(&s.maxInFlight, peak, n) {
+			break
+		}
+	}
+	<-s.release
+	atomic.AddInt32(&s.inFlight, -1)
+	atomic.AddInt32(&s.delivered, int32(len(events)))
+	return sink.Delivered(events), nil
+}
+
+func (s *gatedSink) Close() error {
+	return nil
+}
+
+func (s *gatedSink) open() {
+	s.once.Do(func() { close(s.release) })
+}
+
+func TestUpdater_BackpressureBoundsQueuedEvents(t *testing.T) {
+	gated := newGatedSink()
+	opts := sinkOptions("", updater.Route{Sink: gated})
+	opts.MaxQueued = 4
+	u, err := updater.NewWithOptions("", 2, 10*time.Millisecond, opts)
+	require.NoError(t, err)
+	u.Start()
+	defer u.Stop()
+	defer gated.open()
+
+	var accepted int32
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			if err := u.ProcessEvent(testPoseEvent(fmt.Sprintf("backpressure-%d", i))); err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+		}
+	}()
+
+	// One batch of 2 in flight and 4 queued; the next event waits for room
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&accepted) == 6 }, time.Second, time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(6), atomic.LoadInt32(&accepted))
+	assert.Equal(t, 4, u.GetStats()["queue_length"])
+
+	gated.open()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ProcessEvent still blocked after the sink caught up")
+	}
+	assert.Equal(t, int32(20), atomic.LoadInt32(&accepted))
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&gated.delivered) == 20 }, time.Second, 5*time.Millisecond)
+}
+
+func TestUpdater_MaxInFlightBatches(t *testing.T) {
+	gated := newGatedSink()
+	opts := sinkOptions("", updater.Route{Sink: gated})
+	opts.MaxInFlight = 3
+	u, err := updater.NewWithOptions("", 1, 10*time.Millisecond, opts)
+	require.NoError(t, err)
+	u.Start()
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, u.ProcessEvent(testPoseEvent(fmt.Sprintf("inflight-%d", i))))
+	}
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&gated.inFlight) == 3 }, time.Second, time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&gated.maxInFlight), "no more than MaxInFlight batches at once")
+
+	gated.open()
+	u.Stop()
+	assert.Equal(t, int32(10), atomic.LoadInt32(&gated.delivered))
+}
+
+func TestUpdater_StopReleasesBlockedProcessEvent(t *testing.T) {
+	gated := newGatedSink()
+	opts := sinkOptions("", updater.Route{Sink: gated})
+	opts.MaxQueued = 1
+	u, err := updater.NewWithOptions("", 1, 10*time.Millisecond, opts)
+	require.NoError(t, err)
+	u.Start()
+
+	errs := make(chan error, 1)
+	go func() {
+		for i := 0; ; i++ {
+			if err := u.ProcessEvent(testPoseEvent(fmt.Sprintf("stop-%d", i))); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		u.Stop()
+		close(stopped)
+	}()
+	select {
+	case err := <-errs:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("ProcessEvent still blocked after Stop")
+	}
+
+	gated.open()
+	<-stopped
+}
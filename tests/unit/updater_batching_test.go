@@ -0,0 +1,153 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tabular/relay/internal/updater"
+	"github.com/tabular/relay/pkg/sink"
+	"github.com/tabular/relay/pkg/types"
+)
+
+// batchSink records the size of every batch, taking delay to answer
+type batchSink struct {
+	name    string
+	delay   time.Duration
+	mutex   sync.Mutex
+	batches []int
+}
+
+func (s *batchSink) Name() string {
+	return s.name
+}
+
+func (s *batchSink) Send(ctx context.Context, events []types.SpatialEvent) ([]sink.Result, error) {
+	time.Sleep(s.delay)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.batches = append(s.batches, len(events))
+	return sink.Delivered(events), nil
+}
+
+func (s *batchSink) Close() error {
+	return nil
+}
+
+func (s *batchSink) Batches() []int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]int(nil), s.batches...)
+}
+
+// batchTimeout returns a sink's current batch timeout from the updater stats
+func batchTimeout(t *testing.T, u *updater.Updater, sinkName string) time.Duration {
+	t.Helper()
+	stats := u.GetStats()["sinks"].(map[string]interface{})[sinkName].(map[string]interface{})
+	timeout, err := time.ParseDuration(stats["batch_timeout"].(string))
+	require.NoError(t, err)
+	return timeout
+}
+
+func TestUpdater_BatchesByBytes(t *testing.T) {
+	m := testMetrics()
+	byBytes := testutil.ToFloat64(m.BatchFlushes.WithLabelValues("bytes-sink", "bytes"))
+
+	data, err := json.Marshal(testPoseEvent("bytes-0"))
+	require.NoError(t, err)
+
+	recorder := &batchSink{name: "bytes-sink"}
+	opts := sinkOptions("", updater.Route{Sink: recorder, BatchBytes: len(data)*2 + len(data)/2})
+	opts.Metrics = m
+	u, err := updater.NewWithOptions("", 100, 20*time.Millisecond, opts)
+	require.NoError(t, err)
+	u.Start()
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, u.ProcessEvent(testPoseEvent(fmt.Sprintf("bytes-%d", i))))
+	}
+	u.Stop()
+
+	batches := recorder.Batches()
+	total := 0
+	for _, n := range batches {
+		assert.LessOrEqual(t, n, 2, "a batch stays within max bytes")
+		total += n
+	}
+	assert.Equal(t, 10, total)
+	assert.Greater(t, testutil.ToFloat64(m.BatchFlushes.WithLabelValues("bytes-sink", "bytes")), byBytes)
+}
+
+func TestUpdater_OversizedEventIsSentAlone(t *testing.T) {
+	recorder := &batchSink{name: "oversized"}
+	u, err := updater.NewWithOptions("", 100, 20*time.Millisecond, sinkOptions("", updater.Route{Sink: recorder, BatchBytes: 1}))
+	require.NoError(t, err)
+	u.Start()
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, u.ProcessEvent(testPoseEvent(fmt.Sprintf("oversized-%d", i))))
+	}
+	u.Stop()
+
+	assert.Equal(t, []int{1, 1, 1}, recorder.Batches())
+}
+
+func TestUpdater_AdaptiveWindowGrowsForSlowSink(t *testing.T) {
+	m := testMetrics()
+	grown := testutil.ToFloat64(m.BatchWindowDecisions.WithLabelValues("slow", updater.WindowGrow))
+
+	slow := &batchSink{name: "slow", delay: 30 * time.Millisecond}
+	opts := sinkOptions("", updater.Route{Sink: slow})
+	opts.Metrics = m
+	opts.Adaptive = &updater.AdaptiveBatching{
+		MinTimeout:    10 * time.Millisecond,
+		MaxTimeout:    200 * time.Millisecond,
+		TargetLatency: 10 * time.Millisecond,
+	}
+	u, err := updater.NewWithOptions("", 2, 20*time.Millisecond, opts)
+	require.NoError(t, err)
+	u.Start()
+	defer u.Stop()
+
+	for i := 0; i < 20; i++ {
+		require.NoError(t, u.ProcessEvent(testPoseEvent(fmt.Sprintf("slow-%d", i))))
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	require.Eventually(t, func() bool { return batchTimeout(t, u, "slow") > 20*time.Millisecond }, time.Second, 5*time.Millisecond)
+	assert.LessOrEqual(t, batchTimeout(t, u, "slow"), 200*time.Millisecond, "the window stays within max timeout")
+	assert.Greater(t, testutil.ToFloat64(m.BatchWindowDecisions.WithLabelValues("slow", updater.WindowGrow)), grown)
+}
+
+func TestUpdater_AdaptiveWindowShrinksForFastSink(t *testing.T) {
+	fast := &batchSink{name: "fast"}
+	opts := sinkOptions("", updater.Route{Sink: fast})
+	opts.Adaptive = &updater.AdaptiveBatching{
+		MinTimeout:    10 * time.Millisecond,
+		MaxTimeout:    time.Second,
+		TargetLatency: 100 * time.Millisecond,
+	}
+	u, err := updater.NewWithOptions("", 1, 100*time.Millisecond, opts)
+	require.NoError(t, err)
+	u.Start()
+	defer u.Stop()
+
+	for i := 0; i < 30; i++ {
+		require.NoError(t, u.ProcessEvent(testPoseEvent(fmt.Sprintf("fast-%d", i))))
+	}
+
+	require.Eventually(t, func() bool { return batchTimeout(t, u, "fast") == 10*time.Millisecond }, time.Second, 5*time.Millisecond)
+}
+
+func TestUpdater_AdaptiveRejectsInvertedBounds(t *testing.T) {
+	opts := sinkOptions("", updater.Route{Sink: &batchSink{name: "inverted"}})
+	opts.Adaptive = &updater.AdaptiveBatching{MinTimeout: time.Second, MaxTimeout: time.Millisecond}
+	_, err := updater.NewWithOptions("", 1, 100*time.Millisecond, opts)
+	assert.Error(t, err)
+}
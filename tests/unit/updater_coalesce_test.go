@@ -0,0 +1,143 @@
+package unit
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tabular/relay/internal/spool"
+	"github.com/tabular/relay/internal/updater"
+	"github.com/tabular/relay/pkg/types"
+)
+
+// anchorPose is a pose event for one anchor of the coalesce-session
+func anchorPose(anchorID string, i int, pose types.PoseData) types.SpatialEvent {
+	return types.SpatialEvent{
+		SessionID: "coalesce-session",
+		EventID:   fmt.Sprintf("%s-%d", anchorID, i),
+		Timestamp: time.Now().UnixMilli(),
+		Anchors:   []types.Anchor{{ID: anchorID, Pose: pose}},
+	}
+}
+
+func atX(x float64) types.PoseData {
+	return types.PoseData{X: x, Rotation: [4]float64{0, 0, 0, 1}}
+}
+
+// coalesceOneBatch sends events through an updater with a batch window
+// long enough to hold them all, and returns what the sink received
+func coalesceOneBatch(t *testing.T, opts updater.Options, recorder *fakeSink, events ...types.SpatialEvent) []types.SpatialEvent {
+	t.Helper()
+	u, err := updater.NewWithOptions("", 1000, time.Minute, opts)
+	require.NoError(t, err)
+	u.Start()
+	for _, event := range events {
+		require.NoError(t, u.ProcessEvent(event))
+	}
+	u.Stop()
+	return recorder.Events()
+}
+
+func TestUpdater_CoalesceLatestPerAnchor(t *testing.T) {
+	m := testMetrics()
+	coalesced := testutil.ToFloat64(m.CoalescedPoses.WithLabelValues("latest", updater.CoalesceLatest))
+
+	recorder := &fakeSink{name: "latest"}
+	opts := sinkOptions("", updater.Route{Sink: recorder})
+	opts.Metrics = m
+	opts.Coalesce = updater.CoalescePolicy{Mode: updater.CoalesceLatest}
+
+	var events []types.SpatialEvent
+	for i := 0; i < 10; i++ {
+		events = append(events, anchorPose("anchor-a", i, atX(float64(i))), anchorPose("anchor-b", i, atX(float64(-i))))
+	}
+	delivered := coalesceOneBatch(t, opts, recorder, events...)
+
+	assert.Equal(t, []string{"anchor-a-9", "anchor-b-9"}, eventIDs(delivered))
+	assert.Equal(t, coalesced+18, testutil.ToFloat64(m.CoalescedPoses.WithLabelValues("latest", updater.CoalesceLatest)))
+}
+
+func TestUpdater_CoalesceEveryNth(t *testing.T) {
+	recorder := &fakeSink{name: "every-nth"}
+	opts := sinkOptions("", updater.Route{Sink: recorder})
+	opts.Coalesce = updater.CoalescePolicy{Mode: updater.CoalesceEveryN, EveryN: 3}
+
+	var events []types.SpatialEvent
+	for i := 0; i < 8; i++ {
+		events = append(events, anchorPose("anchor-a", i, atX(float64(i))))
+	}
+	delivered := coalesceOneBatch(t, opts, recorder, events...)
+
+	assert.Equal(t, []string{"anchor-a-0", "anchor-a-3", "anchor-a-6"}, eventIDs(delivered))
+}
+
+func TestUpdater_CoalesceMotionThreshold(t *testing.T) {
+	recorder := &fakeSink{name: "motion"}
+	opts := sinkOptions("", updater.Route{Sink: recorder})
+	opts.Coalesce = updater.CoalescePolicy{Mode: updater.CoalesceMotion, MinDistance: 0.01, MinAngle: 5}
+
+	// A quarter turn about Y is 90 degrees
+	turned := atX(0.025)
+	turned.Rotation = [4]float64{0, 0.7071068, 0, 0.7071068}
+
+	delivered := coalesceOneBatch(t, opts, recorder,
+		anchorPose("anchor-a", 0, atX(0)),
+		anchorPose("anchor-a", 1, atX(0.004)),
+		anchorPose("anchor-a", 2, atX(0.008)),
+		anchorPose("anchor-a", 3, atX(0.02)), // 2cm from the last pose kept
+		anchorPose("anchor-a", 4, atX(0.025)),
+		anchorPose("anchor-a", 5, turned),
+	)
+
+	assert.Equal(t, []string{"anchor-a-0", "anchor-a-3", "anchor-a-5"}, eventIDs(delivered))
+}
+
+func TestUpdater_CoalesceKeepsMeshesAndPerSinkPolicies(t *testing.T) {
+	latest := &fakeSink{name: "coalesced"}
+	all := &fakeSink{name: "everything"}
+	opts := sinkOptions("",
+		updater.Route{Sink: latest},
+		updater.Route{Sink: all, Coalesce: &updater.CoalescePolicy{Mode: updater.CoalesceNone}},
+	)
+	opts.Coalesce = updater.CoalescePolicy{Mode: updater.CoalesceLatest}
+
+	mesh := meshEvent("anchor-mesh", gridVertices(4, 0))
+	mesh.SessionID = "coalesce-session"
+	coalesceOneBatch(t, opts, latest,
+		anchorPose("anchor-a", 0, atX(0)),
+		mesh,
+		anchorPose("anchor-a", 1, atX(1)),
+	)
+
+	assert.Equal(t, []string{mesh.EventID, "anchor-a-1"}, eventIDs(latest.Events()))
+	assert.Len(t, all.Events(), 3, "a sink's own policy replaces the default")
+}
+
+func TestUpdater_CoalescedPosesLeaveTheSpool(t *testing.T) {
+	dir := t.TempDir()
+	recorder := &fakeSink{name: "spooled"}
+	opts := sinkOptions(t.TempDir(), updater.Route{Sink: recorder})
+	opts.Spool = &spool.Options{Dir: dir}
+	opts.Coalesce = updater.CoalescePolicy{Mode: updater.CoalesceLatest}
+	coalesceOneBatch(t, opts, recorder,
+		anchorPose("anchor-a", 0, atX(0)),
+		anchorPose("anchor-a", 1, atX(1)),
+	)
+	require.Equal(t, []string{"anchor-a-1"}, eventIDs(recorder.Events()))
+
+	// Nothing is replayed after a restart
+	replayed := &fakeSink{name: "spooled"}
+	opts = sinkOptions(t.TempDir(), updater.Route{Sink: replayed})
+	opts.Spool = &spool.Options{Dir: dir}
+	assert.Empty(t, coalesceOneBatch(t, opts, replayed))
+}
+
+func TestUpdater_CoalesceRejectsUnknownMode(t *testing.T) {
+	opts := sinkOptions("", updater.Route{Sink: &fakeSink{name: "unknown"}})
+	opts.Coalesce = updater.CoalescePolicy{Mode: "average"}
+	_, err := updater.NewWithOptions("", 1, time.Second, opts)
+	assert.Error(t, err)
+}
@@ -0,0 +1,311 @@
+package unit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tabular/relay/internal/updater"
+	"github.com/tabular/relay/pkg/types"
+	"github.com/tabular/relay/tests/testdata"
+)
+
+// captureSTAG records every event posted to /ingest
+type captureSTAG struct {
+	server *httptest.Server
+	mutex  sync.Mutex
+	events []types.SpatialEvent
+	resync []string // Anchors to ask for a keyframe in the next response
+}
+
+func newCaptureSTAG() *captureSTAG {
+	c := &captureSTAG{}
+	c.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch struct {
+			Events []types.SpatialEvent `json:"events"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		c.mutex.Lock()
+		c.events = append(c.events, batch.Events...)
+		resync := c.resync
+		c.resync = nil
+		c.mutex.Unlock()
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string][]string{"resync": resync})
+	}))
+	return c
+}
+
+func (c *captureSTAG) Events() []types.SpatialEvent {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]types.SpatialEvent(nil), c.events...)
+}
+
+func (c *captureSTAG) Close() {
+	c.server.Close()
+}
+
+func gunzipBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	defer reader.Close()
+	out, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	return out
+}
+
+func gridVertices(n int, offset float32) []float32 {
+	vertices := make([]float32, 0, n*3)
+	for i := 0; i < n; i++ {
+		vertices = append(vertices, float32(i%10)+offset, float32(i/10)+offset, offset)
+	}
+	return vertices
+}
+
+func meshEvent(anchorID string, vertices []float32) types.SpatialEvent {
+	return types.SpatialEvent{
+		SessionID: "delta-session",
+		EventID:   anchorID,
+		Timestamp: time.Now().UnixMilli(),
+		Meshes: []types.MeshDiff{{
+			AnchorID:      anchorID,
+			VerticesDelta: testdata.CreateRawVertexData(vertices),
+			Decoded:       true,
+		}},
+	}
+}
+
+func sendMeshes(t *testing.T, meshes ...[]float32) []types.MeshDiff {
+	t.Helper()
+	events := make([]types.SpatialEvent, len(meshes))
+	for i, vertices := range meshes {
+		events[i] = meshEvent("anchor-delta", vertices)
+	}
+	return sendMeshEvents(t, events...)
+}
+
+func sendMeshEvents(t *testing.T, events ...types.SpatialEvent) []types.MeshDiff {
+	t.Helper()
+	return sendMeshEventsWithOptions(t, updater.DefaultOptions(), events...)
+}
+
+func sendMeshEventsWithOptions(t *testing.T, opts updater.Options, events ...types.SpatialEvent) []types.MeshDiff {
+	t.Helper()
+	stag := newCaptureSTAG()
+	defer stag.Close()
+
+	u, err := updater.NewWithOptions(stag.server.URL, 1, 20*time.Millisecond, opts)
+	require.NoError(t, err)
+	u.Start()
+	for _, event := range events {
+		require.NoError(t, u.ProcessEvent(event))
+	}
+	time.Sleep(100 * time.Millisecond)
+	u.Stop()
+
+	var diffs []types.MeshDiff
+	for _, event := range stag.Events() {
+		diffs = append(diffs, event.Meshes...)
+	}
+	require.Len(t, diffs, len(events))
+	return diffs
+}
+
+func TestUpdater_VertexJitterWithinToleranceIsDelta(t *testing.T) {
+	base := gridVertices(500, 0)
+
+	// Sub-millimetre jitter everywhere plus one vertex that really moved
+	jittered := gridVertices(500, 0.0004)
+	jittered[42*3] += 0.5
+
+	diffs := sendMeshes(t, base, jittered)
+	assert.False(t, diffs[0].IsDelta)
+	require.True(t, diffs[1].IsDelta)
+
+	delta := gunzipBytes(t, diffs[1].VerticesDelta)
+	assert.Equal(t, "TXVD", string(delta[:4]))
+	assert.Less(t, len(delta), len(base)*4/10, "one changed vertex should not cost a full buffer")
+}
+
+func TestUpdater_EncodedMeshIsSentInFull(t *testing.T) {
+	// Bytes the parser couldn't decode look like vertices but aren't
+	base := meshEvent("anchor-encoded", gridVertices(500, 0))
+	base.Meshes[0].Decoded = false
+	jittered := meshEvent("anchor-encoded", gridVertices(500, 0.0004))
+	jittered.Meshes[0].Decoded = false
+
+	diffs := sendMeshEvents(t, base, jittered)
+	assert.False(t, diffs[0].IsDelta)
+	assert.False(t, diffs[1].IsDelta, "encoded buffers must not be diffed")
+}
+
+func TestUpdater_VertexCountChangeIsDelta(t *testing.T) {
+	base := gridVertices(500, 0)
+	grown := append(append([]float32(nil), base...), 100, 100, 100, 101, 101, 101)
+	shrunk := append([]float32(nil), grown[:len(grown)-30]...)
+
+	diffs := sendMeshes(t, base, grown, shrunk)
+	assert.False(t, diffs[0].IsDelta)
+	assert.True(t, diffs[1].IsDelta, "appended vertices should be sent as a delta")
+	assert.True(t, diffs[2].IsDelta, "removed vertices should be sent as a delta")
+}
+
+func TestUpdater_UnrelatedMeshIsSentInFull(t *testing.T) {
+	diffs := sendMeshes(t, gridVertices(200, 0), gridVertices(200, 3))
+	assert.False(t, diffs[0].IsDelta)
+	assert.False(t, diffs[1].IsDelta)
+}
+
+func triangleList(format string, triangles [][3]uint32) []byte {
+	var buf []byte
+	for _, tri := range triangles {
+		for _, index := range tri {
+			if format == "uint16" {
+				buf = binary.LittleEndian.AppendUint16(buf, uint16(index))
+			} else {
+				buf = binary.LittleEndian.AppendUint32(buf, index)
+			}
+		}
+	}
+	return buf
+}
+
+func stripTriangles(n int, offset uint32) [][3]uint32 {
+	triangles := make([][3]uint32, n)
+	for i := range triangles {
+		v := uint32(i) + offset
+		triangles[i] = [3]uint32{v, v + 1, v + 2}
+	}
+	return triangles
+}
+
+func TestUpdater_FaceDiffing(t *testing.T) {
+	vertices := gridVertices(400, 0)
+
+	for _, format := range []string{"uint16", "uint32"} {
+		t.Run(format, func(t *testing.T) {
+			base := stripTriangles(300, 0)
+
+			// Drop two triangles, rotate one (same winding) and append three
+			edited := append([][3]uint32(nil), base[:100]...)
+			edited = append(edited, base[102:]...)
+			edited[5] = [3]uint32{edited[5][1], edited[5][2], edited[5][0]}
+			edited = append(edited, [3]uint32{0, 10, 20}, [3]uint32{1, 11, 21}, [3]uint32{2, 12, 22})
+
+			first := meshEvent("anchor-faces-"+format, vertices)
+			first.Meshes[0].FacesDelta = triangleList(format, base)
+			first.Meshes[0].IndexFormat = format
+			second := meshEvent("anchor-faces-"+format, vertices)
+			second.Meshes[0].FacesDelta = triangleList(format, edited)
+			second.Meshes[0].IndexFormat = format
+
+			diffs := sendMeshEvents(t, first, second)
+			assert.False(t, diffs[0].FacesIsDelta)
+			require.True(t, diffs[1].FacesIsDelta)
+			assert.Equal(t, format, diffs[1].IndexFormat)
+			assert.Equal(t, "TXFD", string(diffs[1].FacesDelta[:4]))
+			assert.Less(t, len(diffs[1].FacesDelta), len(second.Meshes[0].FacesDelta)/4)
+		})
+	}
+}
+
+func TestUpdater_FaceDiffingFallsBackToFullBuffer(t *testing.T) {
+	vertices := gridVertices(400, 0)
+
+	first := meshEvent("anchor-faces-full", vertices)
+	first.Meshes[0].FacesDelta = triangleList("uint32", stripTriangles(100, 0))
+	second := meshEvent("anchor-faces-full", vertices)
+	second.Meshes[0].FacesDelta = triangleList("uint32", stripTriangles(100, 1000))
+
+	diffs := sendMeshEvents(t, first, second)
+	assert.False(t, diffs[1].FacesIsDelta, "a rewritten index buffer is cheaper to send in full")
+	assert.Equal(t, second.Meshes[0].FacesDelta, diffs[1].FacesDelta)
+}
+
+func TestUpdater_MeshDiffsCarryVersionChain(t *testing.T) {
+	base := gridVertices(500, 0)
+	moved := gridVertices(500, 0)
+	moved[10*3] += 0.5
+	movedAgain := append([]float32(nil), moved...)
+	movedAgain[20*3] += 0.5
+
+	diffs := sendMeshes(t, base, moved, movedAgain)
+	for i, diff := range diffs {
+		assert.Equal(t, uint64(i+1), diff.Version)
+	}
+	assert.Equal(t, uint64(0), diffs[0].BaseVersion, "a keyframe has no base")
+	assert.Equal(t, uint64(1), diffs[1].BaseVersion)
+	assert.Equal(t, uint64(2), diffs[2].BaseVersion)
+
+	// The hash covers the reconstructed mesh, not the wire bytes
+	full := sha256.Sum256(testdata.CreateRawVertexData(movedAgain))
+	assert.Equal(t, hex.EncodeToString(full[:]), diffs[2].Hash)
+}
+
+func TestUpdater_ForcesKeyframeEveryNDeltas(t *testing.T) {
+	opts := updater.DefaultOptions()
+	opts.KeyframeInterval = 2
+
+	var meshes [][]float32
+	for i := 0; i < 5; i++ {
+		vertices := gridVertices(500, 0)
+		vertices[i*3] += 0.5
+		meshes = append(meshes, vertices)
+	}
+	events := make([]types.SpatialEvent, len(meshes))
+	for i, vertices := range meshes {
+		events[i] = meshEvent("anchor-keyframes", vertices)
+	}
+
+	diffs := sendMeshEventsWithOptions(t, opts, events...)
+	isDelta := make([]bool, len(diffs))
+	for i, diff := range diffs {
+		isDelta[i] = diff.IsDelta
+	}
+	assert.Equal(t, []bool{false, true, true, false, true}, isDelta)
+	assert.Equal(t, uint64(4), diffs[3].Version, "keyframes continue the version sequence")
+	assert.Equal(t, uint64(0), diffs[3].BaseVersion)
+}
+
+func TestUpdater_ForcesKeyframeOnStagResync(t *testing.T) {
+	stag := newCaptureSTAG()
+	defer stag.Close()
+	stag.resync = []string{"anchor-resync"}
+
+	u, err := updater.NewWithOptions(stag.server.URL, 1, 20*time.Millisecond, updater.DefaultOptions())
+	require.NoError(t, err)
+	u.Start()
+	defer u.Stop()
+
+	send := func(offset float32) {
+		vertices := gridVertices(500, 0)
+		vertices[0] += offset
+		require.NoError(t, u.ProcessEvent(meshEvent("anchor-resync", vertices)))
+		time.Sleep(60 * time.Millisecond)
+	}
+	send(0)   // Keyframe; STAG answers with a resync request
+	send(0.5) // Must be a keyframe again
+	send(1.0) // Back to deltas
+
+	events := stag.Events()
+	require.Len(t, events, 3)
+	assert.False(t, events[1].Meshes[0].IsDelta, "STAG asked for a resync")
+	assert.True(t, events[2].Meshes[0].IsDelta)
+	assert.Equal(t, events[1].Meshes[0].Version, events[2].Meshes[0].BaseVersion)
+}
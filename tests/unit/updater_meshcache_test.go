@@ -0,0 +1,144 @@
+package unit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tabular/relay/internal/updater"
+	"github.com/tabular/relay/pkg/types"
+)
+
+// meshCacheUpdater runs an updater with the given cache limits against a
+// capturing STAG
+func meshCacheUpdater(t *testing.T, maxBytes int64, idleTTL time.Duration) (*updater.Updater, *captureSTAG) {
+	t.Helper()
+	stag := newCaptureSTAG()
+	t.Cleanup(stag.Close)
+
+	opts := updater.DefaultOptions()
+	opts.MeshCacheBytes = maxBytes
+	opts.MeshIdleTTL = idleTTL
+	u, err := updater.NewWithOptions(stag.server.URL, 1, 10*time.Millisecond, opts)
+	require.NoError(t, err)
+	u.Start()
+	t.Cleanup(u.Stop)
+	return u, stag
+}
+
+func sessionMeshEvent(sessionID, anchorID string, offset float32) types.SpatialEvent {
+	vertices := gridVertices(500, 0)
+	vertices[0] += offset
+	event := meshEvent(anchorID, vertices)
+	event.SessionID = sessionID
+	return event
+}
+
+// lastDiff returns the most recently delivered diff for an anchor
+func lastDiff(t *testing.T, stag *captureSTAG, anchorID string) types.MeshDiff {
+	t.Helper()
+	time.Sleep(50 * time.Millisecond)
+	events := stag.Events()
+	for i := len(events) - 1; i >= 0; i-- {
+		for _, mesh := range events[i].Meshes {
+			if mesh.AnchorID == anchorID {
+				return mesh
+			}
+		}
+	}
+	t.Fatalf("no diff delivered for %s", anchorID)
+	return types.MeshDiff{}
+}
+
+func TestUpdater_MeshCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	// 500 vertices are 6000 bytes, so two baselines fit but not three
+	u, stag := meshCacheUpdater(t, 14000, time.Minute)
+
+	for _, anchorID := range []string{"anchor-a", "anchor-b", "anchor-c"} {
+		require.NoError(t, u.ProcessEvent(sessionMeshEvent("s", anchorID, 0)))
+	}
+	assert.Equal(t, 2, u.GetStats()["tracked_meshes"])
+	assert.LessOrEqual(t, u.GetStats()["mesh_cache_bytes"], int64(14000))
+
+	// anchor-a was evicted, anchor-c is still cached
+	require.NoError(t, u.ProcessEvent(sessionMeshEvent("s", "anchor-c", 0.5)))
+	assert.True(t, lastDiff(t, stag, "anchor-c").IsDelta)
+	require.NoError(t, u.ProcessEvent(sessionMeshEvent("s", "anchor-a", 0.5)))
+	assert.False(t, lastDiff(t, stag, "anchor-a").IsDelta, "evicted anchors restart with a keyframe")
+}
+
+func TestUpdater_MeshCacheEvictsIdleBaselines(t *testing.T) {
+	u, stag := meshCacheUpdater(t, 1<<20, 40*time.Millisecond)
+
+	require.NoError(t, u.ProcessEvent(sessionMeshEvent("s", "anchor-idle", 0)))
+	assert.Equal(t, 1, u.GetStats()["tracked_meshes"])
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, u.GetStats()["tracked_meshes"], "the janitor drops idle baselines")
+
+	require.NoError(t, u.ProcessEvent(sessionMeshEvent("s", "anchor-idle", 0.5)))
+	assert.False(t, lastDiff(t, stag, "anchor-idle").IsDelta)
+}
+
+func TestUpdater_EndSessionDropsItsBaselines(t *testing.T) {
+	u, stag := meshCacheUpdater(t, 1<<20, time.Minute)
+
+	require.NoError(t, u.ProcessEvent(sessionMeshEvent("ended", "anchor-ended", 0)))
+	require.NoError(t, u.ProcessEvent(sessionMeshEvent("live", "anchor-live", 0)))
+	u.EndSession("ended")
+	assert.Equal(t, 1, u.GetStats()["tracked_meshes"])
+
+	require.NoError(t, u.ProcessEvent(sessionMeshEvent("live", "anchor-live", 0.5)))
+	assert.True(t, lastDiff(t, stag, "anchor-live").IsDelta)
+	require.NoError(t, u.ProcessEvent(sessionMeshEvent("ended", "anchor-ended", 0.5)))
+	assert.False(t, lastDiff(t, stag, "anchor-ended").IsDelta)
+}
+
+func TestUpdater_EvictedAnchorKeepsCountingVersions(t *testing.T) {
+	u, stag := meshCacheUpdater(t, 14000, time.Minute)
+
+	require.NoError(t, u.ProcessEvent(sessionMeshEvent("s", "anchor-a", 0)))
+	require.NoError(t, u.ProcessEvent(sessionMeshEvent("s", "anchor-a", 0.5)))
+	before := lastDiff(t, stag, "anchor-a")
+	require.True(t, before.IsDelta)
+
+	// Two more baselines push anchor-a out of the cache
+	require.NoError(t, u.ProcessEvent(sessionMeshEvent("s", "anchor-b", 0)))
+	require.NoError(t, u.ProcessEvent(sessionMeshEvent("s", "anchor-c", 0)))
+
+	require.NoError(t, u.ProcessEvent(sessionMeshEvent("s", "anchor-a", 1)))
+	after := lastDiff(t, stag, "anchor-a")
+	assert.False(t, after.IsDelta, "evicted anchors restart with a keyframe")
+	assert.Greater(t, after.Version, before.Version)
+}
+
+func TestUpdater_VersionsNeverRestart(t *testing.T) {
+	u, stag := meshCacheUpdater(t, 1<<20, time.Minute)
+
+	var versions []uint64
+	send := func(event types.SpatialEvent) {
+		require.NoError(t, u.ProcessEvent(event))
+		versions = append(versions, lastDiff(t, stag, event.Meshes[0].AnchorID).Version)
+	}
+
+	send(sessionMeshEvent("s", "anchor-v", 0))
+	send(sessionMeshEvent("s", "anchor-v", 0.5))
+
+	u.ClearMeshHistory("anchor-v")
+	send(sessionMeshEvent("s", "anchor-v", 1))
+
+	u.EndSession("s")
+	send(sessionMeshEvent("s", "anchor-v", 1.5))
+
+	// A client delta passes through with the client's version
+	clientDelta := sessionMeshEvent("s", "anchor-v", 0)
+	clientDelta.Meshes[0].IsDelta = true
+	clientDelta.Meshes[0].Version = 10
+	send(clientDelta)
+	send(sessionMeshEvent("s", "anchor-v", 2))
+
+	for i := 1; i < len(versions); i++ {
+		assert.Greater(t, versions[i], versions[i-1], "versions %v", versions)
+	}
+}
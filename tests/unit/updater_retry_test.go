@@ -0,0 +1,167 @@
+package unit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tabular/relay/internal/updater"
+	"github.com/tabular/relay/pkg/sink"
+	"github.com/tabular/relay/pkg/types"
+)
+
+func fastRetryOptions(dir string) updater.Options {
+	return updater.Options{
+		Retry: sink.RetryPolicy{
+			MaxAttempts:    3,
+			InitialBackoff: 5 * time.Millisecond,
+			MaxBackoff:     20 * time.Millisecond,
+			Multiplier:     2,
+		},
+		DeadLetterDir: dir,
+	}
+}
+
+func testPoseEvent(sessionID string) types.SpatialEvent {
+	return types.SpatialEvent{
+		SessionID: sessionID,
+		EventID:   "event-" + sessionID,
+		Timestamp: time.Now().UnixMilli(),
+		Anchors: []types.Anchor{{
+			ID:   "anchor-1",
+			Pose: types.PoseData{X: 1, Y: 2, Z: 3, Rotation: [4]float64{0, 0, 0, 1}},
+		}},
+	}
+}
+
+func TestUpdater_RetriesHonorRetryAfter(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	u, err := updater.NewWithOptions(server.URL, 1, 50*time.Millisecond, fastRetryOptions(""))
+	require.NoError(t, err)
+	u.Start()
+
+	require.NoError(t, u.ProcessEvent(testPoseEvent("retry-session")))
+	time.Sleep(200 * time.Millisecond)
+	u.Stop()
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	assert.Equal(t, 0, u.DeadLetters().Len())
+}
+
+func TestUpdater_DeadLettersAndRedrive(t *testing.T) {
+	var healthy int32
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	u, err := updater.NewWithOptions(server.URL, 1, 50*time.Millisecond, fastRetryOptions(dir))
+	require.NoError(t, err)
+	u.Start()
+
+	require.NoError(t, u.ProcessEvent(testPoseEvent("dead-session")))
+	time.Sleep(300 * time.Millisecond)
+	u.Stop()
+
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls), "should stop after MaxAttempts")
+
+	entries := u.DeadLetters().List()
+	require.Len(t, entries, 1)
+	assert.Equal(t, 3, entries[0].Attempts)
+	assert.Contains(t, entries[0].LastError, "500")
+	assert.False(t, entries[0].FirstFailure.IsZero())
+	require.Len(t, entries[0].Events, 1)
+	assert.Equal(t, "dead-session", entries[0].Events[0].SessionID)
+
+	// A restarted updater picks the entry back up from disk and can redrive it
+	restarted, err := updater.NewWithOptions(server.URL, 1, 50*time.Millisecond, fastRetryOptions(dir))
+	require.NoError(t, err)
+	require.Equal(t, 1, restarted.DeadLetters().Len())
+
+	atomic.StoreInt32(&healthy, 1)
+	redriven, err := restarted.RedriveAll()
+	require.NoError(t, err)
+	assert.Equal(t, 1, redriven)
+	assert.Equal(t, 0, restarted.DeadLetters().Len())
+}
+
+func TestUpdater_ClientErrorsAreNotRetried(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	u, err := updater.NewWithOptions(server.URL, 1, 50*time.Millisecond, fastRetryOptions(""))
+	require.NoError(t, err)
+	u.Start()
+
+	require.NoError(t, u.ProcessEvent(testPoseEvent("bad-session")))
+	time.Sleep(200 * time.Millisecond)
+	u.Stop()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	assert.Equal(t, 1, u.DeadLetters().Len())
+}
+
+func TestRetryPolicy_BackoffIsBounded(t *testing.T) {
+	policy := sink.RetryPolicy{
+		MaxAttempts:    10,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Multiplier:     2,
+		Jitter:         0.5,
+	}
+
+	for retry := 1; retry <= 10; retry++ {
+		delay := policy.Backoff(retry)
+		assert.Greater(t, delay, time.Duration(0))
+		assert.LessOrEqual(t, delay, policy.MaxBackoff, "jitter stays within max backoff")
+	}
+}
+
+func TestUpdater_RetryAfterIsNotCutToMaxBackoff(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	// Max backoff is 20ms, far shorter than the second the server asked for
+	u, err := updater.NewWithOptions(server.URL, 1, 10*time.Millisecond, fastRetryOptions(""))
+	require.NoError(t, err)
+	u.Start()
+	defer u.Stop()
+
+	require.NoError(t, u.ProcessEvent(testPoseEvent("retry-after-session")))
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "no retry before Retry-After")
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&calls) == 2 }, 2*time.Second, 10*time.Millisecond)
+}
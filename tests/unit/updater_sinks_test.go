@@ -0,0 +1,311 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tabular/relay/internal/spool"
+	"github.com/tabular/relay/internal/updater"
+	"github.com/tabular/relay/pkg/sink"
+	"github.com/tabular/relay/pkg/types"
+)
+
+// fakeSink records delivered events and fails those fail() returns an error for
+type fakeSink struct {
+	name   string
+	mutex  sync.Mutex
+	events []types.SpatialEvent
+	calls  int
+	fail   func(event types.SpatialEvent, call int) error
+}
+
+func (s *fakeSink) Name() string {
+	return s.name
+}
+
+func (s *fakeSink) Send(ctx context.Context, events []types.SpatialEvent) ([]sink.Result, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.calls++
+	results := sink.Delivered(events)
+	for i, event := range events {
+		if s.fail != nil {
+			results[i].Err = s.fail(event, s.calls)
+		}
+		if results[i].Err == nil {
+			s.events = append(s.events, event)
+		}
+	}
+	return results, nil
+}
+
+func (s *fakeSink) Close() error {
+	return nil
+}
+
+func (s *fakeSink) Events() []types.SpatialEvent {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]types.SpatialEvent(nil), s.events...)
+}
+
+func (s *fakeSink) Calls() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.calls
+}
+
+func eventIDs(events []types.SpatialEvent) []string {
+	ids := make([]string, len(events))
+	for i, event := range events {
+		ids[i] = event.EventID
+	}
+	return ids
+}
+
+func sinkOptions(dir string, routes ...updater.Route) updater.Options {
+	opts := fastRetryOptions(dir)
+	opts.Sinks = routes
+	return opts
+}
+
+func TestUpdater_FansOutToFilteredSinks(t *testing.T) {
+	all := &fakeSink{name: "all"}
+	poses := &fakeSink{name: "poses"}
+
+	u, err := updater.NewWithOptions("", 10, 20*time.Millisecond, sinkOptions("",
+		updater.Route{Sink: all},
+		updater.Route{Sink: poses, Filter: updater.Filter{Types: []string{"pose"}}},
+	))
+	require.NoError(t, err)
+	u.Start()
+
+	require.NoError(t, u.ProcessEvent(testPoseEvent("fanout-pose")))
+	require.NoError(t, u.ProcessEvent(meshEvent("anchor-fanout", gridVertices(4, 0))))
+	time.Sleep(100 * time.Millisecond)
+	u.Stop()
+
+	assert.Len(t, all.Events(), 2)
+	require.Len(t, poses.Events(), 1)
+	assert.Equal(t, "event-fanout-pose", poses.Events()[0].EventID)
+
+	stats := u.GetStats()
+	assert.Contains(t, stats["sinks"], "all")
+	assert.Contains(t, stats["sinks"], "poses")
+}
+
+func TestUpdater_RetriesOnlyFailedEvents(t *testing.T) {
+	flaky := &fakeSink{name: "flaky", fail: func(event types.SpatialEvent, call int) error {
+		if event.SessionID == "partial-b" && call == 1 {
+			return &sink.DeliveryError{Sink: "flaky", StatusCode: 503}
+		}
+		return nil
+	}}
+
+	u, err := updater.NewWithOptions("", 2, time.Second, sinkOptions("", updater.Route{Sink: flaky}))
+	require.NoError(t, err)
+	u.Start()
+
+	require.NoError(t, u.ProcessEvent(testPoseEvent("partial-a")))
+	require.NoError(t, u.ProcessEvent(testPoseEvent("partial-b")))
+	time.Sleep(100 * time.Millisecond)
+	u.Stop()
+
+	assert.Equal(t, 2, flaky.Calls())
+	assert.Equal(t, []string{"event-partial-a", "event-partial-b"}, eventIDs(flaky.Events()))
+	assert.Equal(t, 0, u.DeadLetters().Len())
+}
+
+// wrappingSink fails whole requests with a wrapped delivery error
+type wrappingSink struct {
+	fakeSink
+}
+
+func (s *wrappingSink) Send(ctx context.Context, events []types.SpatialEvent) ([]sink.Result, error) {
+	s.fakeSink.Send(ctx, nil)
+	return nil, fmt.Errorf("send batch: %w", &sink.DeliveryError{Sink: s.name, StatusCode: 503})
+}
+
+func TestUpdater_RecordsStatusOfWrappedDeliveryErrors(t *testing.T) {
+	m := testMetrics()
+	unavailable := testutil.ToFloat64(m.SinkRequests.WithLabelValues("wrapping", "503"))
+
+	wrapping := &wrappingSink{fakeSink{name: "wrapping"}}
+	opts := sinkOptions(t.TempDir(), updater.Route{Sink: wrapping})
+	opts.Metrics = m
+	u, err := updater.NewWithOptions("", 1, 20*time.Millisecond, opts)
+	require.NoError(t, err)
+	u.Start()
+
+	require.NoError(t, u.ProcessEvent(testPoseEvent("wrapped")))
+	require.Eventually(t, func() bool { return wrapping.Calls() > 0 }, time.Second, 5*time.Millisecond)
+	u.Stop()
+
+	assert.Equal(t, unavailable+float64(wrapping.Calls()), testutil.ToFloat64(m.SinkRequests.WithLabelValues("wrapping", "503")))
+}
+
+func TestUpdater_DeadLettersPerSinkAndRedrives(t *testing.T) {
+	var rejecting sync.Mutex
+	reject := true
+	healthy := &fakeSink{name: "healthy"}
+	picky := &fakeSink{name: "picky", fail: func(event types.SpatialEvent, call int) error {
+		rejecting.Lock()
+		defer rejecting.Unlock()
+		if reject {
+			return &sink.DeliveryError{Sink: "picky", Permanent: true, Err: errors.New("schema mismatch")}
+		}
+		return nil
+	}}
+
+	u, err := updater.NewWithOptions("", 1, 20*time.Millisecond, sinkOptions(t.TempDir(),
+		updater.Route{Sink: healthy},
+		updater.Route{Sink: picky},
+	))
+	require.NoError(t, err)
+	u.Start()
+
+	require.NoError(t, u.ProcessEvent(testPoseEvent("picky-session")))
+	time.Sleep(100 * time.Millisecond)
+	u.Stop()
+
+	assert.Len(t, healthy.Events(), 1)
+	assert.Equal(t, 1, picky.Calls(), "permanent failures should not be retried")
+
+	entries := u.DeadLetters().List()
+	require.Len(t, entries, 1)
+	assert.Equal(t, "picky", entries[0].Sink)
+	assert.Contains(t, entries[0].LastError, "schema mismatch")
+
+	rejecting.Lock()
+	reject = false
+	rejecting.Unlock()
+
+	require.NoError(t, u.Redrive(entries[0].ID))
+	assert.Len(t, picky.Events(), 1)
+	assert.Len(t, healthy.Events(), 1, "redrive should only go to the failed sink")
+	assert.Equal(t, 0, u.DeadLetters().Len())
+}
+
+func TestUpdater_RedriveClaimsTheDeadLetter(t *testing.T) {
+	release := make(chan struct{})
+	var redriving atomic.Bool
+	started := make(chan struct{}, 1)
+	slow := &fakeSink{name: "slow", fail: func(event types.SpatialEvent, call int) error {
+		if !redriving.Load() {
+			return &sink.DeliveryError{Sink: "slow", Permanent: true, Err: errors.New("rejected")}
+		}
+		started <- struct{}{}
+		<-release
+		return nil
+	}}
+
+	u, err := updater.NewWithOptions("", 1, 20*time.Millisecond, sinkOptions(t.TempDir(), updater.Route{Sink: slow}))
+	require.NoError(t, err)
+	u.Start()
+	require.NoError(t, u.ProcessEvent(testPoseEvent("slow-session")))
+	time.Sleep(100 * time.Millisecond)
+	u.Stop()
+
+	entries := u.DeadLetters().List()
+	require.Len(t, entries, 1)
+	redriving.Store(true)
+
+	done := make(chan error, 1)
+	go func() { done <- u.Redrive(entries[0].ID) }()
+	<-started
+
+	assert.ErrorIs(t, u.Redrive(entries[0].ID), updater.ErrRedriveInProgress)
+	close(release)
+	require.NoError(t, <-done)
+	assert.Len(t, slow.Events(), 1, "the batch should be delivered once")
+	assert.ErrorIs(t, u.Redrive(entries[0].ID), updater.ErrDeadLetterNotFound)
+}
+
+func TestUpdater_RedriveAllContinuesPastFailures(t *testing.T) {
+	var rejecting sync.Mutex
+	rejected := map[string]bool{"first": true, "second": true, "third": true}
+	picky := &fakeSink{name: "picky", fail: func(event types.SpatialEvent, call int) error {
+		rejecting.Lock()
+		defer rejecting.Unlock()
+		if rejected[event.SessionID] {
+			return &sink.DeliveryError{Sink: "picky", Permanent: true, Err: errors.New("rejected " + event.SessionID)}
+		}
+		return nil
+	}}
+
+	u, err := updater.NewWithOptions("", 1, 20*time.Millisecond, sinkOptions(t.TempDir(), updater.Route{Sink: picky}))
+	require.NoError(t, err)
+	u.Start()
+	for _, session := range []string{"first", "second", "third"} {
+		require.NoError(t, u.ProcessEvent(testPoseEvent(session)))
+		time.Sleep(50 * time.Millisecond)
+	}
+	u.Stop()
+	require.Equal(t, 3, u.DeadLetters().Len())
+
+	// Only the oldest keeps failing
+	rejecting.Lock()
+	rejected = map[string]bool{"first": true}
+	rejecting.Unlock()
+
+	redriven, err := u.RedriveAll()
+	assert.Equal(t, 2, redriven)
+	assert.ErrorContains(t, err, "rejected first")
+	entries := u.DeadLetters().List()
+	require.Len(t, entries, 1)
+	assert.Equal(t, "first", entries[0].Events[0].SessionID)
+}
+
+func TestUpdater_SpoolKeepsEventsUntilEverySinkDelivers(t *testing.T) {
+	dir := t.TempDir()
+	fast := &fakeSink{name: "fast"}
+	down := &fakeSink{name: "down", fail: func(event types.SpatialEvent, call int) error {
+		return &sink.DeliveryError{Sink: "down", StatusCode: 503}
+	}}
+
+	// Still backing off when stopped, so the event is neither delivered nor dead-lettered
+	slowRetry := fastRetryOptions("").Retry
+	slowRetry.InitialBackoff = time.Minute
+	slowRetry.MaxBackoff = time.Minute
+	opts := sinkOptions(t.TempDir(), updater.Route{Sink: fast}, updater.Route{Sink: down, Retry: &slowRetry})
+	opts.Spool = &spool.Options{Dir: dir}
+	u, err := updater.NewWithOptions("", 1, 20*time.Millisecond, opts)
+	require.NoError(t, err)
+	u.Start()
+
+	require.NoError(t, u.ProcessEvent(testPoseEvent("spooled-session")))
+	time.Sleep(100 * time.Millisecond)
+	u.Stop()
+	require.Len(t, fast.Events(), 1)
+
+	// The event is still owed to "down", so both sinks see it again after a restart
+	fast2 := &fakeSink{name: "fast"}
+	down2 := &fakeSink{name: "down"}
+	opts = sinkOptions(t.TempDir(), updater.Route{Sink: fast2}, updater.Route{Sink: down2})
+	opts.Spool = &spool.Options{Dir: dir}
+	restarted, err := updater.NewWithOptions("", 1, 20*time.Millisecond, opts)
+	require.NoError(t, err)
+	restarted.Start()
+	time.Sleep(100 * time.Millisecond)
+	restarted.Stop()
+
+	assert.Equal(t, []string{"event-spooled-session"}, eventIDs(down2.Events()))
+	assert.Equal(t, []string{"event-spooled-session"}, eventIDs(fast2.Events()))
+}
+
+func TestUpdater_RejectsDuplicateSinkNames(t *testing.T) {
+	_, err := updater.NewWithOptions("", 1, time.Second, sinkOptions("",
+		updater.Route{Sink: &fakeSink{name: "dup"}},
+		updater.Route{Sink: &fakeSink{name: "dup"}},
+	))
+	assert.Error(t, err)
+}
@@ -0,0 +1,244 @@
+package unit
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tabular/relay/internal/updater"
+	"github.com/tabular/relay/internal/webhook"
+	"github.com/tabular/relay/pkg/sink"
+	"github.com/tabular/relay/pkg/types"
+)
+
+// webhookRequest is a request received by a webhookReceiver
+type webhookRequest struct {
+	header       http.Header
+	body         []byte
+	notification webhook.Notification
+}
+
+// webhookReceiver records webhook requests and answers with the statuses
+// respond returns
+type webhookReceiver struct {
+	server   *httptest.Server
+	mutex    sync.Mutex
+	requests []webhookRequest
+	respond  func(attempt int) int
+}
+
+func newWebhookReceiver(t *testing.T, respond func(attempt int) int) *webhookReceiver {
+	t.Helper()
+	r := &webhookReceiver{respond: respond}
+	r.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		var notification webhook.Notification
+		json.Unmarshal(body, &notification)
+
+		r.mutex.Lock()
+		r.requests = append(r.requests, webhookRequest{header: req.Header.Clone(), body: body, notification: notification})
+		attempt := len(r.requests)
+		r.mutex.Unlock()
+
+		status := http.StatusOK
+		if r.respond != nil {
+			status = r.respond(attempt)
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+func (r *webhookReceiver) Requests() []webhookRequest {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]webhookRequest(nil), r.requests...)
+}
+
+func (r *webhookReceiver) waitRequests(t *testing.T, n int) []webhookRequest {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		return len(r.Requests()) >= n
+	}, 2*time.Second, 5*time.Millisecond)
+	return r.Requests()
+}
+
+func newNotifier(t *testing.T, subscribers ...webhook.Subscriber) *webhook.Notifier {
+	t.Helper()
+	n, err := webhook.New(webhook.Options{
+		Subscribers: subscribers,
+		Timeout:     time.Second,
+		Retry:       fastRetryOptions("").Retry,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { n.Close() })
+	return n
+}
+
+func TestWebhook_SignedSessionLifecycle(t *testing.T) {
+	receiver := newWebhookReceiver(t, nil)
+	other := newWebhookReceiver(t, nil)
+	n := newNotifier(t,
+		webhook.Subscriber{APIKey: "key-a", URL: receiver.server.URL, Secret: "secret-a"},
+		webhook.Subscriber{APIKey: "key-b", URL: other.server.URL, Secret: "secret-b"},
+	)
+
+	n.SessionStarted("session-1", "key-a")
+	first := testPoseEvent("session-1")
+	last := first
+	last.EventID = "event-session-1-last"
+	n.BatchDelivered("stag", []types.SpatialEvent{first, testPoseEvent("unknown-session"), last})
+	n.SessionEnded("session-1")
+
+	requests := receiver.waitRequests(t, 3)
+	require.Len(t, requests, 3)
+	assert.Equal(t, webhook.SessionStarted, requests[0].notification.Type)
+	assert.Equal(t, webhook.BatchDelivered, requests[1].notification.Type)
+	assert.Equal(t, webhook.SessionEnded, requests[2].notification.Type)
+
+	delivered := requests[1].notification
+	assert.Equal(t, "session-1", delivered.SessionID)
+	assert.Equal(t, "stag", delivered.Sink)
+	assert.Equal(t, 2, delivered.Events)
+	assert.Equal(t, "event-session-1", delivered.FirstEventID)
+	assert.Equal(t, "event-session-1-last", delivered.LastEventID)
+
+	ids := make(map[string]bool)
+	for _, req := range requests {
+		assert.True(t, webhook.Verify("secret-a", req.header.Get(webhook.SignatureHeader),
+			req.header.Get(webhook.TimestampHeader), req.body, time.Minute))
+		assert.False(t, webhook.Verify("secret-b", req.header.Get(webhook.SignatureHeader),
+			req.header.Get(webhook.TimestampHeader), req.body, time.Minute))
+		assert.Equal(t, req.notification.ID, req.header.Get(webhook.DeliveryHeader))
+		assert.Equal(t, req.notification.Type, req.header.Get(webhook.EventHeader))
+		ids[req.notification.ID] = true
+	}
+	assert.Len(t, ids, 3, "every notification gets its own delivery ID")
+
+	// Other API keys don't hear about the session
+	time.Sleep(20 * time.Millisecond)
+	assert.Empty(t, other.Requests())
+}
+
+func TestWebhook_RetriesWithSameDeliveryID(t *testing.T) {
+	receiver := newWebhookReceiver(t, func(attempt int) int {
+		if attempt < 3 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	})
+	n := newNotifier(t, webhook.Subscriber{APIKey: "key-a", URL: receiver.server.URL, Secret: "secret"})
+
+	n.SessionStarted("session-1", "key-a")
+
+	requests := receiver.waitRequests(t, 3)
+	for _, req := range requests {
+		assert.Equal(t, requests[0].notification.ID, req.header.Get(webhook.DeliveryHeader))
+		assert.True(t, webhook.Verify("secret", req.header.Get(webhook.SignatureHeader),
+			req.header.Get(webhook.TimestampHeader), req.body, time.Minute))
+	}
+	assert.Empty(t, n.Failures())
+}
+
+func TestWebhook_RecordsFailures(t *testing.T) {
+	rejecting := newWebhookReceiver(t, func(int) int { return http.StatusBadRequest })
+	down := newWebhookReceiver(t, func(int) int { return http.StatusBadGateway })
+	n := newNotifier(t,
+		webhook.Subscriber{APIKey: "key-a", URL: rejecting.server.URL, Secret: "secret"},
+		webhook.Subscriber{APIKey: "key-a", URL: down.server.URL, Secret: "secret"},
+	)
+
+	n.SessionStarted("session-1", "key-a")
+
+	require.Eventually(t, func() bool {
+		return len(n.Failures()) == 2
+	}, 2*time.Second, 5*time.Millisecond)
+
+	attempts := make(map[string]int)
+	for _, failure := range n.Failures() {
+		assert.Equal(t, webhook.SessionStarted, failure.Notification.Type)
+		assert.NotEmpty(t, failure.Error)
+		attempts[failure.URL] = failure.Attempts
+	}
+	assert.Equal(t, 1, attempts[rejecting.server.URL], "a 4xx is not retried")
+	assert.Equal(t, 3, attempts[down.server.URL])
+	assert.Len(t, down.Requests(), 3)
+}
+
+func TestWebhook_EventFilterAndValidation(t *testing.T) {
+	receiver := newWebhookReceiver(t, nil)
+	n := newNotifier(t, webhook.Subscriber{
+		APIKey: "key-a",
+		URL:    receiver.server.URL,
+		Secret: "secret",
+		Events: []string{webhook.SessionEnded},
+	})
+
+	n.SessionStarted("session-1", "key-a")
+	n.BatchDelivered("stag", []types.SpatialEvent{testPoseEvent("session-1")})
+	n.SessionEnded("session-1")
+
+	requests := receiver.waitRequests(t, 1)
+	assert.Equal(t, webhook.SessionEnded, requests[0].notification.Type)
+	time.Sleep(20 * time.Millisecond)
+	assert.Len(t, receiver.Requests(), 1)
+
+	_, err := webhook.New(webhook.Options{Subscribers: []webhook.Subscriber{{APIKey: "k", URL: "ftp://example.com", Secret: "s"}}})
+	assert.Error(t, err)
+	_, err = webhook.New(webhook.Options{Subscribers: []webhook.Subscriber{{APIKey: "k", URL: "https://example.com"}}})
+	assert.Error(t, err, "secret is required")
+	_, err = webhook.New(webhook.Options{Subscribers: []webhook.Subscriber{{APIKey: "k", URL: "https://example.com", Secret: "s", Events: []string{"session.paused"}}}})
+	assert.Error(t, err)
+}
+
+func TestWebhook_VerifyRejectsTamperingAndReplays(t *testing.T) {
+	body := []byte(`{"type":"session.started"}`)
+	now := time.Now().Unix()
+	signature := webhook.Sign("secret", now, body)
+
+	assert.True(t, webhook.Verify("secret", signature, strconv.FormatInt(now, 10), body, time.Minute))
+	assert.False(t, webhook.Verify("secret", signature, strconv.FormatInt(now, 10), []byte(`{"type":"session.ended"}`), time.Minute))
+	assert.False(t, webhook.Verify("secret", signature, strconv.FormatInt(now+1, 10), body, time.Minute))
+
+	old := now - 3600
+	assert.False(t, webhook.Verify("secret", webhook.Sign("secret", old, body), strconv.FormatInt(old, 10), body, time.Minute))
+}
+
+func TestUpdater_ReportsDeliveredEvents(t *testing.T) {
+	picky := &fakeSink{name: "picky", fail: func(event types.SpatialEvent, call int) error {
+		if event.SessionID == "rejected" {
+			return &sink.DeliveryError{Sink: "picky", StatusCode: 400}
+		}
+		return nil
+	}}
+
+	var mutex sync.Mutex
+	var delivered []string
+	opts := sinkOptions("", updater.Route{Sink: picky})
+	opts.OnDelivered = func(sinkName string, events []types.SpatialEvent) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		assert.Equal(t, "picky", sinkName)
+		delivered = append(delivered, eventIDs(events)...)
+	}
+
+	u, err := updater.NewWithOptions("", 3, time.Second, opts)
+	require.NoError(t, err)
+	u.Start()
+	require.NoError(t, u.ProcessEvent(testPoseEvent("accepted-a")))
+	require.NoError(t, u.ProcessEvent(testPoseEvent("rejected")))
+	require.NoError(t, u.ProcessEvent(testPoseEvent("accepted-b")))
+	u.Stop()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, []string{"event-accepted-a", "event-accepted-b"}, delivered)
+}